@@ -5,12 +5,15 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider"
-	"github.com/lwmacct/251215-go-pkg-mcp/pkg/mcp"
 	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
 )
 
@@ -21,6 +24,24 @@ import (
 var (
 	// ErrAgentStopped Agent 已停止错误
 	ErrAgentStopped = errors.New("agent is stopped")
+
+	// ErrAgentBusy Agent 正在执行中错误
+	ErrAgentBusy = errors.New("agent is running")
+
+	// ErrMaxStepsExceeded 执行步数超过上限错误
+	ErrMaxStepsExceeded = errors.New("max steps exceeded")
+
+	// ErrTooManyToolErrors 连续工具失败次数超过上限错误
+	ErrTooManyToolErrors = errors.New("too many consecutive tool errors")
+
+	// ErrInvalidStructuredOutput 结构化输出不符合 Schema 错误
+	ErrInvalidStructuredOutput = errors.New("invalid structured output")
+
+	// ErrAnswerRejected 最终答案未通过校验错误（区别于 Provider 错误）
+	ErrAnswerRejected = errors.New("answer rejected by validator")
+
+	// ErrEmptyInput 空输入错误（输入为空或仅包含空白字符）
+	ErrEmptyInput = errors.New("empty input: text is empty or whitespace-only (enable AllowEmptyInput for continuation prompts)")
 )
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -33,6 +54,7 @@ var (
 // 核心方法:
 //   - Run(): 执行对话，返回事件流，支持流式/非流式两种模式
 //   - Chat(): 同步对话，等待完成（内部使用非流式）
+//   - RunThread(): 在命名会话中执行对话，各会话历史相互隔离
 type Agent struct {
 	// 基础信息
 	id       string
@@ -42,26 +64,106 @@ type Agent struct {
 
 	// 核心组件
 	provider     llm.Provider
+	fallbacks    []llm.Provider // 备用 Provider（主 Provider 不可用时依次尝试）
 	toolRegistry *tool.Registry
+	noToolsOnce  sync.Once // 模型不支持工具调用的警告只记录一次
+	noSeedOnce   sync.Once // Provider 忽略采样种子的警告只记录一次
+
+	// ID 生成函数（Fork 时沿用）
+	idGenerator func() string
+
+	// Provider 工厂与降级 Provider（延迟创建）
+	newProvider  func(cfg *llm.Config) (llm.Provider, error)
+	fastProvider llm.Provider
 
 	// MCP 服务器
-	mcpServers []*mcp.Server
+	mcpServers []mcpConnection
+	mcpTools   *mcpToolIndex // MCP 工具与所属服务器的对应关系
+	mcpMu      sync.Mutex    // 保护 mcpServers 和 mcpTools，串行化重连
 
 	// 重试配置
-	retryConfig *RetryConfig
+	retryConfig     *RetryConfig
+	retryClassifier RetryClassifier
+
+	// 系统提示词模板（nil 表示未设置）
+	systemTemplate *template.Template
+
+	// 工具手册模板
+	toolManualTemplate *template.Template
+
+	// 结构化输出格式（nil 表示自由文本）
+	responseFormat *llm.ResponseFormat
+
+	// 生命周期钩子
+	hooks Hooks
+
+	// 最终答案校验
+	answerValidator AnswerValidator
+
+	// Provider 中间件
+	middlewares []ProviderMiddleware
+
+	// 事件转换器（按顺序作用于发送给调用方的事件）
+	eventTransformers []EventTransformer
+
+	// 工具结果消息构建
+	toolResultMessageFunc ToolResultMessageFunc
+
+	// 工具调用审批（nil 表示不审批）
+	toolApproval ToolApprovalFunc
+
+	// 工具结果脱敏（nil 表示不脱敏）
+	redactor Redactor
+
+	// 工具错误格式化（nil 表示使用默认格式）
+	toolErrorFormatter ToolErrorFormatter
+
+	// 工具结果缓存（nil 表示不缓存）
+	toolCache ToolResultCache
+
+	// 工具执行的共享并发限制（nil 表示不限制）
+	toolSemaphore ToolSemaphore
+
+	// 模型价格表（按模型名查找，用于估算费用）
+	pricing map[string]ModelPrice
+
+	// 对话历史压缩器
+	compactor Compactor
+
+	// Token 计数器（nil 表示使用内置估算）
+	tokenCounter TokenCounter
+
+	// 指标收集器（nil 表示不记录）
+	metrics Metrics
+
+	// 链路追踪器（nil 表示不追踪）
+	tracer Tracer
 
 	// 状态管理
 	mu           sync.RWMutex
 	state        State
-	messages     []llm.Message
+	messages     []llm.Message                 // 默认会话历史
+	seedHistory  []llm.Message                 // 初始对话历史（Stateless 模式下每次执行前恢复）
+	threads      map[string][]llm.Message      // 命名会话历史（RunThread）
+	activeRuns   int                           // 进行中的执行数
+	idleCh       chan struct{}                 // 进行中的执行全部结束时关闭（WaitIdle 使用）
+	runCancels   map[uint64]context.CancelFunc // 进行中执行的取消函数（Stop 使用）
+	nextRunID    uint64
+	threadLocks  map[string]chan struct{} // 各会话的执行锁（同一会话的执行排队依次进行）
 	stepCount    int
 	lastActivity time.Time
-	createdAt    time.Time
+
+	// 上下文窗口使用情况
+	contextTokens      int
+	contextUtilization float64
+
+	createdAt time.Time
 
 	// 生命周期
-	ctx    context.Context
-	cancel context.CancelFunc
-	stopCh chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopCh     chan struct{}
+	stopFollow func() bool // 取消对父 context 的跟随（未设置 BaseContext 时为 nil）
 
 	// 日志
 	logger *slog.Logger
@@ -99,15 +201,36 @@ func NewAgent(opts ...Option) (*Agent, error) {
 // newAgentFromBuilder 从 builder 构建 Agent（内部共享逻辑）
 func newAgentFromBuilder(builder *builder) (*Agent, error) {
 	// 自动创建 Provider（如果未传入）
+	newProvider := builder.providerFactory()
 	if builder.provider == nil {
 		// 直接使用嵌套的 LLM 配置
-		p, err := provider.New(&builder.config.LLM)
+		p, err := newProvider(&builder.config.LLM)
 		if err != nil {
 			return nil, fmt.Errorf("auto-create provider: %w", err)
 		}
 		builder.provider = p
 	}
 
+	// 解析结构化输出 Schema
+	var responseFormat *llm.ResponseFormat
+	if builder.responseSchema != nil {
+		rf, err := newResponseFormat(builder.responseSchema)
+		if err != nil {
+			return nil, err
+		}
+		responseFormat = rf
+	}
+
+	// 解析系统提示词模板
+	systemTemplate, err := parseSystemTemplate(builder.config.SystemTemplate)
+	if err != nil {
+		return nil, err
+	}
+	toolManualTemplate, err := parseToolManualTemplate(builder.config.ToolManualTemplate)
+	if err != nil {
+		return nil, err
+	}
+
 	// 验证工具名称（Fail-Fast）
 	if len(builder.config.Tools) > 0 && builder.toolRegistry != nil {
 		var missing []string
@@ -123,11 +246,23 @@ func newAgentFromBuilder(builder *builder) (*Agent, error) {
 
 	// 生成 ID
 	id := builder.config.ID
-	if id == "" {
+	switch {
+	case id != "":
+	case builder.config.DeterministicID:
+		id = deriveAgentID(builder.config)
+	case builder.idGenerator != nil:
+		if id = builder.idGenerator(); id == "" {
+			return nil, errors.New("id generator returned an empty ID")
+		}
+	default:
 		id = generateAgentID()
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	baseCtx := builder.baseCtx
+	if baseCtx == nil {
+		baseCtx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(baseCtx)
 	// Ensure cancel is called on error paths
 	defer func() {
 		if cancel != nil {
@@ -141,6 +276,7 @@ func newAgentFromBuilder(builder *builder) (*Agent, error) {
 	}
 
 	// 连接 MCP 服务器并加载工具
+	mcpTools := newMCPToolIndex()
 	if len(builder.mcpServers) > 0 {
 		if builder.toolRegistry == nil {
 			builder.toolRegistry = tool.NewRegistry()
@@ -166,32 +302,64 @@ func newAgentFromBuilder(builder *builder) (*Agent, error) {
 			}
 
 			// 注册到工具注册表
-			for _, t := range tools {
-				if err := builder.toolRegistry.Register(t); err != nil {
-					logger.Warn("register MCP tool failed", "server", server.Name(), "tool", t.Name(), "error", err)
-				} else {
-					logger.Info("registered MCP tool", "server", server.Name(), "tool", t.Name())
-				}
-			}
+			mcpTools.add(builder.toolRegistry, logger, server, tools)
 		}
 	}
+	mcpServers := make([]mcpConnection, 0, len(builder.mcpServers))
+	for _, server := range builder.mcpServers {
+		mcpServers = append(mcpServers, server)
+	}
+
+	// 按名称声明了可缓存工具但未设置缓存时使用默认 LRU
+	toolCache := builder.toolCache
+	if toolCache == nil && len(builder.config.CacheableTools) > 0 {
+		toolCache = NewToolResultLRU(DefaultToolResultCacheSize)
+	}
+
+	// 初始对话历史（复制，避免与调用方共享底层数组）
+	messages := make([]llm.Message, len(builder.history))
+	copy(messages, builder.history)
 
 	agent := &Agent{
-		id:           id,
-		name:         builder.config.Name,
-		parentID:     builder.config.ParentID,
-		config:       builder.config,
-		provider:     builder.provider,
-		toolRegistry: builder.toolRegistry,
-		mcpServers:   builder.mcpServers,
-		retryConfig:  builder.retryConfig,
-		state:        StateReady,
-		messages:     make([]llm.Message, 0),
-		createdAt:    time.Now(),
-		ctx:          ctx,
-		cancel:       cancel,
-		stopCh:       make(chan struct{}),
-		logger:       logger,
+		id:                    id,
+		name:                  builder.config.Name,
+		parentID:              builder.config.ParentID,
+		config:                builder.config,
+		provider:              builder.provider,
+		fallbacks:             slices.Clone(builder.fallbacks),
+		toolRegistry:          builder.toolRegistry,
+		newProvider:           newProvider,
+		idGenerator:           builder.idGenerator,
+		mcpServers:            mcpServers,
+		mcpTools:              mcpTools,
+		retryConfig:           builder.retryConfig,
+		retryClassifier:       builder.retryClassifier,
+		systemTemplate:        systemTemplate,
+		toolManualTemplate:    toolManualTemplate,
+		responseFormat:        responseFormat,
+		hooks:                 builder.hooks,
+		answerValidator:       builder.answerValidator,
+		middlewares:           builder.middlewares,
+		eventTransformers:     builder.eventTransformers,
+		toolResultMessageFunc: builder.toolResultMessageFunc,
+		toolApproval:          builder.toolApproval,
+		redactor:              builder.redactor,
+		toolErrorFormatter:    builder.toolErrorFormatter,
+		toolCache:             toolCache,
+		toolSemaphore:         builder.toolSemaphore,
+		pricing:               builder.pricing,
+		compactor:             builder.compactor,
+		tokenCounter:          builder.tokenCounter,
+		metrics:               builder.metrics,
+		tracer:                builder.tracer,
+		state:                 StateReady,
+		messages:              messages,
+		seedHistory:           slices.Clone(messages),
+		createdAt:             time.Now(),
+		ctx:                   ctx,
+		cancel:                cancel,
+		stopCh:                make(chan struct{}),
+		logger:                logger,
 	}
 
 	// 使用默认重试配置（如果未设置）
@@ -202,6 +370,14 @@ func newAgentFromBuilder(builder *builder) (*Agent, error) {
 	// Prevent defer from calling cancel since agent owns it now
 	cancel = nil
 
+	// 父 context 取消时自动关闭
+	if builder.baseCtx != nil {
+		agent.stopFollow = context.AfterFunc(builder.baseCtx, func() {
+			agent.logger.Info("base context done, closing agent", "id", id)
+			_ = agent.Close()
+		})
+	}
+
 	agent.logger.Info("agent created", "id", id, "name", agent.name)
 	return agent, nil
 }
@@ -235,6 +411,14 @@ func (a *Agent) ParentID() string {
 //   - 非流式（默认）：一次性返回完整结果，适合简单问答
 //   - 流式：实时返回文本增量，适合长文本生成
 //
+// 可以并发调用：同一会话（默认会话或同一 threadID）的执行排队依次进行，
+// 前一次执行结束后才追加下一条用户消息，历史不会交错。排队期间取消 ctx 或调用 Stop
+// 会放弃等待并发送错误事件。
+//
+// 调用方应读取事件直到通道关闭。提前停止读取时须取消 ctx（或关闭 Agent）：
+// 通道缓冲区已满时剩余事件被丢弃，执行 goroutine 随之退出，不会泄漏。
+// 缓冲大小见 Builder.EventBufferSize 与 WithEventBuffer。
+//
 // 使用示例:
 //
 //	// 非流式（默认）
@@ -251,11 +435,65 @@ func (a *Agent) ParentID() string {
 //	    }
 //	}
 func (a *Agent) Run(ctx context.Context, text string, opts ...RunOption) <-chan *AgentEvent {
-	eventCh := make(chan *AgentEvent, 16)
+	return a.run(ctx, "", textInput(text), opts...)
+}
+
+// RunWith 以任意内容块作为用户消息执行对话，返回事件流
+//
+// 与 Run 相同，但用户消息由调用方提供的内容块组成（如文本加图片），适合多模态模型。
+// 内容块按原样发送给 Provider，Provider 需支持相应的块类型。
+// 所有文本块都为空白且没有其他类型的块时视为空输入。
+//
+// 使用示例:
+//
+//	events := ag.RunWith(ctx, []llm.ContentBlock{
+//	    &llm.TextBlock{Text: "描述这张图片"},
+//	    imageBlock, // Provider 支持的图片内容块
+//	})
+func (a *Agent) RunWith(ctx context.Context, blocks []llm.ContentBlock, opts ...RunOption) <-chan *AgentEvent {
+	return a.run(ctx, "", slices.Clone(blocks), opts...)
+}
+
+// RunThread 在命名会话中执行对话，返回事件流
+//
+// 每个 threadID 维护独立的消息历史，共享同一个 Agent 的 Provider、工具和配置。
+// 不同会话可以并发执行；同一会话的并发执行排队依次进行（见 Run）。
+// threadID 为空时等价于 Run，使用默认会话。
+//
+// 使用示例:
+//
+//	for event := range ag.RunThread(ctx, "user-1", "你好") {
+//	    // ...
+//	}
+//	history := ag.ThreadMessages("user-1")
+func (a *Agent) RunThread(ctx context.Context, threadID, text string, opts ...RunOption) <-chan *AgentEvent {
+	return a.run(ctx, threadID, textInput(text), opts...)
+}
+
+// textInput 将文本包装为单个文本块
+func textInput(text string) []llm.ContentBlock {
+	return []llm.ContentBlock{&llm.TextBlock{Text: text}}
+}
 
+// isEmptyInput 判断用户输入是否为空（所有块都是空白文本块）
+func isEmptyInput(blocks []llm.ContentBlock) bool {
+	for _, block := range blocks {
+		tb, ok := block.(*llm.TextBlock)
+		if !ok || strings.TrimSpace(tb.Text) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// run 执行对话的公共实现，threadID 为空表示默认会话，input 为用户消息的内容块
+func (a *Agent) run(ctx context.Context, threadID string, input []llm.ContentBlock, opts ...RunOption) <-chan *AgentEvent {
 	// 应用选项
 	options := ApplyRunOptions(opts...)
 
+	eventCh := make(chan *AgentEvent, a.eventBufferSize(options))
+	events := a.filterEvents(ctx, a.transformEvents(ctx, eventCh), options.EventFilter)
+
 	go func() {
 		defer close(eventCh)
 
@@ -266,53 +504,196 @@ func (a *Agent) Run(ctx context.Context, text string, opts ...RunOption) <-chan
 					"panic", r,
 					"agent_id", a.id,
 				)
-				eventCh <- &AgentEvent{
-					Type:  llm.EventTypeError,
-					Error: fmt.Errorf("agent panic: %v", r),
-				}
+				a.emitError(ctx, eventCh, fmt.Errorf("agent panic: %v", r))
 			}
 		}()
 
-		// 检查状态
+		// 校验输入
+		emptyInput := isEmptyInput(input)
+		if emptyInput && !a.config.AllowEmptyInput {
+			a.emitError(ctx, eventCh, ErrEmptyInput)
+			return
+		}
+
+		// 检查状态，并记录本轮开始位置
 		a.mu.Lock()
-		if a.state == StateStopped || a.state == StateStopping {
+		if a.state == StateStopped || a.state == StateStopping || a.ctx.Err() != nil {
 			a.mu.Unlock()
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: ErrAgentStopped}
+			a.emitError(ctx, eventCh, ErrAgentStopped)
 			return
 		}
+		if a.activeRuns == 0 {
+			a.idleCh = make(chan struct{})
+		}
+		a.activeRuns++
+		prevState := a.state
 		a.state = StateRunning
+		ctx, cancel := context.WithCancel(ctx)
+		runID := a.nextRunID
+		a.nextRunID++
+		if a.runCancels == nil {
+			a.runCancels = make(map[uint64]context.CancelFunc)
+		}
+		a.runCancels[runID] = cancel
+		lock := a.threadLockLocked(threadID)
 		a.mu.Unlock()
+		a.hookStateChange(prevState, StateRunning)
+
+		// Agent 关闭或父 context 取消时中断本次执行
+		stopRun := context.AfterFunc(a.ctx, cancel)
 
 		defer func() {
+			stopRun()
+			cancel()
 			a.mu.Lock()
-			a.state = StateReady
+			delete(a.runCancels, runID)
+			a.activeRuns--
+			ready := false
+			if a.activeRuns == 0 {
+				if a.state == StateRunning {
+					a.state = StateReady
+					ready = true
+				}
+				close(a.idleCh)
+			}
 			a.mu.Unlock()
+			if ready {
+				a.hookStateChange(StateRunning, StateReady)
+			}
 		}()
 
-		// 添加用户消息
-		userMsg := llm.Message{
-			Role:          llm.RoleUser,
-			ContentBlocks: []llm.ContentBlock{&llm.TextBlock{Text: text}},
+		// 等待同一会话的前一次执行结束，再记录本轮开始位置
+		if !options.threadLocked {
+			select {
+			case lock <- struct{}{}:
+			case <-ctx.Done():
+				a.emitError(ctx, eventCh, ctx.Err())
+				return
+			}
+			defer func() { <-lock }()
+		}
+
+		a.mu.Lock()
+		if a.config.Stateless && !options.keepHistory {
+			// 无状态模式：本轮从初始历史开始
+			a.resetHistoryLocked(threadID)
 		}
-		a.appendMessage(userMsg)
+		startMsgIndex := len(a.historyLocked(threadID))
+		a.mu.Unlock()
 
-		// 记录本轮开始位置
-		startMsgIndex := len(a.messages) - 1
+		// 渲染本次执行的系统提示词模板（失败时不追加用户消息）
+		if err := a.renderSystem(options); err != nil {
+			a.emitError(ctx, eventCh, err)
+			return
+		}
+
+		// 添加用户消息（允许的空输入视为续写，不追加消息）
+		if !emptyInput {
+			userMsg := llm.Message{
+				Role:          llm.RoleUser,
+				ContentBlocks: input,
+			}
+			a.appendMessage(threadID, userMsg)
+		}
+
+		state := a.newRunState(options, threadID, startMsgIndex)
+		if a.config.Seed != nil && a.supportsSeed() {
+			state.setMetadata("seed", *a.config.Seed)
+		}
+		state.logger.Debug("run started", "agent_id", a.id, "thread_id", threadID, "streaming", options.Streaming)
+
+		// 根 span，步骤和工具 span 挂在其下
+		runCtx, span := a.startSpan(ctx, SpanRun,
+			slog.String("agent.id", a.id),
+			slog.String("agent.thread_id", threadID),
+			slog.Bool("agent.streaming", options.Streaming),
+		)
+		state.span = span
+		defer func() {
+			state.stepSpan.End()
+			span.SetAttributes(slog.Int("agent.steps", state.stepCount))
+			span.End()
+		}()
 
 		// 根据模式选择执行方法
 		var result *Result
 		if options.Streaming {
-			result = a.runLoopStreaming(ctx, eventCh, startMsgIndex)
+			result = a.runLoopStreaming(runCtx, eventCh, state)
 		} else {
-			result = a.runLoopBlocking(ctx, eventCh, startMsgIndex)
+			result = a.runLoopBlocking(runCtx, eventCh, state)
 		}
 
+		state.logger.Debug("run finished", "agent_id", a.id, "steps", state.stepCount)
+
 		if result != nil {
-			eventCh <- &AgentEvent{Type: llm.EventTypeDone, Result: result}
+			a.sendEvent(ctx, eventCh, &AgentEvent{Type: EventTypeUsage, Usage: state.usageInfo()})
+			a.sendEvent(ctx, eventCh, &AgentEvent{Type: llm.EventTypeDone, Result: result})
+		}
+	}()
+
+	return events
+}
+
+// threadLockLocked 返回会话的执行锁（容量为 1 的通道），调用方需持有 a.mu
+func (a *Agent) threadLockLocked(threadID string) chan struct{} {
+	if a.threadLocks == nil {
+		a.threadLocks = make(map[string]chan struct{})
+	}
+	lock, ok := a.threadLocks[threadID]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		a.threadLocks[threadID] = lock
+	}
+	return lock
+}
+
+// filterEvents 按类型过滤事件流（未设置过滤类型时原样返回）
+//
+// 被过滤的事件直接丢弃；错误事件始终转发。调用方放弃读取时继续排空源通道，避免执行 goroutine 阻塞。
+func (a *Agent) filterEvents(ctx context.Context, events <-chan *AgentEvent, types []llm.EventType) <-chan *AgentEvent {
+	if len(types) == 0 {
+		return events
+	}
+
+	out := make(chan *AgentEvent, cap(events))
+	go func() {
+		defer close(out)
+		for event := range events {
+			if event.Type == llm.EventTypeError || slices.Contains(types, event.Type) {
+				a.sendEvent(ctx, out, event)
+			}
 		}
 	}()
+	return out
+}
 
-	return eventCh
+// EventTransformer 在事件发送给调用方之前对其进行处理（改写、脱敏、翻译等）
+//
+// 返回的事件替代原事件，返回 nil 丢弃该事件。多个转换器按添加顺序依次执行，
+// 转换在 EventFilter 之前进行。丢弃 Done 事件会使 Chat 等同步方法拿不到结果，应只丢弃中间事件。
+type EventTransformer func(event *AgentEvent) *AgentEvent
+
+// transformEvents 依次应用事件转换器（未设置时直接返回原通道）
+func (a *Agent) transformEvents(ctx context.Context, events <-chan *AgentEvent) <-chan *AgentEvent {
+	if len(a.eventTransformers) == 0 {
+		return events
+	}
+
+	out := make(chan *AgentEvent, cap(events))
+	go func() {
+		defer close(out)
+		for event := range events {
+			for _, fn := range a.eventTransformers {
+				if event = fn(event); event == nil {
+					break
+				}
+			}
+			if event != nil {
+				a.sendEvent(ctx, out, event)
+			}
+		}
+	}()
+	return out
 }
 
 // Chat 同步对话（阻塞直到完成）
@@ -320,6 +701,9 @@ func (a *Agent) Run(ctx context.Context, text string, opts ...RunOption) <-chan
 // 这是便捷方法，内部使用非流式模式，更高效。
 // 适用于简单问答场景，不需要实时输出。
 //
+// 执行开始后出错时（如 Provider 调用失败、ErrMaxStepsExceeded），同时返回部分结果和错误：
+// 部分结果包含出错前产生的消息、工具调用和用量，Result.Err 为导致失败的错误。
+//
 // 使用示例:
 //
 //	result, err := agent.Chat(ctx, "1+1=?")
@@ -328,24 +712,67 @@ func (a *Agent) Run(ctx context.Context, text string, opts ...RunOption) <-chan
 //	}
 //	fmt.Println(result.Text)
 func (a *Agent) Chat(ctx context.Context, text string) (*Result, error) {
+	// 使用非流式模式（默认）
+	return collectResult(a.Run(ctx, text))
+}
+
+// RunCollect 执行对话直到完成，返回全部事件、最终结果和最后一个错误
+//
+// 始终完整消费事件流，不会因调用方忘记遍历通道而泄漏 goroutine。
+// 适用于测试和批处理；需要实时处理事件时使用 Run。
+//
+// 使用示例:
+//
+//	events, result, err := ag.RunCollect(ctx, "分析日志", agent.WithStreaming(true))
+//	for _, event := range events {
+//	    if event.Type == llm.EventTypeToolCall {
+//	        fmt.Println("tool:", event.ToolCall.Name)
+//	    }
+//	}
+func (a *Agent) RunCollect(ctx context.Context, text string, opts ...RunOption) ([]*AgentEvent, *Result, error) {
+	var events []*AgentEvent
 	var result *Result
 	var lastError error
 
-	// 使用非流式模式（默认）
-	for event := range a.Run(ctx, text) {
+	for event := range a.Run(ctx, text, opts...) {
+		events = append(events, event)
+		switch event.Type {
+		case llm.EventTypeDone:
+			result = event.Result
+		case llm.EventTypeError:
+			lastError = event.Error
+			if event.Result != nil {
+				result = event.Result
+			}
+		default:
+		}
+	}
+	return events, result, lastError
+}
+
+// collectResult 消费事件流，返回最终结果和最后一个错误
+func collectResult(events <-chan *AgentEvent) (*Result, error) {
+	var result *Result
+	var lastError error
+
+	for event := range events {
 		switch event.Type {
 		case llm.EventTypeDone:
 			result = event.Result
 		case llm.EventTypeError:
 			lastError = event.Error
+			if event.Result != nil {
+				result = event.Result
+			}
 		case llm.EventTypeText, llm.EventTypeToolCall, llm.EventTypeToolResult,
-			llm.EventTypeReasoning, llm.EventTypeThinking:
+			llm.EventTypeReasoning, llm.EventTypeThinking, EventTypeUsage, EventTypeToolCallDelta,
+			EventTypeHeartbeat, EventTypeContextWarning:
 			// 忽略流式事件，仅关注最终结果
 		}
 	}
 
 	if lastError != nil {
-		return nil, lastError
+		return result, lastError
 	}
 	return result, nil
 }
@@ -365,6 +792,9 @@ func (a *Agent) Status() *Status {
 		StepCount:    a.stepCount,
 		MessageCount: len(a.messages),
 		LastActivity: a.lastActivity,
+
+		ContextTokens:      a.contextTokens,
+		ContextUtilization: a.contextUtilization,
 	}
 }
 
@@ -379,6 +809,120 @@ func (a *Agent) Messages() []llm.Message {
 	return msgs
 }
 
+// ThreadMessages 获取命名会话的消息历史
+//
+// 返回副本；threadID 为空时等价于 Messages，不存在的会话返回空切片。
+func (a *Agent) ThreadMessages(threadID string) []llm.Message {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	history := a.historyLocked(threadID)
+	msgs := make([]llm.Message, len(history))
+	copy(msgs, history)
+	return msgs
+}
+
+// AppendMessage 向默认会话历史追加一条消息
+//
+// 用于手动构造历史，例如插入 few-shot 示例的用户/助手轮次，或预置助手回复的开头让模型续写。
+// 与执行过程中追加的消息一样更新步数和最近活动时间，并体现在 Messages() 中。
+// 无状态模式下同时追加到初始历史，之后每轮执行都会带上这条消息。
+//
+// 消息角色必须是 user、assistant、tool 或 system 之一，否则返回错误；
+// 已关闭的 Agent 返回 ErrAgentStopped；正在执行中返回 ErrAgentBusy。
+//
+// 使用示例:
+//
+//	_ = ag.AppendMessage(llm.Message{Role: llm.RoleUser, Content: "2+2"})
+//	_ = ag.AppendMessage(llm.Message{Role: llm.RoleAssistant, Content: "4"})
+//	result, err := ag.Chat(ctx, "3+5")
+func (a *Agent) AppendMessage(msg llm.Message) error {
+	switch msg.Role {
+	case llm.RoleUser, llm.RoleAssistant, llm.RoleTool, llm.RoleSystem:
+	default:
+		return fmt.Errorf("invalid message role %q", msg.Role)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkEditableLocked(); err != nil {
+		return err
+	}
+
+	a.appendMessageLocked("", msg)
+	if a.config.Stateless {
+		a.seedHistory = append(a.seedHistory, msg)
+	}
+	return nil
+}
+
+// Truncate 从默认会话历史末尾删除 n 条消息
+//
+// 步数统计同步减少。n 为负数或超过历史长度时返回错误且不做任何修改；
+// 已关闭的 Agent 返回 ErrAgentStopped；正在执行中返回 ErrAgentBusy。
+func (a *Agent) Truncate(n int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkEditableLocked(); err != nil {
+		return err
+	}
+	if n < 0 || n > len(a.messages) {
+		return fmt.Errorf("cannot truncate %d of %d messages", n, len(a.messages))
+	}
+	a.truncateLocked(len(a.messages) - n)
+	return nil
+}
+
+// Undo 撤销默认会话的最后一轮对话
+//
+// 删除最后一条用户输入及其之后的所有消息（助手回复、工具调用和工具结果），
+// 适合交互式界面的“编辑后重发”。没有可撤销的用户输入时返回错误。
+//
+// 使用示例:
+//
+//	_, _ = ag.Chat(ctx, "写一首关于秋天的诗")
+//	_ = ag.Undo()
+//	result, err := ag.Chat(ctx, "写一首关于秋天的七言绝句")
+func (a *Agent) Undo() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.checkEditableLocked(); err != nil {
+		return err
+	}
+	for i := len(a.messages) - 1; i >= 0; i-- {
+		msg := a.messages[i]
+		// 工具结果同样以 user 角色发送，不算作用户输入
+		if msg.Role == llm.RoleUser && len(msg.GetToolResults()) == 0 {
+			a.truncateLocked(i)
+			return nil
+		}
+	}
+	return errors.New("no user message to undo")
+}
+
+// checkEditableLocked 检查当前是否可以修改历史（调用方需持有锁）
+func (a *Agent) checkEditableLocked() error {
+	switch a.state {
+	case StateStopped, StateStopping:
+		return ErrAgentStopped
+	case StateRunning:
+		return ErrAgentBusy
+	case StateReady:
+	}
+	return nil
+}
+
+// truncateLocked 将默认会话历史截断为前 keep 条，并同步减少步数（调用方需持有锁）
+func (a *Agent) truncateLocked(keep int) {
+	removed := len(a.messages) - keep
+	// 限制容量，之后追加时重新分配，不覆盖仍被 Result 等引用的旧元素
+	a.messages = slices.Clip(a.messages[:keep])
+	a.stepCount = max(a.stepCount-removed, 0)
+}
+
 // Config 返回配置的副本
 //
 // 返回 Agent 当前配置的深拷贝，用于以下场景：
@@ -393,19 +937,215 @@ func (a *Agent) Config() *Config {
 	return cloneConfig(a.config)
 }
 
+// Fork 从当前对话分叉出一个独立的 Agent
+//
+// 新 Agent 使用相同的配置、工具、钩子、中间件等设置，Provider 按配置重新创建（不共享），
+// 并带有当前默认会话历史的深拷贝。之后两个 Agent 的历史互不影响，适合探索多种后续走向。
+// 与 CloneAgent 不同：CloneAgent 只复制配置，从空历史开始；CloneWithHistory 只复制配置和历史。
+//
+// 使用示例:
+//
+//	_, _ = ag.Chat(ctx, "给出三种方案")
+//	branch, err := ag.Fork(agent.WithName("branch-a"))
+//	_, _ = branch.Chat(ctx, "展开方案 A")
+func (a *Agent) Fork(opts ...Option) (*Agent, error) {
+	history := a.historySnapshot()
+
+	allOpts := make([]Option, 0, len(opts)+1)
+	allOpts = append(allOpts, func(b *builder) {
+		b.config = a.Config()
+		b.config.ID = "" // 分叉使用新的 ID
+		b.config.DeterministicID = false
+		b.newProvider = a.newProvider
+		b.idGenerator = a.idGenerator
+		b.retryConfig = a.retryConfig
+		b.retryClassifier = a.retryClassifier
+		b.hooks = a.hooks
+		b.answerValidator = a.answerValidator
+		b.middlewares = slices.Clone(a.middlewares)
+		b.eventTransformers = slices.Clone(a.eventTransformers)
+		b.toolResultMessageFunc = a.toolResultMessageFunc
+		b.toolApproval = a.toolApproval
+		b.redactor = a.redactor
+		b.toolErrorFormatter = a.toolErrorFormatter
+		b.toolCache = a.toolCache
+		b.toolSemaphore = a.toolSemaphore
+		b.pricing = a.pricing
+		b.compactor = a.compactor
+		b.tokenCounter = a.tokenCounter
+		b.metrics = a.metrics
+		b.tracer = a.tracer
+		b.logger = a.logger
+		b.history = history
+		if a.toolRegistry != nil {
+			b.toolRegistry = a.toolRegistry.Clone()
+		}
+	})
+	allOpts = append(allOpts, opts...)
+
+	forked, err := NewAgent(allOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("fork agent: %w", err)
+	}
+	forked.responseFormat = a.responseFormat
+	return forked, nil
+}
+
+// CloneWithHistory 复制配置和当前对话历史，创建一个独立的 Agent
+//
+// 适用于在执行有风险的操作前保存检查点：出问题时丢弃原 Agent，改用克隆继续。
+// 三种复制方式的区别：
+//   - CloneAgent / From：只复制配置，从空历史开始
+//   - CloneWithHistory：复制配置和默认会话历史（深拷贝），不复制工具、钩子、中间件等运行时设置
+//   - Fork：复制配置、历史以及工具、钩子、中间件等全部设置
+//
+// 克隆使用新的 ID，Provider 按配置重新创建（不共享）。历史快照在读锁下获取，
+// 可以与源 Agent 的执行并发调用。
+//
+// 使用示例:
+//
+//	checkpoint, err := ag.CloneWithHistory()
+//	if _, err := ag.Chat(ctx, "执行迁移"); err != nil {
+//	    ag = checkpoint // 回到迁移前的对话状态
+//	}
+func (a *Agent) CloneWithHistory() (*Agent, error) {
+	history := a.historySnapshot()
+
+	cloned, err := NewAgent(func(b *builder) {
+		b.config = a.Config()
+		b.config.ID = "" // 克隆使用新的 ID
+		b.config.DeterministicID = false
+		b.newProvider = a.newProvider
+		b.idGenerator = a.idGenerator
+		b.history = history
+	})
+	if err != nil {
+		return nil, fmt.Errorf("clone agent: %w", err)
+	}
+	return cloned, nil
+}
+
+// historySnapshot 返回默认会话历史的深拷贝
+func (a *Agent) historySnapshot() []llm.Message {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.config.Stateless {
+		// 无状态模式下复制出的 Agent 同样从初始历史开始每一轮
+		return cloneMessages(a.seedHistory)
+	}
+	return cloneMessages(a.messages)
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 生命周期
 // ═══════════════════════════════════════════════════════════════════════════
 
+// Reset 清空对话状态
+//
+// 清除消息历史（包括所有命名会话）、步数统计和最近活动时间，保留 Provider、工具注册表和 MCP 连接，
+// 适用于在多个独立会话之间复用同一个 Agent。
+//
+// 已关闭的 Agent 返回 ErrAgentStopped；正在执行中返回 ErrAgentBusy。
+//
+// 使用示例：
+//
+//	result, _ := ag.Chat(ctx, "session A")
+//	_ = ag.Reset()
+//	result, _ = ag.Chat(ctx, "session B") // 不包含 session A 的上下文
+func (a *Agent) Reset() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	switch a.state {
+	case StateStopped, StateStopping:
+		return ErrAgentStopped
+	case StateRunning:
+		return ErrAgentBusy
+	case StateReady:
+	}
+
+	a.messages = make([]llm.Message, 0)
+	a.threads = nil
+	a.stepCount = 0
+	a.lastActivity = time.Time{}
+	a.contextTokens = 0
+	a.contextUtilization = 0
+
+	a.logger.Debug("agent reset", "id", a.id)
+	return nil
+}
+
+// Stop 中断所有进行中的执行，Agent 保持可用
+//
+// 与 Close 不同，Stop 不关闭 Provider 和 MCP 服务器：被中断的执行会发送 ctx.Err()
+// 错误事件并关闭事件通道，之后 Agent 回到 StateReady，可以继续 Run。
+// Stop 不等待执行退出；空闲时调用无任何效果。
+//
+// 使用示例:
+//
+//	// 聊天界面的停止按钮
+//	stopButton.OnClick(ag.Stop)
+func (a *Agent) Stop() {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, cancel := range a.runCancels {
+		cancel()
+	}
+	if len(a.runCancels) > 0 {
+		a.logger.Debug("agent runs stopped", "id", a.id, "count", len(a.runCancels))
+	}
+}
+
+// WaitIdle 阻塞直到没有进行中的执行，或 ctx 取消
+//
+// 空闲时立即返回 nil；ctx 取消时返回 ctx.Err()。
+// 适合优雅关闭：先停止接收新请求，等待当前执行完成后再调用 Close。
+//
+// 使用示例:
+//
+//	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	if err := ag.WaitIdle(shutdownCtx); err != nil {
+//	    ag.Stop() // 超时后中断剩余执行
+//	}
+//	_ = ag.Close()
+func (a *Agent) WaitIdle(ctx context.Context) error {
+	a.mu.RLock()
+	if a.activeRuns == 0 {
+		a.mu.RUnlock()
+		return nil
+	}
+	idleCh := a.idleCh
+	a.mu.RUnlock()
+
+	select {
+	case <-idleCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Close 关闭 Agent
+//
+// 中断进行中的执行并释放 Provider、MCP 连接等资源，之后的 Run 返回 ErrAgentStopped。
+// 重复调用无副作用。
 func (a *Agent) Close() error {
 	a.mu.Lock()
-	if a.state == StateStopped {
+	if a.state == StateStopped || a.state == StateStopping {
 		a.mu.Unlock()
 		return nil
 	}
+	prevState := a.state
 	a.state = StateStopping
 	a.mu.Unlock()
+	a.hookStateChange(prevState, StateStopping)
+
+	if a.stopFollow != nil {
+		a.stopFollow()
+	}
 
 	// 收集所有错误
 	var errs []error
@@ -424,8 +1164,31 @@ func (a *Agent) Close() error {
 		}
 	}
 
+	// 关闭备用 Provider
+	for i, fb := range a.fallbacks {
+		if err := fb.Close(); err != nil {
+			a.logger.Warn("failed to close fallback provider", "index", i+1, "error", err)
+			errs = append(errs, fmt.Errorf("close fallback provider %d: %w", i+1, err))
+		}
+	}
+
+	// 关闭降级 Provider
+	a.mu.Lock()
+	fastProvider := a.fastProvider
+	a.fastProvider = nil
+	a.mu.Unlock()
+	if fastProvider != nil {
+		if err := fastProvider.Close(); err != nil {
+			a.logger.Warn("failed to close downgrade provider", "error", err)
+			errs = append(errs, fmt.Errorf("close downgrade provider: %w", err))
+		}
+	}
+
 	// 关闭 MCP 服务器
-	for _, server := range a.mcpServers {
+	a.mcpMu.Lock()
+	mcpServers := slices.Clone(a.mcpServers)
+	a.mcpMu.Unlock()
+	for _, server := range mcpServers {
 		if err := server.Close(); err != nil {
 			a.logger.Warn("failed to close MCP server", "server", server.Name(), "error", err)
 			errs = append(errs, fmt.Errorf("close MCP server %s: %w", server.Name(), err))
@@ -435,6 +1198,7 @@ func (a *Agent) Close() error {
 	a.mu.Lock()
 	a.state = StateStopped
 	a.mu.Unlock()
+	a.hookStateChange(StateStopping, StateStopped)
 
 	a.logger.Info("agent closed", "id", a.id)
 
@@ -471,6 +1235,24 @@ func (a *Agent) ToolRegistry() *tool.Registry {
 	return a.toolRegistry
 }
 
+// ToolManual 返回工具手册内容
+//
+// 手册根据当前注册表实时生成，与注入到系统提示词中的内容一致，
+// 但独立于系统提示词，便于 UI 展示可用工具或在测试中检查。
+// 未配置工具时返回空字符串。
+//
+// 使用示例：
+//
+//	fmt.Println(agent.ToolManual())
+//	// ### Tools Manual
+//	//
+//	// The following tools are available:
+//	//
+//	// - `calculator`: 计算器
+func (a *Agent) ToolManual() string {
+	return a.buildToolManual(nil)
+}
+
 // AddTool 运行时添加或替换工具
 //
 // 这是热加载工具的推荐方法，适用于以下场景：
@@ -527,6 +1309,108 @@ func (a *Agent) RemoveTool(name string) error {
 	return a.toolRegistry.Unregister(name)
 }
 
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider 管理
+// ═══════════════════════════════════════════════════════════════════════════
+
+// HTTPClientSetter 支持自定义 HTTP 客户端的 Provider
+//
+// 配合 Builder.HTTPClient 使用：自动创建的 Provider 实现该接口时注入客户端。
+type HTTPClientSetter interface {
+	SetHTTPClient(client *http.Client)
+}
+
+// ProviderCapabilities Provider 当前模型支持的能力
+type ProviderCapabilities struct {
+	// FunctionCalling 是否支持原生工具调用（function calling）
+	FunctionCalling bool
+
+	// Seed 是否读取 llm.Options.Metadata["seed"] 并作为采样种子发送给模型
+	Seed bool
+}
+
+// CapabilityReporter 能声明模型能力的 Provider（可选接口）
+//
+// Provider 实现该接口且声明不支持工具调用时，Agent 不再发送工具 Schema，
+// 仅依靠系统提示词中的工具手册描述工具；Config.ForceToolSchemas 可以强制发送。
+//
+// llm.Options 没有种子字段，内置 Provider 均不读取 Metadata，因此只有声明 Seed 的
+// Provider（或包装 Provider 的中间件）才被视为支持 Config.Seed。
+type CapabilityReporter interface {
+	Capabilities() ProviderCapabilities
+}
+
+// providerFactory 返回自动创建 Provider 使用的工厂（已应用 HTTPClient）
+func (b *builder) providerFactory() func(*llm.Config) (llm.Provider, error) {
+	factory := b.newProvider
+	if factory == nil {
+		factory = provider.New
+	}
+	if b.httpClient != nil {
+		factory = withHTTPClient(factory, b.httpClient)
+	}
+	return factory
+}
+
+// withHTTPClient 包装 Provider 工厂，为创建的 Provider 设置 HTTP 客户端
+//
+// Provider 不支持自定义客户端时关闭它并返回错误。
+func withHTTPClient(factory func(*llm.Config) (llm.Provider, error), client *http.Client) func(*llm.Config) (llm.Provider, error) {
+	return func(cfg *llm.Config) (llm.Provider, error) {
+		p, err := factory(cfg)
+		if err != nil {
+			return nil, err
+		}
+		setter, ok := p.(HTTPClientSetter)
+		if !ok {
+			_ = p.Close()
+			return nil, fmt.Errorf("provider %T does not support a custom HTTP client", p)
+		}
+		setter.SetHTTPClient(client)
+		return p, nil
+	}
+}
+
+// SetProvider 运行时替换 Provider，保留对话历史
+//
+// 替换后关闭旧 Provider（与 Close 一致，Agent 持有的 Provider 由 Agent 负责关闭），
+// 关闭失败时仍完成替换并返回错误。Config().LLM 不随之改变，降级 Provider 仍按配置创建。
+//
+// 有执行进行中时返回 ErrAgentBusy（可先 WaitIdle），已关闭的 Agent 返回 ErrAgentStopped。
+//
+// 使用示例:
+//
+//	if _, err := ag.Chat(ctx, "Hello"); err != nil {
+//	    _ = ag.SetProvider(secondary) // 主 Provider 持续出错时切换到备用
+//	}
+func (a *Agent) SetProvider(p llm.Provider) error {
+	if p == nil {
+		return errors.New("provider is nil")
+	}
+
+	a.mu.Lock()
+	switch a.state {
+	case StateStopped, StateStopping:
+		a.mu.Unlock()
+		return ErrAgentStopped
+	case StateRunning:
+		a.mu.Unlock()
+		return ErrAgentBusy
+	case StateReady:
+	}
+	old := a.provider
+	a.provider = p
+	a.mu.Unlock()
+
+	a.logger.Info("provider replaced", "id", a.id)
+	if old != nil && old != p {
+		if err := old.Close(); err != nil {
+			return fmt.Errorf("close previous provider: %w", err)
+		}
+	}
+	return nil
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 接口断言
 // ═══════════════════════════════════════════════════════════════════════════
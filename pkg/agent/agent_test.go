@@ -0,0 +1,3859 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 测试辅助
+// ═══════════════════════════════════════════════════════════════════════════
+
+// newTestAgent 使用 mock provider 创建测试 Agent
+func newTestAgent(t *testing.T, provider *mock.Client, opts ...Option) *Agent {
+	t.Helper()
+
+	allOpts := make([]Option, 0, len(opts)+1)
+	allOpts = append(allOpts, WithProvider(provider))
+	allOpts = append(allOpts, opts...)
+
+	ag, err := NewAgent(allOpts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ag.Close() })
+	return ag
+}
+
+// echoInput echo 工具输入
+type echoInput struct {
+	Text string `json:"text"`
+}
+
+// newEchoTool 创建回显工具
+func newEchoTool() tool.Tool {
+	return tool.Func("echo", "Echo the input text",
+		func(_ context.Context, in echoInput) (string, error) {
+			return in.Text, nil
+		})
+}
+
+// newFailingTool 创建总是失败的工具
+func newFailingTool() tool.Tool {
+	return tool.Func("fail", "Always fails",
+		func(_ context.Context, _ echoInput) (string, error) {
+			return "", errors.New("boom")
+		})
+}
+
+// toolCallMessage 构造包含单个工具调用的助手消息
+func toolCallMessage(id, name string, input map[string]any) llm.Message {
+	return llm.Message{
+		Role: llm.RoleAssistant,
+		ContentBlocks: []llm.ContentBlock{
+			&llm.ToolCall{ID: id, Name: name, Input: input},
+		},
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 输入校验测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_EmptyInput(t *testing.T) {
+	t.Run("rejected_by_default", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("should not be called"))
+		ag := newTestAgent(t, provider)
+
+		for _, input := range []string{"", "   ", "\n\t"} {
+			_, err := ag.Chat(context.Background(), input)
+			require.ErrorIs(t, err, ErrEmptyInput)
+			assert.Contains(t, err.Error(), "empty input")
+		}
+
+		assert.Equal(t, 0, provider.CallCount(), "provider should not be called for empty input")
+		assert.Empty(t, ag.Messages(), "empty input should not be recorded")
+	})
+
+	t.Run("allowed_for_continuation", func(t *testing.T) {
+		provider := mock.New(mock.WithResponses("first", "continued"))
+		ag := newTestAgent(t, provider, WithAllowEmptyInput(true))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		result, err := ag.Chat(context.Background(), "")
+		require.NoError(t, err)
+		assert.Equal(t, "continued", result.Text)
+
+		// 续写不追加用户消息：user, assistant, assistant
+		assert.Len(t, ag.Messages(), 3)
+	})
+}
+
+// imageBlock 测试用图片内容块
+type imageBlock struct {
+	URL string `json:"url"`
+}
+
+func (b *imageBlock) BlockType() string { return "image" }
+
+func TestAgent_RunWith(t *testing.T) {
+	t.Run("sends_blocks_as_user_message", func(t *testing.T) {
+		for _, streaming := range []bool{false, true} {
+			provider := mock.New(mock.WithResponse("a cat"))
+			ag := newTestAgent(t, provider)
+
+			blocks := []llm.ContentBlock{
+				&llm.TextBlock{Text: "What is this?"},
+				&imageBlock{URL: "https://example.com/cat.png"},
+			}
+			result, err := collectResult(ag.RunWith(context.Background(), blocks, WithStreaming(streaming)))
+			require.NoError(t, err)
+			assert.Equal(t, "a cat", result.Text)
+
+			sent := provider.LastCall().Messages
+			require.Len(t, sent, 1)
+			assert.Equal(t, llm.RoleUser, sent[0].Role)
+			assert.Equal(t, blocks, sent[0].ContentBlocks)
+
+			// 调用方修改切片不影响历史
+			blocks[0] = &llm.TextBlock{Text: "changed"}
+			assert.Equal(t, "What is this?", ag.Messages()[0].GetContent())
+		}
+	})
+
+	t.Run("image_only_is_not_empty", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider)
+
+		_, err := collectResult(ag.RunWith(context.Background(), []llm.ContentBlock{&imageBlock{URL: "x"}}))
+		require.NoError(t, err)
+		assert.Equal(t, 1, provider.CallCount())
+	})
+
+	t.Run("blank_text_is_empty", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		_, err := collectResult(ag.RunWith(context.Background(), []llm.ContentBlock{&llm.TextBlock{Text: " "}}))
+		require.ErrorIs(t, err, ErrEmptyInput)
+		_, err = collectResult(ag.RunWith(context.Background(), nil))
+		require.ErrorIs(t, err, ErrEmptyInput)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 截止时间降级测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_DeadlineDowngrade(t *testing.T) {
+	// 主模型：每次都请求工具调用，且响应较慢
+	primary := mock.New(
+		mock.WithDelay(200*time.Millisecond),
+		mock.WithMessageFunc(func(_ []llm.Message, _ int) llm.Message {
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+		}),
+	)
+	fast := mock.New(mock.WithResponse("fast answer"))
+
+	var requestedModel string
+	ag := newTestAgent(t, primary,
+		WithTools(newEchoTool()),
+		WithDeadlineDowngrade("fast-model", 900*time.Millisecond),
+		func(b *builder) {
+			b.newProvider = func(cfg *llm.Config) (llm.Provider, error) {
+				requestedModel = cfg.Model
+				return fast, nil
+			}
+		},
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	result, err := ag.Chat(ctx, "Hello")
+	require.NoError(t, err)
+
+	assert.Equal(t, "fast answer", result.Text)
+	assert.Equal(t, "fast-model", requestedModel)
+	assert.Equal(t, 1, primary.CallCount(), "primary model should handle the first step")
+	assert.Equal(t, 1, fast.CallCount(), "fast model should handle the final step")
+	assert.Empty(t, fast.LastCall().Options.Tools, "tools should be disabled for the final step")
+	assert.Equal(t, "fast-model", result.Metadata["downgraded_model"])
+	assert.Equal(t, 2, result.Metadata["downgraded_at_step"])
+}
+
+func TestAgent_DeadlineDowngrade_NoDeadline(t *testing.T) {
+	provider := mock.New(mock.WithResponse("primary answer"))
+	ag := newTestAgent(t, provider, WithDeadlineDowngrade("fast-model", time.Hour))
+
+	result, err := ag.Chat(context.Background(), "Hello")
+	require.NoError(t, err)
+
+	assert.Equal(t, "primary answer", result.Text)
+	assert.NotContains(t, result.Metadata, "downgraded_model")
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Token 统计测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_TokenUsage(t *testing.T) {
+	t.Run("single_step", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, _ int) llm.Message {
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		// mock: input = len(messages)*10, output = 20
+		assert.Equal(t, 10, result.PromptTokens)
+		assert.Equal(t, 20, result.CompletionTokens)
+		assert.Equal(t, 30, result.TotalTokens)
+	})
+
+	t.Run("sums_across_tool_loop", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		// 第 1 步: 1 条消息 → 10/20；第 2 步: 3 条消息 → 30/20
+		assert.Equal(t, 2, result.StepCount)
+		assert.Equal(t, 40, result.PromptTokens)
+		assert.Equal(t, 40, result.CompletionTokens)
+		assert.Equal(t, 80, result.TotalTokens)
+	})
+
+	t.Run("streaming_has_no_usage", func(t *testing.T) {
+		// llm.Event 不携带用量，流式执行的 Token 统计为 0（见 Result 文档）
+		ag := newTestAgent(t, mock.New(mock.WithResponse("done")))
+
+		result, err := collectResult(ag.Run(context.Background(), "Hello", WithStreaming(true)))
+		require.NoError(t, err)
+		assert.Equal(t, "done", result.Text)
+		assert.Zero(t, result.TotalTokens)
+		require.Len(t, result.Steps, 1)
+		assert.Zero(t, result.Steps[0].Tokens)
+	})
+}
+
+func TestAgent_Steps(t *testing.T) {
+	provider := mock.New(
+		mock.WithDelay(10*time.Millisecond),
+		mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}),
+	)
+	ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+	result, err := ag.Chat(context.Background(), "Hello")
+	require.NoError(t, err)
+	require.Len(t, result.Steps, 2)
+
+	assert.Equal(t, 1, result.Steps[0].Index)
+	assert.Equal(t, []string{"echo"}, result.Steps[0].ToolsUsed)
+	assert.Equal(t, 30, result.Steps[0].Tokens)
+	assert.GreaterOrEqual(t, result.Steps[0].Duration, 10*time.Millisecond)
+
+	assert.Equal(t, 2, result.Steps[1].Index)
+	assert.Empty(t, result.Steps[1].ToolsUsed)
+	assert.Equal(t, 50, result.Steps[1].Tokens)
+}
+
+func TestAgent_FinishReason(t *testing.T) {
+	t.Run("last_call_wins", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "stop", result.FinishReason)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		truncate := func(next ProviderCallFunc) ProviderCallFunc {
+			return func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+				resp, err := next(ctx, messages, opts)
+				if err == nil {
+					resp.FinishReason = "length"
+				}
+				return resp, err
+			}
+		}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("partial")), WithMiddleware(truncate))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "length", result.FinishReason)
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")))
+
+		_, result, err := ag.RunCollect(context.Background(), "Hello", WithStreaming(true))
+		require.NoError(t, err)
+		assert.Equal(t, "stop", result.FinishReason)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 工具手册测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_ToolManual(t *testing.T) {
+	t.Run("lists_registered_tools", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithTools(newEchoTool()))
+
+		manual := ag.ToolManual()
+		assert.Contains(t, manual, "### Tools Manual")
+		assert.Contains(t, manual, "- `echo`: Echo the input text")
+		assert.NotContains(t, manual, ag.Config().SystemPrompt)
+	})
+
+	t.Run("reflects_registry_changes", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithTools(newEchoTool()))
+
+		upper := tool.Func("upper", "Uppercase the input text",
+			func(_ context.Context, in echoInput) (string, error) {
+				return in.Text, nil
+			})
+		require.NoError(t, ag.AddTool(upper))
+		assert.Contains(t, ag.ToolManual(), "- `upper`: Uppercase the input text")
+
+		require.NoError(t, ag.RemoveTool("echo"))
+		assert.NotContains(t, ag.ToolManual(), "`echo`")
+	})
+
+	t.Run("empty_without_tools", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+		assert.Empty(t, ag.ToolManual())
+	})
+
+	t.Run("matches_injected_system_prompt", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Contains(t, provider.LastCall().Options.System, ag.ToolManual())
+	})
+
+	t.Run("custom_header_and_template", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider,
+			WithTools(newEchoTool()),
+			WithToolManualHeader("### 工具手册"),
+			WithToolManualTemplate("可用工具：{{range .Tools}}\n* {{.Name}}（{{.Description}}）{{end}}"),
+		)
+
+		assert.Equal(t, "### 工具手册\n\n可用工具：\n* echo（Echo the input text）", ag.ToolManual())
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		system := provider.LastCall().Options.System
+		assert.Contains(t, system, "### 工具手册")
+		assert.NotContains(t, system, DefaultToolManualHeader)
+	})
+
+	t.Run("dedup_uses_configured_header", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider,
+			WithTools(newEchoTool()),
+			WithPrompt("### 工具手册\n\n手写的工具说明"),
+			WithToolManualHeader("### 工具手册"),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		system := provider.LastCall().Options.System
+		assert.Equal(t, 1, strings.Count(system, "### 工具手册"))
+		assert.NotContains(t, system, "`echo`")
+	})
+
+	t.Run("injection_disabled", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithInjectToolManual(false))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.NotContains(t, provider.LastCall().Options.System, DefaultToolManualHeader)
+		assert.Len(t, provider.LastCall().Options.Tools, 1, "tool schemas are still sent")
+		assert.NotEmpty(t, ag.ToolManual())
+	})
+
+	t.Run("invalid_template", func(t *testing.T) {
+		_, err := New().ToolManualTemplate("{{.Tools").Provider(mock.New()).Build()
+		require.ErrorContains(t, err, "parse tool manual template")
+
+		_, err = NewAgent(WithProvider(mock.New()), WithToolManualTemplate("{{.Tools"))
+		require.ErrorContains(t, err, "parse tool manual template")
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 连续工具失败测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_MaxConsecutiveToolErrors(t *testing.T) {
+	t.Run("breaks_failure_loop", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, _ int) llm.Message {
+			return toolCallMessage("call-1", "fail", map[string]any{"text": "x"})
+		}))
+		ag := newTestAgent(t, provider,
+			WithTools(newFailingTool()),
+			WithMaxConsecutiveToolErrors(2),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.ErrorIs(t, err, ErrTooManyToolErrors)
+		assert.Contains(t, err.Error(), "3 consecutive steps")
+		assert.Equal(t, 3, provider.CallCount())
+	})
+
+	t.Run("success_resets_counter", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			switch {
+			case n >= 6:
+				return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+			case n%2 == 0:
+				return toolCallMessage("call-ok", "echo", map[string]any{"text": "ok"})
+			default:
+				return toolCallMessage("call-fail", "fail", map[string]any{"text": "x"})
+			}
+		}))
+		ag := newTestAgent(t, provider,
+			WithTools(newEchoTool(), newFailingTool()),
+			WithMaxConsecutiveToolErrors(1),
+		)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "done", result.Text)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 步数上限测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_MaxSteps(t *testing.T) {
+	t.Run("stops_infinite_tool_loop", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, _ int) llm.Message {
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "again"})
+		}))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithMaxSteps(3))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.ErrorIs(t, err, ErrMaxStepsExceeded)
+		require.NotNil(t, result, "partial result should be returned")
+		require.ErrorIs(t, result.Err, ErrMaxStepsExceeded)
+
+		assert.Equal(t, 3, provider.CallCount())
+		assert.Equal(t, 3, result.StepCount)
+		assert.Len(t, result.ToolsUsed, 3)
+	})
+
+	t.Run("zero_means_unlimited", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n <= 30 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "again"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithMaxSteps(0))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, 31, result.StepCount)
+	})
+}
+
+func TestAgent_PartialResult(t *testing.T) {
+	failure := errors.New("API error: 400 - bad request")
+
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("provider_error_after_tools/streaming=%v", streaming), func(t *testing.T) {
+			// 第一步返回工具调用，第二步失败
+			ag := newTestAgent(t, mock.New(), WithTools(newEchoTool()), WithRetryConfig(&RetryConfig{}),
+				WithMiddleware(func(ProviderCallFunc) ProviderCallFunc {
+					return func(_ context.Context, messages []llm.Message, _ *llm.Options) (*llm.Response, error) {
+						if len(messages) > 1 {
+							return nil, failure
+						}
+						return &llm.Response{Message: toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})}, nil
+					}
+				}))
+
+			events, result, err := ag.RunCollect(context.Background(), "Hello", WithStreaming(streaming))
+			require.ErrorIs(t, err, failure)
+			require.NotNil(t, result, "partial result should be returned")
+			require.ErrorIs(t, result.Err, failure)
+
+			assert.Equal(t, 2, result.StepCount)
+			assert.Equal(t, []string{"echo"}, result.ToolsUsed)
+			require.Len(t, result.Messages, 3, "user message, tool call and tool result")
+			assert.Len(t, result.Messages[2].GetToolResults(), 1)
+			for _, event := range events {
+				assert.NotEqual(t, llm.EventTypeDone, event.Type, "failed runs do not complete")
+			}
+		})
+	}
+
+	// 所有失败的执行都以附带部分结果的错误事件结束，不发送 Usage 和 Done
+	schema := `{"type":"object","required":["name"]}`
+	failures := []struct {
+		name     string
+		opts     []Option
+		provider func() *mock.Client
+		wantErr  error
+		wantText string
+	}{
+		{
+			name: "max_steps",
+			// 中间件直接返回工具调用（mock 的流式接口只输出文本）
+			opts: []Option{WithTools(newEchoTool()), WithMaxSteps(2),
+				WithMiddleware(func(ProviderCallFunc) ProviderCallFunc {
+					return func(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+						return &llm.Response{Message: toolCallMessage("call-1", "echo", map[string]any{"text": "again"})}, nil
+					}
+				}),
+			},
+			provider: func() *mock.Client { return mock.New() },
+			wantErr:  ErrMaxStepsExceeded,
+		},
+		{
+			name: "answer_rejected",
+			opts: []Option{WithAnswerValidator(func(context.Context, string) error {
+				return errors.New("wrong")
+			})},
+			provider: func() *mock.Client { return mock.New(mock.WithResponse("no idea")) },
+			wantErr:  ErrAnswerRejected,
+			wantText: "no idea",
+		},
+		{
+			name: "invalid_structured_output",
+			opts: []Option{WithResponseSchema(schema), WithRetryConfig(&RetryConfig{
+				InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1,
+			})},
+			provider: func() *mock.Client { return mock.New(mock.WithResponse("not json")) },
+			wantErr:  ErrInvalidStructuredOutput,
+			wantText: "not json",
+		},
+	}
+	for _, tc := range failures {
+		for _, streaming := range []bool{false, true} {
+			t.Run(fmt.Sprintf("terminal_events/%s/streaming=%v", tc.name, streaming), func(t *testing.T) {
+				ag := newTestAgent(t, tc.provider(), tc.opts...)
+
+				events, result, err := ag.RunCollect(context.Background(), "Hello", WithStreaming(streaming))
+				require.ErrorIs(t, err, tc.wantErr)
+				require.NotNil(t, result)
+				require.ErrorIs(t, result.Err, tc.wantErr)
+				assert.Equal(t, tc.wantText, result.Text)
+
+				require.NotEmpty(t, events)
+				last := events[len(events)-1]
+				assert.Equal(t, llm.EventTypeError, last.Type)
+				assert.Same(t, result, last.Result)
+				for _, event := range events {
+					assert.NotEqual(t, llm.EventTypeDone, event.Type)
+					assert.NotEqual(t, EventTypeUsage, event.Type)
+				}
+			})
+		}
+	}
+
+	t.Run("success_has_no_error", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.NoError(t, result.Err)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 执行级日志属性测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_WithLogAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+	ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithLogger(logger))
+
+	for range ag.Run(context.Background(), "Hello", WithLogAttrs(slog.String("request_id", "req-42"))) {
+	}
+
+	var runLines int
+	for line := range bytes.Lines(buf.Bytes()) {
+		if bytes.Contains(line, []byte(`"msg":"agent created"`)) {
+			assert.NotContains(t, string(line), "req-42", "agent-level logs should not carry run attributes")
+			continue
+		}
+		runLines++
+		assert.Contains(t, string(line), `"request_id":"req-42"`)
+	}
+	assert.Positive(t, runLines, "run should emit logs")
+}
+
+// BenchmarkRunLogger_WithOnce 执行开始时绑定一次属性，后续日志复用
+func BenchmarkRunLogger_WithOnce(b *testing.B) {
+	base := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	attrs := []slog.Attr{slog.String("request_id", "req-42"), slog.String("tenant", "acme")}
+
+	for b.Loop() {
+		ag := &Agent{logger: base}
+		state := ag.newRunState(&RunOptions{LogAttrs: attrs}, "", 0)
+		for range 10 {
+			state.logger.Info("tool call", "tool", "echo")
+		}
+	}
+}
+
+// BenchmarkRunLogger_PerCallAttrs 每条日志重复传入属性
+func BenchmarkRunLogger_PerCallAttrs(b *testing.B) {
+	base := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	attrs := []slog.Attr{slog.String("request_id", "req-42"), slog.String("tenant", "acme")}
+
+	for b.Loop() {
+		for range 10 {
+			base.Info("tool call", "tool", "echo", attrs[0], attrs[1])
+		}
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 初始历史测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_History(t *testing.T) {
+	history := []llm.Message{
+		{Role: llm.RoleUser, Content: "My name is Alice."},
+		{Role: llm.RoleAssistant, Content: "Nice to meet you, Alice."},
+	}
+
+	provider := mock.New(mock.WithResponse("Your name is Alice."))
+	ag := newTestAgent(t, provider, WithHistory(history))
+
+	assert.Equal(t, history, ag.Messages())
+
+	result, err := ag.Chat(context.Background(), "What is my name?")
+	require.NoError(t, err)
+
+	// 历史被发送给 Provider
+	sent := provider.LastCall().Messages
+	require.Len(t, sent, 3)
+	assert.Equal(t, history, sent[:2])
+
+	// 本轮结果只包含本轮消息
+	require.Len(t, result.Messages, 2)
+	assert.Equal(t, llm.RoleUser, result.Messages[0].Role)
+	assert.Equal(t, "What is my name?", result.Messages[0].GetContent())
+	assert.Len(t, ag.Messages(), 4)
+
+	// 修改原切片不影响 Agent
+	history[0].Content = "changed"
+	assert.Equal(t, "My name is Alice.", ag.Messages()[0].Content)
+}
+
+func TestBuilder_History(t *testing.T) {
+	ag, err := New().
+		Provider(mock.New(mock.WithResponse("ok"))).
+		History(llm.Message{Role: llm.RoleUser, Content: "hi"}).
+		History(llm.Message{Role: llm.RoleAssistant, Content: "hello"}).
+		Build()
+	require.NoError(t, err)
+	defer func() { _ = ag.Close() }()
+
+	assert.Len(t, ag.Messages(), 2)
+}
+
+func TestAgent_Seed(t *testing.T) {
+	t.Run("supported", func(t *testing.T) {
+		p := &capabilityProvider{Client: mock.New(mock.WithResponse("ok")), seed: true}
+		ag := newTestAgent(t, p.Client, WithProvider(p), WithSeed(7), WithTemperature(0))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, 7, result.Metadata["seed"])
+		assert.Equal(t, 7, p.LastCall().Options.Metadata["seed"])
+	})
+
+	t.Run("ignored_by_provider", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithSeed(7), WithLogger(logger))
+
+		for range 2 {
+			result, err := ag.Chat(context.Background(), "Hello")
+			require.NoError(t, err)
+			assert.NotContains(t, result.Metadata, "seed", "run not reported as seeded")
+		}
+		assert.Equal(t, 1, strings.Count(buf.String(), "provider ignores seed"), "warned once")
+	})
+}
+
+func TestAgent_Examples(t *testing.T) {
+	examples := []llm.Message{
+		{Role: llm.RoleUser, Content: "你好"},
+		{Role: llm.RoleAssistant, Content: "Hello"},
+	}
+
+	t.Run("prepended_but_not_in_history", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("Thanks"))
+		ag := newTestAgent(t, provider, WithExamples(examples...))
+
+		for _, input := range []string{"谢谢", "再见"} {
+			_, err := ag.Chat(context.Background(), input)
+			require.NoError(t, err)
+
+			sent := provider.LastCall().Messages
+			assert.Equal(t, examples, sent[:2])
+			assert.Equal(t, input, sent[len(sent)-1].GetContent())
+		}
+		assert.Len(t, ag.Messages(), 4, "examples not part of history")
+	})
+
+	t.Run("not_trimmed_by_window", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithExamples(examples...), WithMaxHistoryMessages(2))
+
+		for range 3 {
+			_, err := ag.Chat(context.Background(), "Hi")
+			require.NoError(t, err)
+		}
+
+		sent := provider.LastCall().Messages
+		require.Len(t, sent, 3)
+		assert.Equal(t, examples, sent[:2])
+		assert.Equal(t, "Hi", sent[2].GetContent())
+	})
+
+	t.Run("builder_and_validation", func(t *testing.T) {
+		ag, err := New().Provider(mock.New()).Examples(examples...).Build()
+		require.NoError(t, err)
+		defer func() { _ = ag.Close() }()
+		assert.Equal(t, examples, ag.Config().Examples)
+
+		_, err = New().Provider(mock.New()).Examples(llm.Message{Role: llm.RoleSystem, Content: "x"}).Build()
+		require.ErrorContains(t, err, "examples[0]")
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Reset 测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Reset(t *testing.T) {
+	t.Run("clears_conversation_state", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		require.NotZero(t, ag.Status().MessageCount)
+
+		require.NoError(t, ag.Reset())
+
+		status := ag.Status()
+		assert.Equal(t, 0, status.MessageCount)
+		assert.Equal(t, 0, status.StepCount)
+		assert.True(t, status.LastActivity.IsZero())
+		assert.Equal(t, StateReady, status.State)
+		assert.True(t, ag.ToolRegistry().Has("echo"), "tools should be preserved")
+
+		// 重置后仍可继续使用，且不包含旧历史
+		_, err = ag.Chat(context.Background(), "Again")
+		require.NoError(t, err)
+		assert.Len(t, provider.LastCall().Messages, 1)
+	})
+
+	t.Run("stopped_agent", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+		require.NoError(t, ag.Close())
+
+		assert.ErrorIs(t, ag.Reset(), ErrAgentStopped)
+	})
+
+	t.Run("concurrent_with_status", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range 100 {
+				_ = ag.Status()
+			}
+		}()
+		for range 100 {
+			_ = ag.Reset()
+		}
+		<-done
+	})
+}
+
+func TestAgent_AppendMessage(t *testing.T) {
+	t.Run("few_shot_history", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("8"))
+		ag := newTestAgent(t, provider)
+
+		require.NoError(t, ag.AppendMessage(llm.Message{Role: llm.RoleUser, Content: "2+2"}))
+		require.NoError(t, ag.AppendMessage(llm.Message{Role: llm.RoleAssistant, Content: "4"}))
+
+		status := ag.Status()
+		assert.Equal(t, 2, status.MessageCount)
+		assert.Equal(t, 2, status.StepCount)
+		assert.False(t, status.LastActivity.IsZero())
+		assert.Equal(t, "4", ag.Messages()[1].GetContent())
+
+		_, err := ag.Chat(context.Background(), "3+5")
+		require.NoError(t, err)
+		sent := provider.LastCall().Messages
+		require.Len(t, sent, 3)
+		assert.Equal(t, llm.RoleAssistant, sent[1].Role)
+		assert.Equal(t, "3+5", sent[2].GetContent())
+	})
+
+	t.Run("stateless_keeps_appended_messages", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithStateless(true))
+		require.NoError(t, ag.AppendMessage(llm.Message{Role: llm.RoleUser, Content: "example"}))
+
+		for range 2 {
+			_, err := ag.Chat(context.Background(), "Hello")
+			require.NoError(t, err)
+			assert.Len(t, provider.LastCall().Messages, 2)
+		}
+	})
+
+	t.Run("invalid_role", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New())
+		require.ErrorContains(t, ag.AppendMessage(llm.Message{Content: "no role"}), "invalid message role")
+		assert.Empty(t, ag.Messages())
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(100*time.Millisecond))
+		ag := newTestAgent(t, provider)
+
+		events := ag.Run(context.Background(), "Hello")
+		require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+		require.ErrorIs(t, ag.AppendMessage(llm.Message{Role: llm.RoleUser, Content: "x"}), ErrAgentBusy)
+		for range events {
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New())
+		require.NoError(t, ag.Close())
+		require.ErrorIs(t, ag.AppendMessage(llm.Message{Role: llm.RoleUser, Content: "x"}), ErrAgentStopped)
+	})
+}
+
+func TestAgent_Truncate(t *testing.T) {
+	newAgent := func(t *testing.T) (*Agent, *mock.Client) {
+		t.Helper()
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 2 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: fmt.Sprintf("reply %d", n)}
+		}))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		_, err := ag.Chat(context.Background(), "first")
+		require.NoError(t, err)
+		_, err = ag.Chat(context.Background(), "second") // user, tool call, tool result, assistant
+		require.NoError(t, err)
+		require.Len(t, ag.Messages(), 6)
+		return ag, provider
+	}
+
+	t.Run("truncate", func(t *testing.T) {
+		ag, _ := newAgent(t)
+		steps := ag.Status().StepCount
+
+		require.NoError(t, ag.Truncate(2))
+		assert.Len(t, ag.Messages(), 4)
+		assert.Equal(t, steps-2, ag.Status().StepCount)
+
+		require.NoError(t, ag.Truncate(0))
+		assert.Len(t, ag.Messages(), 4)
+	})
+
+	t.Run("out_of_range", func(t *testing.T) {
+		ag, _ := newAgent(t)
+		require.ErrorContains(t, ag.Truncate(7), "cannot truncate 7 of 6 messages")
+		require.Error(t, ag.Truncate(-1))
+		assert.Len(t, ag.Messages(), 6)
+	})
+
+	t.Run("undo_last_exchange", func(t *testing.T) {
+		ag, provider := newAgent(t)
+
+		// 工具结果消息不算作用户输入，整轮一起撤销
+		require.NoError(t, ag.Undo())
+		msgs := ag.Messages()
+		require.Len(t, msgs, 2)
+		assert.Equal(t, "first", msgs[0].GetContent())
+
+		_, err := ag.Chat(context.Background(), "second, reworded")
+		require.NoError(t, err)
+		sent := provider.LastCall().Messages
+		require.Len(t, sent, 3)
+		assert.Equal(t, "second, reworded", sent[2].GetContent())
+
+		require.NoError(t, ag.Undo())
+		require.NoError(t, ag.Undo())
+		assert.Empty(t, ag.Messages())
+		require.ErrorContains(t, ag.Undo(), "no user message")
+	})
+
+	t.Run("result_messages_unaffected", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		require.NoError(t, ag.Undo())
+		_, err = ag.Chat(context.Background(), "Replaced")
+		require.NoError(t, err)
+		assert.Equal(t, "Hello", result.Messages[0].GetContent())
+	})
+
+	t.Run("busy_and_stopped", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(100*time.Millisecond))
+		ag := newTestAgent(t, provider)
+
+		events := ag.Run(context.Background(), "Hello")
+		require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+		require.ErrorIs(t, ag.Truncate(1), ErrAgentBusy)
+		require.ErrorIs(t, ag.Undo(), ErrAgentBusy)
+		for range events {
+		}
+
+		require.NoError(t, ag.Close())
+		require.ErrorIs(t, ag.Truncate(1), ErrAgentStopped)
+		require.ErrorIs(t, ag.Undo(), ErrAgentStopped)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 命名会话测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// runThread 执行命名会话并返回结果
+func runThread(t *testing.T, ag *Agent, threadID, text string) *Result {
+	t.Helper()
+
+	var result *Result
+	for event := range ag.RunThread(context.Background(), threadID, text) {
+		require.NoError(t, event.Error)
+		if event.Type == llm.EventTypeDone {
+			result = event.Result
+		}
+	}
+	require.NotNil(t, result)
+	return result
+}
+
+func TestAgent_RunThread(t *testing.T) {
+	t.Run("independent_histories", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider)
+
+		runThread(t, ag, "a", "A1")
+		runThread(t, ag, "b", "B1")
+		runThread(t, ag, "a", "A2")
+
+		historyA := ag.ThreadMessages("a")
+		historyB := ag.ThreadMessages("b")
+		require.Len(t, historyA, 4)
+		require.Len(t, historyB, 2)
+		assert.Equal(t, "A1", historyA[0].GetContent())
+		assert.Equal(t, "A2", historyA[2].GetContent())
+		assert.Equal(t, "B1", historyB[0].GetContent())
+
+		// 最后一次调用只包含会话 a 的历史
+		assert.Len(t, provider.LastCall().Messages, 3)
+
+		// 默认会话不受影响
+		assert.Empty(t, ag.Messages())
+		assert.Empty(t, ag.ThreadMessages("unknown"))
+	})
+
+	t.Run("concurrent_threads", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok"), mock.WithDelay(time.Millisecond)))
+
+		threads := []string{"a", "b", "c", "d"}
+		var wg sync.WaitGroup
+		for _, id := range threads {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 3 {
+					runThread(t, ag, id, id)
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, id := range threads {
+			history := ag.ThreadMessages(id)
+			require.Len(t, history, 6)
+			for i := 0; i < len(history); i += 2 {
+				assert.Equal(t, id, history[i].GetContent())
+			}
+		}
+		assert.Equal(t, StateReady, ag.Status().State)
+	})
+
+	t.Run("reset_clears_threads", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		runThread(t, ag, "a", "hello")
+		require.NoError(t, ag.Reset())
+
+		assert.Empty(t, ag.ThreadMessages("a"))
+	})
+}
+
+func TestAgent_Stateless(t *testing.T) {
+	seed := []llm.Message{
+		{Role: llm.RoleUser, Content: "context"},
+		{Role: llm.RoleAssistant, Content: "noted"},
+	}
+
+	t.Run("each_call_starts_from_seed", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithHistory(seed), WithStateless(true))
+
+		for _, text := range []string{"first", "second"} {
+			result, err := ag.Chat(context.Background(), text)
+			require.NoError(t, err)
+			assert.Len(t, result.Messages, 2)
+
+			// 发送给模型的只有初始历史和本轮输入
+			sent := provider.LastCall().Messages
+			require.Len(t, sent, 3)
+			assert.Equal(t, text, sent[2].GetContent())
+		}
+
+		history := ag.Messages()
+		require.Len(t, history, 4)
+		assert.Equal(t, "context", history[0].GetContent())
+		assert.Equal(t, "second", history[2].GetContent())
+	})
+
+	t.Run("named_threads", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithStateless(true))
+
+		runThread(t, ag, "a", "A1")
+		runThread(t, ag, "a", "A2")
+		history := ag.ThreadMessages("a")
+		require.Len(t, history, 2)
+		assert.Equal(t, "A2", history[0].GetContent())
+	})
+
+	t.Run("builder", func(t *testing.T) {
+		ag, err := New().Provider(mock.New(mock.WithResponse("ok"))).Stateless(true).Build()
+		require.NoError(t, err)
+		defer func() { _ = ag.Close() }()
+
+		_, err = ag.Chat(context.Background(), "first")
+		require.NoError(t, err)
+		_, err = ag.Chat(context.Background(), "second")
+		require.NoError(t, err)
+		assert.Len(t, ag.Messages(), 2)
+		assert.True(t, ag.Config().Stateless)
+	})
+}
+
+func TestAgent_ConcurrentChat(t *testing.T) {
+	t.Run("same_thread_serialized", func(t *testing.T) {
+		// 回复最后一条用户消息，便于核对每轮问答是否配对
+		provider := mock.New(
+			mock.WithDelay(20*time.Millisecond),
+			mock.WithMessageFunc(func(msgs []llm.Message, _ int) llm.Message {
+				return llm.Message{Role: llm.RoleAssistant, Content: "re: " + msgs[len(msgs)-1].GetContent()}
+			}),
+		)
+		ag := newTestAgent(t, provider)
+
+		var wg sync.WaitGroup
+		for _, text := range []string{"first", "second"} {
+			wg.Go(func() {
+				result, err := ag.Chat(context.Background(), text)
+				assert.NoError(t, err)
+				assert.Equal(t, "re: "+text, result.Text)
+				assert.Len(t, result.Messages, 2)
+			})
+		}
+		wg.Wait()
+
+		history := ag.Messages()
+		require.Len(t, history, 4)
+		for i := 0; i < len(history); i += 2 {
+			assert.Equal(t, llm.RoleUser, history[i].Role)
+			assert.Equal(t, "re: "+history[i].GetContent(), history[i+1].GetContent())
+		}
+		assert.Len(t, provider.LastCall().Messages, 3, "second run sees the first exchange")
+		assert.Equal(t, StateReady, ag.Status().State)
+	})
+
+	t.Run("queued_run_cancelled", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"), mock.WithDelay(200*time.Millisecond))
+		ag := newTestAgent(t, provider)
+
+		first := ag.Run(context.Background(), "first")
+		require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := ag.Chat(ctx, "second")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		for range first {
+		}
+		assert.Equal(t, 1, provider.CallCount())
+		assert.Len(t, ag.Messages(), 2, "queued message is not appended")
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 文本增量合并测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// collectStreamText 执行流式对话，返回文本事件列表
+func collectStreamText(t *testing.T, ag *Agent, text string, opts ...RunOption) []string {
+	t.Helper()
+
+	var deltas []string
+	for event := range ag.Run(context.Background(), text, opts...) {
+		require.NoError(t, event.Error)
+		if event.Type == llm.EventTypeText {
+			deltas = append(deltas, event.Text)
+		}
+	}
+	return deltas
+}
+
+func TestAgent_TextCoalesce(t *testing.T) {
+	const reply = "Hello, coalesced world!"
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse(reply)))
+
+		deltas := collectStreamText(t, ag, "Hi", WithStreaming(true))
+		assert.Len(t, deltas, len(reply))
+	})
+
+	t.Run("merges_deltas_within_window", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse(reply)))
+
+		deltas := collectStreamText(t, ag, "Hi",
+			WithStreaming(true),
+			WithTextCoalesce(time.Hour),
+		)
+		assert.Less(t, len(deltas), len(reply))
+		assert.Equal(t, []string{reply}, deltas)
+	})
+
+	t.Run("preserves_text_and_order", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse(reply)))
+
+		deltas := collectStreamText(t, ag, "Hi",
+			WithStreaming(true),
+			WithTextCoalesce(time.Nanosecond),
+		)
+		assert.Equal(t, reply, strings.Join(deltas, ""))
+	})
+}
+
+func TestAgent_RunCollect(t *testing.T) {
+	t.Run("collects_all_events", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		events, result, err := ag.RunCollect(context.Background(), "Hello")
+		require.NoError(t, err)
+		require.NotNil(t, result)
+		assert.Equal(t, "done", result.Text)
+
+		types := make([]llm.EventType, 0, len(events))
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+		assert.Equal(t, []llm.EventType{
+			llm.EventTypeToolCall, llm.EventTypeToolResult, llm.EventTypeText, EventTypeUsage, llm.EventTypeDone,
+		}, types)
+	})
+
+	t.Run("returns_error", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		events, result, err := ag.RunCollect(context.Background(), "")
+		require.ErrorIs(t, err, ErrEmptyInput)
+		assert.Nil(t, result)
+		require.Len(t, events, 1)
+		assert.Equal(t, llm.EventTypeError, events[0].Type)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 事件过滤测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_EventFilter(t *testing.T) {
+	toolThenAnswer := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+	eventTypes := func(events <-chan *AgentEvent) ([]llm.EventType, *Result) {
+		var types []llm.EventType
+		var result *Result
+		for event := range events {
+			types = append(types, event.Type)
+			if event.Type == llm.EventTypeDone {
+				result = event.Result
+			}
+		}
+		return types, result
+	}
+
+	t.Run("only_selected_types", func(t *testing.T) {
+		ag := newTestAgent(t, toolThenAnswer(), WithTools(newEchoTool()))
+
+		types, result := eventTypes(ag.Run(context.Background(), "Hello", WithEventFilter(llm.EventTypeDone)))
+		assert.Equal(t, []llm.EventType{llm.EventTypeDone}, types)
+
+		// 内部处理不受影响
+		require.NotNil(t, result)
+		assert.Equal(t, "done", result.Text)
+		assert.Equal(t, []string{"echo"}, result.ToolsUsed)
+		assert.Len(t, ag.Messages(), 4)
+	})
+
+	t.Run("all_events_by_default", func(t *testing.T) {
+		ag := newTestAgent(t, toolThenAnswer(), WithTools(newEchoTool()))
+
+		types, _ := eventTypes(ag.Run(context.Background(), "Hello"))
+		assert.Contains(t, types, llm.EventTypeToolCall)
+		assert.Contains(t, types, llm.EventTypeToolResult)
+		assert.Contains(t, types, llm.EventTypeText)
+	})
+
+	t.Run("errors_always_delivered", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		types, _ := eventTypes(ag.Run(context.Background(), "", WithEventFilter(llm.EventTypeDone)))
+		assert.Equal(t, []llm.EventType{llm.EventTypeError}, types)
+	})
+}
+
+func TestAgent_EventTransformers(t *testing.T) {
+	upper := func(e *AgentEvent) *AgentEvent {
+		if e.Type == llm.EventTypeText {
+			return &AgentEvent{Type: e.Type, Text: strings.ToUpper(e.Text)}
+		}
+		return e
+	}
+	dropUsage := func(e *AgentEvent) *AgentEvent {
+		if e.Type == EventTypeUsage {
+			return nil
+		}
+		return e
+	}
+
+	t.Run("chain_applied_in_order", func(t *testing.T) {
+		var seen []string
+		record := func(e *AgentEvent) *AgentEvent {
+			if e.Type == llm.EventTypeText {
+				seen = append(seen, e.Text)
+			}
+			return e
+		}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")),
+			WithEventTransformers(upper, record, dropUsage),
+		)
+
+		events, result, err := ag.RunCollect(context.Background(), "Hi", WithStreaming(true))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", result.Text, "result not affected")
+		assert.NotEmpty(t, seen)
+		for _, text := range seen {
+			assert.Equal(t, strings.ToUpper(text), text, "record sees transformed text")
+		}
+		for _, event := range events {
+			assert.NotEqual(t, EventTypeUsage, event.Type)
+		}
+	})
+
+	t.Run("before_event_filter", func(t *testing.T) {
+		ag, err := New().Provider(mock.New(mock.WithResponse("hello"))).TransformEvents(upper).Build()
+		require.NoError(t, err)
+		defer func() { _ = ag.Close() }()
+
+		events, _, err := ag.RunCollect(context.Background(), "Hi", WithEventFilter(llm.EventTypeText))
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "HELLO", events[0].Text)
+	})
+
+	t.Run("inherited_by_fork", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")), WithEventTransformers(dropUsage))
+		fork, err := ag.Fork(WithProvider(mock.New()))
+		require.NoError(t, err)
+		defer func() { _ = fork.Close() }()
+		assert.Len(t, fork.eventTransformers, 1)
+	})
+}
+
+func TestAgent_EventBufferSize(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")))
+		events := ag.Run(context.Background(), "Hi")
+		assert.Equal(t, DefaultEventBufferSize, cap(events))
+		_, err := collectResult(events)
+		require.NoError(t, err)
+	})
+
+	t.Run("configured_and_run_override", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")), WithEventBufferSize(64))
+		events := ag.Run(context.Background(), "Hi")
+		assert.Equal(t, 64, cap(events))
+		_, err := collectResult(events)
+		require.NoError(t, err)
+
+		events = ag.Run(context.Background(), "Hi", WithEventBuffer(4))
+		assert.Equal(t, 4, cap(events))
+		_, err = collectResult(events)
+		require.NoError(t, err)
+
+		events = ag.Run(context.Background(), "Hi", WithEventBuffer(-1))
+		assert.Equal(t, 64, cap(events), "negative override ignored")
+		_, err = collectResult(events)
+		require.NoError(t, err)
+	})
+
+	t.Run("unbuffered", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")))
+		events := ag.Run(context.Background(), "Hi", WithStreaming(true), WithEventBuffer(0))
+		assert.Equal(t, 0, cap(events))
+
+		result, err := collectResult(events)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", result.Text)
+	})
+
+	t.Run("negative_rejected", func(t *testing.T) {
+		_, err := New().Provider(mock.New()).EventBufferSize(-1).Build()
+		require.ErrorContains(t, err, "eventBufferSize must be non-negative")
+
+		n := -1
+		_, err = New().Provider(mock.New()).FromConfig(&Config{EventBufferSize: &n}).Build()
+		require.ErrorContains(t, err, "event-buffer-size must be non-negative")
+
+		// 未经校验的选项路径回退为默认缓冲，而不是在 Run 中 panic
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hello")), WithEventBufferSize(-1))
+		events := ag.Run(context.Background(), "Hi")
+		assert.Equal(t, DefaultEventBufferSize, cap(events))
+		_, err = collectResult(events)
+		require.NoError(t, err)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 单次执行采样参数测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_RunSamplingOverrides(t *testing.T) {
+	provider := mock.New(mock.WithResponse("ok"))
+	ag := newTestAgent(t, provider, WithTemperature(0.9), WithMaxTokens(2048))
+
+	for event := range ag.Run(context.Background(), "Hi", WithRunTemperature(0), WithRunMaxTokens(64)) {
+		require.NoError(t, event.Error)
+	}
+	opts := provider.LastCall().Options
+	assert.InDelta(t, 0.0, opts.Temperature, 0)
+	assert.Equal(t, 64, opts.MaxTokens)
+
+	// 覆盖只作用于单次执行
+	_, err := ag.Chat(context.Background(), "Again")
+	require.NoError(t, err)
+	opts = provider.LastCall().Options
+	assert.InDelta(t, 0.9, opts.Temperature, 1e-9)
+	assert.Equal(t, 2048, opts.MaxTokens)
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 先规划后执行测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_PlanAndExecute(t *testing.T) {
+	provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		switch n {
+		case 1:
+			return llm.Message{Role: llm.RoleAssistant, Content: "1. echo hi\n2. report"}
+		case 2:
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+		default:
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}
+	}))
+	ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+	result, err := ag.PlanAndExecute(context.Background(), "Say hi")
+	require.NoError(t, err)
+
+	assert.Equal(t, "done", result.Text)
+	assert.Equal(t, "1. echo hi\n2. report", result.Metadata["plan"])
+	assert.Equal(t, []string{"echo"}, result.ToolsUsed)
+	assert.Equal(t, 3, result.StepCount)
+	require.Len(t, result.Steps, 3)
+	assert.Equal(t, 3, result.Steps[2].Index)
+
+	// 规划阶段不提供工具，执行阶段提供工具
+	calls := provider.Calls()
+	require.Len(t, calls, 3)
+	assert.Empty(t, calls[0].Options.Tools)
+	assert.NotEmpty(t, calls[1].Options.Tools)
+
+	// 执行阶段可以看到计划
+	assert.Contains(t, calls[1].Messages[1].GetContent(), "echo hi")
+}
+
+func TestAgent_PlanAndExecuteNoResult(t *testing.T) {
+	t.Run("done_filtered", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("1. greet"))
+		ag := newTestAgent(t, provider)
+
+		result, err := ag.PlanAndExecute(context.Background(), "Say hi", WithEventFilter(llm.EventTypeText))
+		require.ErrorContains(t, err, "plan phase produced no result")
+		assert.Nil(t, result)
+		assert.Equal(t, 1, provider.CallCount(), "execute phase not started")
+	})
+
+	t.Run("plan_done_dropped_by_transformer", func(t *testing.T) {
+		// 只丢弃规划阶段的完成事件：执行阶段有结果时也不能 panic
+		var dones atomic.Int32
+		dropFirstDone := func(e *AgentEvent) *AgentEvent {
+			if e.Type == llm.EventTypeDone && dones.Add(1) == 1 {
+				return nil
+			}
+			return e
+		}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithEventTransformers(dropFirstDone))
+
+		result, err := ag.PlanAndExecute(context.Background(), "Say hi")
+		require.ErrorContains(t, err, "plan phase produced no result")
+		assert.Nil(t, result)
+	})
+
+	t.Run("execute_done_dropped", func(t *testing.T) {
+		var dones atomic.Int32
+		dropSecondDone := func(e *AgentEvent) *AgentEvent {
+			if e.Type == llm.EventTypeDone && dones.Add(1) == 2 {
+				return nil
+			}
+			return e
+		}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithEventTransformers(dropSecondDone))
+
+		result, err := ag.PlanAndExecute(context.Background(), "Say hi")
+		require.ErrorContains(t, err, "execute phase produced no result")
+		assert.Nil(t, result)
+	})
+}
+
+func TestAgent_PlanAndExecuteThread(t *testing.T) {
+	planThenDone := func(_ []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return llm.Message{Role: llm.RoleAssistant, Content: "1. greet"}
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}
+
+	t.Run("stateless_keeps_plan", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(planThenDone))
+		ag := newTestAgent(t, provider, WithStateless(true))
+
+		result, err := ag.PlanAndExecute(context.Background(), "Say hi")
+		require.NoError(t, err)
+		assert.Equal(t, "done", result.Text)
+
+		calls := provider.Calls()
+		require.Len(t, calls, 2)
+		require.Len(t, calls[1].Messages, 3, "plan prompt, plan and execute prompt")
+		assert.Equal(t, "1. greet", calls[1].Messages[1].GetContent())
+	})
+
+	t.Run("concurrent_chat_waits", func(t *testing.T) {
+		planStarted := make(chan struct{})
+		release := make(chan struct{})
+		var calls atomic.Int32
+		provider := mock.New(mock.WithMessageFunc(planThenDone))
+		ag := newTestAgent(t, provider, WithMiddleware(func(next ProviderCallFunc) ProviderCallFunc {
+			return func(ctx context.Context, msgs []llm.Message, opts *llm.Options) (*llm.Response, error) {
+				if calls.Add(1) == 1 {
+					close(planStarted)
+					<-release
+				}
+				return next(ctx, msgs, opts)
+			}
+		}))
+
+		planDone := make(chan error, 1)
+		go func() {
+			_, err := ag.PlanAndExecute(context.Background(), "Say hi")
+			planDone <- err
+		}()
+		<-planStarted
+
+		chatDone := make(chan error, 1)
+		go func() {
+			_, err := ag.Chat(context.Background(), "Other")
+			chatDone <- err
+		}()
+		time.Sleep(20 * time.Millisecond) // 让 Chat 进入排队
+		close(release)
+		require.NoError(t, <-planDone)
+		require.NoError(t, <-chatDone)
+
+		// 执行阶段紧接规划阶段，Chat 排在整个调用之后
+		recorded := provider.Calls()
+		require.Len(t, recorded, 3)
+		for _, msg := range recorded[1].Messages {
+			assert.NotEqual(t, "Other", msg.GetContent())
+		}
+		last := recorded[2].Messages
+		assert.Equal(t, "Other", last[len(last)-1].GetContent())
+	})
+}
+
+func TestAgent_ToolsDisabled(t *testing.T) {
+	var executed atomic.Int32
+	provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n == 1 {
+			// 模型仍然尝试调用工具
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "summary"}
+	}))
+	ag := newTestAgent(t, provider,
+		WithTools(newEchoTool()),
+		WithHooks(Hooks{OnToolCall: func(*llm.ToolCall) { executed.Add(1) }}),
+	)
+
+	_, result, err := ag.RunCollect(context.Background(), "Summarize", WithToolsDisabled())
+	require.NoError(t, err)
+	assert.Equal(t, "summary", result.Text)
+	assert.Empty(t, provider.LastCall().Options.Tools)
+	assert.Equal(t, int32(0), executed.Load())
+
+	toolResults := result.Messages[2].GetToolResults()
+	require.Len(t, toolResults, 1)
+	assert.True(t, toolResults[0].IsError)
+	assert.Contains(t, toolResults[0].Content, "tools are disabled")
+
+	// 注册表不受影响，之后的执行照常提供工具
+	assert.True(t, ag.toolRegistry.Has("echo"))
+	_, err = ag.Chat(context.Background(), "Again")
+	require.NoError(t, err)
+	assert.NotEmpty(t, provider.LastCall().Options.Tools)
+}
+
+func TestAgent_OnlyTools(t *testing.T) {
+	advertised := func(opts *llm.Options) []string {
+		names := make([]string, 0, len(opts.Tools))
+		for _, schema := range opts.Tools {
+			names = append(names, schema.Name)
+		}
+		return names
+	}
+	newProvider := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "fail", map[string]any{"text": "x"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+
+	t.Run("restricts_advertised_and_executed", func(t *testing.T) {
+		provider := newProvider()
+		ag := newTestAgent(t, provider, WithTools(newEchoTool(), newFailingTool()))
+
+		_, result, err := ag.RunCollect(context.Background(), "Research", WithOnlyTools("echo"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"echo"}, advertised(provider.LastCall().Options))
+		assert.NotContains(t, provider.LastCall().Options.System, "`fail`")
+
+		toolResults := result.Messages[2].GetToolResults()
+		require.Len(t, toolResults, 1)
+		assert.True(t, toolResults[0].IsError)
+		assert.Equal(t, "Error: tool 'fail' is not available for this request; available tools: echo", toolResults[0].Content)
+
+		// 之后的执行恢复全部工具
+		_, err = ag.Chat(context.Background(), "Write")
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"echo", "fail"}, advertised(provider.LastCall().Options))
+	})
+
+	t.Run("combined_with_agent_permissions", func(t *testing.T) {
+		provider := newProvider()
+		ag := newTestAgent(t, provider, WithTools(newEchoTool(), newFailingTool()), WithDeniedTools("echo"))
+
+		_, result, err := ag.RunCollect(context.Background(), "Go", WithOnlyTools("echo", "fail"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"fail"}, advertised(provider.Calls()[0].Options))
+		assert.Equal(t, "Error: boom", result.Messages[2].GetToolResults()[0].Content)
+	})
+
+	t.Run("empty_list_offers_no_tools", func(t *testing.T) {
+		provider := newProvider()
+		ag := newTestAgent(t, provider, WithTools(newEchoTool(), newFailingTool()))
+
+		_, result, err := ag.RunCollect(context.Background(), "Go", WithOnlyTools())
+		require.NoError(t, err)
+		assert.Empty(t, provider.Calls()[0].Options.Tools)
+		assert.Contains(t, result.Messages[2].GetToolResults()[0].Content, "no tools are available")
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 审计模式测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_AuditMode(t *testing.T) {
+	newProvider := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		ag := newTestAgent(t, newProvider(), WithTools(newEchoTool()))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Nil(t, result.Audit)
+	})
+
+	t.Run("captures_each_step", func(t *testing.T) {
+		ag := newTestAgent(t, newProvider(),
+			WithTools(newEchoTool()),
+			WithAuditMode(true),
+			WithAPIKey("sk-secret-key"),
+			WithModel("audit-model"),
+			WithPrompt("key is sk-secret-key"),
+		)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		require.Len(t, result.Audit, 2)
+
+		for i, entry := range result.Audit {
+			assert.Equal(t, i+1, entry.Step)
+			assert.Equal(t, "audit-model", entry.Model)
+			assert.NotEmpty(t, entry.Response)
+			assert.NotContains(t, string(entry.Request), "sk-secret-key")
+			assert.Contains(t, string(entry.Request), redactedValue)
+		}
+		assert.Contains(t, string(result.Audit[0].Request), `"echo"`)
+		assert.Contains(t, string(result.Audit[1].Response), "done")
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("streamed")), WithAuditMode(true))
+
+		var result *Result
+		for event := range ag.Run(context.Background(), "Hello", WithStreaming(true)) {
+			require.NoError(t, event.Error)
+			if event.Type == llm.EventTypeDone {
+				result = event.Result
+			}
+		}
+		require.NotNil(t, result)
+		require.Len(t, result.Audit, 1)
+		assert.Contains(t, string(result.Audit[0].Response), "streamed")
+	})
+}
+
+func TestAgent_LogPrompts(t *testing.T) {
+	newLogger := func(level slog.Level) (*slog.Logger, *bytes.Buffer) {
+		var buf bytes.Buffer
+		return slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})), &buf
+	}
+	promptLines := func(buf *bytes.Buffer) []map[string]any {
+		var lines []map[string]any
+		for line := range bytes.Lines(buf.Bytes()) {
+			var entry map[string]any
+			if json.Unmarshal(line, &entry) == nil && entry["msg"] == "llm call" {
+				lines = append(lines, entry)
+			}
+		}
+		return lines
+	}
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		logger, buf := newLogger(slog.LevelDebug)
+		ag := newTestAgent(t, mock.New(mock.WithResponse("done")), WithLogger(logger))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Empty(t, promptLines(buf))
+	})
+
+	t.Run("logs_redacted_request_and_response", func(t *testing.T) {
+		logger, buf := newLogger(slog.LevelDebug)
+		ag := newTestAgent(t, mock.New(mock.WithResponse("done")),
+			WithLogger(logger),
+			WithLogPrompts(true),
+			WithAPIKey("sk-secret-key"),
+			WithPrompt("key is sk-secret-key"),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		lines := promptLines(buf)
+		require.Len(t, lines, 1)
+		assert.Contains(t, lines[0]["request"], "Hello")
+		assert.Contains(t, lines[0]["request"], redactedValue)
+		assert.Contains(t, lines[0]["response"], "done")
+		assert.NotContains(t, buf.String(), "sk-secret-key")
+	})
+
+	t.Run("hash_content", func(t *testing.T) {
+		logger, buf := newLogger(slog.LevelDebug)
+		ag := newTestAgent(t, mock.New(mock.WithResponse("done")),
+			WithLogger(logger),
+			WithLogPrompts(true),
+			WithHashPromptContent(true),
+			WithPrompt("confidential instructions"),
+		)
+
+		_, _, err := ag.RunCollect(context.Background(), "my private question", WithStreaming(true))
+		require.NoError(t, err)
+		lines := promptLines(buf)
+		require.Len(t, lines, 1)
+		assert.Contains(t, lines[0]["request"], `"role":"user"`)
+		assert.Contains(t, lines[0]["request"], "sha256:")
+		for _, text := range []string{"my private question", "confidential instructions", `"done"`} {
+			assert.NotContains(t, buf.String(), text)
+		}
+	})
+
+	t.Run("skipped_above_debug", func(t *testing.T) {
+		logger, buf := newLogger(slog.LevelInfo)
+		ag := newTestAgent(t, mock.New(mock.WithResponse("done")), WithLogger(logger), WithLogPrompts(true))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Empty(t, promptLines(buf))
+	})
+}
+
+func TestRedactTree(t *testing.T) {
+	tree := map[string]any{
+		"max_tokens": 10,
+		"metadata": map[string]any{
+			"Authorization": "Bearer x",
+			"nested":        []any{map[string]any{"api_key": "k"}},
+		},
+	}
+
+	redactTree(tree)
+
+	assert.Equal(t, 10, tree["max_tokens"])
+	meta := tree["metadata"].(map[string]any)
+	assert.Equal(t, redactedValue, meta["Authorization"])
+	assert.Equal(t, redactedValue, meta["nested"].([]any)[0].(map[string]any)["api_key"])
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 结构化输出测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_ResponseSchema(t *testing.T) {
+	schema := `{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`
+	fastRetry := WithRetryConfig(&RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1})
+
+	replies := func(texts ...string) *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			return llm.Message{Role: llm.RoleAssistant, Content: texts[min(n, len(texts))-1]}
+		}))
+	}
+
+	t.Run("valid_output", func(t *testing.T) {
+		provider := replies("```json\n{\"name\": \"Ada\"}\n```")
+		ag := newTestAgent(t, provider, WithResponseSchema(schema))
+
+		result, err := ag.Chat(context.Background(), "Extract")
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"Ada"}`, string(result.Structured))
+
+		rf := provider.LastCall().Options.ResponseFormat
+		require.NotNil(t, rf)
+		assert.Equal(t, "json_schema", rf.Type)
+		assert.Equal(t, "object", rf.Schema["type"])
+	})
+
+	t.Run("retries_once_on_invalid_output", func(t *testing.T) {
+		provider := replies(`{"name": 42}`, `{"name": "Ada"}`)
+		ag := newTestAgent(t, provider, WithResponseSchema(schema), fastRetry)
+
+		result, err := ag.Chat(context.Background(), "Extract")
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"name":"Ada"}`, string(result.Structured))
+		assert.Equal(t, 2, provider.CallCount())
+		assert.Equal(t, 2, result.StepCount)
+	})
+
+	t.Run("fails_after_retry", func(t *testing.T) {
+		provider := replies("not json")
+		ag := newTestAgent(t, provider, WithResponseSchema(schema), fastRetry)
+
+		result, err := ag.Chat(context.Background(), "Extract")
+		require.ErrorIs(t, err, ErrInvalidStructuredOutput)
+		require.NotNil(t, result)
+		assert.Nil(t, result.Structured)
+		assert.Equal(t, 2, provider.CallCount())
+	})
+
+	t.Run("invalid_schema", func(t *testing.T) {
+		_, err := New().Provider(mock.New()).ResponseSchema("{").Build()
+		assert.Error(t, err)
+	})
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"tags"},
+		"properties": map[string]any{
+			"tags":  map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"count": map[string]any{"type": "integer"},
+			"level": map[string]any{"enum": []any{"low", "high"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{name: "valid", input: `{"tags":["a"],"count":2,"level":"low"}`},
+		{name: "missing_required", input: `{"count":2}`, wantErr: true},
+		{name: "wrong_item_type", input: `{"tags":[1]}`, wantErr: true},
+		{name: "non_integer", input: `{"tags":[],"count":1.5}`, wantErr: true},
+		{name: "not_in_enum", input: `{"tags":[],"level":"mid"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseStructured(tt.input, schema)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 生命周期钩子测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Hooks(t *testing.T) {
+	t.Run("invoked_at_each_point", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+
+		var steps []int
+		var calls, results []string
+		ag := newTestAgent(t, provider,
+			WithTools(newEchoTool()),
+			WithHooks(Hooks{
+				OnStep:       func(step int) { steps = append(steps, step) },
+				OnToolCall:   func(tc *llm.ToolCall) { calls = append(calls, tc.Name) },
+				OnToolResult: func(tr *llm.ToolResult) { results = append(results, tr.Content) },
+			}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		assert.Equal(t, []int{1, 2}, steps)
+		assert.Equal(t, []string{"echo"}, calls)
+		assert.Equal(t, []string{`"hi"`}, results)
+	})
+
+	t.Run("on_error", func(t *testing.T) {
+		var hookErr error
+		ag := newTestAgent(t, mock.New(mock.WithError(errors.New("provider down"))),
+			WithHooks(Hooks{OnError: func(err error) { hookErr = err }}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.Error(t, err)
+		assert.Equal(t, err, hookErr)
+	})
+
+	t.Run("panicking_hook_is_recovered", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithHooks(Hooks{OnStep: func(int) { panic("hook bug") }}),
+		)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", result.Text)
+	})
+}
+
+func TestAgent_OnStateChange(t *testing.T) {
+	var mu sync.Mutex
+	var transitions []string
+	var ag *Agent
+	ag = newTestAgent(t, mock.New(mock.WithResponse("ok")),
+		WithOnStateChange(func(from, to State) {
+			// 回调在锁外调用，查询状态不会死锁
+			assert.Equal(t, to, ag.Status().State)
+			mu.Lock()
+			defer mu.Unlock()
+			transitions = append(transitions, string(from)+"->"+string(to))
+		}),
+	)
+	recorded := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(transitions)
+	}
+
+	_, err := ag.Chat(context.Background(), "Hello")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return len(recorded()) == 2 }, time.Second, time.Millisecond)
+
+	require.NoError(t, ag.Close())
+	require.NoError(t, ag.Close())
+	assert.Equal(t, []string{
+		"ready->running",
+		"running->ready",
+		"ready->stopping",
+		"stopping->stopped",
+	}, recorded())
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 指标收集测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// recordingMetrics 记录所有指标调用
+type recordingMetrics struct {
+	mu        sync.Mutex
+	toolCalls []string
+	latencies int
+	retries   int
+	tokens    []int
+}
+
+func (m *recordingMetrics) IncToolCalls(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.toolCalls = append(m.toolCalls, name)
+}
+
+func (m *recordingMetrics) ObserveLLMLatency(time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latencies++
+}
+
+func (m *recordingMetrics) IncRetries(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries += n
+}
+
+func (m *recordingMetrics) ObserveTokens(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens = append(m.tokens, n)
+}
+
+func TestAgent_Metrics(t *testing.T) {
+	t.Run("tool_calls_latency_and_tokens", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		m := &recordingMetrics{}
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithMetrics(m))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"echo"}, m.toolCalls)
+		assert.Equal(t, 2, m.latencies)
+		assert.Equal(t, []int{30, 50}, m.tokens)
+		assert.Zero(t, m.retries)
+	})
+
+	t.Run("tokens_without_total", func(t *testing.T) {
+		// 只返回输入、输出用量的 Provider：与 Result.TotalTokens 一样按两者之和记录
+		m := &recordingMetrics{}
+		ag := newTestAgent(t, mock.New(), WithMetrics(m),
+			WithMiddleware(func(ProviderCallFunc) ProviderCallFunc {
+				return func(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+					return &llm.Response{
+						Message: llm.Message{Role: llm.RoleAssistant, Content: "ok"},
+						Usage:   &llm.TokenUsage{InputTokens: 7, OutputTokens: 5},
+					}, nil
+				}
+			}))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, 12, result.TotalTokens)
+		assert.Equal(t, []int{12}, m.tokens)
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		m := &recordingMetrics{}
+		ag, err := NewAgent(
+			WithProvider(&flakyProvider{failures: 2, err: errors.New("API error: 503 - overloaded")}),
+			WithRetryConfig(&RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}),
+			WithMetrics(m),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ag.Close() })
+
+		_, err = ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, 2, m.retries)
+		assert.Equal(t, 1, m.latencies)
+	})
+
+	t.Run("nop_by_default", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+		assert.Equal(t, NopMetrics{}, ag.metricsOrNop())
+	})
+
+	t.Run("builder", func(t *testing.T) {
+		m := &recordingMetrics{}
+		assert.Same(t, m, New().Metrics(m).inner.metrics)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 工具参数修复测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// toolStreamProvider 首次流式调用返回一个工具调用，之后返回文本
+//
+// 设置 chunks 时参数按块分多次发送，仅首块携带 ID 和 Name。
+type toolStreamProvider struct {
+	mu     sync.Mutex
+	calls  int
+	name   string
+	args   string
+	chunks []string
+}
+
+func (p *toolStreamProvider) Complete(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+	return nil, errors.New("not supported")
+}
+
+func (p *toolStreamProvider) Stream(context.Context, []llm.Message, *llm.Options) (<-chan *llm.Event, error) {
+	p.mu.Lock()
+	p.calls++
+	first := p.calls == 1
+	p.mu.Unlock()
+
+	ch := make(chan *llm.Event, 2+len(p.chunks))
+	switch {
+	case first && len(p.chunks) > 0:
+		for i, chunk := range p.chunks {
+			delta := &llm.ToolCallDelta{Index: 0, ArgumentsDelta: chunk}
+			if i == 0 {
+				delta.ID, delta.Name = "call-1", p.name
+			}
+			ch <- &llm.Event{Type: llm.EventTypeToolCall, ToolCall: delta}
+		}
+	case first:
+		ch <- &llm.Event{Type: llm.EventTypeToolCall, ToolCall: &llm.ToolCallDelta{
+			Index: 0, ID: "call-1", Name: p.name, ArgumentsDelta: p.args,
+		}}
+	default:
+		ch <- &llm.Event{Type: llm.EventTypeText, TextDelta: "done"}
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (p *toolStreamProvider) Close() error { return nil }
+
+func TestAgent_RepairToolArgs(t *testing.T) {
+	run := func(t *testing.T, repair bool) []*llm.ToolResult {
+		t.Helper()
+
+		ag, err := NewAgent(
+			WithProvider(&toolStreamProvider{name: "echo", args: `{"text": "hi",}`}),
+			WithTools(newEchoTool()),
+			WithRepairToolArgs(repair),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ag.Close() })
+
+		var results []*llm.ToolResult
+		for event := range ag.Run(context.Background(), "Hello", WithStreaming(true)) {
+			require.NoError(t, event.Error)
+			if event.Type == llm.EventTypeToolResult {
+				results = append(results, event.ToolResult)
+			}
+		}
+		return results
+	}
+
+	t.Run("repairs_trailing_comma", func(t *testing.T) {
+		results := run(t, true)
+		require.Len(t, results, 1)
+		assert.False(t, results[0].IsError)
+		assert.Equal(t, `"hi"`, results[0].Content)
+	})
+
+	t.Run("disabled_falls_back_to_empty_input", func(t *testing.T) {
+		results := run(t, false)
+		require.Len(t, results, 1)
+		assert.Equal(t, `""`, results[0].Content)
+	})
+}
+
+func TestAgent_StreamingToolArgs(t *testing.T) {
+	run := func(t *testing.T, opts ...RunOption) ([]*llm.ToolCallDelta, []*llm.ToolCall) {
+		t.Helper()
+
+		ag, err := NewAgent(
+			WithProvider(&toolStreamProvider{name: "echo", chunks: []string{`{"text"`, `: "hi"}`}}),
+			WithTools(newEchoTool()),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ag.Close() })
+
+		var deltas []*llm.ToolCallDelta
+		var calls []*llm.ToolCall
+		for event := range ag.Run(context.Background(), "Hello", append(opts, WithStreaming(true))...) {
+			require.NoError(t, event.Error)
+			switch event.Type {
+			case EventTypeToolCallDelta:
+				deltas = append(deltas, event.ToolCallDelta)
+			case llm.EventTypeToolCall:
+				calls = append(calls, event.ToolCall)
+			}
+		}
+		return deltas, calls
+	}
+
+	t.Run("emits_deltas_and_final_call", func(t *testing.T) {
+		deltas, calls := run(t, WithStreamingToolArgs(true))
+
+		require.Len(t, deltas, 2)
+		for _, d := range deltas {
+			assert.Equal(t, "call-1", d.ID)
+			assert.Equal(t, "echo", d.Name)
+		}
+		assert.Equal(t, `{"text": "hi"}`, deltas[0].ArgumentsDelta+deltas[1].ArgumentsDelta)
+
+		require.Len(t, calls, 1)
+		assert.Equal(t, map[string]any{"text": "hi"}, calls[0].Input)
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		deltas, calls := run(t)
+		assert.Empty(t, deltas)
+		assert.Len(t, calls, 1)
+	})
+}
+
+func TestAgent_Heartbeat(t *testing.T) {
+	slowTool := tool.Func("slow", "Sleeps for a while",
+		func(context.Context, echoInput) (string, error) {
+			time.Sleep(80 * time.Millisecond)
+			return "ok", nil
+		})
+	newAgent := func(t *testing.T) *Agent {
+		t.Helper()
+		return newTestAgent(t, mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "slow", map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		})), WithTools(slowTool))
+	}
+
+	t.Run("emits_during_tool_execution", func(t *testing.T) {
+		ag := newAgent(t)
+
+		var types []llm.EventType
+		for event := range ag.Run(context.Background(), "Hello", WithHeartbeat(10*time.Millisecond)) {
+			require.NoError(t, event.Error)
+			types = append(types, event.Type)
+		}
+
+		callIdx := slices.Index(types, llm.EventTypeToolCall)
+		textIdx := slices.Index(types, llm.EventTypeText)
+		require.GreaterOrEqual(t, callIdx, 0)
+		require.Greater(t, textIdx, callIdx)
+
+		heartbeats := 0
+		for i, typ := range types {
+			if typ == EventTypeHeartbeat {
+				heartbeats++
+				assert.Greater(t, i, callIdx)
+				assert.Less(t, i, textIdx, "heartbeat must stop once tools finish")
+			}
+		}
+		assert.GreaterOrEqual(t, heartbeats, 2)
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		ag := newAgent(t)
+		for event := range ag.Run(context.Background(), "Hello") {
+			assert.NotEqual(t, EventTypeHeartbeat, event.Type)
+		}
+	})
+
+	t.Run("stops_when_receiver_abandons", func(t *testing.T) {
+		eventCh := make(chan *AgentEvent)
+		stop := startHeartbeat(context.Background(), time.Millisecond, eventCh)
+		time.Sleep(5 * time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("stop blocked on an unread event channel")
+		}
+	})
+}
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{name: "trailing_comma_object", input: `{"a": 1,}`, want: `{"a": 1}`},
+		{name: "trailing_comma_array", input: `{"a": [1, 2, ]}`, want: `{"a": [1, 2]}`},
+		{name: "single_quotes", input: `{'a': 'it\'s "x"'}`, want: `{"a": "it's \"x\""}`},
+		{name: "unclosed_brackets", input: `{"a": [1, 2`, want: `{"a": [1, 2]}`},
+		{name: "code_fence", input: "```json\n{\"a\": 1}\n```", want: `{"a": 1}`},
+		{name: "comma_inside_string_kept", input: `{"a": "x,}"}`, want: `{"a": "x,}"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := repairJSON(tt.input)
+			assert.Equal(t, tt.want, got)
+			assert.True(t, json.Valid([]byte(got)))
+		})
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 最终答案校验测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_AnswerValidator(t *testing.T) {
+	requireAnswer := func(_ context.Context, text string) error {
+		if !strings.Contains(text, "42") {
+			return errors.New("answer must contain 42")
+		}
+		return nil
+	}
+
+	t.Run("retry_produces_valid_answer", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return llm.Message{Role: llm.RoleAssistant, Content: "I don't know"}
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "It is 42"}
+		}))
+		ag := newTestAgent(t, provider, WithAnswerValidator(requireAnswer), WithAnswerRetries(1))
+
+		result, err := ag.Chat(context.Background(), "Answer?")
+		require.NoError(t, err)
+		assert.Equal(t, "It is 42", result.Text)
+		assert.Equal(t, 2, result.StepCount)
+		assert.Equal(t, 1, result.Metadata["answer_retries"])
+
+		// 失败原因作为反馈发给模型
+		msgs := provider.LastCall().Messages
+		assert.Contains(t, msgs[len(msgs)-1].GetContent(), "answer must contain 42")
+	})
+
+	t.Run("rejected_after_retries", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("no idea"))
+		ag := newTestAgent(t, provider, WithAnswerValidator(requireAnswer), WithAnswerRetries(2))
+
+		result, err := ag.Chat(context.Background(), "Answer?")
+		require.ErrorIs(t, err, ErrAnswerRejected)
+		assert.Contains(t, err.Error(), "answer must contain 42")
+		require.NotNil(t, result)
+		assert.Equal(t, "no idea", result.Text)
+		assert.Equal(t, 3, provider.CallCount())
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider 中间件测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Middleware(t *testing.T) {
+	t.Run("order_and_request_mutation", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+
+		var order []string
+		trace := func(name string) ProviderMiddleware {
+			return func(next ProviderCallFunc) ProviderCallFunc {
+				return func(ctx context.Context, msgs []llm.Message, opts *llm.Options) (*llm.Response, error) {
+					order = append(order, name)
+					return next(ctx, msgs, opts)
+				}
+			}
+		}
+		mutate := func(next ProviderCallFunc) ProviderCallFunc {
+			return func(ctx context.Context, msgs []llm.Message, opts *llm.Options) (*llm.Response, error) {
+				opts.StopSequences = []string{"END"}
+				return next(ctx, msgs, opts)
+			}
+		}
+
+		ag := newTestAgent(t, provider, WithMiddleware(trace("outer"), trace("inner"), mutate))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"outer", "inner"}, order)
+		assert.Equal(t, []string{"END"}, provider.LastCall().Options.StopSequences)
+	})
+
+	shortCircuit := func(next ProviderCallFunc) ProviderCallFunc {
+		return func(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+			return &llm.Response{Message: llm.Message{Role: llm.RoleAssistant, Content: "cached"}}, nil
+		}
+	}
+
+	t.Run("short_circuit_blocking", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithMiddleware(shortCircuit))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "cached", result.Text)
+		assert.Equal(t, 0, provider.CallCount())
+	})
+
+	t.Run("short_circuit_streaming", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+
+		var streaming bool
+		detect := func(next ProviderCallFunc) ProviderCallFunc {
+			return func(ctx context.Context, msgs []llm.Message, opts *llm.Options) (*llm.Response, error) {
+				streaming = IsStreamingCall(ctx)
+				return next(ctx, msgs, opts)
+			}
+		}
+		ag := newTestAgent(t, provider, WithMiddleware(detect, shortCircuit))
+
+		deltas := collectStreamText(t, ag, "Hello", WithStreaming(true))
+		assert.Equal(t, []string{"cached"}, deltas)
+		assert.True(t, streaming)
+		assert.Equal(t, 0, provider.CallCount())
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 工具结果消息构建测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_ToolResultMessageBuilder(t *testing.T) {
+	twoCalls := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return llm.Message{
+					Role: llm.RoleAssistant,
+					ContentBlocks: []llm.ContentBlock{
+						&llm.ToolCall{ID: "call-1", Name: "echo", Input: map[string]any{"text": "a"}},
+						&llm.ToolCall{ID: "call-2", Name: "echo", Input: map[string]any{"text": "b"}},
+					},
+				}
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+
+	t.Run("one_message_per_result", func(t *testing.T) {
+		perResult := func(results []llm.ContentBlock) []llm.Message {
+			msgs := make([]llm.Message, 0, len(results))
+			for _, r := range results {
+				msgs = append(msgs, llm.Message{Role: llm.RoleTool, ContentBlocks: []llm.ContentBlock{r}})
+			}
+			return msgs
+		}
+		ag := newTestAgent(t, twoCalls(), WithTools(newEchoTool()), WithToolResultMessageBuilder(perResult))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		// user, assistant(tool calls), tool, tool, assistant
+		require.Len(t, result.Messages, 5)
+		for i, id := range []string{"call-1", "call-2"} {
+			msg := result.Messages[2+i]
+			assert.Equal(t, llm.RoleTool, msg.Role)
+			require.Len(t, msg.GetToolResults(), 1)
+			assert.Equal(t, id, msg.GetToolResults()[0].ToolUseID)
+		}
+	})
+
+	t.Run("default_single_message", func(t *testing.T) {
+		ag := newTestAgent(t, twoCalls(), WithTools(newEchoTool()))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		require.Len(t, result.Messages, 4)
+		assert.Equal(t, llm.RoleUser, result.Messages[2].Role)
+		assert.Len(t, result.Messages[2].GetToolResults(), 2)
+	})
+
+	t.Run("lost_ids_fall_back_to_default", func(t *testing.T) {
+		dropAll := func([]llm.ContentBlock) []llm.Message { return nil }
+		ag := newTestAgent(t, twoCalls(), WithTools(newEchoTool()), WithToolResultMessageBuilder(dropAll))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		require.Len(t, result.Messages, 4)
+		assert.Len(t, result.Messages[2].GetToolResults(), 2)
+	})
+
+	t.Run("tool_result_role", func(t *testing.T) {
+		ag := newTestAgent(t, twoCalls(), WithTools(newEchoTool()), WithToolResultRole(llm.RoleTool))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		require.Len(t, result.Messages, 4)
+		assert.Equal(t, llm.RoleTool, result.Messages[2].Role)
+		assert.Len(t, result.Messages[2].GetToolResults(), 2)
+
+		// 以 tool 角色发送的结果不视为用户输入
+		require.NoError(t, ag.Undo())
+		assert.Empty(t, ag.Messages())
+	})
+
+	t.Run("invalid_tool_result_role", func(t *testing.T) {
+		_, err := New().Provider(twoCalls()).ToolResultRole(llm.RoleAssistant).Build()
+		require.ErrorContains(t, err, "tool-result-role")
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 上下文使用率测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_ContextUtilization(t *testing.T) {
+	t.Run("increases_across_turns", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("a fairly long reply to grow the history")),
+			WithContextWindow(1000),
+		)
+		assert.Zero(t, ag.Status().ContextUtilization)
+
+		var last float64
+		for range 3 {
+			_, err := ag.Chat(context.Background(), "Tell me more about this topic")
+			require.NoError(t, err)
+
+			status := ag.Status()
+			assert.Greater(t, status.ContextTokens, 0)
+			assert.Greater(t, status.ContextUtilization, last)
+			assert.Less(t, status.ContextUtilization, 1.0)
+			last = status.ContextUtilization
+		}
+
+		require.NoError(t, ag.Reset())
+		assert.Zero(t, ag.Status().ContextUtilization)
+	})
+
+	t.Run("tokens_without_context_window", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Greater(t, ag.Status().ContextTokens, 0)
+		assert.Zero(t, ag.Status().ContextUtilization)
+	})
+}
+
+func TestAgent_ContextWarning(t *testing.T) {
+	fixedCounter := func(tokens int) TokenCounter {
+		return TokenCounterFunc(func([]llm.Message, *llm.Options) int { return tokens })
+	}
+	warnings := func(t *testing.T, ag *Agent) []*ContextWarning {
+		t.Helper()
+		var got []*ContextWarning
+		for event := range ag.Run(context.Background(), "Hello") {
+			require.NoError(t, event.Error)
+			if event.Type == EventTypeContextWarning {
+				got = append(got, event.ContextWarning)
+			}
+		}
+		return got
+	}
+
+	t.Run("emits_above_default_threshold", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithContextWindow(1000),
+			WithTokenCounter(fixedCounter(950)),
+		)
+
+		got := warnings(t, ag)
+		require.Len(t, got, 1)
+		assert.Equal(t, 950, got[0].Tokens)
+		assert.Equal(t, 1000, got[0].ContextWindow)
+		assert.InDelta(t, 0.95, got[0].Utilization, 1e-9)
+		assert.Equal(t, 950, ag.Status().ContextTokens, "token counter is used for status")
+	})
+
+	t.Run("below_threshold", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithContextWindow(1000),
+			WithTokenCounter(fixedCounter(850)),
+		)
+		assert.Empty(t, warnings(t, ag))
+	})
+
+	t.Run("custom_threshold", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithContextWindow(1000),
+			WithContextWarningThreshold(0.5),
+			WithTokenCounter(fixedCounter(600)),
+		)
+		assert.Len(t, warnings(t, ag), 1)
+	})
+
+	t.Run("requires_context_window", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithTokenCounter(fixedCounter(1_000_000)))
+		assert.Empty(t, warnings(t, ag))
+	})
+
+	t.Run("builder", func(t *testing.T) {
+		counter := fixedCounter(1)
+		b := New().ContextWindow(1000).ContextWarningThreshold(0.8).TokenCounter(counter)
+		assert.InDelta(t, 0.8, b.inner.config.ContextWarningThreshold, 1e-9)
+		assert.NotNil(t, b.inner.tokenCounter)
+
+		require.ErrorContains(t, New().ContextWarningThreshold(1.5).Validate(), "contextWarningThreshold")
+	})
+}
+
+func TestEstimateTokens(t *testing.T) {
+	msgs := []llm.Message{
+		{Role: llm.RoleUser, Content: "12345678"},
+		{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{&llm.TextBlock{Text: "1234"}}},
+	}
+
+	// 2 条消息开销 + 8/4 + 4/4 + 系统提示词 4/4
+	assert.Equal(t, 2*tokensPerMessage+2+1+1, estimateTokens(msgs, &llm.Options{System: "abcd"}))
+	assert.Equal(t, 0, estimateTokens(nil, nil))
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 并发工具执行测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_ParallelTools(t *testing.T) {
+	const calls = 4
+
+	multiCall := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n > 1 {
+				return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+			}
+			blocks := make([]llm.ContentBlock, 0, calls)
+			for i := range calls {
+				blocks = append(blocks, &llm.ToolCall{
+					ID:    fmt.Sprintf("call-%d", i),
+					Name:  "slow",
+					Input: map[string]any{"text": fmt.Sprintf("r%d", i)},
+				})
+			}
+			return llm.Message{Role: llm.RoleAssistant, ContentBlocks: blocks}
+		}))
+	}
+
+	// slow 工具：记录最大并发数，越早的调用耗时越长以打乱完成顺序
+	newSlowTool := func(active, peak *atomic.Int32) tool.Tool {
+		return tool.Func("slow", "Slow echo",
+			func(_ context.Context, in echoInput) (string, error) {
+				n := active.Add(1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				var idx int
+				_, _ = fmt.Sscanf(in.Text, "r%d", &idx)
+				time.Sleep(time.Duration(calls-idx) * 10 * time.Millisecond)
+				active.Add(-1)
+				return in.Text, nil
+			})
+	}
+
+	run := func(t *testing.T, opts ...Option) (*Result, map[string]string, int32) {
+		t.Helper()
+
+		var active, peak atomic.Int32
+		ag := newTestAgent(t, multiCall(), append(opts, WithTools(newSlowTool(&active, &peak)))...)
+
+		events := make(map[string]string)
+		var result *Result
+		for event := range ag.Run(context.Background(), "Hello") {
+			require.NoError(t, event.Error)
+			switch event.Type {
+			case llm.EventTypeToolResult:
+				events[event.ToolResult.ToolID] = event.ToolResult.Content
+			case llm.EventTypeDone:
+				result = event.Result
+			}
+		}
+		require.NotNil(t, result)
+		return result, events, peak.Load()
+	}
+
+	t.Run("concurrent_with_ordered_results", func(t *testing.T) {
+		result, events, peak := run(t, WithParallelTools(true), WithMaxParallelTools(2))
+
+		assert.Equal(t, int32(2), peak, "concurrency should be bounded")
+
+		// 返回给模型的结果顺序与调用一致
+		toolResults := result.Messages[2].GetToolResults()
+		require.Len(t, toolResults, calls)
+		for i, tr := range toolResults {
+			assert.Equal(t, fmt.Sprintf("call-%d", i), tr.ToolUseID)
+			assert.Equal(t, fmt.Sprintf(`"r%d"`, i), tr.Content)
+		}
+
+		// 每个事件携带正确的 ToolID
+		require.Len(t, events, calls)
+		for i := range calls {
+			assert.Equal(t, fmt.Sprintf(`"r%d"`, i), events[fmt.Sprintf("call-%d", i)])
+		}
+	})
+
+	t.Run("sequential_by_default", func(t *testing.T) {
+		_, _, peak := run(t)
+		assert.Equal(t, int32(1), peak)
+	})
+
+	t.Run("shared_semaphore_across_agents", func(t *testing.T) {
+		var active, peak atomic.Int32
+		sem := make(chanSemaphore, 2)
+
+		var wg sync.WaitGroup
+		for range 3 {
+			ag := newTestAgent(t, multiCall(),
+				WithTools(newSlowTool(&active, &peak)),
+				WithParallelTools(true),
+				WithToolSemaphore(sem),
+			)
+			wg.Go(func() {
+				_, err := ag.Chat(context.Background(), "Hello")
+				assert.NoError(t, err)
+			})
+		}
+		wg.Wait()
+
+		assert.Equal(t, int32(2), peak.Load(), "total concurrency bounded by the shared semaphore")
+		assert.Empty(t, sem, "every slot released")
+	})
+
+	t.Run("semaphore_acquire_failure", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		sem := make(chanSemaphore, 1)
+		sem <- struct{}{} // 名额被占满
+		ag := newTestAgent(t, multiCall(),
+			WithTools(newEchoTool()),
+			WithToolSemaphore(sem),
+			WithHooks(Hooks{OnStep: func(step int) {
+				if step == 1 {
+					time.AfterFunc(10*time.Millisecond, cancel)
+				}
+			}}),
+		)
+
+		_, result, err := ag.RunCollect(ctx, "Hello")
+		require.ErrorIs(t, err, context.Canceled)
+		require.NotNil(t, result)
+		toolResults := result.Messages[2].GetToolResults()
+		require.Len(t, toolResults, calls)
+		assert.Contains(t, toolResults[0].Content, "was not executed")
+	})
+
+	t.Run("panic_recovered_per_goroutine", func(t *testing.T) {
+		panicky := tool.Func("slow", "Panics",
+			func(context.Context, echoInput) (string, error) { panic("boom") })
+		ag := newTestAgent(t, multiCall(), WithTools(panicky), WithParallelTools(true))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		toolResults := result.Messages[2].GetToolResults()
+		require.Len(t, toolResults, calls)
+		for _, tr := range toolResults {
+			assert.True(t, tr.IsError)
+			assert.Contains(t, tr.Content, "panic")
+		}
+	})
+}
+
+// chanSemaphore 基于通道的 ToolSemaphore（只支持 n = 1）
+type chanSemaphore chan struct{}
+
+func (s chanSemaphore) Acquire(ctx context.Context, _ int64) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s chanSemaphore) Release(int64) { <-s }
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider 调用重试测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// flakyProvider 前 failures 次调用失败，之后返回 "ok"
+//
+// partial 为 true 时流式调用先输出部分文本再通过错误事件失败。
+type flakyProvider struct {
+	mu       sync.Mutex
+	calls    int
+	failures int
+	partial  bool
+	err      error
+}
+
+func (p *flakyProvider) next() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	return p.calls <= p.failures
+}
+
+func (p *flakyProvider) Complete(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+	if p.next() {
+		return nil, p.err
+	}
+	return &llm.Response{Message: llm.Message{Role: llm.RoleAssistant, Content: "ok"}}, nil
+}
+
+func (p *flakyProvider) Stream(context.Context, []llm.Message, *llm.Options) (<-chan *llm.Event, error) {
+	fail := p.next()
+	if fail && !p.partial {
+		return nil, p.err
+	}
+
+	ch := make(chan *llm.Event, 2)
+	if fail {
+		ch <- &llm.Event{Type: llm.EventTypeText, TextDelta: "partial"}
+		ch <- &llm.Event{Type: llm.EventTypeError, Error: p.err}
+	} else {
+		ch <- &llm.Event{Type: llm.EventTypeText, TextDelta: "ok"}
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (p *flakyProvider) Close() error { return nil }
+
+func TestAgent_ProviderRetry(t *testing.T) {
+	transient := errors.New("API error: 503 - overloaded")
+	fastRetry := WithRetryConfig(&RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1})
+
+	newAgent := func(t *testing.T, p *flakyProvider, opts ...Option) *Agent {
+		t.Helper()
+		ag, err := NewAgent(append([]Option{WithProvider(p)}, opts...)...)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ag.Close() })
+		return ag
+	}
+
+	t.Run("blocking_recovers", func(t *testing.T) {
+		p := &flakyProvider{failures: 2, err: transient}
+		result, err := newAgent(t, p, fastRetry).Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", result.Text)
+		assert.Equal(t, 3, p.calls)
+	})
+
+	t.Run("blocking_gives_up", func(t *testing.T) {
+		p := &flakyProvider{failures: 5, err: transient}
+		_, err := newAgent(t, p, fastRetry).Chat(context.Background(), "Hello")
+		require.ErrorIs(t, err, transient)
+		assert.Equal(t, 3, p.calls)
+	})
+
+	t.Run("permanent_error_not_retried", func(t *testing.T) {
+		p := &flakyProvider{failures: 1, err: errors.New("API error: 401 - invalid key")}
+		_, err := newAgent(t, p, fastRetry).Chat(context.Background(), "Hello")
+		require.Error(t, err)
+		assert.Equal(t, 1, p.calls)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		p := &flakyProvider{failures: 1, err: transient}
+		_, err := newAgent(t, p, DisableRetry()).Chat(context.Background(), "Hello")
+		require.ErrorIs(t, err, transient)
+		assert.Equal(t, 1, p.calls)
+	})
+
+	t.Run("streaming_recovers_before_first_chunk", func(t *testing.T) {
+		p := &flakyProvider{failures: 1, err: transient}
+		ag := newAgent(t, p, fastRetry)
+
+		var text strings.Builder
+		for event := range ag.Run(context.Background(), "Hello", WithStreaming(true)) {
+			require.NoError(t, event.Error)
+			if event.Type == llm.EventTypeText {
+				text.WriteString(event.Text)
+			}
+		}
+		assert.Equal(t, "ok", text.String())
+		assert.Equal(t, 2, p.calls)
+	})
+
+	t.Run("streaming_not_retried_after_chunks", func(t *testing.T) {
+		p := &flakyProvider{failures: 1, partial: true, err: transient}
+		ag := newAgent(t, p, fastRetry)
+
+		var text strings.Builder
+		var runErr error
+		for event := range ag.Run(context.Background(), "Hello", WithStreaming(true)) {
+			switch event.Type {
+			case llm.EventTypeText:
+				text.WriteString(event.Text)
+			case llm.EventTypeError:
+				runErr = event.Error
+			}
+		}
+		require.ErrorIs(t, runErr, transient)
+		assert.Equal(t, "partial", text.String(), "no duplicate text")
+		assert.Equal(t, 1, p.calls)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Stop 测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// closeTrackingProvider 记录 Close 调用次数的 Provider
+type closeTrackingProvider struct {
+	*mock.Client
+	closed atomic.Int32
+}
+
+func (p *closeTrackingProvider) Close() error {
+	p.closed.Add(1)
+	return nil
+}
+
+func TestAgent_SetProvider(t *testing.T) {
+	t.Run("swaps_and_keeps_history", func(t *testing.T) {
+		primary := &closeTrackingProvider{Client: mock.New(mock.WithResponse("primary"))}
+		ag := newTestAgent(t, primary.Client)
+		ag.provider = primary
+
+		_, err := ag.Chat(context.Background(), "first")
+		require.NoError(t, err)
+
+		secondary := mock.New(mock.WithResponse("secondary"))
+		require.NoError(t, ag.SetProvider(secondary))
+		assert.Equal(t, int32(1), primary.closed.Load())
+
+		result, err := ag.Chat(context.Background(), "second")
+		require.NoError(t, err)
+		assert.Equal(t, "secondary", result.Text)
+		assert.Len(t, secondary.LastCall().Messages, 3, "history is preserved")
+	})
+
+	t.Run("busy", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(100*time.Millisecond))
+		ag := newTestAgent(t, provider)
+
+		events := ag.Run(context.Background(), "Hello")
+		require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+		require.ErrorIs(t, ag.SetProvider(mock.New()), ErrAgentBusy)
+		for range events {
+		}
+
+		require.NoError(t, ag.SetProvider(mock.New()))
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New())
+		require.NoError(t, ag.Close())
+		require.ErrorIs(t, ag.SetProvider(mock.New()), ErrAgentStopped)
+	})
+
+	t.Run("nil_provider", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New())
+		require.Error(t, ag.SetProvider(nil))
+	})
+}
+
+// httpClientProvider 支持自定义 HTTP 客户端的测试 Provider
+type httpClientProvider struct {
+	*mock.Client
+	client *http.Client
+}
+
+func (p *httpClientProvider) SetHTTPClient(client *http.Client) { p.client = client }
+
+func TestAgent_HTTPClient(t *testing.T) {
+	client := &http.Client{Timeout: time.Minute}
+
+	t.Run("injected_into_auto_created_provider", func(t *testing.T) {
+		created := &httpClientProvider{Client: mock.New(mock.WithResponse("ok"))}
+		ag, err := NewAgent(WithAPIKey("sk-test"), WithHTTPClient(client), func(b *builder) {
+			b.newProvider = func(*llm.Config) (llm.Provider, error) { return created, nil }
+		})
+		require.NoError(t, err)
+		defer func() { _ = ag.Close() }()
+		assert.Same(t, client, created.client)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "ok", result.Text)
+	})
+
+	t.Run("unsupported_provider_fails_build", func(t *testing.T) {
+		plain := &closeTrackingProvider{Client: mock.New()}
+		_, err := NewAgent(WithAPIKey("sk-test"), WithHTTPClient(client), func(b *builder) {
+			b.newProvider = func(*llm.Config) (llm.Provider, error) { return plain, nil }
+		})
+		require.ErrorContains(t, err, "does not support a custom HTTP client")
+		assert.Equal(t, int32(1), plain.closed.Load(), "rejected provider is closed")
+	})
+
+	t.Run("explicit_provider_unaffected", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithHTTPClient(client))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+	})
+}
+
+// capabilityProvider 声明模型能力的 Provider
+type capabilityProvider struct {
+	*mock.Client
+	functionCalling bool
+	seed            bool
+}
+
+func (p *capabilityProvider) Capabilities() ProviderCapabilities {
+	return ProviderCapabilities{FunctionCalling: p.functionCalling, Seed: p.seed}
+}
+
+func TestAgent_ProviderCapabilities(t *testing.T) {
+	t.Run("no_function_calling_skips_schemas", func(t *testing.T) {
+		p := &capabilityProvider{Client: mock.New()}
+		ag := newTestAgent(t, p.Client, WithProvider(p), WithTools(newEchoTool()))
+
+		preview, err := ag.Preview("Hello")
+		require.NoError(t, err)
+		assert.Empty(t, preview.Options.Tools)
+		assert.Contains(t, preview.Options.System, DefaultToolManualHeader)
+	})
+
+	t.Run("function_calling_sends_schemas", func(t *testing.T) {
+		p := &capabilityProvider{Client: mock.New(), functionCalling: true}
+		ag := newTestAgent(t, p.Client, WithProvider(p), WithTools(newEchoTool()))
+
+		preview, err := ag.Preview("Hello")
+		require.NoError(t, err)
+		assert.Len(t, preview.Options.Tools, 1)
+	})
+
+	t.Run("force_tool_schemas", func(t *testing.T) {
+		p := &capabilityProvider{Client: mock.New()}
+		ag := newTestAgent(t, p.Client, WithProvider(p), WithTools(newEchoTool()), WithForceToolSchemas(true))
+
+		preview, err := ag.Preview("Hello")
+		require.NoError(t, err)
+		assert.Len(t, preview.Options.Tools, 1)
+	})
+}
+
+func TestAgent_Stop(t *testing.T) {
+	t.Run("idle_noop", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hi")))
+		ag.Stop()
+		assert.Equal(t, StateReady, ag.Status().State)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "hi", result.Text)
+	})
+
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("aborts_run_streaming_%v", streaming), func(t *testing.T) {
+			provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(300*time.Millisecond))
+			ag := newTestAgent(t, provider)
+
+			events := ag.Run(context.Background(), "Hello", WithStreaming(streaming))
+			require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+
+			start := time.Now()
+			ag.Stop()
+
+			var runErr error
+			for event := range events {
+				assert.NotEqual(t, llm.EventTypeDone, event.Type)
+				if event.Type == llm.EventTypeError {
+					runErr = event.Error
+				}
+			}
+			require.ErrorIs(t, runErr, context.Canceled)
+			assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+			// Agent 仍然可用
+			assert.Equal(t, StateReady, ag.Status().State)
+			result, err := ag.Chat(context.Background(), "Again")
+			require.NoError(t, err)
+			assert.Equal(t, "hi", result.Text)
+		})
+	}
+}
+
+func TestAgent_AbandonedEventStream(t *testing.T) {
+	longText := strings.Repeat("streaming output ", 20)
+	manyTools := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n%2 == 0 {
+				return llm.Message{Role: llm.RoleAssistant, Content: longText}
+			}
+			blocks := make([]llm.ContentBlock, 0, 40)
+			for i := range 40 {
+				blocks = append(blocks, &llm.ToolCall{ID: fmt.Sprintf("call-%d-%d", n, i), Name: "echo", Input: map[string]any{"text": "hi"}})
+			}
+			return llm.Message{Role: llm.RoleAssistant, ContentBlocks: blocks}
+		}))
+	}
+	identity := func(e *AgentEvent) *AgentEvent { return e }
+
+	tests := []struct {
+		name     string
+		provider func() *mock.Client
+		opts     []Option
+		runOpts  []RunOption
+		close    bool // 关闭 Agent 而不是取消 ctx
+	}{
+		{name: "streaming_text", provider: func() *mock.Client { return mock.New(mock.WithResponse(longText)) }, runOpts: []RunOption{WithStreaming(true)}},
+		{name: "blocking_tools", provider: manyTools, opts: []Option{WithTools(newEchoTool())}},
+		{name: "parallel_tools", provider: manyTools, opts: []Option{WithTools(newEchoTool()), WithParallelTools(true)}, runOpts: []RunOption{WithStreaming(true)}},
+		{
+			name:     "filter_and_transform",
+			provider: func() *mock.Client { return mock.New(mock.WithResponse(longText)) },
+			opts:     []Option{WithEventTransformers(identity)},
+			runOpts:  []RunOption{WithStreaming(true), WithEventFilter(llm.EventTypeText, llm.EventTypeDone)},
+		},
+		{
+			name:     "agent_closed",
+			provider: func() *mock.Client { return mock.New(mock.WithResponse(longText)) },
+			opts:     []Option{WithEventTransformers(identity)},
+			runOpts:  []RunOption{WithStreaming(true)},
+			close:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+			for range 20 {
+				ag := newTestAgent(t, tt.provider(), tt.opts...)
+				ctx, cancel := context.WithCancel(context.Background())
+
+				// 读取一个事件后停止读取，让执行 goroutine 填满缓冲区
+				events := ag.Run(ctx, "Hello", tt.runOpts...)
+				<-events
+				if tt.close {
+					require.NoError(t, ag.Close())
+				} else {
+					cancel()
+				}
+
+				waitCtx, waitCancel := context.WithTimeout(context.Background(), 2*time.Second)
+				require.NoError(t, ag.WaitIdle(waitCtx), "run goroutine must finish without a reader")
+				waitCancel()
+				cancel()
+				_ = ag.Close()
+			}
+		})
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 用量事件测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_WaitIdle(t *testing.T) {
+	t.Run("idle_returns_immediately", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("hi")))
+		require.NoError(t, ag.WaitIdle(context.Background()))
+	})
+
+	t.Run("waits_for_runs", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(100*time.Millisecond))
+		ag := newTestAgent(t, provider)
+
+		done := make(chan struct{})
+		for range 2 {
+			go func() {
+				_, _ = ag.Chat(context.Background(), "Hello")
+				done <- struct{}{}
+			}()
+		}
+		require.Eventually(t, func() bool { return provider.CallCount() == 2 }, time.Second, time.Millisecond)
+
+		require.NoError(t, ag.WaitIdle(context.Background()))
+		assert.Equal(t, StateReady, ag.Status().State)
+		<-done
+		<-done
+	})
+
+	t.Run("context_cancelled", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(300*time.Millisecond))
+		ag := newTestAgent(t, provider)
+
+		events := ag.Run(context.Background(), "Hello")
+		require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, ag.WaitIdle(ctx), context.DeadlineExceeded)
+
+		_, _ = collectResult(events)
+		require.NoError(t, ag.WaitIdle(context.Background()))
+	})
+}
+
+func TestAgent_BaseContext(t *testing.T) {
+	t.Run("cancel_closes_agent", func(t *testing.T) {
+		base, cancel := context.WithCancel(context.Background())
+		provider := mock.New(mock.WithResponse("hi"), mock.WithDelay(300*time.Millisecond))
+		ag := newTestAgent(t, provider, WithBaseContext(base))
+
+		events := ag.Run(context.Background(), "Hello")
+		require.Eventually(t, func() bool { return provider.CallCount() == 1 }, time.Second, time.Millisecond)
+
+		cancel()
+		_, err := collectResult(events)
+		require.ErrorIs(t, err, context.Canceled)
+
+		// 取消后立即拒绝新的执行
+		_, err = ag.Chat(context.Background(), "Again")
+		require.ErrorIs(t, err, ErrAgentStopped)
+		require.Eventually(t, func() bool { return ag.Status().State == StateStopped }, time.Second, time.Millisecond)
+	})
+
+	t.Run("close_stops_following", func(t *testing.T) {
+		base, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		ag, err := New().Provider(mock.New()).BaseContext(base).Build()
+		require.NoError(t, err)
+		require.NoError(t, ag.Close())
+		require.NoError(t, ag.Close())
+		cancel()
+		assert.Equal(t, StateStopped, ag.Status().State)
+	})
+
+	t.Run("nil_context_rejected", func(t *testing.T) {
+		//nolint:staticcheck // SA1012: 验证 nil context 的错误收集
+		_, err := New().Provider(mock.New()).BaseContext(nil).Build()
+		require.Error(t, err)
+	})
+}
+
+func TestAgent_UsageEvent(t *testing.T) {
+	collect := func(t *testing.T, ag *Agent) []*AgentEvent {
+		t.Helper()
+		var events []*AgentEvent
+		for event := range ag.Run(context.Background(), "Hello") {
+			require.NoError(t, event.Error)
+			events = append(events, event)
+		}
+		require.GreaterOrEqual(t, len(events), 2)
+		return events
+	}
+
+	t.Run("before_done_with_cost", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("abcdefgh")),
+			WithModel("test-model"),
+			WithPricingTable(map[string]ModelPrice{"test-model": {Input: 1000, Output: 5000}}),
+		)
+
+		events := collect(t, ag)
+		usage := events[len(events)-2]
+		done := events[len(events)-1]
+		require.Equal(t, EventTypeUsage, usage.Type)
+		require.Equal(t, llm.EventTypeDone, done.Type)
+
+		// mock：输入 10 token（1 条消息），输出 len("abcdefgh")/4 = 2 token
+		assert.Equal(t, 10, usage.Usage.PromptTokens)
+		assert.Equal(t, 2, usage.Usage.CompletionTokens)
+		assert.Equal(t, done.Result.TotalTokens, usage.Usage.TotalTokens)
+		assert.InDelta(t, (10*1000+2*5000)/1e6, usage.Usage.Cost, 1e-9)
+	})
+
+	t.Run("tokens_only_without_pricing", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("abcdefgh")), WithModel("test-model"))
+
+		events := collect(t, ag)
+		usage := events[len(events)-2].Usage
+		require.NotNil(t, usage)
+		assert.Equal(t, 12, usage.TotalTokens)
+		assert.Zero(t, usage.Cost)
+	})
+
+	t.Run("unknown_model_zero_cost", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("abcdefgh")),
+			WithModel("other"),
+			WithPricingTable(map[string]ModelPrice{"test-model": {Input: 1, Output: 1}}),
+		)
+
+		events := collect(t, ag)
+		assert.Zero(t, events[len(events)-2].Usage.Cost)
+	})
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 推理内容记录测试
+// ═══════════════════════════════════════════════════════════════════════════
+
+// reasoningStreamProvider 流式输出推理增量后输出答案
+type reasoningStreamProvider struct{}
+
+func (reasoningStreamProvider) Complete(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+	return nil, errors.New("not supported")
+}
+
+func (reasoningStreamProvider) Stream(context.Context, []llm.Message, *llm.Options) (<-chan *llm.Event, error) {
+	ch := make(chan *llm.Event, 3)
+	ch <- &llm.Event{Type: llm.EventTypeReasoning, TextDelta: "think "}
+	ch <- &llm.Event{Type: llm.EventTypeThinking, Reasoning: &llm.ReasoningDelta{ThoughtDelta: "harder"}}
+	ch <- &llm.Event{Type: llm.EventTypeText, TextDelta: "42"}
+	close(ch)
+	return ch, nil
+}
+
+func (reasoningStreamProvider) Close() error { return nil }
+
+func TestAgent_CaptureReasoning(t *testing.T) {
+	// 第一步思考后调用工具，第二步思考后回答
+	thinkingProvider := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return llm.Message{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{
+					&llm.ThinkingBlock{Thinking: "need echo"},
+					&llm.ToolCall{ID: "call-1", Name: "echo", Input: map[string]any{"text": "hi"}},
+				}}
+			}
+			return llm.Message{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{
+				&llm.ThinkingBlock{Thinking: "got it"},
+				&llm.TextBlock{Text: "hi"},
+			}}
+		}))
+	}
+
+	t.Run("blocking", func(t *testing.T) {
+		ag := newTestAgent(t, thinkingProvider(), WithTools(newEchoTool()), WithCaptureReasoning(true))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "need echo\n\ngot it", result.Reasoning)
+		assert.Equal(t, "hi", result.Text)
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		ag := newTestAgent(t, thinkingProvider(), WithTools(newEchoTool()))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Empty(t, result.Reasoning)
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		ag, err := NewAgent(WithProvider(reasoningStreamProvider{}), WithCaptureReasoning(true))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ag.Close() })
+
+		var deltas []string
+		var result *Result
+		for event := range ag.Run(context.Background(), "Hello", WithStreaming(true)) {
+			require.NoError(t, event.Error)
+			switch event.Type {
+			case llm.EventTypeReasoning:
+				deltas = append(deltas, event.Reasoning)
+			case llm.EventTypeDone:
+				result = event.Result
+			}
+		}
+		require.NotNil(t, result)
+		assert.Equal(t, []string{"think ", "harder"}, deltas)
+		assert.Equal(t, "think harder", result.Reasoning)
+		assert.Equal(t, "42", result.Text)
+	})
+}
+
+func TestAgent_Fork(t *testing.T) {
+	source := mock.New(mock.WithResponse("source"))
+	forkProvider := mock.New(mock.WithResponse("fork"))
+	ag := newTestAgent(t, source,
+		WithName("origin"),
+		WithTools(newEchoTool()),
+		func(b *builder) {
+			b.newProvider = func(*llm.Config) (llm.Provider, error) {
+				return forkProvider, nil
+			}
+		},
+	)
+
+	_, err := ag.Chat(context.Background(), "Hello")
+	require.NoError(t, err)
+
+	forked, err := ag.Fork()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = forked.Close() })
+
+	assert.NotEqual(t, ag.ID(), forked.ID())
+	assert.Equal(t, "origin", forked.Name())
+	assert.Equal(t, ag.Messages(), forked.Messages())
+	assert.True(t, forked.toolRegistry.Has("echo"))
+
+	// Provider 重新创建，不与源 Agent 共享
+	_, err = forked.Chat(context.Background(), "Branch")
+	require.NoError(t, err)
+	assert.Equal(t, 1, source.CallCount())
+	assert.Equal(t, 1, forkProvider.CallCount())
+
+	// 两边的历史互不影响
+	assert.Len(t, ag.Messages(), 2)
+	assert.Len(t, forked.Messages(), 4)
+
+	_, err = ag.Chat(context.Background(), "Again")
+	require.NoError(t, err)
+	assert.Equal(t, "Again", ag.Messages()[2].GetContent())
+	assert.Equal(t, "Branch", forked.Messages()[2].GetContent())
+
+	t.Run("options_override", func(t *testing.T) {
+		branch, err := ag.Fork(WithName("branch"))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = branch.Close() })
+		assert.Equal(t, "branch", branch.Name())
+	})
+}
+
+func TestAgent_CloneWithHistory(t *testing.T) {
+	cloneProvider := mock.New(mock.WithResponse("clone"))
+	ag := newTestAgent(t, mock.New(mock.WithResponse("source")),
+		WithName("origin"),
+		WithTools(newEchoTool()),
+		func(b *builder) {
+			b.newProvider = func(*llm.Config) (llm.Provider, error) {
+				return cloneProvider, nil
+			}
+		},
+	)
+
+	_, err := ag.Chat(context.Background(), "Hello")
+	require.NoError(t, err)
+
+	cloned, err := ag.CloneWithHistory()
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = cloned.Close() })
+
+	assert.NotEqual(t, ag.ID(), cloned.ID())
+	assert.Equal(t, "origin", cloned.Name())
+	assert.Equal(t, ag.Messages(), cloned.Messages())
+	assert.Nil(t, cloned.toolRegistry, "runtime settings are not copied")
+
+	// 历史是深拷贝，两边互不影响
+	_, err = cloned.Chat(context.Background(), "Branch")
+	require.NoError(t, err)
+	assert.Equal(t, 1, cloneProvider.CallCount())
+	assert.Len(t, ag.Messages(), 2)
+	assert.Len(t, cloned.Messages(), 4)
+
+	t.Run("concurrent_with_runs", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Go(func() {
+				_, _ = ag.Chat(context.Background(), "More")
+			})
+			wg.Go(func() {
+				c, err := ag.CloneWithHistory()
+				if assert.NoError(t, err) {
+					_ = c.Close()
+				}
+			})
+		}
+		wg.Wait()
+	})
+}
+
+func TestCloneMessages(t *testing.T) {
+	src := []llm.Message{
+		{Role: llm.RoleUser, Content: "hi"},
+		{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{
+			&llm.TextBlock{Text: "call"},
+			&llm.ToolCall{ID: "c1", Name: "echo", Input: map[string]any{"text": "x"}},
+		}},
+	}
+
+	dst := cloneMessages(src)
+	require.Equal(t, src, dst)
+
+	dst[1].ContentBlocks[0].(*llm.TextBlock).Text = "changed"
+	dst[1].ContentBlocks[1].(*llm.ToolCall).Input["text"] = "y"
+	assert.Equal(t, "call", src[1].ContentBlocks[0].(*llm.TextBlock).Text)
+	assert.Equal(t, "x", src[1].ContentBlocks[1].(*llm.ToolCall).Input["text"])
+}
+
+func TestAgent_ApproveToolCall(t *testing.T) {
+	// 第一步调用 echo，之后回答
+	newProvider := func(feedback *string) *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(msgs []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			*feedback = msgs[len(msgs)-1].GetToolResults()[0].Content
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+
+	t.Run("approved", func(t *testing.T) {
+		var feedback string
+		var approved []string
+		ag := newTestAgent(t, newProvider(&feedback),
+			WithTools(newEchoTool()),
+			WithApproveToolCall(func(_ context.Context, call *llm.ToolCall) (bool, error) {
+				approved = append(approved, call.Name)
+				return true, nil
+			}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"echo"}, approved)
+		assert.Contains(t, feedback, "hi")
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		var feedback string
+		ag := newTestAgent(t, newProvider(&feedback),
+			WithTools(newEchoTool()),
+			WithApproveToolCall(func(context.Context, *llm.ToolCall) (bool, error) {
+				return false, nil
+			}),
+		)
+
+		var toolResult *llm.ToolResult
+		for event := range ag.Run(context.Background(), "Hello") {
+			if event.Type == llm.EventTypeToolResult {
+				toolResult = event.ToolResult
+			}
+		}
+
+		require.NotNil(t, toolResult)
+		assert.True(t, toolResult.IsError)
+		assert.Contains(t, feedback, "denied")
+		assert.Equal(t, "done", ag.Messages()[len(ag.Messages())-1].GetContent())
+	})
+
+	t.Run("error_aborts_run", func(t *testing.T) {
+		var feedback string
+		provider := newProvider(&feedback)
+		ag := newTestAgent(t, provider,
+			WithTools(newEchoTool()),
+			WithApproveToolCall(func(context.Context, *llm.ToolCall) (bool, error) {
+				return false, errors.New("terminal closed")
+			}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "terminal closed")
+		assert.Equal(t, 1, provider.CallCount())
+
+		// 历史中的工具调用仍有对应结果
+		history := ag.Messages()
+		require.Len(t, history, 3)
+		require.Len(t, history[2].GetToolResults(), 1)
+		assert.True(t, history[2].GetToolResults()[0].IsError)
+	})
+
+	t.Run("parallel_partial_denial", func(t *testing.T) {
+		var executed atomic.Int32
+		counting := tool.Func("count", "Counts calls",
+			func(_ context.Context, _ echoInput) (string, error) {
+				executed.Add(1)
+				return "ok", nil
+			})
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return llm.Message{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{
+					&llm.ToolCall{ID: "c1", Name: "count", Input: map[string]any{"text": "a"}},
+					&llm.ToolCall{ID: "c2", Name: "count", Input: map[string]any{"text": "b"}},
+					&llm.ToolCall{ID: "c3", Name: "count", Input: map[string]any{"text": "c"}},
+				}}
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider,
+			WithTools(counting),
+			WithParallelTools(true),
+			WithApproveToolCall(func(_ context.Context, call *llm.ToolCall) (bool, error) {
+				return call.ID != "c2", nil
+			}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), executed.Load())
+
+		results := ag.Messages()[2].GetToolResults()
+		require.Len(t, results, 3)
+		assert.False(t, results[0].IsError)
+		assert.True(t, results[1].IsError)
+		assert.False(t, results[2].IsError)
+	})
+}
+
+func TestAgent_Redactor(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	var modelSaw, hookSaw string
+	provider := mock.New(mock.WithMessageFunc(func(msgs []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "card 4111-1111-1111-1111"})
+		}
+		modelSaw = msgs[len(msgs)-1].GetToolResults()[0].Content
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+	ag := newTestAgent(t, provider,
+		WithTools(newEchoTool()),
+		WithLogger(logger),
+		WithRedactor(func(s string) string {
+			return strings.ReplaceAll(s, "4111-1111-1111-1111", "[CARD]")
+		}),
+		WithHooks(Hooks{OnToolResult: func(tr *llm.ToolResult) { hookSaw = tr.Content }}),
+	)
+
+	events, _, err := ag.RunCollect(context.Background(), "Pay")
+	require.NoError(t, err)
+
+	var eventSaw string
+	for _, event := range events {
+		if event.Type == llm.EventTypeToolResult {
+			eventSaw = event.ToolResult.Content
+		}
+	}
+	assert.Contains(t, eventSaw, "[CARD]")
+	assert.Contains(t, hookSaw, "[CARD]")
+	assert.Contains(t, buf.String(), "[CARD]")
+	assert.NotContains(t, buf.String(), "4111-1111-1111-1111")
+	assert.Contains(t, modelSaw, "4111-1111-1111-1111", "model receives the original content")
+}
+
+func TestAgent_ToolErrorFormatter(t *testing.T) {
+	run := func(t *testing.T, opts ...Option) string {
+		t.Helper()
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "fail", map[string]any{"text": "x"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider, append(opts, WithTools(newFailingTool()))...)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		toolResults := result.Messages[2].GetToolResults()
+		require.Len(t, toolResults, 1)
+		assert.True(t, toolResults[0].IsError)
+		return toolResults[0].Content
+	}
+
+	t.Run("default_format", func(t *testing.T) {
+		assert.Equal(t, "Error: boom", run(t))
+	})
+
+	t.Run("custom_format", func(t *testing.T) {
+		content := run(t, WithToolErrorFormatter(func(name string, err error) string {
+			return fmt.Sprintf("%s failed (%v); check the arguments and retry", name, err)
+		}))
+		assert.Equal(t, "fail failed (boom); check the arguments and retry", content)
+	})
+}
+
+func TestAgent_MaxToolCallsPerStep(t *testing.T) {
+	newProvider := func() *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				blocks := make([]llm.ContentBlock, 0, 3)
+				for i := range 3 {
+					blocks = append(blocks, &llm.ToolCall{
+						ID: fmt.Sprintf("call-%d", i), Name: "echo", Input: map[string]any{"text": "hi"},
+					})
+				}
+				return llm.Message{Role: llm.RoleAssistant, ContentBlocks: blocks}
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+
+	t.Run("excess_calls_rejected", func(t *testing.T) {
+		var executed atomic.Int32
+		provider := newProvider()
+		ag := newTestAgent(t, provider,
+			WithTools(newEchoTool()),
+			WithMaxToolCallsPerStep(2),
+			WithHooks(Hooks{OnToolCall: func(*llm.ToolCall) { executed.Add(1) }}),
+		)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), executed.Load())
+
+		toolResults := result.Messages[2].GetToolResults()
+		require.Len(t, toolResults, 3, "every call gets a result")
+		assert.False(t, toolResults[0].IsError)
+		assert.False(t, toolResults[1].IsError)
+		assert.True(t, toolResults[2].IsError)
+		assert.Contains(t, toolResults[2].Content, "at most 2 tool calls")
+
+		assert.Equal(t, 2, provider.LastCall().Options.Metadata["max_tool_calls"])
+	})
+
+	t.Run("single_call_disables_parallel", func(t *testing.T) {
+		provider := newProvider()
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithMaxToolCallsPerStep(1))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, false, provider.LastCall().Options.Metadata["parallel_tool_calls"])
+	})
+
+	t.Run("unlimited_by_default", func(t *testing.T) {
+		provider := newProvider()
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		for _, tr := range result.Messages[2].GetToolResults() {
+			assert.False(t, tr.IsError)
+		}
+		assert.Nil(t, provider.LastCall().Options.Metadata)
+	})
+}
+
+func TestAgent_MaxToolResultBytes(t *testing.T) {
+	long := strings.Repeat("数据", 10)
+	serialized := `"` + long + `"` // 工具结果按 JSON 序列化，共 62 字节
+	run := func(t *testing.T, opts ...Option) (*Result, string) {
+		t.Helper()
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": long})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		var evented string
+		opts = append(opts, WithTools(newEchoTool()),
+			WithHooks(Hooks{OnToolResult: func(tr *llm.ToolResult) { evented = tr.Content }}))
+		ag := newTestAgent(t, provider, opts...)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		return result, evented
+	}
+
+	t.Run("truncated_with_note", func(t *testing.T) {
+		result, evented := run(t, WithMaxToolResultBytes(11))
+
+		content := result.Messages[2].GetToolResults()[0].Content
+		assert.True(t, strings.HasPrefix(content, `"数据数`+"\n"), "cut on a rune boundary")
+		assert.Contains(t, content, "showing the first 10 of 62 bytes")
+		assert.Contains(t, content, "Narrow the request")
+		assert.True(t, utf8.ValidString(content))
+		assert.Equal(t, content, evented)
+	})
+
+	t.Run("full_result_on_event", func(t *testing.T) {
+		result, evented := run(t, WithMaxToolResultBytes(11), WithFullToolResultEvents(true))
+
+		assert.Contains(t, result.Messages[2].GetToolResults()[0].Content, "Output truncated")
+		assert.Equal(t, serialized, evented)
+	})
+
+	t.Run("within_limit", func(t *testing.T) {
+		result, _ := run(t, WithMaxToolResultBytes(62))
+		assert.Equal(t, serialized, result.Messages[2].GetToolResults()[0].Content)
+	})
+
+	t.Run("unlimited_by_default", func(t *testing.T) {
+		result, _ := run(t)
+		assert.Equal(t, serialized, result.Messages[2].GetToolResults()[0].Content)
+	})
+
+	t.Run("negative_rejected", func(t *testing.T) {
+		_, err := New().Provider(mock.New()).MaxToolResultBytes(-1).Build()
+		require.ErrorContains(t, err, "maxToolResultBytes must be non-negative")
+	})
+}
+
+func TestAgent_ToolPermissions(t *testing.T) {
+	newRegistry := func(t *testing.T) *tool.Registry {
+		t.Helper()
+		registry := tool.NewRegistry()
+		require.NoError(t, registry.Register(newEchoTool()))
+		require.NoError(t, registry.Register(newFailingTool()))
+		return registry
+	}
+	advertised := func(opts *llm.Options) []string {
+		names := make([]string, 0, len(opts.Tools))
+		for _, ts := range opts.Tools {
+			names = append(names, ts.Name)
+		}
+		return names
+	}
+
+	t.Run("advertises_permitted_only", func(t *testing.T) {
+		registry := newRegistry(t)
+		allowed := newTestAgent(t, mock.New(), WithToolRegistry(registry), WithAllowedTools("echo"))
+		denied := newTestAgent(t, mock.New(), WithToolRegistry(registry), WithDeniedTools("echo"))
+		both := newTestAgent(t, mock.New(), WithToolRegistry(registry),
+			WithAllowedTools("echo"), WithDeniedTools("echo"))
+
+		assert.Equal(t, []string{"echo"}, advertised(allowed.buildProviderOptions(nil)))
+		assert.NotContains(t, allowed.ToolManual(), "`fail`")
+		assert.Equal(t, []string{"fail"}, advertised(denied.buildProviderOptions(nil)))
+
+		opts := both.buildProviderOptions(nil)
+		assert.Empty(t, opts.Tools)
+		assert.NotContains(t, opts.System, "Tools Manual")
+	})
+
+	t.Run("rejects_denied_call", func(t *testing.T) {
+		var feedback string
+		provider := mock.New(mock.WithMessageFunc(func(msgs []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+			}
+			feedback = msgs[len(msgs)-1].GetToolResults()[0].Content
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		approvals := 0
+		ag := newTestAgent(t, provider,
+			WithToolRegistry(newRegistry(t)),
+			WithDeniedTools("echo"),
+			WithApproveToolCall(func(context.Context, *llm.ToolCall) (bool, error) {
+				approvals++
+				return true, nil
+			}),
+		)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "done", result.Text)
+		assert.Contains(t, feedback, "not permitted")
+		assert.Zero(t, approvals, "denied tools should not reach approval")
+	})
+
+	t.Run("builder_and_config", func(t *testing.T) {
+		b := New().AllowTools("a", "b").DenyTools("b").FromYAML("denied-tools: [c]\n")
+		assert.Equal(t, []string{"a", "b"}, b.inner.config.AllowedTools)
+		assert.Equal(t, []string{"c"}, b.inner.config.DeniedTools)
+
+		cloned := cloneConfig(b.inner.config)
+		cloned.AllowedTools[0] = "x"
+		assert.Equal(t, "a", b.inner.config.AllowedTools[0])
+	})
+}
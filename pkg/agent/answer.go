@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 最终答案校验
+// ═══════════════════════════════════════════════════════════════════════════
+
+// AnswerValidator 最终答案校验函数
+//
+// 返回 nil 表示通过；返回的错误信息会作为修改意见反馈给模型。
+type AnswerValidator func(ctx context.Context, text string) error
+
+// answerFeedbackPrompt 校验失败后的反馈提示
+const answerFeedbackPrompt = "Your answer did not pass validation: %v. Please revise your answer."
+
+// checkAnswer 校验最终答案
+//
+// 未设置校验函数或校验通过时返回 (false, nil)。
+// 校验失败且仍有重试次数时追加反馈消息并返回 (true, nil)，调用方应继续循环；
+// 重试耗尽时返回包装了 ErrAnswerRejected 的错误，与 Provider 错误区分。
+func (a *Agent) checkAnswer(ctx context.Context, state *runState, text string) (bool, error) {
+	if a.answerValidator == nil {
+		return false, nil
+	}
+
+	err := a.answerValidator(ctx, text)
+	if err == nil {
+		return false, nil
+	}
+
+	if state.answerRetries < a.config.AnswerRetries {
+		state.answerRetries++
+		state.setMetadata("answer_retries", state.answerRetries)
+		state.logger.Info("answer rejected, retrying",
+			"attempt", state.answerRetries,
+			"limit", a.config.AnswerRetries,
+			"reason", err,
+		)
+		a.appendMessage(state.threadID, llm.Message{
+			Role:    llm.RoleUser,
+			Content: fmt.Sprintf(answerFeedbackPrompt, err),
+		})
+		return true, nil
+	}
+
+	state.logger.Warn("answer rejected", "reason", err)
+	return false, fmt.Errorf("%w: %w", ErrAnswerRejected, err)
+}
@@ -0,0 +1,211 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 审计记录
+// ═══════════════════════════════════════════════════════════════════════════
+
+// redactedValue 脱敏后的占位值
+const redactedValue = "[REDACTED]"
+
+// sensitiveKeys 需要脱敏的字段名（小写）
+var sensitiveKeys = map[string]struct{}{
+	"api_key":       {},
+	"apikey":        {},
+	"api-key":       {},
+	"authorization": {},
+	"password":      {},
+	"secret":        {},
+	"access_token":  {},
+	"refresh_token": {},
+}
+
+// AuditEntry 单步审计记录
+//
+// 仅在开启 AuditMode 时生成，记录每次 LLM 调用实际发送的请求和收到的响应，
+// 敏感字段（API Key 等）已脱敏，可直接持久化。
+type AuditEntry struct {
+	Step     int             `json:"step"`               // 步骤序号（从 1 开始）
+	Time     time.Time       `json:"time"`               // 请求发起时间
+	Model    string          `json:"model"`              // 请求使用的模型
+	Request  json.RawMessage `json:"request"`            // 序列化的请求（messages + options）
+	Response json.RawMessage `json:"response,omitempty"` // 序列化的原始响应
+	Error    string          `json:"error,omitempty"`    // 调用失败时的错误信息
+}
+
+// auditRequest 审计请求的序列化结构
+type auditRequest struct {
+	Messages []llm.Message `json:"messages"`
+	Options  *llm.Options  `json:"options"`
+}
+
+// recordAudit 记录当前步骤的请求与响应
+//
+// 开启 LogPrompts 时输出调试日志，开启 AuditMode 时追加到 Result.Audit，均未开启时直接返回。
+func (a *Agent) recordAudit(state *runState, start time.Time, downgraded bool,
+	messages []llm.Message, opts *llm.Options, resp *llm.Response, callErr error,
+) {
+	a.logPrompt(state, downgraded, messages, opts, resp, callErr)
+	if !a.config.AuditMode {
+		return
+	}
+
+	entry := AuditEntry{
+		Step:    state.stepCount,
+		Time:    start,
+		Model:   a.callModel(downgraded),
+		Request: a.auditJSON(state, auditRequest{Messages: messages, Options: opts}),
+	}
+	if resp != nil {
+		entry.Response = a.auditJSON(state, resp)
+	}
+	if callErr != nil {
+		entry.Error = a.redactString(callErr.Error())
+	}
+
+	state.audit = append(state.audit, entry)
+}
+
+// logPrompt 以 debug 级别输出完整的请求与原始响应
+//
+// 内容与审计记录一致（已脱敏）；开启 HashPromptContent 时消息内容、系统提示词和
+// 工具参数替换为 SHA-256 摘要，日志中只保留结构和可比对的指纹。
+func (a *Agent) logPrompt(state *runState, downgraded bool,
+	messages []llm.Message, opts *llm.Options, resp *llm.Response, callErr error,
+) {
+	if !a.config.LogPrompts || !state.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	args := []any{
+		"step", state.stepCount,
+		"model", a.callModel(downgraded),
+		"request", string(a.promptLogJSON(state, auditRequest{Messages: messages, Options: opts})),
+	}
+	if resp != nil {
+		args = append(args, "response", string(a.promptLogJSON(state, resp)))
+	}
+	if callErr != nil {
+		args = append(args, "error", a.redactString(callErr.Error()))
+	}
+	state.logger.Debug("llm call", args...)
+}
+
+// promptLogJSON 序列化提示词日志内容（脱敏，按配置摘要化消息内容）
+func (a *Agent) promptLogJSON(state *runState, v any) json.RawMessage {
+	data := a.auditJSON(state, v)
+	if !a.config.HashPromptContent || data == nil {
+		return data
+	}
+
+	var tree any
+	if err := json.Unmarshal(data, &tree); err != nil {
+		return data
+	}
+	hashed, err := json.Marshal(hashContentTree(tree))
+	if err != nil {
+		return data
+	}
+	return hashed
+}
+
+// auditJSON 序列化并脱敏
+func (a *Agent) auditJSON(state *runState, v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		state.logger.Warn("failed to marshal audit entry", "error", err)
+		return nil
+	}
+
+	// 按字段名脱敏
+	var tree any
+	if err := json.Unmarshal(data, &tree); err == nil {
+		if redacted, err := json.Marshal(redactTree(tree)); err == nil {
+			data = redacted
+		}
+	}
+
+	// 按值脱敏（防止 API Key 出现在内容中）
+	if key := a.config.LLM.APIKey; key != "" {
+		data = bytes.ReplaceAll(data, []byte(key), []byte(redactedValue))
+	}
+	return data
+}
+
+// redactString 从文本中移除 API Key
+func (a *Agent) redactString(s string) string {
+	if key := a.config.LLM.APIKey; key != "" {
+		return strings.ReplaceAll(s, key, redactedValue)
+	}
+	return s
+}
+
+// redactTree 递归替换敏感字段的值
+func redactTree(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		for k, child := range node {
+			if _, ok := sensitiveKeys[strings.ToLower(k)]; ok {
+				node[k] = redactedValue
+				continue
+			}
+			node[k] = redactTree(child)
+		}
+	case []any:
+		for i, child := range node {
+			node[i] = redactTree(child)
+		}
+	}
+	return v
+}
+
+// contentKeys 摘要化时替换的内容字段
+var contentKeys = map[string]struct{}{
+	"content":  {},
+	"text":     {},
+	"thinking": {},
+	"input":    {},
+	"system":   {},
+}
+
+// hashContentTree 递归将内容字段替换为摘要（相同内容得到相同摘要，便于比对）
+func hashContentTree(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		for k, child := range node {
+			if _, ok := contentKeys[k]; ok && child != nil {
+				node[k] = hashContent(child)
+				continue
+			}
+			node[k] = hashContentTree(child)
+		}
+	case []any:
+		for i, child := range node {
+			node[i] = hashContentTree(child)
+		}
+	}
+	return v
+}
+
+// hashContent 返回值的 SHA-256 摘要（字符串直接计算，其他类型按 JSON 计算）
+func hashContent(v any) string {
+	data, ok := v.(string)
+	if !ok {
+		raw, _ := json.Marshal(v)
+		data = string(raw)
+	}
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
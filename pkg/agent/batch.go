@@ -0,0 +1,162 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 批量执行
+// ═══════════════════════════════════════════════════════════════════════════
+
+// DefaultBatchConcurrency BatchRun 的默认并发数（concurrency <= 0 时使用）
+const DefaultBatchConcurrency = 4
+
+// BatchRun 以 base 为模板，对每个输入并发执行一次独立对话
+//
+// 每个输入使用一个新建的 Agent（规则同 NewAgentFactory：复制配置、工具、钩子、中间件，
+// 不连接 MCP 服务器），从空历史（或 base 设置的初始历史）开始，执行完成后立即关闭，
+// 同时存在的 Agent 不超过 concurrency 个。所有 Agent 共享同一个 Provider：
+// base 未设置 Provider 时按配置创建一次，批量结束后关闭；通过 Provider() 传入的 Provider 不会被关闭。
+//
+// 返回的结果和错误与 inputs 按下标一一对应（成功时错误为 nil，失败时结果可能为部分结果）。
+// ctx 取消后尚未开始的输入不再执行，其错误为 ctx.Err()。base 本身不会被构建或修改。
+//
+// 使用示例:
+//
+//	base := agent.New().Model("gpt-4o-mini").APIKeyFromEnv().System("将文本分类为正面或负面")
+//	results, errs := agent.BatchRun(ctx, base, reviews, 8)
+//	for i := range reviews {
+//	    if errs[i] != nil {
+//	        log.Printf("input %d: %v", i, errs[i])
+//	        continue
+//	    }
+//	    fmt.Println(results[i].Text)
+//	}
+func BatchRun(ctx context.Context, base *Builder, inputs []string, concurrency int) ([]*Result, []error) {
+	results := make([]*Result, len(inputs))
+	errs := make([]error, len(inputs))
+	if len(inputs) == 0 {
+		return results, errs
+	}
+	if concurrency <= 0 {
+		concurrency = DefaultBatchConcurrency
+	}
+
+	template, release, err := newBatchTemplate(base)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return results, errs
+	}
+	defer release()
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, input := range inputs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for j := i; j < len(inputs); j++ {
+				errs[j] = ctx.Err()
+			}
+			wg.Wait()
+			return results, errs
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = runBatchItem(ctx, template, input)
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// newBatchTemplate 复制 base 并准备共享的 Provider
+//
+// 返回的 release 关闭由本函数创建的 Provider。
+func newBatchTemplate(base *Builder) (*builder, func(), error) {
+	base.mu.Lock()
+	b := &Builder{
+		inner: base.inner.clone(),
+		errs:  slices.Clone(base.errs),
+	}
+	base.mu.Unlock()
+
+	if err := b.validate(); err != nil {
+		return nil, nil, fmt.Errorf("batch run: %w", err)
+	}
+
+	template := b.inner
+	release := func() {}
+	if template.provider == nil {
+		p, err := template.providerFactory()(&template.config.LLM)
+		if err != nil {
+			return nil, nil, fmt.Errorf("batch run: auto-create provider: %w", err)
+		}
+		template.provider = p
+		release = func() { _ = p.Close() }
+	}
+
+	// 各 Agent 关闭时不关闭共享的 Provider
+	template.shareProviders()
+	return template, release, nil
+}
+
+// runBatchItem 创建独立的 Agent 执行单个输入
+func runBatchItem(ctx context.Context, template *builder, input string) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	b := template.clone()
+	b.config.ID = ""
+	b.config.DeterministicID = false
+
+	ag, err := newAgentFromBuilder(b)
+	if err != nil {
+		return nil, fmt.Errorf("create agent: %w", err)
+	}
+	defer func() { _ = ag.Close() }()
+	return ag.Chat(ctx, input)
+}
+
+// sharedProvider 多个 Agent 共享的 Provider（Close 为空操作，由创建方负责关闭）
+//
+// 能力判断通过 providerCapabilities 解开包装，不影响 CapabilityReporter 的检查。
+type sharedProvider struct {
+	llm.Provider
+}
+
+// Close 不关闭底层 Provider
+func (sharedProvider) Close() error {
+	return nil
+}
+
+// shareProviders 将 builder 中已有的主 Provider 和备用 Provider 标记为共享（已标记的不重复包装）
+//
+// 由同一模板创建多个 Agent 时使用，各 Agent 关闭时不关闭这些 Provider。
+func (b *builder) shareProviders() {
+	if b.provider != nil {
+		b.provider = shareProvider(b.provider)
+	}
+	for i, fb := range b.fallbacks {
+		b.fallbacks[i] = shareProvider(fb)
+	}
+}
+
+// shareProvider 包装为 sharedProvider（已包装的原样返回）
+func shareProvider(p llm.Provider) llm.Provider {
+	if _, ok := p.(sharedProvider); ok {
+		return p
+	}
+	return sharedProvider{p}
+}
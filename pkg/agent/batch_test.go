@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Batch Run Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// newEchoProvider 创建回显最后一条用户消息的 Provider
+func newEchoProvider(delay time.Duration) *mock.Client {
+	return mock.New(
+		mock.WithDelay(delay),
+		mock.WithMessageFunc(func(msgs []llm.Message, _ int) llm.Message {
+			return llm.Message{Role: llm.RoleAssistant, Content: fmt.Sprintf("%d:%s", len(msgs), msgs[len(msgs)-1].GetContent())}
+		}),
+	)
+}
+
+func TestBatchRun(t *testing.T) {
+	inputs := []string{"a", "b", "c", "d", "e"}
+
+	t.Run("preserves_order_with_fresh_conversations", func(t *testing.T) {
+		shared := &closeTrackingProvider{Client: newEchoProvider(5 * time.Millisecond)}
+		var inFlight, peak atomic.Int32
+		base := New().Provider(shared).Use(func(next ProviderCallFunc) ProviderCallFunc {
+			return func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					p := peak.Load()
+					if n <= p || peak.CompareAndSwap(p, n) {
+						break
+					}
+				}
+				return next(ctx, messages, opts)
+			}
+		})
+
+		results, errs := BatchRun(context.Background(), base, inputs, 2)
+		require.Len(t, results, len(inputs))
+		for i, input := range inputs {
+			require.NoError(t, errs[i])
+			assert.Equal(t, "1:"+input, results[i].Text, "each input starts a fresh conversation")
+		}
+		assert.LessOrEqual(t, peak.Load(), int32(2))
+		assert.Equal(t, len(inputs), shared.CallCount(), "all agents share the provider")
+		assert.Equal(t, int32(0), shared.closed.Load(), "caller-supplied provider is not closed")
+	})
+
+	t.Run("per_input_errors", func(t *testing.T) {
+		failure := errors.New("rejected")
+		base := New().Provider(newEchoProvider(0)).
+			RetryConfig(&RetryConfig{}).
+			Use(func(next ProviderCallFunc) ProviderCallFunc {
+				return func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+					if messages[len(messages)-1].GetContent() == "c" {
+						return nil, failure
+					}
+					return next(ctx, messages, opts)
+				}
+			})
+
+		results, errs := BatchRun(context.Background(), base, inputs, 0)
+		for i := range inputs {
+			if i == 2 {
+				require.ErrorIs(t, errs[i], failure)
+				require.NotNil(t, results[i], "partial result")
+				assert.ErrorIs(t, results[i].Err, failure)
+				continue
+			}
+			require.NoError(t, errs[i])
+		}
+	})
+
+	t.Run("auto_created_provider_closed", func(t *testing.T) {
+		created := &closeTrackingProvider{Client: newEchoProvider(0)}
+		var factoryCalls atomic.Int32
+		base := New().APIKey("sk-test")
+		base.inner.newProvider = func(*llm.Config) (llm.Provider, error) {
+			factoryCalls.Add(1)
+			return created, nil
+		}
+
+		_, errs := BatchRun(context.Background(), base, inputs, 3)
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int32(1), factoryCalls.Load(), "provider is created once")
+		assert.Equal(t, int32(1), created.closed.Load())
+	})
+
+	t.Run("capabilities_of_shared_provider", func(t *testing.T) {
+		p := &capabilityProvider{Client: mock.New(mock.WithResponse("ok")), seed: true}
+		base := New().Provider(p).Tools(newEchoTool()).Seed(7)
+
+		results, errs := BatchRun(context.Background(), base, inputs[:2], 1)
+		for i := range 2 {
+			require.NoError(t, errs[i])
+			assert.Equal(t, 7, results[i].Metadata["seed"], "seed support detected through the shared wrapper")
+		}
+		opts := p.LastCall().Options
+		assert.Empty(t, opts.Tools, "provider without function calling gets no tool schemas")
+		assert.Contains(t, opts.System, DefaultToolManualHeader)
+	})
+
+	t.Run("invalid_base", func(t *testing.T) {
+		_, errs := BatchRun(context.Background(), New().Provider(mock.New()).MaxTokens(-1), inputs[:2], 1)
+		for _, err := range errs {
+			require.ErrorContains(t, err, "maxTokens must be positive")
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		results, errs := BatchRun(ctx, New().Provider(newEchoProvider(0)), inputs, 1)
+		require.Len(t, errs, len(inputs))
+		for i := range inputs {
+			assert.Nil(t, results[i])
+			require.ErrorIs(t, errs[i], context.Canceled)
+		}
+	})
+}
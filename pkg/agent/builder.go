@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"log/slog"
 	"maps"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/lwmacct/251207-go-pkg-cfgm/pkg/cfgm"
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
@@ -83,6 +85,32 @@ func (b *Builder) ID(id string) *Builder {
 	return b
 }
 
+// IDGenerator 设置 Agent ID 生成函数
+//
+// 未显式设置 ID 时调用 fn 生成 ID（如 ULID、带租户前缀的 ID），
+// Fork 和 Factory 创建的子 Agent 沿用同一函数；nil 恢复默认的 "agt-" + UUID 方案。
+// DeterministicID 开启时优先使用派生 ID。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    IDGenerator(func() string { return "acme-" + ulid.Make().String() }).
+//	    Build()
+func (b *Builder) IDGenerator(fn func() string) *Builder {
+	b.inner.idGenerator = fn
+	return b
+}
+
+// DeterministicID 设置是否根据配置派生稳定的 Agent ID
+//
+// 未显式设置 ID 时，由名称、Provider 类型、模型、端点和系统提示词的哈希得到 ID，
+// 服务重启后 ID 不变，便于跨重启关联日志和状态。
+// 注意：配置相同的多个 Agent 会得到相同 ID（如都加入同一个 Runtime 会冲突）。
+func (b *Builder) DeterministicID(enabled bool) *Builder {
+	b.inner.config.DeterministicID = enabled
+	return b
+}
+
 // Name 设置 Agent 名称
 func (b *Builder) Name(name string) *Builder {
 	b.inner.config.Name = name
@@ -140,12 +168,32 @@ func (b *Builder) APIKeyFromEnv(envNames ...string) *Builder {
 	return b
 }
 
+// ProviderType 设置 Provider 类型（如 llm.ProviderTypeAnthropic）
+func (b *Builder) ProviderType(t llm.ProviderType) *Builder {
+	b.inner.config.LLM.Type = t
+	return b
+}
+
 // BaseURL 设置 API 端点
 func (b *Builder) BaseURL(url string) *Builder {
 	b.inner.config.LLM.BaseURL = url
 	return b
 }
 
+// LLMTimeout 设置单次 Provider 调用的超时时间（默认 120 秒，0 表示不限制）
+//
+// 每次调用（含每次重试、每个备用 Provider）使用从执行 ctx 派生的独立超时，
+// 单次调用超时只让这一次调用失败（可重试），不影响多步执行的其余步骤。
+// 与调用方 ctx 的截止时间同时生效、以先到者为准：ctx 到期时整个执行结束，不再重试。
+func (b *Builder) LLMTimeout(d time.Duration) *Builder {
+	if d < 0 {
+		b.errs = append(b.errs, errors.New("llmTimeout must be non-negative"))
+		return b
+	}
+	b.inner.config.LLM.Timeout = d
+	return b
+}
+
 // MaxTokens 设置最大 token 数
 func (b *Builder) MaxTokens(n int) *Builder {
 	if n <= 0 {
@@ -156,6 +204,155 @@ func (b *Builder) MaxTokens(n int) *Builder {
 	return b
 }
 
+// ContextWindow 设置模型上下文窗口大小（token 数）
+//
+// 设置后每次调用 Provider 前估算输入 token 数并计算使用率，
+// 通过 Status().ContextUtilization 实时查询（如提示"已使用 80% 上下文"）。
+func (b *Builder) ContextWindow(tokens int) *Builder {
+	if tokens <= 0 {
+		b.errs = append(b.errs, errors.New("contextWindow must be positive"))
+		return b
+	}
+	b.inner.config.ContextWindow = tokens
+	return b
+}
+
+// ContextWarningThreshold 设置上下文溢出告警的使用率（0..1，默认 0.9）
+//
+// 需配合 ContextWindow 使用：调用 Provider 前估算的输入 token 数达到该比例时
+// 发送 EventTypeContextWarning 事件，便于在 Provider 因上下文过长失败前主动处理。
+func (b *Builder) ContextWarningThreshold(ratio float64) *Builder {
+	if ratio <= 0 || ratio > 1 {
+		b.errs = append(b.errs, errors.New("contextWarningThreshold must be in (0, 1]"))
+		return b
+	}
+	b.inner.config.ContextWarningThreshold = ratio
+	return b
+}
+
+// TokenCounter 设置输入 token 数的计算方式
+//
+// 用于上下文使用率、溢出告警和历史压缩阈值判断，默认按字符数粗略估算。
+//
+// 示例：
+//
+//	ag, err := agent.New().
+//	    ContextWindow(128000).
+//	    TokenCounter(agent.TokenCounterFunc(func(msgs []llm.Message, opts *llm.Options) int {
+//	        return tiktokenCount(msgs, opts)
+//	    })).
+//	    Build()
+func (b *Builder) TokenCounter(tc TokenCounter) *Builder {
+	b.inner.tokenCounter = tc
+	return b
+}
+
+// Compactor 设置对话历史压缩器
+//
+// 估算的上下文 token 数超过 CompactThreshold（未设置时为 ContextWindow 的 80%）时，
+// 在调用 Provider 前压缩会话历史，避免长对话超出模型上下文窗口。
+//
+// 示例：
+//
+//	ag, err := agent.New().
+//	    ContextWindow(128000).
+//	    Compactor(agent.NewSummaryCompactor(6)).
+//	    Build()
+func (b *Builder) Compactor(c Compactor) *Builder {
+	b.inner.compactor = c
+	return b
+}
+
+// MaxHistoryMessages 设置每次调用 Provider 时最多发送的历史消息数（滑动窗口）
+//
+// 轻量的上下文控制方式，不需要额外的模型调用：只发送开头的系统消息和最近 n 条消息，
+// Messages() 返回的完整历史不受影响。窗口起点总是落在用户发起的一轮上，
+// 不会出现缺少对应工具调用的工具结果。
+//
+// 设置了 Compactor 时以 Compactor 为准，滑动窗口不生效。
+func (b *Builder) MaxHistoryMessages(n int) *Builder {
+	if n <= 0 {
+		b.errs = append(b.errs, errors.New("maxHistoryMessages must be positive"))
+		return b
+	}
+	b.inner.config.MaxHistoryMessages = n
+	return b
+}
+
+// CompactThreshold 设置触发历史压缩的估算 token 数
+func (b *Builder) CompactThreshold(tokens int) *Builder {
+	if tokens <= 0 {
+		b.errs = append(b.errs, errors.New("compactThreshold must be positive"))
+		return b
+	}
+	b.inner.config.CompactThreshold = tokens
+	return b
+}
+
+// Temperature 设置采样温度
+//
+// 显式设置的 0 会被保留（确定性输出），未设置时使用 DefaultTemperature。
+func (b *Builder) Temperature(t float64) *Builder {
+	if t < 0 {
+		b.errs = append(b.errs, errors.New("temperature must be non-negative"))
+		return b
+	}
+	b.inner.config.Temperature = &t
+	return b
+}
+
+// TopP 设置核采样概率（0~1），未设置时使用 Provider 默认值
+func (b *Builder) TopP(p float64) *Builder {
+	if p < 0 || p > 1 {
+		b.errs = append(b.errs, errors.New("topP must be between 0 and 1"))
+		return b
+	}
+	b.inner.config.TopP = &p
+	return b
+}
+
+// Seed 设置采样随机种子，用于可复现的执行（如回归测试）
+//
+// llm.Options 没有种子字段，种子通过 Metadata["seed"] 传递，内置 Provider 均不读取；
+// 只有通过 CapabilityReporter 声明 ProviderCapabilities.Seed 的 Provider 才会使用，
+// 此时种子记录在 Result.Metadata["seed"] 中，否则执行时记录一次警告。
+// 即使模型使用了种子，输出也不保证完全可复现。
+func (b *Builder) Seed(seed int) *Builder {
+	b.inner.config.Seed = &seed
+	return b
+}
+
+// StopSequences 添加停止序列，模型生成到任一序列时停止
+//
+// 并非所有 Provider 都支持停止序列，不支持时由 Provider 忽略。
+// 单次执行可通过 WithStopSequences 追加。
+func (b *Builder) StopSequences(stops ...string) *Builder {
+	b.inner.config.StopSequences = append(b.inner.config.StopSequences, stops...)
+	return b
+}
+
+// DeadlineDowngrade 设置临近截止时间时的模型降级策略
+//
+// 当 ctx 带有截止时间且剩余时间低于 threshold 时，
+// 下一步改用 fastModel 并禁用工具，尽量在截止前返回结果。
+// 降级信息记录在 Result.Metadata 中。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Model("gpt-4").
+//	    DeadlineDowngrade("gpt-4o-mini", 5*time.Second).
+//	    Build()
+func (b *Builder) DeadlineDowngrade(fastModel string, threshold time.Duration) *Builder {
+	if fastModel == "" || threshold <= 0 {
+		b.errs = append(b.errs, errors.New("deadline downgrade requires a model and a positive threshold"))
+		return b
+	}
+	b.inner.config.DowngradeModel = fastModel
+	b.inner.config.DowngradeThreshold = threshold
+	return b
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 行为配置
 // ═══════════════════════════════════════════════════════════════════════════
@@ -166,6 +363,47 @@ func (b *Builder) System(prompt string) *Builder {
 	return b
 }
 
+// SystemTemplate 设置系统提示词模板
+//
+// 模板使用 text/template 语法，在每次执行开始时用 WithPromptVars 提供的变量渲染，
+// 渲染结果替代 System 设置的提示词（AppendSystem 的分段仍追加在其后）。
+// 引用未提供的变量会使本次执行返回错误。与配置文件模板不同，后者在加载时一次性展开。
+//
+// 使用示例：
+//
+//	ag, _ := agent.New().
+//	    SystemTemplate("You are helping {{.User}}. Today is {{.Date}}.").
+//	    Build()
+//	events := ag.Run(ctx, "hi", agent.WithPromptVars(map[string]any{
+//	    "User": "alice",
+//	    "Date": time.Now().Format(time.DateOnly),
+//	}))
+func (b *Builder) SystemTemplate(tmpl string) *Builder {
+	if _, err := parseSystemTemplate(tmpl); err != nil {
+		b.errs = append(b.errs, err)
+		return b
+	}
+	b.inner.config.SystemTemplate = tmpl
+	return b
+}
+
+// AppendSystem 追加系统提示词分段
+//
+// 分段按调用顺序追加在 System 设置的基础提示词之后，以空行分隔，
+// 便于分层组织提示词（基础人设、任务指令、动态上下文等）。
+//
+// 使用示例：
+//
+//	agent.New().
+//	    System("You are a code reviewer.").
+//	    AppendSystem("Focus on concurrency issues.").
+//	    AppendSystem("Repository: " + repo).
+//	    Build()
+func (b *Builder) AppendSystem(segment string) *Builder {
+	b.inner.config.SystemSegments = append(b.inner.config.SystemSegments, segment)
+	return b
+}
+
 // SystemFromFile 从文件读取系统提示词
 func (b *Builder) SystemFromFile(path string) *Builder {
 	data, err := os.ReadFile(path) //nolint:gosec // G304: 用户提供的配置文件路径
@@ -177,12 +415,121 @@ func (b *Builder) SystemFromFile(path string) *Builder {
 	return b
 }
 
+// History 设置初始对话历史（恢复已保存的对话）
+//
+// 历史消息按原样追加，不校验角色顺序。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    History(saved...).
+//	    Build()
+func (b *Builder) History(msgs ...llm.Message) *Builder {
+	b.inner.history = append(b.inner.history, msgs...)
+	return b
+}
+
+// Examples 添加少样本示例（user/assistant 消息对）
+//
+// 每次调用 Provider 时示例插入在系统提示词之后、会话历史之前；
+// 示例不属于会话历史，不出现在 Messages() 中，也不参与 MaxHistoryMessages 截取。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    System("将用户输入翻译为英文").
+//	    Examples(
+//	        llm.Message{Role: llm.RoleUser, Content: "你好"},
+//	        llm.Message{Role: llm.RoleAssistant, Content: "Hello"},
+//	    ).
+//	    Build()
+func (b *Builder) Examples(msgs ...llm.Message) *Builder {
+	b.inner.config.Examples = append(b.inner.config.Examples, msgs...)
+	return b
+}
+
 // WorkDir 设置工作目录
 func (b *Builder) WorkDir(dir string) *Builder {
 	b.inner.config.WorkDir = dir
 	return b
 }
 
+// AllowEmptyInput 设置是否允许空输入
+//
+// 默认拒绝空白输入并返回 ErrEmptyInput。
+// 启用后，空输入不会追加用户消息，Agent 直接基于现有历史继续生成（续写场景）。
+func (b *Builder) AllowEmptyInput(allow bool) *Builder {
+	b.inner.config.AllowEmptyInput = allow
+	return b
+}
+
+// Stateless 设置无状态模式
+//
+// 启用后每次 Chat/Run 都是一轮新的对话：执行前将会话历史重置为 History 设置的初始历史
+// （命名会话重置为空），Messages() 只包含初始历史和最近一轮对话。
+// 适用于请求/响应式服务，无需为每个请求重新创建 Agent。
+func (b *Builder) Stateless(enabled bool) *Builder {
+	b.inner.config.Stateless = enabled
+	return b
+}
+
+// ResponseSchema 设置结构化输出的 JSON Schema
+//
+// schema 可以是 map[string]any、JSON 字符串，或可序列化为 JSON Schema 的值。
+// 最终回复会按 Schema 校验并解析到 Result.Structured；校验失败会重新请求一次，
+// 仍失败则返回 ErrInvalidStructuredOutput。
+//
+// 使用示例：
+//
+//	result, err := agent.New().
+//	    ResponseSchema(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`).
+//	    Chat(ctx, "提取文档中的人名")
+//	fmt.Println(string(result.Structured))
+func (b *Builder) ResponseSchema(schema any) *Builder {
+	if _, err := newResponseFormat(schema); err != nil {
+		b.errs = append(b.errs, err)
+		return b
+	}
+	b.inner.responseSchema = schema
+	return b
+}
+
+// AuditMode 设置是否开启审计记录
+//
+// 开启后每一步 LLM 调用的请求（messages + options）和原始响应会被序列化、
+// 脱敏后记录到 Result.Audit，便于合规场景持久化存档。关闭时（默认）无额外开销。
+func (b *Builder) AuditMode(enabled bool) *Builder {
+	b.inner.config.AuditMode = enabled
+	return b
+}
+
+// LogPrompts 设置是否在 debug 日志中记录完整提示词与响应
+//
+// 开启后每次 LLM 调用以 debug 级别输出一条 "llm call" 日志，包含系统提示词、消息列表
+// 和原始响应，API Key 等敏感字段已脱敏。仅在日志器启用 debug 级别时序列化，用于排查提示词问题。
+func (b *Builder) LogPrompts(enabled bool) *Builder {
+	b.inner.config.LogPrompts = enabled
+	return b
+}
+
+// HashPromptContent 设置提示词日志是否以摘要代替消息内容
+//
+// 开启后提示词日志中的消息内容、系统提示词和工具参数替换为 SHA-256 摘要，
+// 保留消息结构和可比对的指纹，避免用户数据写入日志。需配合 LogPrompts 使用。
+func (b *Builder) HashPromptContent(enabled bool) *Builder {
+	b.inner.config.HashPromptContent = enabled
+	return b
+}
+
+// CaptureReasoning 设置是否记录推理内容
+//
+// 开启后推理模型（o1、DeepSeek R1、Claude extended thinking 等）的思考过程
+// 会累积到 Result.Reasoning，流式和非流式模式均生效。默认关闭，不保存推理内容。
+func (b *Builder) CaptureReasoning(enabled bool) *Builder {
+	b.inner.config.CaptureReasoning = enabled
+	return b
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 工具配置
 // ═══════════════════════════════════════════════════════════════════════════
@@ -219,6 +566,270 @@ func (b *Builder) ToolRegistry(registry *tool.Registry) *Builder {
 	return b
 }
 
+// AllowTools 限制模型只能使用指定的工具
+//
+// 与注册表无关的权限边界：多个 Agent 共享同一个 tool.Registry 时，
+// 可为每个 Agent 单独限制可用工具。未允许的工具不会提供给模型，模型仍调用时返回错误结果。
+//
+// 使用示例：
+//
+//	reader := agent.New().ToolRegistry(shared).AllowTools("read_file", "grep").Build()
+func (b *Builder) AllowTools(names ...string) *Builder {
+	b.inner.config.AllowedTools = append(b.inner.config.AllowedTools, names...)
+	return b
+}
+
+// DenyTools 禁止模型使用指定的工具（优先于 AllowTools）
+func (b *Builder) DenyTools(names ...string) *Builder {
+	b.inner.config.DeniedTools = append(b.inner.config.DeniedTools, names...)
+	return b
+}
+
+// ToolResultCache 设置工具结果缓存
+//
+// 可缓存的工具（实现 CacheableTool 或在 CacheableTools 中声明）执行前先以工具名和参数查找缓存，
+// 命中时直接复用结果，不再执行；只缓存成功的结果。多个 Agent 可以共享同一个缓存。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Tools(convertTool).
+//	    CacheableTools("convert_units").
+//	    ToolResultCache(agent.NewToolResultLRU(512)).
+//	    Build()
+func (b *Builder) ToolResultCache(cache ToolResultCache) *Builder {
+	b.inner.toolCache = cache
+	return b
+}
+
+// CacheableTools 声明结果可缓存的工具（未设置 ToolResultCache 时使用默认 LRU）
+func (b *Builder) CacheableTools(names ...string) *Builder {
+	b.inner.config.CacheableTools = append(b.inner.config.CacheableTools, names...)
+	return b
+}
+
+// ParallelTools 设置是否并发执行同一步中的多个工具调用
+//
+// 适合 HTTP、数据库等 I/O 密集型工具，并发数由 MaxParallelTools 限制（为 1 时仍按顺序执行）。
+// 工具结果仍按调用顺序返回给模型；工具结果事件和钩子可能乱序触发，但都携带正确的 ToolID。
+// 需要跨 Agent 限制总并发时配合 ToolSemaphore 使用。
+func (b *Builder) ParallelTools(enabled bool) *Builder {
+	b.inner.config.ParallelTools = enabled
+	return b
+}
+
+// MaxParallelTools 设置并发执行工具的最大数量（0 表示使用默认值 4）
+func (b *Builder) MaxParallelTools(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("maxParallelTools must be non-negative"))
+		return b
+	}
+	b.inner.config.MaxParallelTools = n
+	return b
+}
+
+// ToolSemaphore 设置工具执行的共享并发限制
+//
+// 每次工具执行（无论是否开启 ParallelTools）都先从 sem 获取一个名额，多个 Agent 共享同一个 sem
+// 时可以保护连接数有限的下游（如数据库）。MaxParallelTools 限制单个 Agent 单步内的并发，
+// sem 限制所有共享它的 Agent 的总并发，两者同时生效。获取名额时 ctx 取消，
+// 该调用不执行并向模型返回错误结果。
+//
+// 使用示例：
+//
+//	dbLimit := semaphore.NewWeighted(8) // golang.org/x/sync/semaphore
+//	for range 20 {
+//	    ag, err := agent.New().Tools(queryTool).ParallelTools(true).ToolSemaphore(dbLimit).Build()
+//	    // ...
+//	}
+func (b *Builder) ToolSemaphore(sem ToolSemaphore) *Builder {
+	b.inner.toolSemaphore = sem
+	return b
+}
+
+// MaxToolCallsPerStep 设置单步最多执行的工具调用数（0 表示不限制）
+//
+// 模型一次返回更多调用时只执行前 n 个，其余不执行并以错误结果告知模型在后续步骤中再调用，
+// 防止模型一次扇出大量调用压垮下游系统。同时通过 llm.Options.Metadata 向 Provider 传递
+// "max_tool_calls" 提示（n 为 1 时另加 "parallel_tool_calls": false），支持的 Provider 可据此限制模型输出。
+func (b *Builder) MaxToolCallsPerStep(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("maxToolCallsPerStep must be non-negative"))
+		return b
+	}
+	b.inner.config.MaxToolCallsPerStep = n
+	return b
+}
+
+// MaxToolResultBytes 设置单个工具结果发送给模型的最大字节数（0 表示不限制）
+//
+// 超出时按字符边界截断，并附加说明提示模型缩小查询范围（过滤、分页等），
+// 防止失控的工具输出撑爆上下文和 Token 费用。截断后的内容写入对话历史；
+// ToolResult 事件默认同样携带截断后的内容，开启 FullToolResultEvents 后携带完整内容。
+func (b *Builder) MaxToolResultBytes(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("maxToolResultBytes must be non-negative"))
+		return b
+	}
+	b.inner.config.MaxToolResultBytes = n
+	return b
+}
+
+// FullToolResultEvents 设置工具结果被截断时 ToolResult 事件是否携带完整内容
+//
+// 用于客户端需要展示完整输出、而模型只需看到截断版本的场景。
+func (b *Builder) FullToolResultEvents(enabled bool) *Builder {
+	b.inner.config.FullToolResultEvents = enabled
+	return b
+}
+
+// EventBufferSize 设置 Run 返回的事件通道的缓冲大小（默认 DefaultEventBufferSize）
+//
+// 缓冲越大，执行越能领先于较慢的消费者（如逐帧写入网络的 SSE），
+// 减少因等待读取而阻塞模型流和工具执行，代价是积压事件占用的内存与更高的端到端延迟。
+// 0 表示无缓冲：每个事件都要等消费者取走后执行才继续，内存占用最低，
+// 但执行速度受限于消费者，且取消后尚未取走的事件（包括最终的错误事件）更容易被丢弃。
+// 可通过 WithEventBuffer 为单次执行覆盖。
+func (b *Builder) EventBufferSize(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("eventBufferSize must be non-negative"))
+		return b
+	}
+	b.inner.config.EventBufferSize = &n
+	return b
+}
+
+// RepairToolArgs 设置是否修复不规范的工具调用参数
+//
+// 较弱的模型有时输出带尾随逗号、单引号的参数 JSON，标准解析会失败并得到空参数。
+// 开启后解析失败时先尝试修复再解析，修复时记录日志；修复失败仍回退为空参数。
+//
+// 注意：仅作用于 Agent 自行拼接参数的流式路径；非流式路径的参数由 Provider 解析。
+func (b *Builder) RepairToolArgs(enabled bool) *Builder {
+	b.inner.config.RepairToolArgs = enabled
+	return b
+}
+
+// InjectToolManual 设置是否将工具手册追加到系统提示词
+//
+// 默认注入，帮助不擅长工具调用的模型了解可用工具；原生支持工具调用的模型可关闭以节省 token。
+// 关闭后工具 Schema 仍会发送给 Provider。
+func (b *Builder) InjectToolManual(enabled bool) *Builder {
+	b.inner.config.InjectToolManual = &enabled
+	return b
+}
+
+// ForceToolSchemas 设置是否始终发送工具 Schema
+//
+// 默认 Provider 实现 CapabilityReporter 且声明模型不支持工具调用时，只注入工具手册而不发送 Schema；
+// 能力声明不准确时可开启以强制发送。
+func (b *Builder) ForceToolSchemas(enabled bool) *Builder {
+	b.inner.config.ForceToolSchemas = enabled
+	return b
+}
+
+// ToolManualHeader 设置工具手册标题
+//
+// 默认为 DefaultToolManualHeader。系统提示词已包含该标题时不再注入，
+// 便于在提示词中手写工具说明。
+func (b *Builder) ToolManualHeader(header string) *Builder {
+	b.inner.config.ToolManualHeader = header
+	return b
+}
+
+// ToolManualTemplate 设置工具手册正文模板
+//
+// 模板使用 text/template 语法，数据为 ToolManualData，渲染结果追加在标题之后。
+//
+// 使用示例：
+//
+//	ag, _ := agent.New().
+//	    ToolManualHeader("### 工具手册").
+//	    ToolManualTemplate("可用工具：\n{{range .Tools}}\n- {{.Name}}：{{.Description}}{{end}}").
+//	    Build()
+func (b *Builder) ToolManualTemplate(tmpl string) *Builder {
+	if _, err := parseToolManualTemplate(tmpl); err != nil {
+		b.errs = append(b.errs, err)
+		return b
+	}
+	b.inner.config.ToolManualTemplate = tmpl
+	return b
+}
+
+// ToolResultMessageBuilder 设置工具结果转换为对话消息的方式
+//
+// 默认所有结果合并为一条 RoleUser 消息；严格的 Provider 协议可能要求每个结果单独成消息。
+// 返回的消息须保留全部 ToolUseID，否则回退到默认方式。
+//
+// 使用示例：
+//
+//	// 每个工具结果单独一条消息
+//	ag, err := agent.New().
+//	    ToolResultMessageBuilder(func(results []llm.ContentBlock) []llm.Message {
+//	        msgs := make([]llm.Message, 0, len(results))
+//	        for _, r := range results {
+//	            msgs = append(msgs, llm.Message{Role: llm.RoleTool, ContentBlocks: []llm.ContentBlock{r}})
+//	        }
+//	        return msgs
+//	    }).
+//	    Build()
+func (b *Builder) ToolResultMessageBuilder(fn ToolResultMessageFunc) *Builder {
+	b.inner.toolResultMessageFunc = fn
+	return b
+}
+
+// ToolResultRole 设置承载工具结果的消息角色
+//
+// 默认工具结果以 RoleUser 消息发送；部分本地部署的模型拒绝该格式，可改为 llm.RoleTool。
+// 仅支持 llm.RoleUser 和 llm.RoleTool，其他值在 Build 时报错。
+// 设置 ToolResultMessageBuilder 时以自定义函数返回的角色为准。
+func (b *Builder) ToolResultRole(role llm.Role) *Builder {
+	b.inner.config.ToolResultRole = role
+	return b
+}
+
+// PricingTable 设置模型价格表（模型名 → 每百万 token 单价）
+//
+// 每次执行结束时，EventTypeUsage 事件按价格表估算费用；未设置或模型不在表中时费用为 0。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    PricingTable(map[string]agent.ModelPrice{
+//	        "gpt-4o": {Input: 2.5, Output: 10},
+//	    }).
+//	    Build()
+func (b *Builder) PricingTable(table map[string]ModelPrice) *Builder {
+	b.inner.pricing = maps.Clone(table)
+	return b
+}
+
+// MaxSteps 设置单次执行的最大步数
+//
+// 模型持续发起工具调用时，超过 n 步后中止执行，
+// 发送 ErrMaxStepsExceeded 错误事件并返回部分结果。0 表示不限制，默认 25。
+func (b *Builder) MaxSteps(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("maxSteps must be non-negative"))
+		return b
+	}
+	b.inner.config.MaxSteps = n
+	return b
+}
+
+// MaxConsecutiveToolErrors 设置连续工具失败步数上限
+//
+// 当连续超过 n 个步骤中所有工具调用都失败时，中止执行并返回 ErrTooManyToolErrors。
+// 任意一次工具调用成功或模型给出文本回复都会重置计数。0 表示不限制。
+func (b *Builder) MaxConsecutiveToolErrors(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("maxConsecutiveToolErrors must be non-negative"))
+		return b
+	}
+	b.inner.config.MaxConsecutiveToolErrors = n
+	return b
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // MCP 服务器配置
 // ═══════════════════════════════════════════════════════════════════════════
@@ -262,18 +873,250 @@ func (b *Builder) Provider(p llm.Provider) *Builder {
 	return b
 }
 
+// ProviderPool 使用 Provider 池作为 Provider（按加权轮询分配每次调用）
+//
+// 等价于 Provider(pool)，池由 Agent 持有，Close 时关闭全部成员。
+func (b *Builder) ProviderPool(pool *ProviderPool) *Builder {
+	if pool == nil {
+		b.errs = append(b.errs, errors.New("provider pool is nil"))
+		return b
+	}
+	b.inner.provider = pool
+	return b
+}
+
+// HTTPClient 设置自动创建 Provider 时使用的 HTTP 客户端
+//
+// 用于自定义超时、代理、连接池或注入带链路追踪的 Transport。作用于根据 LLM 配置
+// 自动创建的主 Provider 和降级 Provider；通过 Provider() 直接传入的 Provider 自行管理传输层。
+// 创建出的 Provider 需实现 HTTPClientSetter，否则 Build 返回错误，避免客户端被静默忽略。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Model("gpt-4o").
+//	    HTTPClient(&http.Client{
+//	        Timeout:   60 * time.Second,
+//	        Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+//	    }).
+//	    Build()
+func (b *Builder) HTTPClient(client *http.Client) *Builder {
+	b.inner.httpClient = client
+	return b
+}
+
+// Fallbacks 添加备用 Provider
+//
+// 主 Provider 重试后仍因超时、限流、5xx 等可用性错误失败时，按顺序改用备用 Provider 完成本次调用，
+// 下一次调用重新从主 Provider 开始。提供响应的 Provider 序号记录在
+// Result.Metadata["provider_index"] 中（0 为主 Provider）。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Provider(openaiProvider).
+//	    Fallbacks(anthropicProvider, openrouterProvider).
+//	    Build()
+func (b *Builder) Fallbacks(providers ...llm.Provider) *Builder {
+	b.inner.fallbacks = append(b.inner.fallbacks, providers...)
+	return b
+}
+
+// BaseContext 设置 Agent 生命周期的父 context
+//
+// ctx 取消时，进行中的执行被中断，Agent 自动关闭并拒绝新的 Run。
+//
+// 使用示例：
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+//	defer stop()
+//	ag, err := agent.New().BaseContext(ctx).Build()
+func (b *Builder) BaseContext(ctx context.Context) *Builder {
+	if ctx == nil {
+		b.errs = append(b.errs, errors.New("base context must not be nil"))
+		return b
+	}
+	b.inner.baseCtx = ctx
+	return b
+}
+
 // Logger 设置日志器
 func (b *Builder) Logger(logger *slog.Logger) *Builder {
 	b.inner.logger = logger
 	return b
 }
 
+// Hooks 设置生命周期钩子（OnStep、OnToolCall、OnToolResult、OnError、OnStateChange）
+func (b *Builder) Hooks(h Hooks) *Builder {
+	b.inner.hooks = h
+	return b
+}
+
+// OnStateChange 设置 Agent 状态变化回调（等价于设置 Hooks.OnStateChange）
+//
+// 回调在锁外调用，可以在其中查询 Status()，适合向界面推送实时状态而无需轮询。
+// 之后调用 Hooks 会整体替换钩子，需要同时使用时先调用 Hooks。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    OnStateChange(func(from, to agent.State) {
+//	        dashboard.Push(string(to))
+//	    }).
+//	    Build()
+func (b *Builder) OnStateChange(fn func(from, to State)) *Builder {
+	b.inner.hooks.OnStateChange = fn
+	return b
+}
+
+// Metrics 设置指标收集器，用于接入 Prometheus 等监控系统
+func (b *Builder) Metrics(m Metrics) *Builder {
+	b.inner.metrics = m
+	return b
+}
+
+// Tracer 设置链路追踪器（如 OpenTelemetry 适配器，见 Tracer 接口文档）
+func (b *Builder) Tracer(t Tracer) *Builder {
+	b.inner.tracer = t
+	return b
+}
+
+// ApproveToolCall 设置工具调用审批函数（人工确认）
+//
+// 每个工具执行前调用 fn：返回 false 时跳过执行并告知模型调用被拒绝；返回 error 时中止本次执行。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Tools(shellTool).
+//	    ApproveToolCall(func(ctx context.Context, call *llm.ToolCall) (bool, error) {
+//	        fmt.Printf("Run %s %v? [y/N] ", call.Name, call.Input)
+//	        answer, err := stdin.ReadString('\n')
+//	        return strings.TrimSpace(answer) == "y", err
+//	    }).
+//	    Build()
+func (b *Builder) ApproveToolCall(fn ToolApprovalFunc) *Builder {
+	b.inner.toolApproval = fn
+	return b
+}
+
+// Redactor 设置工具结果脱敏函数
+//
+// fn 作用于工具结果的日志预览、ToolResult 事件和 OnToolResult 钩子，
+// 发送给模型的工具结果保持原样，模型仍能基于真实数据工作。
+//
+// 使用示例：
+//
+//	cardNumber := regexp.MustCompile(`\b\d{4}(?:[ -]?\d{4}){3}\b`)
+//	ag, err := agent.New().
+//	    Tools(paymentTool).
+//	    Redactor(func(s string) string {
+//	        return cardNumber.ReplaceAllString(s, "[CARD]")
+//	    }).
+//	    Build()
+func (b *Builder) Redactor(fn Redactor) *Builder {
+	b.inner.redactor = fn
+	return b
+}
+
+// ToolErrorFormatter 设置工具执行失败时反馈给模型的内容格式化函数
+//
+// 默认内容为 "Error: <err>"。fn 只影响工具执行本身失败的情况，
+// 审批拒绝、未允许的工具等由 Agent 生成的反馈保持不变。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Tools(queryTool).
+//	    ToolErrorFormatter(func(name string, err error) string {
+//	        return fmt.Sprintf("Tool %s failed: %v. Check the arguments against the schema and try again.", name, err)
+//	    }).
+//	    Build()
+func (b *Builder) ToolErrorFormatter(fn ToolErrorFormatter) *Builder {
+	b.inner.toolErrorFormatter = fn
+	return b
+}
+
+// AnswerValidator 设置最终答案校验函数
+//
+// 在返回结果前校验最终答案（如非空、匹配正则、通过业务检查）。
+// 校验失败时把失败原因反馈给模型重新生成，最多 AnswerRetries 次；
+// 重试耗尽后返回 ErrAnswerRejected（可用 errors.Is 与 Provider 错误区分）。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    AnswerValidator(func(ctx context.Context, text string) error {
+//	        if !strings.Contains(text, "结论") {
+//	            return errors.New("missing conclusion")
+//	        }
+//	        return nil
+//	    }).
+//	    AnswerRetries(2).
+//	    Build()
+func (b *Builder) AnswerValidator(fn AnswerValidator) *Builder {
+	b.inner.answerValidator = fn
+	return b
+}
+
+// AnswerRetries 设置答案校验失败后的最大重试次数（0 表示不重试）
+func (b *Builder) AnswerRetries(n int) *Builder {
+	if n < 0 {
+		b.errs = append(b.errs, errors.New("answerRetries must be non-negative"))
+		return b
+	}
+	b.inner.config.AnswerRetries = n
+	return b
+}
+
+// Use 添加 Provider 调用中间件
+//
+// 中间件包装每一次 LLM 调用（流式与非流式），先添加的在最外层。
+// 可用于日志、请求改写，或直接返回缓存的响应（短路）。
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Use(loggingMiddleware, cachingMiddleware).
+//	    Build()
+func (b *Builder) Use(mw ...ProviderMiddleware) *Builder {
+	b.inner.middlewares = append(b.inner.middlewares, mw...)
+	return b
+}
+
+// TransformEvents 添加事件转换器
+//
+// 事件发送给调用方之前依次经过各转换器，返回 nil 丢弃事件。
+// 适合实时脱敏、翻译文本或聚合工具结果，无需改动执行循环。
+//
+// 使用示例：
+//
+//	// 屏蔽文本中的手机号
+//	ag, err := agent.New().
+//	    TransformEvents(func(e *agent.AgentEvent) *agent.AgentEvent {
+//	        if e.Type == llm.EventTypeText {
+//	            e.Text = phonePattern.ReplaceAllString(e.Text, "***")
+//	        }
+//	        return e
+//	    }).
+//	    Build()
+func (b *Builder) TransformEvents(fns ...EventTransformer) *Builder {
+	b.inner.eventTransformers = append(b.inner.eventTransformers, fns...)
+	return b
+}
+
 // RetryConfig 设置重试配置
 func (b *Builder) RetryConfig(cfg *RetryConfig) *Builder {
 	b.inner.retryConfig = cfg
 	return b
 }
 
+// RetryClassifier 设置自定义的可重试错误判断函数（替代 IsRetriable 的默认判断）
+func (b *Builder) RetryClassifier(fn RetryClassifier) *Builder {
+	b.inner.retryClassifier = fn
+	return b
+}
+
 // MaxRetries 设置最大重试次数（便捷方法）
 func (b *Builder) MaxRetries(maxRetries int) *Builder {
 	if b.inner.retryConfig == nil {
@@ -283,6 +1126,15 @@ func (b *Builder) MaxRetries(maxRetries int) *Builder {
 	return b
 }
 
+// MaxTotalRetries 设置单次执行的重试总数上限（便捷方法，0 表示不限制）
+func (b *Builder) MaxTotalRetries(maxTotalRetries int) *Builder {
+	if b.inner.retryConfig == nil {
+		b.inner.retryConfig = DefaultRetryConfig()
+	}
+	b.inner.retryConfig.MaxTotalRetries = maxTotalRetries
+	return b
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 配置加载
 // ═══════════════════════════════════════════════════════════════════════════
@@ -346,6 +1198,45 @@ func (b *Builder) FromFile(path string) *Builder {
 	return b
 }
 
+// FromJSON 从 JSON 字符串加载配置
+//
+// 支持与配置文件相同的模板语法，适合内嵌默认配置或从远程配置中心获取的配置。
+//
+// 示例：
+//
+//	ag, err := agent.New().
+//	    FromJSON(`{"name": "assistant", "llm": {"model": "gpt-4o"}}`).
+//	    Build()
+func (b *Builder) FromJSON(s string) *Builder {
+	cfg, err := ParseConfig(s, "json")
+	if err != nil {
+		b.errs = append(b.errs, fmt.Errorf("load JSON config: %w", err))
+		return b
+	}
+	b.applyConfig(cfg)
+	return b
+}
+
+// FromYAML 从 YAML 字符串加载配置
+//
+// 支持与配置文件相同的模板语法（如 {{ env "API_KEY" }}）。
+//
+// 示例：
+//
+//	//go:embed default.yaml
+//	var defaultYAML string
+//
+//	ag, err := agent.New().FromYAML(defaultYAML).Build()
+func (b *Builder) FromYAML(s string) *Builder {
+	cfg, err := ParseConfig(s, "yaml")
+	if err != nil {
+		b.errs = append(b.errs, fmt.Errorf("load YAML config: %w", err))
+		return b
+	}
+	b.applyConfig(cfg)
+	return b
+}
+
 // ToYAML 导出当前配置为 YAML 字节
 //
 // 使用 koanf tags 和 comment tags 生成带注释的 YAML。
@@ -363,6 +1254,9 @@ func (b *Builder) applyConfig(cfg *Config) {
 	if cfg.ID != "" {
 		b.inner.config.ID = cfg.ID
 	}
+	if cfg.DeterministicID {
+		b.inner.config.DeterministicID = true
+	}
 	if cfg.Name != "" {
 		b.inner.config.Name = cfg.Name
 	}
@@ -398,15 +1292,126 @@ func (b *Builder) applyConfig(cfg *Config) {
 	if cfg.MaxTokens > 0 {
 		b.inner.config.MaxTokens = cfg.MaxTokens
 	}
+	if cfg.ContextWindow > 0 {
+		b.inner.config.ContextWindow = cfg.ContextWindow
+	}
+	if cfg.ContextWarningThreshold > 0 {
+		b.inner.config.ContextWarningThreshold = cfg.ContextWarningThreshold
+	}
+	if cfg.CompactThreshold > 0 {
+		b.inner.config.CompactThreshold = cfg.CompactThreshold
+	}
+	if cfg.MaxHistoryMessages > 0 {
+		b.inner.config.MaxHistoryMessages = cfg.MaxHistoryMessages
+	}
+	if cfg.Temperature != nil {
+		b.inner.config.Temperature = cloneFloat(cfg.Temperature)
+	}
+	if cfg.TopP != nil {
+		b.inner.config.TopP = cloneFloat(cfg.TopP)
+	}
+	if cfg.Seed != nil {
+		b.inner.config.Seed = cloneInt(cfg.Seed)
+	}
+	if len(cfg.StopSequences) > 0 {
+		b.inner.config.StopSequences = cfg.StopSequences
+	}
+	if len(cfg.Examples) > 0 {
+		b.inner.config.Examples = cfg.Examples
+	}
+	if cfg.DowngradeModel != "" {
+		b.inner.config.DowngradeModel = cfg.DowngradeModel
+	}
+	if cfg.DowngradeThreshold > 0 {
+		b.inner.config.DowngradeThreshold = cfg.DowngradeThreshold
+	}
 	if cfg.SystemPrompt != "" {
 		b.inner.config.SystemPrompt = cfg.SystemPrompt
 	}
+	if cfg.SystemTemplate != "" {
+		b.inner.config.SystemTemplate = cfg.SystemTemplate
+	}
+	if len(cfg.SystemSegments) > 0 {
+		b.inner.config.SystemSegments = append(b.inner.config.SystemSegments, cfg.SystemSegments...)
+	}
 	if cfg.WorkDir != "" {
 		b.inner.config.WorkDir = cfg.WorkDir
 	}
+	if cfg.AllowEmptyInput {
+		b.inner.config.AllowEmptyInput = true
+	}
+	if cfg.Stateless {
+		b.inner.config.Stateless = true
+	}
+	if cfg.AnswerRetries > 0 {
+		b.inner.config.AnswerRetries = cfg.AnswerRetries
+	}
+	if cfg.RepairToolArgs {
+		b.inner.config.RepairToolArgs = true
+	}
+	if cfg.AuditMode {
+		b.inner.config.AuditMode = true
+	}
+	if cfg.LogPrompts {
+		b.inner.config.LogPrompts = true
+	}
+	if cfg.HashPromptContent {
+		b.inner.config.HashPromptContent = true
+	}
+	if cfg.CaptureReasoning {
+		b.inner.config.CaptureReasoning = true
+	}
 	if len(cfg.Tools) > 0 {
 		b.inner.config.Tools = cfg.Tools
 	}
+	if len(cfg.AllowedTools) > 0 {
+		b.inner.config.AllowedTools = cfg.AllowedTools
+	}
+	if len(cfg.DeniedTools) > 0 {
+		b.inner.config.DeniedTools = cfg.DeniedTools
+	}
+	if len(cfg.CacheableTools) > 0 {
+		b.inner.config.CacheableTools = cfg.CacheableTools
+	}
+	if cfg.ToolResultRole != "" {
+		b.inner.config.ToolResultRole = cfg.ToolResultRole
+	}
+	if cfg.ForceToolSchemas {
+		b.inner.config.ForceToolSchemas = true
+	}
+	if cfg.InjectToolManual != nil {
+		b.inner.config.InjectToolManual = cloneBool(cfg.InjectToolManual)
+	}
+	if cfg.ToolManualHeader != "" {
+		b.inner.config.ToolManualHeader = cfg.ToolManualHeader
+	}
+	if cfg.ToolManualTemplate != "" {
+		b.inner.config.ToolManualTemplate = cfg.ToolManualTemplate
+	}
+	if cfg.MaxSteps > 0 {
+		b.inner.config.MaxSteps = cfg.MaxSteps
+	}
+	if cfg.ParallelTools {
+		b.inner.config.ParallelTools = true
+	}
+	if cfg.MaxParallelTools > 0 {
+		b.inner.config.MaxParallelTools = cfg.MaxParallelTools
+	}
+	if cfg.MaxToolCallsPerStep > 0 {
+		b.inner.config.MaxToolCallsPerStep = cfg.MaxToolCallsPerStep
+	}
+	if cfg.MaxToolResultBytes > 0 {
+		b.inner.config.MaxToolResultBytes = cfg.MaxToolResultBytes
+	}
+	if cfg.FullToolResultEvents {
+		b.inner.config.FullToolResultEvents = true
+	}
+	if cfg.EventBufferSize != nil {
+		b.inner.config.EventBufferSize = cloneInt(cfg.EventBufferSize)
+	}
+	if cfg.MaxConsecutiveToolErrors > 0 {
+		b.inner.config.MaxConsecutiveToolErrors = cfg.MaxConsecutiveToolErrors
+	}
 	if len(cfg.Metadata) > 0 {
 		b.inner.config.Metadata = cfg.Metadata
 	}
@@ -475,6 +1480,23 @@ func (b *Builder) Run(ctx context.Context, text string, opts ...RunOption) <-cha
 	return b.agent.Run(ctx, text, opts...)
 }
 
+// RunWith 以任意内容块（如文本加图片）作为用户消息执行对话，返回事件流
+//
+// 自动构建 Agent 并执行，见 Agent.RunWith。
+func (b *Builder) RunWith(ctx context.Context, blocks []llm.ContentBlock, opts ...RunOption) <-chan *AgentEvent {
+	if err := b.ensureBuilt(); err != nil {
+		errCh := make(chan *AgentEvent, 1)
+		errCh <- &AgentEvent{
+			Type:  llm.EventTypeError,
+			Error: err,
+		}
+		close(errCh)
+		return errCh
+	}
+
+	return b.agent.RunWith(ctx, blocks, opts...)
+}
+
 // Close 释放资源
 //
 // 仅当使用了 Chat() 或 Run() 方法时需要调用。
@@ -514,6 +1536,23 @@ func (b *Builder) Build() (*Agent, error) {
 	return b.agent, nil
 }
 
+// Validate 校验 Builder 的配置（不构建 Agent）
+//
+// 返回链式调用中收集的错误与 ValidateConfig 的结果（errors.Join 合并）。
+// 不创建 Provider、不连接 MCP 服务器，无副作用，可多次调用，
+// 适合在配置界面中提前展示用户输入的错误。
+//
+// 使用示例:
+//
+//	if err := agent.New().Model(model).APIKey(key).MaxTokens(n).Validate(); err != nil {
+//	    showErrors(err)
+//	}
+func (b *Builder) Validate() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.validate()
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 内部构建逻辑
 // ═══════════════════════════════════════════════════════════════════════════
@@ -528,9 +1567,9 @@ func (b *Builder) ensureBuilt() error {
 		return nil
 	}
 
-	// 检查收集的错误
-	if len(b.errs) > 0 {
-		return errors.Join(b.errs...)
+	// 检查收集的错误和配置
+	if err := b.validate(); err != nil {
+		return err
 	}
 
 	// 构建 Agent
@@ -544,6 +1583,17 @@ func (b *Builder) ensureBuilt() error {
 	return nil
 }
 
+// validate 合并收集的错误与配置校验结果（调用方需持有 b.mu）
+//
+// 已注入 Provider 时跳过 LLM 连接配置检查。
+func (b *Builder) validate() error {
+	errs := append([]error(nil), b.errs...)
+	if err := validateConfig(b.inner.config, b.inner.provider == nil); err != nil {
+		errs = append(errs, fmt.Errorf("invalid config: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
 // buildAgent 内部构建方法（直接复用 newAgentFromBuilder）
 func (b *Builder) buildAgent() (*Agent, error) {
 	return newAgentFromBuilder(b.inner)
@@ -3,10 +3,13 @@ package agent
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
 )
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -163,6 +166,62 @@ func TestBuilder_ErrorCollection(t *testing.T) {
 			t.Errorf("Errors should be consistent:\n  First: %v\n  Second: %v", err1, err2)
 		}
 	})
+
+	t.Run("should_validate_config_before_creating_provider", func(t *testing.T) {
+		_, err := New().Model("").APIKey("").Build()
+		if err == nil {
+			t.Fatal("Build() should fail without model and api key")
+		}
+		for _, want := range []string{"invalid config", "llm.model is required", "llm.api-key is required"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q should contain %q", err, want)
+			}
+		}
+	})
+
+	t.Run("should_skip_llm_checks_with_provider", func(t *testing.T) {
+		ag, err := New().Model("").APIKey("").Provider(mock.New()).Build()
+		if err != nil {
+			t.Fatalf("Build() with injected provider should succeed: %v", err)
+		}
+		_ = ag.Close()
+	})
+}
+
+// TestBuilder_Validate 测试仅校验不构建
+func TestBuilder_Validate(t *testing.T) {
+	t.Run("valid_config", func(t *testing.T) {
+		builder := New().Model("test-model").APIKey("test-key")
+		if err := builder.Validate(); err != nil {
+			t.Fatalf("Validate() unexpected error: %v", err)
+		}
+		if builder.built || builder.agent != nil {
+			t.Error("Validate() should not build the agent")
+		}
+	})
+
+	t.Run("joins_collected_and_config_errors", func(t *testing.T) {
+		builder := New().Model("").APIKey("test-key").MaxTokens(-1).MaxSteps(-1)
+
+		err1 := builder.Validate()
+		if err1 == nil {
+			t.Fatal("Validate() should fail")
+		}
+		for _, want := range []string{"maxTokens must be positive", "maxSteps must be non-negative", "llm.model is required"} {
+			if !strings.Contains(err1.Error(), want) {
+				t.Errorf("error %q should contain %q", err1, want)
+			}
+		}
+
+		// 可多次调用，结果一致
+		err2 := builder.Validate()
+		if err2 == nil || err1.Error() != err2.Error() {
+			t.Errorf("Errors should be consistent:\n  First: %v\n  Second: %v", err1, err2)
+		}
+		if builder.built {
+			t.Error("Validate() should not build the agent")
+		}
+	})
 }
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -170,6 +229,79 @@ func TestBuilder_ErrorCollection(t *testing.T) {
 // ═══════════════════════════════════════════════════════════════════════════
 
 // TestBuilder_ConcurrentBuild 测试并发构建的线程安全性
+// TestBuilder_DeterministicID 测试根据配置派生稳定 ID
+func TestBuilder_DeterministicID(t *testing.T) {
+	build := func(b *Builder) *Agent {
+		ag, err := b.Provider(mock.New()).DeterministicID(true).Build()
+		if err != nil {
+			t.Fatalf("Build() failed: %v", err)
+		}
+		t.Cleanup(func() { _ = ag.Close() })
+		return ag
+	}
+
+	first := build(New().Name("assistant").System("hi"))
+	if second := build(New().Name("assistant").System("hi")); first.ID() != second.ID() {
+		t.Errorf("same config should derive the same ID: %s != %s", first.ID(), second.ID())
+	}
+	if other := build(New().Name("assistant").System("bye")); first.ID() == other.ID() {
+		t.Error("different prompts should derive different IDs")
+	}
+
+	// 显式 ID 优先
+	if ag := build(New().ID("fixed")); ag.ID() != "fixed" {
+		t.Errorf("explicit ID should win, got %s", ag.ID())
+	}
+
+	// 分叉的 Agent 使用新的随机 ID
+	forked, err := first.Fork(WithProvider(mock.New()))
+	if err != nil {
+		t.Fatalf("Fork() failed: %v", err)
+	}
+	defer func() { _ = forked.Close() }()
+	if forked.ID() == first.ID() {
+		t.Error("forked agent should not reuse the derived ID")
+	}
+}
+
+func TestBuilder_IDGenerator(t *testing.T) {
+	var n atomic.Int32
+	gen := func() string { return fmt.Sprintf("tenant-%d", n.Add(1)) }
+
+	ag, err := New().Provider(mock.New()).IDGenerator(gen).Build()
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	defer func() { _ = ag.Close() }()
+	if ag.ID() != "tenant-1" {
+		t.Errorf("ID() = %s, want tenant-1", ag.ID())
+	}
+
+	// 分叉的 Agent 沿用生成函数
+	forked, err := ag.Fork(WithProvider(mock.New()))
+	if err != nil {
+		t.Fatalf("Fork() failed: %v", err)
+	}
+	defer func() { _ = forked.Close() }()
+	if forked.ID() != "tenant-2" {
+		t.Errorf("forked ID() = %s, want tenant-2", forked.ID())
+	}
+
+	// 显式 ID 优先
+	fixed, err := New().Provider(mock.New()).IDGenerator(gen).ID("fixed").Build()
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	defer func() { _ = fixed.Close() }()
+	if fixed.ID() != "fixed" {
+		t.Errorf("explicit ID should win, got %s", fixed.ID())
+	}
+
+	if _, err := New().Provider(mock.New()).IDGenerator(func() string { return "" }).Build(); err == nil {
+		t.Error("empty generated ID should fail Build()")
+	}
+}
+
 func TestBuilder_ConcurrentBuild(t *testing.T) {
 	t.Run("concurrent_Build_should_be_safe", func(t *testing.T) {
 		builder := New().
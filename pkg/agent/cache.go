@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 响应缓存
+// ═══════════════════════════════════════════════════════════════════════════
+
+// CacheStore 响应缓存存储
+//
+// 实现需要并发安全。返回的响应会被 Agent 直接使用，存储方不应再修改。
+type CacheStore interface {
+	Get(key string) (*llm.Response, bool)
+	Set(key string, resp *llm.Response)
+}
+
+// NewCacheMiddleware 创建响应缓存中间件
+//
+// 以消息历史、模型和调用选项（含 temperature、tools 等）的稳定哈希为键，
+// 命中时直接返回缓存的响应，不再请求 Provider。适合开发调试和测试回放。
+//
+// 注意：
+//   - 仅缓存非流式调用，流式调用直接透传（不读也不写缓存）
+//   - 调用失败不会写入缓存
+//
+// 使用示例：
+//
+//	ag, err := agent.New().
+//	    Use(agent.NewCacheMiddleware(agent.NewLRUCache(256))).
+//	    Build()
+func NewCacheMiddleware(store CacheStore) ProviderMiddleware {
+	return func(next ProviderCallFunc) ProviderCallFunc {
+		return func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+			if IsStreamingCall(ctx) {
+				return next(ctx, messages, opts)
+			}
+
+			key, err := cacheKey(CallModel(ctx), messages, opts)
+			if err != nil {
+				return next(ctx, messages, opts)
+			}
+			if resp, ok := store.Get(key); ok {
+				return resp, nil
+			}
+
+			resp, err := next(ctx, messages, opts)
+			if err != nil {
+				return nil, err
+			}
+			store.Set(key, resp)
+			return resp, nil
+		}
+	}
+}
+
+// cacheKey 计算缓存键（SHA-256 十六进制）
+func cacheKey(model string, messages []llm.Message, opts *llm.Options) (string, error) {
+	data, err := json.Marshal(struct {
+		Model    string        `json:"model"`
+		Messages []llm.Message `json:"messages"`
+		Options  *llm.Options  `json:"options"`
+	}{model, messages, opts})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// LRU 缓存实现
+// ═══════════════════════════════════════════════════════════════════════════
+
+// LRUCache 内存 LRU 缓存（并发安全）
+type LRUCache struct {
+	lru *lru[*llm.Response]
+}
+
+// NewLRUCache 创建 LRU 缓存，capacity 为最大条目数（小于 1 时按 1 处理）
+func NewLRUCache(capacity int) *LRUCache {
+	return &LRUCache{lru: newLRU[*llm.Response](capacity)}
+}
+
+// Get 获取缓存并标记为最近使用
+func (c *LRUCache) Get(key string) (*llm.Response, bool) {
+	return c.lru.get(key)
+}
+
+// Set 写入缓存，超出容量时淘汰最久未使用的条目
+func (c *LRUCache) Set(key string, resp *llm.Response) {
+	c.lru.set(key, resp)
+}
+
+// Len 返回当前条目数
+func (c *LRUCache) Len() int {
+	return c.lru.len()
+}
+
+// lru 泛型 LRU 存储（并发安全），供响应缓存和工具结果缓存共用
+type lru[V any] struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+// lruEntry LRU 缓存条目
+type lruEntry[V any] struct {
+	key   string
+	value V
+}
+
+// newLRU 创建 LRU 存储（capacity 小于 1 时按 1 处理）
+func newLRU[V any](capacity int) *lru[V] {
+	return &lru[V]{
+		capacity: max(capacity, 1),
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get 获取条目并标记为最近使用
+func (c *lru[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry[V]).value, true
+}
+
+// set 写入条目，超出容量时淘汰最久未使用的条目
+func (c *lru[V]) set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lruEntry[V]).value = value
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value})
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// len 返回当前条目数
+func (c *lru[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
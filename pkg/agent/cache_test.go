@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Cache Middleware Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestCacheMiddleware(t *testing.T) {
+	t.Run("hit_skips_provider", func(t *testing.T) {
+		store := NewLRUCache(16)
+		provider := mock.New(mock.WithResponse("ok"))
+
+		// 两个独立 Agent 共享缓存，相同的请求只调用一次 Provider
+		for range 2 {
+			ag := newTestAgent(t, provider, WithMiddleware(NewCacheMiddleware(store)))
+			result, err := ag.Chat(context.Background(), "Hello")
+			require.NoError(t, err)
+			assert.Equal(t, "ok", result.Text)
+		}
+
+		assert.Equal(t, 1, provider.CallCount())
+		assert.Equal(t, 1, store.Len())
+	})
+
+	t.Run("key_includes_model_and_temperature", func(t *testing.T) {
+		store := NewLRUCache(16)
+		provider := mock.New(mock.WithResponse("ok"))
+
+		for _, opts := range [][]Option{
+			{WithModel("a")},
+			{WithModel("b")},
+			{WithModel("b"), WithTemperature(0)},
+		} {
+			ag := newTestAgent(t, provider, append(opts, WithMiddleware(NewCacheMiddleware(store)))...)
+			_, err := ag.Chat(context.Background(), "Hello")
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 3, provider.CallCount())
+	})
+
+	t.Run("streaming_bypasses_cache", func(t *testing.T) {
+		store := NewLRUCache(16)
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithMiddleware(NewCacheMiddleware(store)))
+
+		for event := range ag.Run(context.Background(), "Hello", WithStreaming(true)) {
+			require.NoError(t, event.Error)
+		}
+
+		assert.Equal(t, 0, store.Len())
+	})
+}
+
+func TestCacheKey_Stable(t *testing.T) {
+	msgs := []llm.Message{{Role: llm.RoleUser, Content: "hi"}}
+	opts := &llm.Options{Temperature: 0.5}
+
+	k1, err := cacheKey("m", msgs, opts)
+	require.NoError(t, err)
+	k2, err := cacheKey("m", msgs, &llm.Options{Temperature: 0.5})
+	require.NoError(t, err)
+	k3, err := cacheKey("m", msgs, &llm.Options{Temperature: 0.6})
+	require.NoError(t, err)
+
+	assert.Equal(t, k1, k2)
+	assert.NotEqual(t, k1, k3)
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// LRUCache Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestLRUCache(t *testing.T) {
+	resp := func(text string) *llm.Response {
+		return &llm.Response{Message: llm.Message{Role: llm.RoleAssistant, Content: text}}
+	}
+
+	cache := NewLRUCache(2)
+	cache.Set("a", resp("A"))
+	cache.Set("b", resp("B"))
+
+	// 访问 a 后，b 成为最久未使用
+	_, ok := cache.Get("a")
+	require.True(t, ok)
+	cache.Set("c", resp("C"))
+
+	_, ok = cache.Get("b")
+	assert.False(t, ok, "b should be evicted")
+
+	got, ok := cache.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, "A", got.Message.Content)
+
+	// 覆盖已有键不增加条目
+	cache.Set("c", resp("C2"))
+	got, _ = cache.Get("c")
+	assert.Equal(t, "C2", got.Message.Content)
+	assert.Equal(t, 2, cache.Len())
+}
+
+func TestLRUCache_Concurrent(t *testing.T) {
+	cache := NewLRUCache(8)
+	done := make(chan struct{})
+
+	for w := range 4 {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := range 100 {
+				key := fmt.Sprintf("%d-%d", w, i%10)
+				cache.Set(key, &llm.Response{})
+				_, _ = cache.Get(key)
+			}
+		}()
+	}
+	for range 4 {
+		<-done
+	}
+
+	assert.LessOrEqual(t, cache.Len(), 8)
+}
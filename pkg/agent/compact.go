@@ -0,0 +1,230 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 上下文压缩
+// ═══════════════════════════════════════════════════════════════════════════
+
+// Compactor 对话历史压缩器
+//
+// 估算的上下文 token 数超过阈值时，Agent 在调用 Provider 前用 Compactor 替换会话历史。
+// 实现应保留最近的对话轮次，返回的消息将作为新的会话历史。
+// 设置 Compactor 后 MaxHistoryMessages 滑动窗口不再生效。
+type Compactor interface {
+	Compact(ctx context.Context, msgs []llm.Message) ([]llm.Message, error)
+}
+
+// defaultKeepRecent SummaryCompactor 默认保留的最近消息数
+const defaultKeepRecent = 6
+
+// compactThresholdRatio 未设置 CompactThreshold 时，按上下文窗口的该比例触发压缩
+const compactThresholdRatio = 0.8
+
+// defaultSummaryPrompt 默认摘要指令
+const defaultSummaryPrompt = "Summarize the following conversation so it can replace the original messages. " +
+	"Keep facts, decisions, user preferences, tool results and open tasks. Be concise."
+
+// summaryAck 摘要消息之后的助手确认，保持 user/assistant 交替
+const summaryAck = "Understood. I'll continue from this summary."
+
+// SummaryCompactor 内置的摘要压缩器
+//
+// 将较早的消息交给模型生成摘要，替换为一对 user/assistant 消息；
+// 开头的系统消息和最近 KeepRecent 条消息保持不变。
+// 切分点总是落在用户发起的新一轮对话上，不会拆开工具调用与工具结果。
+type SummaryCompactor struct {
+	Provider   llm.Provider // 用于生成摘要的 Provider（nil 表示使用 Agent 的 Provider）
+	KeepRecent int          // 保留的最近消息数（0 表示使用默认值 6）
+	Prompt     string       // 摘要指令（空表示使用默认指令）
+}
+
+// NewSummaryCompactor 创建使用 Agent 自身 Provider 的摘要压缩器
+func NewSummaryCompactor(keepRecent int) *SummaryCompactor {
+	return &SummaryCompactor{KeepRecent: keepRecent}
+}
+
+// Compact 实现 Compactor 接口
+func (c *SummaryCompactor) Compact(ctx context.Context, msgs []llm.Message) ([]llm.Message, error) {
+	return c.compact(ctx, c.Provider, msgs)
+}
+
+// compact 使用指定 Provider 压缩历史
+func (c *SummaryCompactor) compact(ctx context.Context, p llm.Provider, msgs []llm.Message) ([]llm.Message, error) {
+	if p == nil {
+		return nil, errors.New("summary compactor: no provider")
+	}
+
+	lead := 0
+	for lead < len(msgs) && msgs[lead].Role == llm.RoleSystem {
+		lead++
+	}
+	split := c.splitIndex(msgs, lead)
+	if split <= lead {
+		return msgs, nil
+	}
+
+	prompt := c.Prompt
+	if prompt == "" {
+		prompt = defaultSummaryPrompt
+	}
+	resp, err := p.Complete(ctx, []llm.Message{{
+		Role:    llm.RoleUser,
+		Content: prompt + "\n\n" + renderTranscript(msgs[lead:split]),
+	}}, &llm.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("summarize history: %w", err)
+	}
+
+	compacted := make([]llm.Message, 0, lead+2+len(msgs)-split)
+	compacted = append(compacted, msgs[:lead]...)
+	compacted = append(compacted,
+		llm.Message{Role: llm.RoleUser, Content: "Summary of the earlier conversation:\n\n" + resp.Message.GetContent()},
+		llm.Message{Role: llm.RoleAssistant, Content: summaryAck},
+	)
+	compacted = append(compacted, msgs[split:]...)
+	return compacted, nil
+}
+
+// splitIndex 计算保留部分的起始位置：不少于 KeepRecent 条，且从用户发起的一轮开始
+func (c *SummaryCompactor) splitIndex(msgs []llm.Message, lead int) int {
+	keep := c.KeepRecent
+	if keep <= 0 {
+		keep = defaultKeepRecent
+	}
+
+	split := len(msgs) - keep
+	for split > lead && !isTurnStart(msgs[split]) {
+		split--
+	}
+	return split
+}
+
+// isTurnStart 判断消息是否为用户发起的新一轮（而非工具结果）
+func isTurnStart(msg llm.Message) bool {
+	return msg.Role == llm.RoleUser && len(msg.GetToolResults()) == 0
+}
+
+// renderTranscript 将消息渲染为供摘要使用的纯文本
+func renderTranscript(msgs []llm.Message) string {
+	var sb strings.Builder
+	for i := range msgs {
+		msg := &msgs[i]
+		if text := msg.GetContent(); text != "" {
+			fmt.Fprintf(&sb, "%s: %s\n", msg.Role, text)
+		}
+		for _, tc := range msg.GetToolCalls() {
+			args, _ := json.Marshal(tc.Input)
+			fmt.Fprintf(&sb, "%s: [call %s %s]\n", msg.Role, tc.Name, args)
+		}
+		for _, tr := range msg.GetToolResults() {
+			fmt.Fprintf(&sb, "tool: %s\n", truncateString(tr.Content, 2000))
+		}
+	}
+	return sb.String()
+}
+
+// trimHistory 按 MaxHistoryMessages 截取发送给 Provider 的历史（滑动窗口）
+//
+// 保留开头的系统消息和最近的消息，窗口起点向后移动到用户发起的一轮，
+// 找不到时向前扩展，保证不拆开工具调用与工具结果。设置了 Compactor 时不截取。
+func (a *Agent) trimHistory(msgs []llm.Message) []llm.Message {
+	limit := a.config.MaxHistoryMessages
+	if limit <= 0 || a.compactor != nil {
+		return msgs
+	}
+
+	lead := 0
+	for lead < len(msgs) && msgs[lead].Role == llm.RoleSystem {
+		lead++
+	}
+	if len(msgs)-lead <= limit {
+		return msgs
+	}
+
+	start := len(msgs) - limit
+	for start < len(msgs) && !isTurnStart(msgs[start]) {
+		start++
+	}
+	if start == len(msgs) {
+		start = len(msgs) - limit
+		for start > lead && !isTurnStart(msgs[start]) {
+			start--
+		}
+	}
+	if start <= lead {
+		return msgs
+	}
+
+	trimmed := make([]llm.Message, 0, lead+len(msgs)-start)
+	trimmed = append(trimmed, msgs[:lead]...)
+	return append(trimmed, msgs[start:]...)
+}
+
+// compactThreshold 返回触发压缩的 token 阈值（0 表示不压缩）
+func (a *Agent) compactThreshold() int {
+	if a.config.CompactThreshold > 0 {
+		return a.config.CompactThreshold
+	}
+	return int(float64(a.config.ContextWindow) * compactThresholdRatio)
+}
+
+// maybeCompact 估算的上下文超过阈值时压缩会话历史
+//
+// 压缩失败只记录警告，继续使用完整历史；压缩期间历史被并发修改时放弃本次结果。
+func (a *Agent) maybeCompact(ctx context.Context, state *runState) {
+	threshold := a.compactThreshold()
+	if a.compactor == nil || threshold <= 0 {
+		return
+	}
+
+	history := a.snapshotHistory(state.threadID)
+	tokens := a.countTokens(history, &llm.Options{System: a.systemPrompt(state.options)})
+	if tokens < threshold {
+		return
+	}
+
+	var compacted []llm.Message
+	var err error
+	if sc, ok := a.compactor.(*SummaryCompactor); ok && sc.Provider == nil {
+		compacted, err = sc.compact(ctx, a.provider, history)
+	} else {
+		compacted, err = a.compactor.Compact(ctx, history)
+	}
+	if err != nil {
+		state.logger.Warn("history compaction failed", "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.historyLocked(state.threadID)) != len(history) {
+		state.logger.Warn("history changed during compaction, skipped")
+		return
+	}
+	if state.threadID == "" {
+		a.messages = compacted
+	} else {
+		a.threads[state.threadID] = compacted
+	}
+
+	// 本轮消息保持在历史末尾，按保留的数量重新定位起点
+	runCount := len(history) - state.startMsgIndex
+	state.startMsgIndex = max(0, len(compacted)-runCount)
+
+	state.logger.Info("history compacted",
+		"tokens", tokens,
+		"threshold", threshold,
+		"messages_before", len(history),
+		"messages_after", len(compacted),
+	)
+}
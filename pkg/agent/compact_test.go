@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Compactor Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// compactHistory 一段包含系统消息和工具调用的历史
+func compactHistory() []llm.Message {
+	return []llm.Message{
+		{Role: llm.RoleSystem, Content: "system"},
+		{Role: llm.RoleUser, Content: "u1"},
+		{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{
+			&llm.ToolCall{ID: "c1", Name: "echo", Input: map[string]any{"text": "x"}},
+		}},
+		{Role: llm.RoleUser, ContentBlocks: []llm.ContentBlock{
+			&llm.ToolResultBlock{ToolUseID: "c1", Content: `"x"`},
+		}},
+		{Role: llm.RoleAssistant, Content: "a1"},
+		{Role: llm.RoleUser, Content: "u2"},
+		{Role: llm.RoleAssistant, Content: "a2"},
+	}
+}
+
+func TestSummaryCompactor(t *testing.T) {
+	t.Run("summarizes_older_turns", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("earlier summary"))
+		c := &SummaryCompactor{Provider: provider, KeepRecent: 2}
+
+		got, err := c.Compact(context.Background(), compactHistory())
+		require.NoError(t, err)
+
+		require.Len(t, got, 5)
+		assert.Equal(t, "system", got[0].Content)
+		assert.Contains(t, got[1].Content, "earlier summary")
+		assert.Equal(t, llm.RoleAssistant, got[2].Role)
+		assert.Equal(t, "u2", got[3].Content)
+		assert.Equal(t, "a2", got[4].Content)
+
+		// 摘要请求包含被压缩的消息，不包含保留的消息
+		prompt := provider.LastCall().Messages[0].Content
+		assert.Contains(t, prompt, "user: u1")
+		assert.Contains(t, prompt, "[call echo")
+		assert.Contains(t, prompt, `tool: "x"`)
+		assert.NotContains(t, prompt, "u2")
+	})
+
+	t.Run("never_splits_tool_results", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("summary"))
+		// 保留 4 条时切分点落在工具结果上，应回退到 u1
+		c := &SummaryCompactor{Provider: provider, KeepRecent: 4}
+
+		got, err := c.Compact(context.Background(), compactHistory())
+		require.NoError(t, err)
+		assert.Equal(t, compactHistory(), got)
+		assert.Zero(t, provider.CallCount())
+	})
+
+	t.Run("requires_provider", func(t *testing.T) {
+		_, err := NewSummaryCompactor(2).Compact(context.Background(), compactHistory())
+		require.Error(t, err)
+	})
+}
+
+// stubCompactor 记录调用并返回固定结果
+type stubCompactor struct {
+	calls int
+	err   error
+}
+
+func (c *stubCompactor) Compact(_ context.Context, msgs []llm.Message) ([]llm.Message, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return msgs[len(msgs)-1:], nil
+}
+
+func TestAgent_Compaction(t *testing.T) {
+	long := strings.Repeat("word ", 200)
+
+	t.Run("summary_with_agent_provider", func(t *testing.T) {
+		provider := mock.New(mock.WithMessageFunc(func(msgs []llm.Message, _ int) llm.Message {
+			if strings.HasPrefix(msgs[0].Content, defaultSummaryPrompt) {
+				return llm.Message{Role: llm.RoleAssistant, Content: "summary"}
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "answer"}
+		}))
+		ag := newTestAgent(t, provider,
+			WithCompactor(NewSummaryCompactor(2)),
+			WithCompactThreshold(100),
+		)
+
+		for range 3 {
+			_, err := ag.Chat(context.Background(), long)
+			require.NoError(t, err)
+		}
+		result, err := ag.Chat(context.Background(), "last")
+		require.NoError(t, err)
+
+		history := ag.Messages()
+		assert.Contains(t, history[0].Content, "summary")
+		assert.Equal(t, "last", history[len(history)-2].GetContent())
+
+		// 本轮结果只包含本轮消息
+		require.Len(t, result.Messages, 2)
+		assert.Equal(t, "last", result.Messages[0].GetContent())
+		assert.Equal(t, "answer", result.Text)
+	})
+
+	t.Run("below_threshold_untouched", func(t *testing.T) {
+		c := &stubCompactor{}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithCompactor(c),
+			WithCompactThreshold(1_000_000),
+		)
+
+		_, err := ag.Chat(context.Background(), long)
+		require.NoError(t, err)
+		assert.Zero(t, c.calls)
+	})
+
+	t.Run("threshold_from_context_window", func(t *testing.T) {
+		c := &stubCompactor{}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithCompactor(c),
+			WithContextWindow(100),
+		)
+
+		_, err := ag.Chat(context.Background(), long)
+		require.NoError(t, err)
+		assert.Equal(t, 1, c.calls)
+	})
+
+	t.Run("failure_keeps_history", func(t *testing.T) {
+		c := &stubCompactor{err: errors.New("boom")}
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+			WithHistory([]llm.Message{{Role: llm.RoleUser, Content: long}, {Role: llm.RoleAssistant, Content: "ok"}}),
+			WithCompactor(c),
+			WithCompactThreshold(10),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, 1, c.calls)
+		assert.Len(t, ag.Messages(), 4)
+	})
+}
+
+func TestAgent_TrimHistory(t *testing.T) {
+	trim := func(limit int, compactor Compactor) []llm.Message {
+		a := &Agent{config: &Config{MaxHistoryMessages: limit}, compactor: compactor}
+		return a.trimHistory(compactHistory())
+	}
+
+	t.Run("keeps_system_and_recent_turn", func(t *testing.T) {
+		got := trim(2, nil)
+		require.Len(t, got, 3)
+		assert.Equal(t, "system", got[0].Content)
+		assert.Equal(t, "u2", got[1].Content)
+		assert.Equal(t, "a2", got[2].Content)
+	})
+
+	t.Run("moves_forward_past_tool_results", func(t *testing.T) {
+		// 最近 4 条从工具结果开始，窗口应前移到 u2
+		got := trim(4, nil)
+		require.Len(t, got, 3)
+		assert.Equal(t, "u2", got[1].Content)
+		for _, msg := range got {
+			assert.Empty(t, msg.GetToolResults())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Len(t, trim(0, nil), len(compactHistory()))
+		assert.Len(t, trim(100, nil), len(compactHistory()))
+	})
+
+	t.Run("compactor_takes_precedence", func(t *testing.T) {
+		assert.Len(t, trim(2, &stubCompactor{}), len(compactHistory()))
+	})
+
+	t.Run("full_history_kept_for_messages", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithMaxHistoryMessages(2))
+
+		for range 3 {
+			_, err := ag.Chat(context.Background(), "Hello")
+			require.NoError(t, err)
+		}
+
+		assert.Len(t, ag.Messages(), 6)
+		assert.Len(t, provider.LastCall().Messages, 1)
+	})
+}
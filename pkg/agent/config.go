@@ -2,12 +2,27 @@ package agent
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/parsers/yaml"
+	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/knadh/koanf/providers/structs"
+	"github.com/knadh/koanf/v2"
 	"github.com/lwmacct/251207-go-pkg-cfgm/pkg/cfgm"
+	"github.com/lwmacct/251207-go-pkg-cfgm/pkg/tmpl"
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 	"github.com/urfave/cli/v3"
 )
 
+// DefaultTemperature 未配置 Temperature 时使用的采样温度
+const DefaultTemperature = 0.7
+
+// DefaultEventBufferSize 未配置 EventBufferSize 时事件通道的缓冲大小
+const DefaultEventBufferSize = 16
+
 // Config Agent configuration
 type Config struct {
 	// Basic Info
@@ -15,21 +30,132 @@ type Config struct {
 	Name     string `koanf:"name" desc:"Agent 名称"`
 	ParentID string `koanf:"parent-id"`
 
+	// DeterministicID 未设置 ID 时根据名称、模型和系统提示词派生稳定的 ID（默认随机生成）
+	DeterministicID bool `koanf:"deterministic-id" desc:"是否根据配置派生稳定的 Agent ID"`
+
 	// System SystemPrompt
 	SystemPrompt string `koanf:"system-prompt" desc:"系统提示词"`
 
+	// SystemSegments 追加在 SystemPrompt 之后的提示词分段（如任务指令、动态上下文）
+	SystemSegments []string `koanf:"system-segments" desc:"系统提示词分段"`
+
+	// SystemTemplate 系统提示词模板（text/template 语法，每次执行时用 PromptVars 渲染，设置后替代 SystemPrompt）
+	SystemTemplate string `koanf:"system-template" desc:"系统提示词模板"`
+
+	// Examples 少样本示例（user/assistant 消息），每次调用 Provider 时插入在会话历史之前，不计入 Messages()
+	Examples []llm.Message `koanf:"examples" desc:"少样本示例消息"`
+
 	// LLM Configuration (嵌套结构，统一管理 LLM 相关配置)
 	LLM llm.Config `koanf:"llm" desc:"LLM 配置"`
 
 	// MaxTokens 最大 token 数（llm.Config 中无此字段，保留在 agent 层）
 	MaxTokens int `koanf:"max-tokens" desc:"最大 token 数"`
 
+	// ContextWindow 模型上下文窗口大小（token 数，0 表示未知，不计算使用率）
+	ContextWindow int `koanf:"context-window" desc:"模型上下文窗口大小"`
+
+	// ContextWarningThreshold 发送上下文溢出告警的使用率（0..1，0 表示使用 0.9；需设置 ContextWindow）
+	ContextWarningThreshold float64 `koanf:"context-warning-threshold" desc:"上下文溢出告警的使用率阈值"`
+
+	// MaxHistoryMessages 每次调用 Provider 时最多发送的历史消息数（0 表示不限制，仅在未设置 Compactor 时生效）
+	MaxHistoryMessages int `koanf:"max-history-messages" desc:"发送给模型的最大历史消息数"`
+
+	// CompactThreshold 触发历史压缩的估算 token 数（需配合 Compactor；0 表示使用 ContextWindow 的 80%）
+	CompactThreshold int `koanf:"compact-threshold" desc:"触发历史压缩的 token 阈值"`
+
+	// Sampling（nil 表示未设置：Temperature 使用 DefaultTemperature，TopP 使用 Provider 默认值）
+	// 使用指针区分"未设置"与显式的 0（如 Temperature 为 0 的确定性输出）
+	Temperature *float64 `koanf:"temperature" desc:"采样温度"`
+	TopP        *float64 `koanf:"top-p" desc:"核采样概率"`
+
+	// Seed 采样随机种子（nil 表示不设置；仅声明 ProviderCapabilities.Seed 的 Provider 使用，内置 Provider 均会忽略）
+	Seed *int `koanf:"seed" desc:"采样随机种子"`
+
+	// StopSequences 停止序列，模型生成到任一序列时停止（不支持的 Provider 会忽略）
+	StopSequences []string `koanf:"stop-sequences" desc:"停止序列"`
+
+	// Deadline Downgrade（临近截止时间时切换到更快的模型完成最后一步）
+	DowngradeModel     string        `koanf:"downgrade-model" desc:"临近截止时间时使用的快速模型"`
+	DowngradeThreshold time.Duration `koanf:"downgrade-threshold" desc:"剩余时间低于该阈值时触发降级"`
+
 	// Tool Configuration
 	Tools []string `koanf:"tools" desc:"工具列表"`
 
+	// AllowedTools 允许模型使用的工具（空表示不限制）；与 DeniedTools 同时命中时以拒绝为准
+	AllowedTools []string `koanf:"allowed-tools" desc:"允许使用的工具"`
+
+	// DeniedTools 禁止模型使用的工具（即使已注册，也不会提供给模型或被执行）
+	DeniedTools []string `koanf:"denied-tools" desc:"禁止使用的工具"`
+
+	// CacheableTools 结果可缓存的工具（相同参数的调用复用结果，未设置 ToolResultCache 时使用默认 LRU）
+	CacheableTools []string `koanf:"cacheable-tools" desc:"结果可缓存的工具"`
+
+	// ToolResultRole 承载工具结果的消息角色（仅支持 user 或 tool，空表示 user；部分本地模型要求 tool）
+	ToolResultRole llm.Role `koanf:"tool-result-role" desc:"工具结果消息的角色"`
+
+	// ForceToolSchemas 是否始终发送工具 Schema（即使 Provider 声明模型不支持工具调用，见 CapabilityReporter）
+	ForceToolSchemas bool `koanf:"force-tool-schemas" desc:"是否强制发送工具 Schema"`
+
+	// InjectToolManual 是否将工具手册追加到系统提示词（nil 表示注入；原生支持工具调用的模型可关闭）
+	InjectToolManual *bool `koanf:"inject-tool-manual" desc:"是否注入工具手册"`
+
+	// ToolManualHeader 工具手册标题（空表示使用 DefaultToolManualHeader），系统提示词已包含该标题时不再注入
+	ToolManualHeader string `koanf:"tool-manual-header" desc:"工具手册标题"`
+
+	// ToolManualTemplate 工具手册正文模板（text/template 语法，数据为 ToolManualData；空表示使用 DefaultToolManualTemplate）
+	ToolManualTemplate string `koanf:"tool-manual-template" desc:"工具手册模板"`
+
+	// MaxSteps 单次执行的最大步数（LLM 调用次数，0 表示不限制）
+	MaxSteps int `koanf:"max-steps" desc:"单次执行最大步数"`
+
+	// ParallelTools 是否并发执行同一步中的多个工具调用
+	ParallelTools bool `koanf:"parallel-tools" desc:"是否并发执行工具调用"`
+
+	// MaxParallelTools 并发执行工具的最大数量（0 表示使用默认值 4）
+	MaxParallelTools int `koanf:"max-parallel-tools" desc:"并发执行工具的最大数量"`
+
+	// MaxToolCallsPerStep 单步最多执行的工具调用数，超出部分以错误结果反馈给模型（0 表示不限制）
+	MaxToolCallsPerStep int `koanf:"max-tool-calls-per-step" desc:"单步最多执行的工具调用数"`
+
+	// MaxToolResultBytes 单个工具结果发送给模型的最大字节数，超出部分截断并附加说明（0 表示不限制）
+	MaxToolResultBytes int `koanf:"max-tool-result-bytes" desc:"单个工具结果的最大字节数"`
+
+	// FullToolResultEvents 工具结果被截断时，ToolResult 事件是否仍携带完整内容
+	FullToolResultEvents bool `koanf:"full-tool-result-events" desc:"截断时事件是否携带完整工具结果"`
+
+	// EventBufferSize 事件通道的缓冲大小（nil 表示 DefaultEventBufferSize；0 表示无缓冲）
+	EventBufferSize *int `koanf:"event-buffer-size" desc:"事件通道缓冲大小"`
+
+	// MaxConsecutiveToolErrors 允许连续出现"工具全部失败"步骤的最大次数（0 表示不限制）
+	MaxConsecutiveToolErrors int `koanf:"max-consecutive-tool-errors" desc:"连续工具失败步数上限"`
+
 	// Sandbox Configuration
 	WorkDir string `koanf:"work-dir" desc:"工作目录"`
 
+	// AllowEmptyInput 是否允许空输入（续写场景：不追加用户消息，直接基于历史继续生成）
+	AllowEmptyInput bool `koanf:"allow-empty-input" desc:"是否允许空输入"`
+
+	// Stateless 无状态模式：每次执行前将会话历史重置为初始历史，不在调用之间累积对话
+	Stateless bool `koanf:"stateless" desc:"是否每次执行都开始新的对话"`
+
+	// AnswerRetries 最终答案未通过校验时的最大重试次数（需配合 AnswerValidator）
+	AnswerRetries int `koanf:"answer-retries" desc:"答案校验失败后的最大重试次数"`
+
+	// RepairToolArgs 是否修复格式不规范的工具调用参数（尾随逗号、单引号等）
+	RepairToolArgs bool `koanf:"repair-tool-args" desc:"是否修复不规范的工具参数 JSON"`
+
+	// AuditMode 是否记录每一步的请求与响应（脱敏后随 Result.Audit 返回）
+	AuditMode bool `koanf:"audit-mode" desc:"是否开启审计记录"`
+
+	// LogPrompts 是否以 debug 级别记录每次 LLM 调用的完整请求与响应（已脱敏）
+	LogPrompts bool `koanf:"log-prompts" desc:"是否在 debug 日志中记录完整提示词与响应"`
+
+	// HashPromptContent 提示词日志中以 SHA-256 摘要代替消息内容（需配合 LogPrompts）
+	HashPromptContent bool `koanf:"hash-prompt-content" desc:"提示词日志是否以摘要代替消息内容"`
+
+	// CaptureReasoning 是否将推理/思考内容记录到 Result.Reasoning
+	CaptureReasoning bool `koanf:"capture-reasoning" desc:"是否记录推理内容"`
+
 	// Extension Configuration
 	Metadata map[string]any `koanf:"metadata"`
 }
@@ -39,11 +165,31 @@ func DefaultConfig() *Config {
 	return &Config{
 		LLM:          *llm.DefaultConfig(),
 		MaxTokens:    4096,
+		MaxSteps:     25,
 		SystemPrompt: "You are a helpful AI assistant.",
 		WorkDir:      ".",
 	}
 }
 
+// systemSeparator 系统提示词分段之间的分隔符
+const systemSeparator = "\n\n"
+
+// system 组合最终的系统提示词：SystemPrompt 在前，SystemSegments 按顺序追加，忽略空段
+func (c *Config) system() string {
+	return c.systemWith(c.SystemPrompt)
+}
+
+// systemWith 以 base 作为基础提示词组合系统提示词
+func (c *Config) systemWith(base string) string {
+	parts := make([]string, 0, 1+len(c.SystemSegments))
+	for _, s := range append([]string{base}, c.SystemSegments...) {
+		if strings.TrimSpace(s) != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, systemSeparator)
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // Config Loading (Koanf)
 // ═══════════════════════════════════════════════════════════════════════════
@@ -161,6 +307,43 @@ func DefaultConfigPaths() []string {
 	return cfgm.DefaultPaths(AppName)
 }
 
+// ParseConfig 从内存中的 YAML/JSON 内容解析配置
+//
+// 与文件加载一致：以 DefaultConfig 为基础，解析前展开模板（如 {{ env "API_KEY" }}）。
+// format 为 "json" 时按 JSON 解析，其余按 YAML 解析（YAML 兼容 JSON）。
+//
+// 示例:
+//
+//	//go:embed default.yaml
+//	var defaultYAML string
+//
+//	cfg, err := agent.ParseConfig(defaultYAML, "yaml")
+func ParseConfig(content, format string) (*Config, error) {
+	expanded, err := tmpl.ExpandTemplate(content)
+	if err != nil {
+		return nil, fmt.Errorf("expand template: %w", err)
+	}
+
+	var parser koanf.Parser = yaml.Parser()
+	if strings.EqualFold(format, "json") {
+		parser = json.Parser()
+	}
+
+	k := koanf.New(".")
+	if err := k.Load(structs.Provider(*DefaultConfig(), "koanf"), nil); err != nil {
+		return nil, fmt.Errorf("load default config: %w", err)
+	}
+	if err := k.Load(rawbytes.Provider([]byte(expanded)), parser); err != nil {
+		return nil, fmt.Errorf("parse %s config: %w", strings.ToLower(format), err)
+	}
+
+	var cfg Config
+	if err := k.Unmarshal("", &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config: %w", err)
+	}
+	return &cfg, nil
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // Config Export
 // ═══════════════════════════════════════════════════════════════════════════
@@ -189,12 +372,78 @@ func MarshalConfigJSON(cfg *Config) []byte {
 // ═══════════════════════════════════════════════════════════════════════════
 
 // ValidateConfig validates configuration
+//
+// 按自动创建 Provider 的场景检查：除取值范围外，还要求设置 LLM.Model，
+// 以及除 Ollama 外的 Provider 类型设置 LLM.APIKey。所有问题通过 errors.Join 一并返回。
 func ValidateConfig(cfg *Config) error {
+	return validateConfig(cfg, true)
+}
+
+// validateConfig 校验配置；checkLLM 为 false 时跳过 Provider 连接配置检查（已注入 Provider）
+func validateConfig(cfg *Config, checkLLM bool) error {
 	var errs []error
 
+	if checkLLM {
+		if cfg.LLM.Model == "" {
+			errs = append(errs, errors.New("llm.model is required when no provider is set"))
+		}
+		if cfg.LLM.APIKey == "" && requiresAPIKey(cfg.LLM.Type) {
+			errs = append(errs, fmt.Errorf("llm.api-key is required for provider type %q", providerTypeOrDefault(cfg.LLM.Type)))
+		}
+	}
+	if cfg.LLM.Timeout < 0 {
+		errs = append(errs, errors.New("llm.timeout must be non-negative"))
+	}
 	if cfg.MaxTokens < 0 {
 		errs = append(errs, errors.New("max-tokens must be non-negative"))
 	}
+	if cfg.MaxSteps < 0 {
+		errs = append(errs, errors.New("max-steps must be non-negative"))
+	}
+	if cfg.MaxToolResultBytes < 0 {
+		errs = append(errs, errors.New("max-tool-result-bytes must be non-negative"))
+	}
+	if cfg.EventBufferSize != nil && *cfg.EventBufferSize < 0 {
+		errs = append(errs, errors.New("event-buffer-size must be non-negative"))
+	}
+	if cfg.MaxToolCallsPerStep < 0 {
+		errs = append(errs, errors.New("max-tool-calls-per-step must be non-negative"))
+	}
+	for i, msg := range cfg.Examples {
+		if msg.Role != llm.RoleUser && msg.Role != llm.RoleAssistant {
+			errs = append(errs, fmt.Errorf("examples[%d]: role must be %q or %q, got %q", i, llm.RoleUser, llm.RoleAssistant, msg.Role))
+		}
+	}
+	if cfg.ToolResultRole != "" && cfg.ToolResultRole != llm.RoleUser && cfg.ToolResultRole != llm.RoleTool {
+		errs = append(errs, fmt.Errorf("tool-result-role must be %q or %q, got %q", llm.RoleUser, llm.RoleTool, cfg.ToolResultRole))
+	}
+	if cfg.ContextWarningThreshold < 0 || cfg.ContextWarningThreshold > 1 {
+		errs = append(errs, errors.New("context-warning-threshold must be between 0 and 1"))
+	}
+	if cfg.Temperature != nil && *cfg.Temperature < 0 {
+		errs = append(errs, errors.New("temperature must be non-negative"))
+	}
+	if cfg.TopP != nil && (*cfg.TopP < 0 || *cfg.TopP > 1) {
+		errs = append(errs, errors.New("top-p must be between 0 and 1"))
+	}
 
 	return errors.Join(errs...)
 }
+
+// providerTypeOrDefault 返回 Provider 类型（未设置时为 provider.New 使用的默认类型）
+func providerTypeOrDefault(t llm.ProviderType) llm.ProviderType {
+	if t == "" {
+		return llm.ProviderTypeOpenRouter
+	}
+	return t
+}
+
+// requiresAPIKey 判断 Provider 类型是否需要 API Key（本地 Ollama 和 Mock 不需要）
+func requiresAPIKey(t llm.ProviderType) bool {
+	switch providerTypeOrDefault(t) {
+	case llm.ProviderTypeOllama, llm.ProviderTypeMock:
+		return false
+	default:
+		return true
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/lwmacct/251207-go-pkg-cfgm/pkg/cfgm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -19,6 +20,7 @@ func TestDefaultConfig(t *testing.T) {
 	assert.Equal(t, "anthropic/claude-haiku-4.5", cfg.LLM.Model)
 	assert.Equal(t, "https://openrouter.ai/api/v1", cfg.LLM.BaseURL)
 	assert.Equal(t, 4096, cfg.MaxTokens)
+	assert.Equal(t, 25, cfg.MaxSteps)
 	assert.Equal(t, "You are a helpful AI assistant.", cfg.SystemPrompt)
 	assert.Equal(t, ".", cfg.WorkDir)
 }
@@ -28,9 +30,12 @@ func TestDefaultConfig(t *testing.T) {
 // ═══════════════════════════════════════════════════════════════════════════
 
 func TestValidateConfig(t *testing.T) {
+	validLLM := llm.Config{Model: "test-model", APIKey: "test-key"}
+
 	t.Run("valid_config", func(t *testing.T) {
 		cfg := &Config{
 			Name:      "valid",
+			LLM:       validLLM,
 			MaxTokens: 1000,
 		}
 
@@ -40,6 +45,7 @@ func TestValidateConfig(t *testing.T) {
 
 	t.Run("zero_max_tokens_is_valid", func(t *testing.T) {
 		cfg := &Config{
+			LLM:       validLLM,
 			MaxTokens: 0,
 		}
 
@@ -49,6 +55,7 @@ func TestValidateConfig(t *testing.T) {
 
 	t.Run("negative_max_tokens", func(t *testing.T) {
 		cfg := &Config{
+			LLM:       validLLM,
 			MaxTokens: -1,
 		}
 
@@ -57,10 +64,45 @@ func TestValidateConfig(t *testing.T) {
 		assert.Contains(t, err.Error(), "max-tokens must be non-negative")
 	})
 
-	t.Run("empty_config_is_valid", func(t *testing.T) {
-		cfg := &Config{}
+	t.Run("negative_max_steps", func(t *testing.T) {
+		cfg := &Config{
+			LLM:      validLLM,
+			MaxSteps: -1,
+		}
+
 		err := ValidateConfig(cfg)
-		assert.NoError(t, err)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "max-steps must be non-negative")
+	})
+
+	t.Run("context_warning_threshold_out_of_range", func(t *testing.T) {
+		cfg := &Config{
+			LLM:                     validLLM,
+			ContextWarningThreshold: 1.2,
+		}
+
+		err := ValidateConfig(cfg)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "context-warning-threshold must be between 0 and 1")
+	})
+
+	t.Run("empty_config_reports_all_problems", func(t *testing.T) {
+		cfg := &Config{MaxSteps: -1}
+		err := ValidateConfig(cfg)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "llm.model is required")
+		assert.Contains(t, err.Error(), `llm.api-key is required for provider type "openrouter"`)
+		assert.Contains(t, err.Error(), "max-steps must be non-negative")
+	})
+
+	t.Run("ollama_does_not_require_api_key", func(t *testing.T) {
+		cfg := &Config{LLM: llm.Config{Type: llm.ProviderTypeOllama, Model: "llama3"}}
+		assert.NoError(t, ValidateConfig(cfg))
+	})
+
+	t.Run("injected_provider_skips_llm_checks", func(t *testing.T) {
+		assert.NoError(t, validateConfig(&Config{}, false))
+		require.Error(t, validateConfig(&Config{MaxSteps: -1}, false))
 	})
 }
 
@@ -185,3 +227,72 @@ func TestLoadConfig_JSONSupport(t *testing.T) {
 		assert.Equal(t, 8192, cfg.MaxTokens)
 	})
 }
+
+func TestParseConfig(t *testing.T) {
+	t.Run("yaml_with_template", func(t *testing.T) {
+		t.Setenv("TEST_API_KEY", "inline-key")
+
+		cfg, err := ParseConfig(`
+name: inline
+llm:
+  model: gpt-4o
+  api-key: '{{ env "TEST_API_KEY" }}'
+temperature: 0.2
+`, "yaml")
+		require.NoError(t, err)
+
+		assert.Equal(t, "inline", cfg.Name)
+		assert.Equal(t, "gpt-4o", cfg.LLM.Model)
+		assert.Equal(t, "inline-key", cfg.LLM.APIKey)
+		require.NotNil(t, cfg.Temperature)
+		assert.InDelta(t, 0.2, *cfg.Temperature, 1e-9)
+		// 未设置的字段保留默认值
+		assert.Equal(t, DefaultConfig().MaxSteps, cfg.MaxSteps)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		cfg, err := ParseConfig(`{"name": "json-inline", "max-tokens": 1024}`, "json")
+		require.NoError(t, err)
+		assert.Equal(t, "json-inline", cfg.Name)
+		assert.Equal(t, 1024, cfg.MaxTokens)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := ParseConfig(`{"name": `, "json")
+		require.Error(t, err)
+
+		_, err = ParseConfig(`name: '{{ env }}'`, "yaml")
+		require.Error(t, err)
+	})
+}
+
+func TestBuilder_FromInline(t *testing.T) {
+	t.Run("from_yaml", func(t *testing.T) {
+		b := New().FromYAML("name: yaml-inline\nmax-steps: 7\n")
+		assert.Equal(t, "yaml-inline", b.inner.config.Name)
+		assert.Equal(t, 7, b.inner.config.MaxSteps)
+		assert.Empty(t, b.errs)
+	})
+
+	t.Run("from_json", func(t *testing.T) {
+		b := New().FromJSON(`{"name": "json-inline", "llm": {"model": "m1"}}`)
+		assert.Equal(t, "json-inline", b.inner.config.Name)
+		assert.Equal(t, "m1", b.inner.config.LLM.Model)
+		assert.Empty(t, b.errs)
+	})
+
+	t.Run("system_segments", func(t *testing.T) {
+		b := New().
+			FromYAML("system-segments:\n  - task\n").
+			System("base").
+			AppendSystem("context")
+		assert.Equal(t, []string{"task", "context"}, b.inner.config.SystemSegments)
+		assert.Equal(t, "base\n\ntask\n\ncontext", b.inner.config.system())
+	})
+
+	t.Run("parse_error_collected", func(t *testing.T) {
+		_, err := New().FromJSON(`not json`).Build()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "load JSON config")
+	})
+}
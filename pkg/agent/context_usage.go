@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 上下文窗口使用率
+// ═══════════════════════════════════════════════════════════════════════════
+
+// 估算参数：约 4 个字符 1 个 token，每条消息额外计入固定开销
+const (
+	charsPerToken       = 4
+	tokensPerMessage    = 4
+	tokensPerToolSchema = 8
+)
+
+// TokenCounter 估算一次请求的输入 token 数
+//
+// 用于上下文使用率、溢出告警和历史压缩阈值判断。未设置时使用按字符数的粗略估算（约 4 个字符 1 个 token），
+// 需要更准确的结果时可接入模型对应的分词器（如 tiktoken）。
+type TokenCounter interface {
+	CountTokens(messages []llm.Message, opts *llm.Options) int
+}
+
+// TokenCounterFunc 函数形式的 TokenCounter
+type TokenCounterFunc func(messages []llm.Message, opts *llm.Options) int
+
+// CountTokens 实现 TokenCounter
+func (f TokenCounterFunc) CountTokens(messages []llm.Message, opts *llm.Options) int {
+	return f(messages, opts)
+}
+
+// countTokens 使用 TokenCounter（未设置时使用内置估算）计算输入 token 数
+func (a *Agent) countTokens(messages []llm.Message, opts *llm.Options) int {
+	if a.tokenCounter == nil {
+		return estimateTokens(messages, opts)
+	}
+	return a.tokenCounter.CountTokens(messages, opts)
+}
+
+// estimateTokens 估算一次请求的输入 token 数
+//
+// 使用字符数近似（不依赖具体模型的分词器），包括系统提示词、消息和工具 Schema。
+// 结果用于上下文使用率指示，不保证与 Provider 计费一致。
+func estimateTokens(messages []llm.Message, opts *llm.Options) int {
+	tokens := 0
+	if opts != nil {
+		tokens += textTokens(opts.System)
+		for _, schema := range opts.Tools {
+			tokens += tokensPerToolSchema + textTokens(schema.Name) + textTokens(schema.Description)
+			if data, err := json.Marshal(schema.InputSchema); err == nil {
+				tokens += textTokens(string(data))
+			}
+		}
+	}
+
+	for i := range messages {
+		tokens += tokensPerMessage + textTokens(messages[i].Content)
+		for _, block := range messages[i].ContentBlocks {
+			switch b := block.(type) {
+			case *llm.TextBlock:
+				tokens += textTokens(b.Text)
+			case *llm.ToolResultBlock:
+				tokens += textTokens(b.Content)
+			case *llm.ToolCall:
+				tokens += textTokens(b.Name)
+				if data, err := json.Marshal(b.Input); err == nil {
+					tokens += textTokens(string(data))
+				}
+			case *llm.ThinkingBlock:
+				tokens += textTokens(b.Thinking)
+			}
+		}
+	}
+	return tokens
+}
+
+// textTokens 按字符数估算文本 token 数（向上取整）
+func textTokens(s string) int {
+	n := utf8.RuneCountInString(s)
+	return (n + charsPerToken - 1) / charsPerToken
+}
+
+// updateContextUsage 在调用 Provider 前更新上下文使用情况
+//
+// 配置了 ContextWindow 时同时计算使用率，可通过 Status 实时查询；
+// 使用率达到告警阈值时发送 EventTypeContextWarning（eventCh 为 nil 时只记录日志）。
+func (a *Agent) updateContextUsage(ctx context.Context, state *runState, messages []llm.Message, opts *llm.Options, eventCh chan<- *AgentEvent) {
+	tokens := a.countTokens(messages, opts)
+
+	var utilization float64
+	if a.config.ContextWindow > 0 {
+		utilization = float64(tokens) / float64(a.config.ContextWindow)
+	}
+
+	a.mu.Lock()
+	a.contextTokens = tokens
+	a.contextUtilization = utilization
+	a.mu.Unlock()
+
+	state.logger.Debug("context usage",
+		"tokens", tokens,
+		"context_window", a.config.ContextWindow,
+		"utilization", utilization,
+	)
+
+	if a.config.ContextWindow > 0 && utilization >= a.contextWarningThreshold() {
+		state.logger.Warn("context window nearly full",
+			"tokens", tokens,
+			"context_window", a.config.ContextWindow,
+			"utilization", utilization,
+		)
+		if eventCh != nil {
+			a.sendEvent(ctx, eventCh, &AgentEvent{
+				Type: EventTypeContextWarning,
+				ContextWarning: &ContextWarning{
+					Tokens:        tokens,
+					ContextWindow: a.config.ContextWindow,
+					Utilization:   utilization,
+				},
+			})
+		}
+	}
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 上下文溢出告警
+// ═══════════════════════════════════════════════════════════════════════════
+
+// EventTypeContextWarning 上下文即将溢出事件（需设置 ContextWindow）
+//
+// 在调用 Provider 前估算的输入 token 数达到 ContextWindow × ContextWarningThreshold 时发送，
+// 客户端可据此压缩历史或提示用户开启新对话。
+const EventTypeContextWarning llm.EventType = "context_warning"
+
+// defaultContextWarningRatio 未设置 ContextWarningThreshold 时的告警比例
+const defaultContextWarningRatio = 0.9
+
+// ContextWarning 上下文告警信息
+type ContextWarning struct {
+	Tokens        int     `json:"tokens"`         // 估算的输入 token 数
+	ContextWindow int     `json:"context_window"` // 模型上下文窗口大小
+	Utilization   float64 `json:"utilization"`    // 占 ContextWindow 的比例
+}
+
+// contextWarningThreshold 返回触发告警的使用率
+func (a *Agent) contextWarningThreshold() float64 {
+	if a.config.ContextWarningThreshold > 0 {
+		return a.config.ContextWarningThreshold
+	}
+	return defaultContextWarningRatio
+}
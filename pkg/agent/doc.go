@@ -62,5 +62,32 @@
 //   - options.go: 函数式选项
 //   - run_blocking.go: 非流式执行引擎
 //   - run_streaming.go: 流式执行引擎
+//   - run_state.go: 单次执行状态
+//   - mcp.go: MCP 服务器运行时管理与断线重连
+//   - downgrade.go: 截止时间感知的模型降级
+//   - failover.go: 备用 Provider 故障转移
+//   - pool.go: Provider 池（加权轮询与健康检查）
+//   - plan.go: 先规划后执行（PlanAndExecute）
+//   - audit.go: 请求/响应审计记录
+//   - structured.go: 结构化输出（JSON Schema 校验）
+//   - hooks.go: 生命周期钩子
+//   - answer.go: 最终答案校验
+//   - middleware.go: Provider 调用中间件
+//   - cache.go: 响应缓存中间件与 LRU 实现
+//   - context_usage.go: 上下文窗口使用率估算
+//   - compact.go: 对话历史压缩
+//   - snapshot.go: Agent 状态快照与恢复
+//   - transcript.go: 对话记录导出（JSON / Markdown）
+//   - prompt.go: 系统提示词模板渲染
+//   - preview.go: 请求预览（不调用 Provider）
+//   - runtime.go: 内存 Runtime（多 Agent 成员与父子关系管理）
+//   - factory.go: Agent 工厂与 spawn_agent 子 Agent 工具
+//   - batch.go: 批量执行（同一模板并发处理多个输入）
+//   - sse.go: 事件流的 Server-Sent Events 输出
+//   - usage.go: 用量汇总与费用估算
+//   - metrics.go: 指标收集接口
+//   - tracing.go: 链路追踪接口（可接入 OpenTelemetry）
 //   - tool_execution.go: 工具调用执行
+//   - tool_cache.go: 工具结果缓存
+//   - tool_args.go: 工具参数解析与修复
 package agent
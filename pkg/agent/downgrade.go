@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 截止时间感知的模型降级
+// ═══════════════════════════════════════════════════════════════════════════
+
+// shouldDowngrade 判断当前步骤是否需要降级到快速模型
+//
+// 仅当配置了降级策略、ctx 带有截止时间且剩余时间低于阈值时返回 true。
+func (a *Agent) shouldDowngrade(ctx context.Context) bool {
+	if a.config.DowngradeModel == "" || a.config.DowngradeThreshold <= 0 {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false
+	}
+	return time.Until(deadline) < a.config.DowngradeThreshold
+}
+
+// downgradeProvider 获取降级 Provider（首次使用时创建并缓存）
+func (a *Agent) downgradeProvider() (llm.Provider, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.fastProvider != nil {
+		return a.fastProvider, nil
+	}
+
+	cfg := a.config.LLM
+	cfg.Model = a.config.DowngradeModel
+	p, err := a.newProvider(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.fastProvider = p
+	return p, nil
+}
+
+// selectProvider 选择本步骤使用的 Provider
+//
+// 触发降级时返回快速模型的 Provider，并在 state 中记录降级信息；
+// 降级 Provider 创建失败时回退到主 Provider。
+func (a *Agent) selectProvider(ctx context.Context, state *runState) (llm.Provider, bool) {
+	if !a.shouldDowngrade(ctx) {
+		return a.provider, false
+	}
+
+	p, err := a.downgradeProvider()
+	if err != nil {
+		state.logger.Warn("create downgrade provider failed, using primary provider",
+			"model", a.config.DowngradeModel,
+			"error", err,
+		)
+		return a.provider, false
+	}
+
+	state.logger.Info("deadline approaching, downgrading model",
+		"model", a.config.DowngradeModel,
+		"step", state.stepCount,
+	)
+	state.setMetadata("downgraded_model", a.config.DowngradeModel)
+	state.setMetadata("downgraded_at_step", state.stepCount)
+	return p, true
+}
@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Agent 工厂与子 Agent 工具
+// ═══════════════════════════════════════════════════════════════════════════
+
+// builderFactory 基于 Builder 模板创建 Agent 的工厂
+type builderFactory struct {
+	base *Builder
+}
+
+// NewAgentFactory 创建以 base 为模板的 Agent 工厂
+//
+// CreateAgent 复制 base 的配置和工具、钩子、中间件等设置，再用传入的 Config
+// 覆盖其中的非零字段（规则同 FromFile），并将 ParentID 设为发起创建的 Agent
+// （从工具执行 context 中获取）。base 本身不会被构建或修改。
+//
+// 传入的 Config 修改了 LLM 的 Type、Model、APIKey 或 BaseURL 时，按新配置重新创建 Provider；
+// 否则与 base 共享通过 Provider() 设置的 Provider。共享的 Provider 与备用 Provider
+// 由调用方负责关闭，子 Agent 关闭时不会关闭它们。
+//
+// 使用示例:
+//
+//	base := agent.New().Model("gpt-4o-mini").APIKeyFromEnv()
+//	factory := agent.NewAgentFactory(base)
+//	lead, _ := agent.New().
+//	    Model("gpt-4o").
+//	    APIKeyFromEnv().
+//	    Tools(agent.NewSpawnAgentTool(factory)).
+//	    Build()
+func NewAgentFactory(base *Builder) AgentFactory {
+	return &builderFactory{base: base}
+}
+
+// CreateAgent 实现 AgentFactory 接口
+func (f *builderFactory) CreateAgent(ctx context.Context, cfg *Config) (AgentInterface, error) {
+	f.base.mu.Lock()
+	b := &Builder{
+		inner: f.base.inner.clone(),
+		errs:  slices.Clone(f.base.errs),
+	}
+	f.base.mu.Unlock()
+
+	// 子 Agent 使用新的 ID（同一模板创建的子 Agent 配置相同，不派生稳定 ID）
+	b.inner.config.ID = ""
+	b.inner.config.DeterministicID = false
+
+	if cfg != nil {
+		b.applyConfig(cfg)
+		if cfg.LLM.Type != "" || cfg.LLM.Model != "" || cfg.LLM.APIKey != "" || cfg.LLM.BaseURL != "" {
+			b.inner.provider = nil
+		}
+	}
+	// 从 base 继承的 Provider 与备用 Provider 由各子 Agent 共享，子 Agent 关闭时不关闭它们
+	b.inner.shareProviders()
+	if parentID := tool.AgentIDFromContext(ctx); parentID != "" {
+		b.inner.config.ParentID = parentID
+	}
+
+	if len(b.errs) > 0 {
+		return nil, fmt.Errorf("create agent: %w", errors.Join(b.errs...))
+	}
+	ag, err := newAgentFromBuilder(b.inner)
+	if err != nil {
+		return nil, fmt.Errorf("create agent: %w", err)
+	}
+	return ag, nil
+}
+
+// SpawnAgentToolName 子 Agent 工具名称
+const SpawnAgentToolName = "spawn_agent"
+
+// spawnAgentInput spawn_agent 工具输入
+type spawnAgentInput struct {
+	Task  string `json:"task" jsonschema:"The self-contained task for the sub-agent to complete"`
+	Model string `json:"model,omitempty" jsonschema:"Optional model for the sub-agent; defaults to the factory's model"`
+}
+
+// spawnAgentOutput spawn_agent 工具输出
+type spawnAgentOutput struct {
+	AgentID string `json:"agent_id"`
+	Text    string `json:"text"`
+	Steps   int    `json:"steps"`
+}
+
+// NewSpawnAgentTool 创建 spawn_agent 工具
+//
+// 模型调用该工具时，通过 factory 创建子 Agent 执行 task（可指定 model），
+// 返回子 Agent 的最终回复；子 Agent 执行完成后即关闭。
+// factory 的模板包含本工具时，子 Agent 可以继续拆分任务（递归分解），
+// 深度由各 Agent 的 MaxSteps 约束。
+func NewSpawnAgentTool(factory AgentFactory) tool.Tool {
+	return tool.Func(SpawnAgentToolName,
+		"Delegate a self-contained sub-task to a new sub-agent and return its final answer.",
+		func(ctx context.Context, in spawnAgentInput) (*spawnAgentOutput, error) {
+			if in.Task == "" {
+				return nil, errors.New("task is required")
+			}
+
+			cfg := &Config{}
+			cfg.LLM.Model = in.Model
+			child, err := factory.CreateAgent(ctx, cfg)
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = child.Close() }()
+
+			result, err := child.Chat(ctx, in.Task)
+			if err != nil {
+				return nil, fmt.Errorf("sub-agent %s: %w", child.ID(), err)
+			}
+			return &spawnAgentOutput{
+				AgentID: child.ID(),
+				Text:    result.Text,
+				Steps:   result.StepCount,
+			}, nil
+		})
+}
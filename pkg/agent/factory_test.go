@@ -0,0 +1,116 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// AgentFactory Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgentFactory(t *testing.T) {
+	shared := mock.New(mock.WithResponse("shared"))
+	rebuilt := mock.New(mock.WithResponse("rebuilt"))
+	var requestedModel string
+
+	base := New().
+		Name("worker").
+		ID("base-id").
+		Provider(shared).
+		System("You are a worker.").
+		Tools(newEchoTool())
+	base.inner.newProvider = func(cfg *llm.Config) (llm.Provider, error) {
+		requestedModel = cfg.Model
+		return rebuilt, nil
+	}
+	factory := NewAgentFactory(base)
+
+	t.Run("inherits_base_and_parent", func(t *testing.T) {
+		ctx := tool.ContextWithAgentID(context.Background(), "parent-1")
+		created, err := factory.CreateAgent(ctx, &Config{Name: "child"})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = created.Close() })
+
+		ag := created.(*Agent)
+		assert.NotEqual(t, "base-id", ag.ID())
+		assert.Equal(t, "child", ag.Name())
+		assert.Equal(t, "parent-1", ag.ParentID())
+		assert.Equal(t, "You are a worker.", ag.Config().SystemPrompt)
+		assert.True(t, ag.toolRegistry.Has("echo"))
+		assert.Equal(t, sharedProvider{shared}, ag.provider)
+
+		// 子 Agent 的工具注册表独立
+		require.NoError(t, ag.RemoveTool("echo"))
+		assert.True(t, base.inner.toolRegistry.Has("echo"))
+	})
+
+	t.Run("model_override_rebuilds_provider", func(t *testing.T) {
+		cfg := &Config{}
+		cfg.LLM.Model = "small-model"
+		created, err := factory.CreateAgent(context.Background(), cfg)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = created.Close() })
+
+		assert.Equal(t, "small-model", requestedModel)
+		assert.Same(t, rebuilt, created.(*Agent).provider)
+		assert.Empty(t, created.ParentID())
+	})
+
+	t.Run("base_errors_propagate", func(t *testing.T) {
+		_, err := NewAgentFactory(New().MaxTokens(-1)).CreateAgent(context.Background(), nil)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "maxTokens must be positive")
+	})
+}
+
+func TestSpawnAgentTool(t *testing.T) {
+	child := mock.New(mock.WithResponse("child answer"))
+	factory := NewAgentFactory(New().Provider(child))
+
+	var toolResult string
+	parent := mock.New(mock.WithMessageFunc(func(msgs []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return toolCallMessage("call-1", SpawnAgentToolName, map[string]any{"task": "Summarize the report"})
+		}
+		toolResult = msgs[len(msgs)-1].GetToolResults()[0].Content
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+	ag := newTestAgent(t, parent, WithID("lead"), WithTools(NewSpawnAgentTool(factory)))
+
+	result, err := ag.Chat(context.Background(), "Handle the report")
+	require.NoError(t, err)
+	assert.Equal(t, "done", result.Text)
+
+	assert.Contains(t, toolResult, "child answer")
+	assert.Equal(t, "Summarize the report", child.LastCall().Messages[0].GetContent())
+}
+
+func TestSpawnAgentTool_SharedProviderNotClosed(t *testing.T) {
+	shared := &closeTrackingProvider{Client: mock.New(mock.WithResponse("child answer"))}
+	fallback := &closeTrackingProvider{Client: mock.New()}
+	factory := NewAgentFactory(New().Provider(shared).Fallbacks(fallback))
+
+	parent := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n <= 2 {
+			return toolCallMessage(fmt.Sprintf("call-%d", n), SpawnAgentToolName, map[string]any{"task": "Sub-task"})
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+	ag := newTestAgent(t, parent, WithTools(NewSpawnAgentTool(factory)))
+
+	_, err := ag.Chat(context.Background(), "Delegate twice")
+	require.NoError(t, err)
+
+	// 子 Agent 执行完即关闭，共享的 Provider 仍可供后续子 Agent 使用
+	assert.Equal(t, 2, shared.CallCount())
+	assert.Equal(t, int32(0), shared.closed.Load())
+	assert.Equal(t, int32(0), fallback.closed.Load())
+}
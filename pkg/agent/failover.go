@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"context"
+	"errors"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider 故障转移
+// ═══════════════════════════════════════════════════════════════════════════
+
+// callWithFallback 依次尝试主 Provider 和备用 Provider
+//
+// call 使用单个 Provider 完成一次调用（含重试）。失败且属于可用性错误时改用下一个备用
+// Provider；每次调用都从主 Provider 开始，下一步不会沿用上一步的备用 Provider。
+// 配置了备用 Provider 时，在 Result.Metadata["provider_index"] 记录提供响应的序号（0 为主 Provider）。
+func (a *Agent) callWithFallback(
+	ctx context.Context,
+	state *runState,
+	primary llm.Provider,
+	call func(p llm.Provider) (*llm.Response, error),
+) (*llm.Response, error) {
+	served := 0
+	resp, err := call(primary)
+	for i := 0; err != nil && i < len(a.fallbacks) && a.shouldFailover(ctx, err); i++ {
+		state.logger.Warn("provider unavailable, trying fallback",
+			"fallback", i+1,
+			"error", err,
+		)
+		served = i + 1
+		resp, err = call(a.fallbacks[i])
+	}
+	if err != nil {
+		return nil, unwrapNoRetry(err)
+	}
+
+	if len(a.fallbacks) > 0 {
+		state.setMetadata("provider_index", served)
+	}
+	return resp, nil
+}
+
+// shouldFailover 判断错误是否应改用备用 Provider
+//
+// 只有重试后仍失败的可用性错误（超时、限流、5xx 等可重试错误）才触发故障转移；
+// 请求本身有误、ctx 已取消或已输出部分内容（noRetryError）时不转移。
+func (a *Agent) shouldFailover(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var nr *noRetryError
+	if errors.As(err, &nr) {
+		return false
+	}
+	return a.isRetriable(err)
+}
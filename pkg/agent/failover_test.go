@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider Failover Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Fallbacks(t *testing.T) {
+	unavailable := errors.New("API error: 503 - service unavailable")
+	noRetry := WithRetryConfig(&RetryConfig{})
+
+	t.Run("fails_over_and_resets", func(t *testing.T) {
+		primary := mock.New(mock.WithError(unavailable))
+		fallback := mock.New(mock.WithResponse("from fallback"))
+		ag := newTestAgent(t, primary, WithFallbacks(fallback), noRetry)
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, "from fallback", result.Text)
+		assert.Equal(t, 1, result.Metadata["provider_index"])
+
+		// 下一轮重新从主 Provider 开始
+		_, err = ag.Chat(context.Background(), "Again")
+		require.NoError(t, err)
+		assert.Equal(t, 2, primary.CallCount())
+		assert.Equal(t, 2, fallback.CallCount())
+	})
+
+	t.Run("primary_served", func(t *testing.T) {
+		fallback := mock.New(mock.WithResponse("from fallback"))
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")), WithFallbacks(fallback))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.Equal(t, 0, result.Metadata["provider_index"])
+		assert.Equal(t, 0, fallback.CallCount())
+	})
+
+	t.Run("chain_exhausted", func(t *testing.T) {
+		second := mock.New(mock.WithError(unavailable))
+		third := mock.New(mock.WithError(unavailable))
+		ag := newTestAgent(t, mock.New(mock.WithError(unavailable)), WithFallbacks(second, third), noRetry)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.ErrorContains(t, err, "503")
+		assert.Equal(t, 1, second.CallCount())
+		assert.Equal(t, 1, third.CallCount())
+	})
+
+	t.Run("request_errors_not_failed_over", func(t *testing.T) {
+		fallback := mock.New(mock.WithResponse("from fallback"))
+		ag := newTestAgent(t, mock.New(mock.WithError(errors.New("API error: 400 - bad request"))),
+			WithFallbacks(fallback), noRetry)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.ErrorContains(t, err, "400")
+		assert.Equal(t, 0, fallback.CallCount())
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		fallback := mock.New(mock.WithResponse("streamed"))
+		ag := newTestAgent(t, mock.New(mock.WithError(unavailable)), WithFallbacks(fallback), noRetry)
+
+		_, result, err := ag.RunCollect(context.Background(), "Hello", WithStreaming(true))
+		require.NoError(t, err)
+		assert.Equal(t, "streamed", result.Text)
+		assert.Equal(t, 1, result.Metadata["provider_index"])
+	})
+
+	t.Run("no_fallbacks_no_metadata", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+
+		result, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.NotContains(t, result.Metadata, "provider_index")
+	})
+
+	t.Run("closed_with_agent", func(t *testing.T) {
+		fallback := &closeTrackingProvider{Client: mock.New()}
+		ag, err := New().Provider(mock.New()).Fallbacks(fallback).Build()
+		require.NoError(t, err)
+
+		require.NoError(t, ag.Close())
+		assert.Equal(t, int32(1), fallback.closed.Load())
+	})
+}
@@ -1,8 +1,12 @@
 package agent
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"maps"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,27 +20,132 @@ import (
 // 内部辅助方法
 // ═══════════════════════════════════════════════════════════════════════════
 
-// appendMessage 线程安全地添加消息
-func (a *Agent) appendMessage(msg llm.Message) {
+// appendMessage 线程安全地向指定会话添加消息（threadID 为空表示默认会话）
+func (a *Agent) appendMessage(threadID string, msg llm.Message) {
 	a.mu.Lock()
-	a.messages = append(a.messages, msg)
+	a.appendMessageLocked(threadID, msg)
+	a.mu.Unlock()
+}
+
+// appendMessageLocked 追加消息并更新步数和最近活动时间（调用方需持有锁）
+func (a *Agent) appendMessageLocked(threadID string, msg llm.Message) {
+	if threadID == "" {
+		a.messages = append(a.messages, msg)
+	} else {
+		if a.threads == nil {
+			a.threads = make(map[string][]llm.Message)
+		}
+		a.threads[threadID] = append(a.threads[threadID], msg)
+	}
 	a.stepCount++
 	a.lastActivity = time.Now()
-	a.mu.Unlock()
+}
+
+// historyLocked 返回指定会话的消息历史（调用方需持有锁）
+func (a *Agent) historyLocked(threadID string) []llm.Message {
+	if threadID == "" {
+		return a.messages
+	}
+	return a.threads[threadID]
+}
+
+// resetHistoryLocked 将会话历史重置为初始历史（命名会话清空），调用方需持有锁
+func (a *Agent) resetHistoryLocked(threadID string) {
+	if threadID == "" {
+		a.messages = slices.Clone(a.seedHistory)
+		return
+	}
+	delete(a.threads, threadID)
+}
+
+// snapshotHistory 线程安全地复制指定会话的消息历史
+func (a *Agent) snapshotHistory(threadID string) []llm.Message {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	history := a.historyLocked(threadID)
+	messages := make([]llm.Message, len(history))
+	copy(messages, history)
+	return messages
+}
+
+// eventBufferSize 返回本次执行事件通道的缓冲大小（RunOptions 优先于配置，负数回退为默认值）
+func (a *Agent) eventBufferSize(options *RunOptions) int {
+	switch {
+	case options.EventBuffer != nil && *options.EventBuffer >= 0:
+		return *options.EventBuffer
+	case a.config.EventBufferSize != nil && *a.config.EventBufferSize >= 0:
+		return *a.config.EventBufferSize
+	default:
+		return DefaultEventBufferSize
+	}
+}
+
+// providerMessages 构建发送给 Provider 的消息：截取后的会话历史，开头插入少样本示例
+//
+// 示例放在历史开头的系统消息之后，不参与 MaxHistoryMessages 截取。
+func (a *Agent) providerMessages(history []llm.Message) []llm.Message {
+	history = a.trimHistory(history)
+	if len(a.config.Examples) == 0 {
+		return history
+	}
+
+	lead := 0
+	for lead < len(history) && history[lead].Role == llm.RoleSystem {
+		lead++
+	}
+	messages := make([]llm.Message, 0, len(a.config.Examples)+len(history))
+	messages = append(messages, history[:lead]...)
+	messages = append(messages, a.config.Examples...)
+	return append(messages, history[lead:]...)
 }
 
 // buildProviderOptions 构建 Provider 选项
-func (a *Agent) buildProviderOptions() *llm.Options {
+//
+// 优先级：RunOptions 单次覆盖 > Config 配置 > 默认值；runOpts 可为 nil。
+func (a *Agent) buildProviderOptions(runOpts *RunOptions) *llm.Options {
 	opts := &llm.Options{
-		System:      a.config.SystemPrompt,
+		System:      a.systemPrompt(runOpts),
 		MaxTokens:   a.config.MaxTokens,
-		Temperature: 0.7,
+		Temperature: DefaultTemperature,
+	}
+	if a.config.Temperature != nil {
+		opts.Temperature = *a.config.Temperature
+	}
+	if a.config.TopP != nil {
+		opts.TopP = *a.config.TopP
+	}
+	opts.StopSequences = slices.Clone(a.config.StopSequences)
+	if a.config.Seed != nil {
+		// llm.Options 没有 seed 字段，通过 Metadata 传给支持的 Provider（或中间件），其余 Provider 忽略（见 supportsSeed）
+		opts.Metadata = map[string]any{"seed": *a.config.Seed}
+	}
+	if a.responseFormat != nil {
+		opts.ResponseFormat = a.responseFormat
+	}
+	if runOpts != nil {
+		if runOpts.Temperature != nil {
+			opts.Temperature = *runOpts.Temperature
+		}
+		if runOpts.MaxTokens != nil {
+			opts.MaxTokens = *runOpts.MaxTokens
+		}
+		// 本次执行的停止序列与配置合并（去重）
+		for _, stop := range runOpts.StopSequences {
+			if !slices.Contains(opts.StopSequences, stop) {
+				opts.StopSequences = append(opts.StopSequences, stop)
+			}
+		}
 	}
 
-	// 添加工具 Schema
-	if a.toolRegistry != nil && a.toolRegistry.Count() > 0 {
+	// 添加工具 Schema（本次执行禁用工具时跳过）
+	toolsDisabled := runOpts != nil && runOpts.disableTools
+	if !toolsDisabled && a.toolRegistry != nil && a.toolRegistry.Count() > 0 {
 		tools := make([]llm.ToolSchema, 0)
 		for _, t := range a.toolRegistry.List() {
+			if !a.toolAvailable(t.Name(), runOpts) {
+				continue
+			}
 			toolSchema := llm.ToolSchema{
 				Name:        t.Name(),
 				Description: t.Description(),
@@ -58,41 +167,178 @@ func (a *Agent) buildProviderOptions() *llm.Options {
 
 			tools = append(tools, toolSchema)
 		}
-		opts.Tools = tools
+		if len(tools) > 0 && !a.supportsToolSchemas() {
+			// 模型不支持原生工具调用：只注入工具手册
+			a.injectToolManual(opts, runOpts)
+		} else if len(tools) > 0 {
+			opts.Tools = tools
+			if limit := a.config.MaxToolCallsPerStep; limit > 0 {
+				// 供支持的 Provider（或中间件）限制模型单次输出的调用数
+				if opts.Metadata == nil {
+					opts.Metadata = make(map[string]any)
+				}
+				opts.Metadata["max_tool_calls"] = limit
+				if limit == 1 {
+					opts.Metadata["parallel_tool_calls"] = false
+				}
+			}
 
-		// 注入工具手册
-		a.injectToolManual(opts)
+			// 注入工具手册
+			a.injectToolManual(opts, runOpts)
+		}
 	}
 
 	return opts
 }
 
+// providerCapabilities 返回 Provider 声明的能力（未实现 CapabilityReporter 时 ok 为 false）
+//
+// 共享的 Provider 会先解开包装，与直接使用底层 Provider 时的判断一致。
+func providerCapabilities(p llm.Provider) (caps ProviderCapabilities, ok bool) {
+	if shared, isShared := p.(sharedProvider); isShared {
+		p = shared.Provider
+	}
+	reporter, ok := p.(CapabilityReporter)
+	if !ok {
+		return ProviderCapabilities{}, false
+	}
+	return reporter.Capabilities(), true
+}
+
+// supportsToolSchemas 判断是否向 Provider 发送工具 Schema
+//
+// 主 Provider 实现 CapabilityReporter 且声明不支持工具调用时返回 false（首次记录警告），
+// Config.ForceToolSchemas 为 true 时始终返回 true。
+func (a *Agent) supportsToolSchemas() bool {
+	if a.config.ForceToolSchemas {
+		return true
+	}
+	caps, ok := providerCapabilities(a.provider)
+	if !ok || caps.FunctionCalling {
+		return true
+	}
+	a.noToolsOnce.Do(func() {
+		a.logger.Warn("model does not support function calling, tool schemas not sent",
+			"model", a.config.LLM.Model,
+		)
+	})
+	return false
+}
+
+// supportsSeed 判断 Provider 是否使用 Config.Seed
+//
+// 只有实现 CapabilityReporter 且声明 Seed 的 Provider 返回 true；
+// 其余 Provider 会忽略种子，首次调用时记录警告。
+func (a *Agent) supportsSeed() bool {
+	if caps, ok := providerCapabilities(a.provider); ok && caps.Seed {
+		return true
+	}
+	a.noSeedOnce.Do(func() {
+		a.logger.Warn("provider ignores seed, sampling is not reproducible",
+			"model", a.config.LLM.Model,
+			"seed", *a.config.Seed,
+		)
+	})
+	return false
+}
+
 // injectToolManual 注入工具手册
-func (a *Agent) injectToolManual(opts *llm.Options) {
-	if strings.Contains(opts.System, "### Tools Manual") {
+//
+// 关闭 InjectToolManual 或系统提示词已包含手册标题时不注入。
+func (a *Agent) injectToolManual(opts *llm.Options, runOpts *RunOptions) {
+	if a.config.InjectToolManual != nil && !*a.config.InjectToolManual {
+		return
+	}
+	if strings.Contains(opts.System, a.toolManualHeader()) {
 		return
 	}
 
+	if manual := a.buildToolManual(runOpts); manual != "" {
+		opts.System += "\n\n" + manual
+	}
+}
+
+// buildToolManual 根据当前注册表生成工具手册（无工具时返回空字符串）
+//
+// runOpts 非 nil 时只包含本次执行可用的工具（见 WithOnlyTools）。
+func (a *Agent) buildToolManual(runOpts *RunOptions) string {
+	if a.toolRegistry == nil {
+		return ""
+	}
+
 	tools := a.toolRegistry.List()
-	lines := make([]string, 0, len(tools))
+	data := ToolManualData{Tools: make([]ToolManualEntry, 0, len(tools))}
 	for _, t := range tools {
-		lines = append(lines, fmt.Sprintf("- `%s`: %s", t.Name(), t.Description()))
+		if !a.toolAvailable(t.Name(), runOpts) {
+			continue
+		}
+		data.Tools = append(data.Tools, ToolManualEntry{Name: t.Name(), Description: t.Description()})
+	}
+	if len(data.Tools) == 0 {
+		return ""
+	}
+
+	tmpl := a.toolManualTemplate
+	if tmpl == nil {
+		tmpl = defaultToolManualTemplate
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		a.logger.Warn("render tool manual template failed, using default", "error", err)
+		sb.Reset()
+		_ = defaultToolManualTemplate.Execute(&sb, data)
 	}
 
-	if len(lines) > 0 {
-		manualSection := "\n\n### Tools Manual\n\n" +
-			"The following tools are available:\n\n" +
-			strings.Join(lines, "\n")
-		opts.System += manualSection
+	return a.toolManualHeader() + "\n\n" + sb.String()
+}
+
+// toolManualHeader 返回工具手册标题
+func (a *Agent) toolManualHeader() string {
+	if a.config.ToolManualHeader != "" {
+		return a.config.ToolManualHeader
+	}
+	return DefaultToolManualHeader
+}
+
+// toolPermitted 判断工具是否在 AllowedTools / DeniedTools 允许范围内
+func (a *Agent) toolPermitted(name string) bool {
+	if slices.Contains(a.config.DeniedTools, name) {
+		return false
+	}
+	return len(a.config.AllowedTools) == 0 || slices.Contains(a.config.AllowedTools, name)
+}
+
+// toolAvailable 判断工具在本次执行中是否可用（Agent 级权限与 WithOnlyTools 同时满足）
+func (a *Agent) toolAvailable(name string, runOpts *RunOptions) bool {
+	if !a.toolPermitted(name) {
+		return false
+	}
+	return runOpts == nil || runOpts.OnlyTools == nil || slices.Contains(runOpts.OnlyTools, name)
+}
+
+// checkMaxSteps 检查是否已达到最大步数
+func (a *Agent) checkMaxSteps(state *runState) error {
+	limit := a.config.MaxSteps
+	if limit <= 0 || state.stepCount < limit {
+		return nil
 	}
+	state.logger.Warn("max steps exceeded", "steps", state.stepCount, "limit", limit)
+	return fmt.Errorf("%w: limit %d", ErrMaxStepsExceeded, limit)
 }
 
-// truncateString 截断字符串到指定长度
+// truncateString 截断字符串到指定长度（按字符计数，不会截断多字节字符）
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
 		return s
 	}
-	return s[:maxLen] + "..."
+	n := 0
+	for i := range s {
+		if n == maxLen {
+			return s[:i] + "..."
+		}
+		n++
+	}
+	return s
 }
 
 // generateAgentID 生成 Agent ID
@@ -100,6 +346,28 @@ func generateAgentID() string {
 	return "agt-" + uuid.New().String()
 }
 
+// deriveAgentID 根据配置派生稳定的 Agent ID（DeterministicID 开启时使用）
+//
+// 对名称、父 Agent、Provider 类型、模型、端点和系统提示词做 SHA-256，取前 128 位，
+// 相同配置重启后得到相同 ID，不同配置发生碰撞的概率可以忽略。
+func deriveAgentID(cfg *Config) string {
+	data, _ := json.Marshal(struct {
+		Name           string           `json:"name"`
+		ParentID       string           `json:"parent_id"`
+		ProviderType   llm.ProviderType `json:"provider_type"`
+		Model          string           `json:"model"`
+		BaseURL        string           `json:"base_url"`
+		SystemPrompt   string           `json:"system_prompt"`
+		SystemSegments []string         `json:"system_segments"`
+		SystemTemplate string           `json:"system_template"`
+	}{
+		cfg.Name, cfg.ParentID, cfg.LLM.Type, cfg.LLM.Model, cfg.LLM.BaseURL,
+		cfg.SystemPrompt, cfg.SystemSegments, cfg.SystemTemplate,
+	})
+	sum := sha256.Sum256(data)
+	return "agt-" + hex.EncodeToString(sum[:16])
+}
+
 // cloneConfig 深拷贝 Config
 //
 // 用于 Agent 克隆，确保配置完全独立，避免互相影响。
@@ -112,6 +380,11 @@ func cloneConfig(src *Config) *Config {
 	// 深拷贝切片
 	tools := make([]string, len(src.Tools))
 	copy(tools, src.Tools)
+	segments := slices.Clone(src.SystemSegments)
+	allowedTools := slices.Clone(src.AllowedTools)
+	stopSequences := slices.Clone(src.StopSequences)
+	deniedTools := slices.Clone(src.DeniedTools)
+	cacheableTools := slices.Clone(src.CacheableTools)
 
 	// 深拷贝 map
 	metadata := make(map[string]any, len(src.Metadata))
@@ -125,10 +398,13 @@ func cloneConfig(src *Config) *Config {
 	}
 
 	return &Config{
-		ID:           src.ID,
-		Name:         src.Name,
-		ParentID:     src.ParentID,
-		SystemPrompt: src.SystemPrompt,
+		ID:              src.ID,
+		Name:            src.Name,
+		ParentID:        src.ParentID,
+		DeterministicID: src.DeterministicID,
+		SystemPrompt:    src.SystemPrompt,
+		SystemSegments:  segments,
+		SystemTemplate:  src.SystemTemplate,
 		LLM: llm.Config{
 			Type:       src.LLM.Type,
 			APIKey:     src.LLM.APIKey,
@@ -138,9 +414,116 @@ func cloneConfig(src *Config) *Config {
 			MaxRetries: src.LLM.MaxRetries,
 			Extra:      llmExtra,
 		},
-		MaxTokens: src.MaxTokens,
-		Tools:     tools,
-		WorkDir:   src.WorkDir,
-		Metadata:  metadata,
+		MaxTokens:                src.MaxTokens,
+		ContextWindow:            src.ContextWindow,
+		ContextWarningThreshold:  src.ContextWarningThreshold,
+		CompactThreshold:         src.CompactThreshold,
+		MaxHistoryMessages:       src.MaxHistoryMessages,
+		Temperature:              cloneFloat(src.Temperature),
+		TopP:                     cloneFloat(src.TopP),
+		Seed:                     cloneInt(src.Seed),
+		StopSequences:            stopSequences,
+		DowngradeModel:           src.DowngradeModel,
+		DowngradeThreshold:       src.DowngradeThreshold,
+		Tools:                    tools,
+		AllowedTools:             allowedTools,
+		CacheableTools:           cacheableTools,
+		DeniedTools:              deniedTools,
+		ToolResultRole:           src.ToolResultRole,
+		Examples:                 cloneExamples(src.Examples),
+		ForceToolSchemas:         src.ForceToolSchemas,
+		InjectToolManual:         cloneBool(src.InjectToolManual),
+		ToolManualHeader:         src.ToolManualHeader,
+		ToolManualTemplate:       src.ToolManualTemplate,
+		MaxSteps:                 src.MaxSteps,
+		ParallelTools:            src.ParallelTools,
+		MaxParallelTools:         src.MaxParallelTools,
+		MaxToolCallsPerStep:      src.MaxToolCallsPerStep,
+		MaxToolResultBytes:       src.MaxToolResultBytes,
+		FullToolResultEvents:     src.FullToolResultEvents,
+		EventBufferSize:          cloneInt(src.EventBufferSize),
+		MaxConsecutiveToolErrors: src.MaxConsecutiveToolErrors,
+		WorkDir:                  src.WorkDir,
+		AllowEmptyInput:          src.AllowEmptyInput,
+		Stateless:                src.Stateless,
+		AnswerRetries:            src.AnswerRetries,
+		RepairToolArgs:           src.RepairToolArgs,
+		AuditMode:                src.AuditMode,
+		LogPrompts:               src.LogPrompts,
+		HashPromptContent:        src.HashPromptContent,
+		CaptureReasoning:         src.CaptureReasoning,
+		Metadata:                 metadata,
+	}
+}
+
+// cloneExamples 深拷贝少样本示例（nil 保持为 nil）
+func cloneExamples(src []llm.Message) []llm.Message {
+	if src == nil {
+		return nil
+	}
+	return cloneMessages(src)
+}
+
+// cloneMessages 深拷贝消息列表（包括内容块）
+func cloneMessages(src []llm.Message) []llm.Message {
+	dst := make([]llm.Message, len(src))
+	for i, msg := range src {
+		dst[i] = msg
+		if msg.ContentBlocks == nil {
+			continue
+		}
+		dst[i].ContentBlocks = make([]llm.ContentBlock, len(msg.ContentBlocks))
+		for j, block := range msg.ContentBlocks {
+			dst[i].ContentBlocks[j] = cloneBlock(block)
+		}
+	}
+	return dst
+}
+
+// cloneBlock 复制内容块（未知类型保持原引用）
+func cloneBlock(block llm.ContentBlock) llm.ContentBlock {
+	switch b := block.(type) {
+	case *llm.TextBlock:
+		c := *b
+		return &c
+	case *llm.ToolCall:
+		c := *b
+		c.Input = maps.Clone(b.Input)
+		return &c
+	case *llm.ToolResultBlock:
+		c := *b
+		return &c
+	case *llm.ThinkingBlock:
+		c := *b
+		return &c
+	default:
+		return block
+	}
+}
+
+// cloneBool 复制 bool 指针
+func cloneBool(p *bool) *bool {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// cloneFloat 复制 float64 指针
+func cloneFloat(p *float64) *float64 {
+	if p == nil {
+		return nil
+	}
+	v := *p
+	return &v
+}
+
+// cloneInt 复制 int 指针
+func cloneInt(p *int) *int {
+	if p == nil {
+		return nil
 	}
+	v := *p
+	return &v
 }
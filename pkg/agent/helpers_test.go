@@ -1,10 +1,14 @@
 package agent
 
 import (
+	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -48,12 +52,37 @@ func TestTruncateString(t *testing.T) {
 			maxLen: 0,
 			want:   "...",
 		},
+		{
+			name:   "chinese_truncated_by_rune",
+			input:  "你好世界",
+			maxLen: 2,
+			want:   "你好...",
+		},
+		{
+			name:   "chinese_within_rune_limit",
+			input:  "你好世界",
+			maxLen: 4,
+			want:   "你好世界",
+		},
+		{
+			name:   "mixed_width",
+			input:  "a中b文c",
+			maxLen: 3,
+			want:   "a中b...",
+		},
+		{
+			name:   "emoji",
+			input:  "👍👍👍",
+			maxLen: 1,
+			want:   "👍...",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got := truncateString(tt.input, tt.maxLen)
 			assert.Equal(t, tt.want, got)
+			assert.True(t, utf8.ValidString(got))
 		})
 	}
 }
@@ -75,6 +104,40 @@ func TestGenerateAgentID(t *testing.T) {
 	})
 }
 
+func TestDeriveAgentID(t *testing.T) {
+	base := func() *Config {
+		return &Config{
+			Name:         "assistant",
+			LLM:          llm.Config{Model: "gpt-4"},
+			SystemPrompt: "You are helpful",
+		}
+	}
+
+	t.Run("stable", func(t *testing.T) {
+		id := deriveAgentID(base())
+		assert.Equal(t, id, deriveAgentID(base()))
+		assert.Len(t, id, len("agt-")+32)
+	})
+
+	t.Run("differs_by_config", func(t *testing.T) {
+		ids := map[string]bool{deriveAgentID(base()): true}
+		for _, mutate := range []func(*Config){
+			func(c *Config) { c.Name = "other" },
+			func(c *Config) { c.LLM.Model = "gpt-4o" },
+			func(c *Config) { c.SystemPrompt = "You are terse" },
+			func(c *Config) { c.SystemSegments = []string{"task"} },
+			// 字段边界不同的拼接结果相同，ID 仍不同
+			func(c *Config) { c.Name, c.LLM.Model = "assistantgpt-4", "" },
+		} {
+			cfg := base()
+			mutate(cfg)
+			id := deriveAgentID(cfg)
+			assert.False(t, ids[id], "unexpected collision for %+v", cfg)
+			ids[id] = true
+		}
+	})
+}
+
 func TestCloneConfig(t *testing.T) {
 	t.Run("nil_config_returns_default", func(t *testing.T) {
 		result := cloneConfig(nil)
@@ -173,6 +236,66 @@ func TestCloneConfig(t *testing.T) {
 		assert.NotNil(t, dst.Tools)
 		assert.NotNil(t, dst.Metadata)
 	})
+
+	t.Run("deep_copy_sampling_pointers", func(t *testing.T) {
+		temperature := 0.0
+		src := &Config{Temperature: &temperature}
+
+		dst := cloneConfig(src)
+
+		require.NotNil(t, dst.Temperature)
+		assert.InDelta(t, 0.0, *dst.Temperature, 0)
+		assert.Nil(t, dst.TopP)
+
+		*dst.Temperature = 1
+		assert.InDelta(t, 0.0, temperature, 0, "Modifying dst should not affect src")
+
+		seed := 1
+		dst = cloneConfig(&Config{Seed: &seed})
+		require.NotNil(t, dst.Seed)
+		*dst.Seed = 2
+		assert.Equal(t, 1, seed)
+	})
+}
+
+func TestBuildProviderOptions_Sampling(t *testing.T) {
+	float := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name        string
+		config      *Config
+		temperature float64
+		topP        float64
+	}{
+		{
+			name:        "unset_uses_default",
+			config:      &Config{},
+			temperature: DefaultTemperature,
+			topP:        0,
+		},
+		{
+			name:        "explicit_zero_temperature",
+			config:      &Config{Temperature: float(0)},
+			temperature: 0,
+			topP:        0,
+		},
+		{
+			name:        "custom_values",
+			config:      &Config{Temperature: float(1.2), TopP: float(0.9)},
+			temperature: 1.2,
+			topP:        0.9,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{config: tt.config}
+			opts := a.buildProviderOptions(nil)
+
+			assert.InDelta(t, tt.temperature, opts.Temperature, 1e-9)
+			assert.InDelta(t, tt.topP, opts.TopP, 1e-9)
+		})
+	}
 }
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -211,3 +334,93 @@ func BenchmarkTruncateString(b *testing.B) {
 		_ = truncateString(longString, 20)
 	}
 }
+
+func TestBuildProviderOptions_RunOverrides(t *testing.T) {
+	temperature := 0.3
+	a := &Agent{config: &Config{MaxTokens: 4096, Temperature: &temperature}}
+
+	t.Run("unset_falls_back_to_config", func(t *testing.T) {
+		opts := a.buildProviderOptions(ApplyRunOptions())
+
+		assert.InDelta(t, 0.3, opts.Temperature, 1e-9)
+		assert.Equal(t, 4096, opts.MaxTokens)
+	})
+
+	t.Run("run_options_win", func(t *testing.T) {
+		opts := a.buildProviderOptions(ApplyRunOptions(
+			WithRunTemperature(0),
+			WithRunMaxTokens(128),
+		))
+
+		assert.InDelta(t, 0.0, opts.Temperature, 0)
+		assert.Equal(t, 128, opts.MaxTokens)
+	})
+}
+
+func TestBuildProviderOptions_StopSequences(t *testing.T) {
+	a := &Agent{config: &Config{StopSequences: []string{"END"}}}
+
+	t.Run("from_config", func(t *testing.T) {
+		assert.Equal(t, []string{"END"}, a.buildProviderOptions(nil).StopSequences)
+	})
+
+	t.Run("merged_with_run_options", func(t *testing.T) {
+		opts := a.buildProviderOptions(ApplyRunOptions(WithStopSequences("---", "END")))
+
+		assert.Equal(t, []string{"END", "---"}, opts.StopSequences)
+		assert.Equal(t, []string{"END"}, a.config.StopSequences, "config is not modified")
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		b := &Agent{config: &Config{}}
+		assert.Empty(t, b.buildProviderOptions(ApplyRunOptions()).StopSequences)
+	})
+}
+
+func TestBuildProviderOptions_Seed(t *testing.T) {
+	seed := 42
+
+	t.Run("passed_in_metadata", func(t *testing.T) {
+		a := &Agent{config: &Config{Seed: &seed}}
+		assert.Equal(t, map[string]any{"seed": 42}, a.buildProviderOptions(nil).Metadata)
+	})
+
+	t.Run("unset", func(t *testing.T) {
+		a := &Agent{config: &Config{}}
+		assert.Nil(t, a.buildProviderOptions(nil).Metadata)
+	})
+}
+
+func TestBuildProviderOptions_SystemSegments(t *testing.T) {
+	t.Run("joins_segments", func(t *testing.T) {
+		a := &Agent{config: &Config{
+			SystemPrompt:   "base",
+			SystemSegments: []string{"task", "", "context"},
+		}}
+		opts := a.buildProviderOptions(nil)
+
+		assert.Equal(t, "base\n\ntask\n\ncontext", opts.System)
+	})
+
+	t.Run("segments_without_base", func(t *testing.T) {
+		a := &Agent{config: &Config{SystemSegments: []string{"task"}}}
+		assert.Equal(t, "task", a.buildProviderOptions(nil).System)
+	})
+
+	t.Run("tool_manual_once", func(t *testing.T) {
+		registry := tool.NewRegistry()
+		require.NoError(t, registry.Register(newEchoTool()))
+		a := &Agent{
+			config:       &Config{SystemPrompt: "base", SystemSegments: []string{"task"}},
+			toolRegistry: registry,
+		}
+
+		for range 2 {
+			opts := a.buildProviderOptions(nil)
+			assert.True(t, strings.HasPrefix(opts.System, "base\n\ntask\n\n### Tools Manual"))
+			assert.Equal(t, 1, strings.Count(opts.System, "### Tools Manual"))
+			a.injectToolManual(opts, nil)
+			assert.Equal(t, 1, strings.Count(opts.System, "### Tools Manual"))
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 生命周期钩子
+// ═══════════════════════════════════════════════════════════════════════════
+
+// Hooks 执行过程的回调钩子
+//
+// 与事件通道互补：无需消费事件流即可观测执行过程（如上报指标、追踪）。
+// 所有字段均可为 nil；钩子在执行 goroutine 中同步调用，应尽快返回。
+// 开启 ParallelTools 时 OnToolCall / OnToolResult 可能被并发调用。
+// 钩子内的 panic 会被恢复并记录日志，不会中断执行。
+type Hooks struct {
+	// OnStep 每次 LLM 调用前触发，step 从 1 开始
+	OnStep func(step int)
+
+	// OnToolCall 每个工具执行前触发
+	OnToolCall func(tc *llm.ToolCall)
+
+	// OnToolResult 每个工具返回结果后触发（包括失败）
+	OnToolResult func(tr *llm.ToolResult)
+
+	// OnError 执行出错时触发（与 EventTypeError 事件对应）
+	OnError func(err error)
+
+	// OnStateChange Agent 状态变化时触发（Ready→Running→Ready、→Stopping→Stopped）
+	//
+	// 在锁外调用，可以在回调中查询 Status()；多个执行并发时回调也可能并发，先后顺序不保证。
+	OnStateChange func(from, to State)
+}
+
+// runHook 调用钩子并恢复其中的 panic
+func (a *Agent) runHook(name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.logger.Error("panic in hook",
+				"hook", name,
+				"panic", r,
+				"agent_id", a.id,
+			)
+		}
+	}()
+	fn()
+}
+
+// hookStep 触发 OnStep
+func (a *Agent) hookStep(step int) {
+	if a.hooks.OnStep != nil {
+		a.runHook("OnStep", func() { a.hooks.OnStep(step) })
+	}
+}
+
+// hookStateChange 状态确实变化时触发 OnStateChange（调用方不得持有 a.mu）
+func (a *Agent) hookStateChange(from, to State) {
+	if from != to && a.hooks.OnStateChange != nil {
+		a.runHook("OnStateChange", func() { a.hooks.OnStateChange(from, to) })
+	}
+}
+
+// hookToolCall 触发 OnToolCall
+func (a *Agent) hookToolCall(tc *llm.ToolCall) {
+	if a.hooks.OnToolCall != nil {
+		a.runHook("OnToolCall", func() { a.hooks.OnToolCall(tc) })
+	}
+}
+
+// sendEvent 向事件通道发送事件，返回是否已发送
+//
+// 通道有空位时直接发送（ctx 已取消时的错误事件仍能送达正在读取的调用方）；
+// 通道已满时等待调用方读取，ctx 取消或 Agent 关闭时放弃发送，
+// 保证调用方停止读取后执行 goroutine 不会永久阻塞。
+func (a *Agent) sendEvent(ctx context.Context, eventCh chan<- *AgentEvent, event *AgentEvent) bool {
+	select {
+	case eventCh <- event:
+		return true
+	default:
+	}
+
+	select {
+	case eventCh <- event:
+		return true
+	case <-ctx.Done():
+	case <-a.stopCh:
+	}
+	return false
+}
+
+// emitToolResult 发送工具结果事件并触发 OnToolResult
+//
+// 设置了 Redactor 时发送脱敏后的副本，调用方持有的 tr 保持原样（用于构建发给模型的结果）。
+func (a *Agent) emitToolResult(ctx context.Context, eventCh chan<- *AgentEvent, tr *llm.ToolResult) {
+	if a.redactor != nil {
+		redacted := *tr
+		redacted.Content = a.redactor(tr.Content)
+		tr = &redacted
+	}
+	a.sendEvent(ctx, eventCh, &AgentEvent{Type: llm.EventTypeToolResult, ToolResult: tr})
+	if a.hooks.OnToolResult != nil {
+		a.runHook("OnToolResult", func() { a.hooks.OnToolResult(tr) })
+	}
+}
+
+// emitError 发送错误事件并触发 OnError
+func (a *Agent) emitError(ctx context.Context, eventCh chan<- *AgentEvent, err error) {
+	a.emitErrorEvent(ctx, eventCh, &AgentEvent{Type: llm.EventTypeError, Error: err})
+}
+
+// emitErrorEvent 发送错误事件（可附带部分结果）并触发 OnError
+func (a *Agent) emitErrorEvent(ctx context.Context, eventCh chan<- *AgentEvent, event *AgentEvent) {
+	a.sendEvent(ctx, eventCh, event)
+	if a.hooks.OnError != nil {
+		a.runHook("OnError", func() { a.hooks.OnError(event.Error) })
+	}
+}
@@ -0,0 +1,297 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+
+	"github.com/lwmacct/251215-go-pkg-mcp/pkg/mcp"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+	sdkmcp "github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// MCP 服务器连接
+// ═══════════════════════════════════════════════════════════════════════════
+
+// mcpConnection MCP 服务器连接（由 *mcp.Server 实现，测试时可替换）
+type mcpConnection interface {
+	Name() string
+	Connect(ctx context.Context) error
+	LoadTools(ctx context.Context) ([]tool.Tool, error)
+	Close() error
+}
+
+// mcpToolIndex 记录 MCP 工具与所属服务器的对应关系
+//
+// 多个服务器提供同名工具时，注册表中以最后注册的为准（与 tool.Registry 一致）；
+// 移除生效工具所属的服务器后，恢复其他服务器提供的同名工具。
+type mcpToolIndex struct {
+	owners   map[string]mcpConnection      // 工具名 → 注册表中生效工具的所属服务器
+	provided map[mcpConnection][]tool.Tool // 服务器 → 该服务器加载的全部工具
+}
+
+func newMCPToolIndex() *mcpToolIndex {
+	return &mcpToolIndex{
+		owners:   make(map[string]mcpConnection),
+		provided: make(map[mcpConnection][]tool.Tool),
+	}
+}
+
+// add 记录服务器加载的工具并注册到注册表
+func (x *mcpToolIndex) add(registry *tool.Registry, logger *slog.Logger, server mcpConnection, tools []tool.Tool) {
+	x.provided[server] = tools
+	for _, t := range tools {
+		if err := registry.Register(t); err != nil {
+			logger.Warn("register MCP tool failed", "server", server.Name(), "tool", t.Name(), "error", err)
+			continue
+		}
+		x.owners[t.Name()] = server
+		logger.Info("registered MCP tool", "server", server.Name(), "tool", t.Name())
+	}
+}
+
+// replace 用重连后加载的工具替换服务器原有的工具
+//
+// 不再提供的工具被注销，其他服务器生效的同名工具保持不变。
+func (x *mcpToolIndex) replace(registry *tool.Registry, logger *slog.Logger, server mcpConnection, tools []tool.Tool) {
+	provided := make(map[string]bool, len(tools))
+	for _, t := range tools {
+		provided[t.Name()] = true
+	}
+	for _, t := range x.provided[server] {
+		if !provided[t.Name()] {
+			x.release(registry, server, t.Name())
+		}
+	}
+
+	x.provided[server] = tools
+	for _, t := range tools {
+		if owner, ok := x.owners[t.Name()]; ok && owner != server {
+			continue
+		}
+		if err := registry.Register(t); err != nil {
+			logger.Warn("register MCP tool failed", "server", server.Name(), "tool", t.Name(), "error", err)
+			continue
+		}
+		x.owners[t.Name()] = server
+	}
+}
+
+// remove 注销服务器生效的工具并删除记录
+func (x *mcpToolIndex) remove(registry *tool.Registry, server mcpConnection) {
+	tools := x.provided[server]
+	delete(x.provided, server)
+	for _, t := range tools {
+		x.release(registry, server, t.Name())
+	}
+}
+
+// release 注销 server 生效的工具 name；其他服务器提供同名工具时改为注册该工具
+func (x *mcpToolIndex) release(registry *tool.Registry, server mcpConnection, name string) {
+	if x.owners[name] != server {
+		return
+	}
+	delete(x.owners, name)
+
+	for other, tools := range x.provided {
+		if other == server {
+			continue
+		}
+		for _, t := range tools {
+			if t.Name() == name && registry.Register(t) == nil {
+				x.owners[name] = other
+				return
+			}
+		}
+	}
+	_ = registry.Unregister(name)
+}
+
+// names 返回服务器生效的工具名称（按加载顺序）
+func (x *mcpToolIndex) names(server mcpConnection) []string {
+	var names []string
+	for _, t := range x.provided[server] {
+		if x.owners[t.Name()] == server {
+			names = append(names, t.Name())
+		}
+	}
+	return names
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 运行时 MCP 服务器管理
+// ═══════════════════════════════════════════════════════════════════════════
+
+// AddMCPServer 运行时添加 MCP 服务器
+//
+// 连接服务器并将其工具注册到工具注册表，与 AddTool 一样在后续对话中生效。
+// 添加的服务器由 Agent 管理，Close 时自动关闭。
+// 同名服务器已存在时返回错误；Agent 没有工具注册表时返回 ErrNoToolRegistry。
+//
+// 使用示例:
+//
+//	err := ag.AddMCPServer(ctx, &mcp.ServerConfig{
+//	    Name:    "filesystem",
+//	    Command: "mcp-server-filesystem",
+//	    Args:    []string{"/data"},
+//	})
+func (a *Agent) AddMCPServer(ctx context.Context, cfg *mcp.ServerConfig) error {
+	return a.addMCPServer(ctx, mcp.NewServer(cfg))
+}
+
+// addMCPServer 连接服务器、注册工具并记录到 mcpServers
+func (a *Agent) addMCPServer(ctx context.Context, server mcpConnection) error {
+	if a.toolRegistry == nil {
+		return ErrNoToolRegistry
+	}
+
+	a.mcpMu.Lock()
+	defer a.mcpMu.Unlock()
+
+	name := server.Name()
+	if slices.ContainsFunc(a.mcpServers, func(s mcpConnection) bool { return s.Name() == name }) {
+		return fmt.Errorf("MCP server %s already added", name)
+	}
+
+	if err := server.Connect(ctx); err != nil {
+		return fmt.Errorf("connect MCP server %s: %w", name, err)
+	}
+	tools, err := server.LoadTools(ctx)
+	if err != nil {
+		_ = server.Close()
+		return fmt.Errorf("load tools from MCP server %s: %w", name, err)
+	}
+
+	a.mcpTools.add(a.toolRegistry, a.logger, server, tools)
+	a.mcpServers = append(a.mcpServers, server)
+	return nil
+}
+
+// RemoveMCPServer 运行时移除 MCP 服务器
+//
+// 只注销该服务器提供的工具（其他服务器提供的同名工具不受影响），然后关闭连接。
+// 正在执行的工具调用可能因连接关闭而失败。
+func (a *Agent) RemoveMCPServer(name string) error {
+	a.mcpMu.Lock()
+	defer a.mcpMu.Unlock()
+
+	idx := slices.IndexFunc(a.mcpServers, func(s mcpConnection) bool { return s.Name() == name })
+	if idx < 0 {
+		return fmt.Errorf("MCP server %q not found", name)
+	}
+	server := a.mcpServers[idx]
+	a.mcpServers = slices.Delete(a.mcpServers, idx, idx+1)
+
+	a.mcpTools.remove(a.toolRegistry, server)
+
+	if err := server.Close(); err != nil {
+		return fmt.Errorf("close MCP server %s: %w", name, err)
+	}
+	a.logger.Info("removed MCP server", "server", name)
+	return nil
+}
+
+// MCPToolNames 返回指定 MCP 服务器提供的工具名称（服务器不存在时返回 nil）
+//
+// 多个服务器提供同名工具时，只计入注册表中实际生效的那个服务器。
+func (a *Agent) MCPToolNames(serverName string) []string {
+	a.mcpMu.Lock()
+	defer a.mcpMu.Unlock()
+
+	for _, server := range a.mcpServers {
+		if server.Name() == serverName {
+			return a.mcpTools.names(server)
+		}
+	}
+	return nil
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 断线重连
+// ═══════════════════════════════════════════════════════════════════════════
+
+// isMCPConnectionError 判断错误是否由 MCP 连接断开引起（如服务器进程退出）
+func isMCPConnectionError(err error) bool {
+	return errors.Is(err, sdkmcp.ErrConnectionClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
+
+// mcpServerOf 返回提供该工具的 MCP 服务器（非 MCP 工具返回 nil）
+func (a *Agent) mcpServerOf(name string) mcpConnection {
+	a.mcpMu.Lock()
+	defer a.mcpMu.Unlock()
+	return a.mcpTools.owners[name]
+}
+
+// recoverMCPTool 在 MCP 连接断开时重连工具所属的服务器并重新执行
+//
+// 最多重连 retryConfig.MaxRetries 次；非 MCP 工具、非连接错误或重连失败时返回原错误。
+func (a *Agent) recoverMCPTool(
+	ctx context.Context,
+	logger *slog.Logger,
+	failed tool.Tool,
+	err error,
+	execute func(tool.Tool) (any, error),
+) (any, error) {
+	server := a.mcpServerOf(failed.Name())
+	if server == nil || a.retryConfig == nil {
+		return nil, err
+	}
+
+	current := failed
+	for attempt := 1; attempt <= a.retryConfig.MaxRetries && isMCPConnectionError(err); attempt++ {
+		logger.Warn("MCP connection lost, reconnecting",
+			"server", server.Name(), "tool", failed.Name(), "attempt", attempt, "error", err)
+
+		next, reconnectErr := a.reconnectMCP(ctx, server, current)
+		if reconnectErr != nil {
+			logger.Warn("MCP reconnect failed", "server", server.Name(), "error", reconnectErr)
+			return nil, fmt.Errorf("%w (reconnect MCP server %s: %w)", err, server.Name(), reconnectErr)
+		}
+
+		current = next
+		var output any
+		output, err = execute(current)
+		if err == nil {
+			logger.Info("MCP tool succeeded after reconnect", "server", server.Name(), "tool", failed.Name())
+			return output, nil
+		}
+	}
+	return nil, err
+}
+
+// reconnectMCP 重连 MCP 服务器并重新注册其工具，返回 failed 的新实例
+//
+// 并发的工具调用可能同时发现断线，只有第一个调用真正重连，其余直接使用重连后的工具。
+func (a *Agent) reconnectMCP(ctx context.Context, server mcpConnection, failed tool.Tool) (tool.Tool, error) {
+	a.mcpMu.Lock()
+	defer a.mcpMu.Unlock()
+
+	name := failed.Name()
+	if current, ok := a.toolRegistry.Get(name); ok && current != failed {
+		return current, nil
+	}
+
+	_ = server.Close()
+	if err := server.Connect(ctx); err != nil {
+		return nil, err
+	}
+	tools, err := server.LoadTools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mcpTools.replace(a.toolRegistry, a.logger, server, tools)
+
+	current, ok := a.toolRegistry.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("tool %q no longer provided by MCP server %s", name, server.Name())
+	}
+	return current, nil
+}
@@ -0,0 +1,267 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/lwmacct/251215-go-pkg-mcp/pkg/mcp"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+	sdkmcp "github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// MCP Reconnect Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// fakeMCPServer 模拟 MCP 服务器：每次连接产生新一代工具，dropped 时旧连接的工具返回连接错误
+type fakeMCPServer struct {
+	name       string
+	mu         sync.Mutex
+	generation int
+	connects   int
+	closed     int
+	dropped    bool
+	connectErr error
+	toolNames  []string
+}
+
+func (s *fakeMCPServer) Name() string {
+	if s.name == "" {
+		return "fake"
+	}
+	return s.name
+}
+
+func (s *fakeMCPServer) Connect(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connectErr != nil {
+		return s.connectErr
+	}
+	s.connects++
+	s.generation++
+	s.dropped = false
+	return nil
+}
+
+func (s *fakeMCPServer) LoadTools(context.Context) ([]tool.Tool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tools := make([]tool.Tool, 0, len(s.toolNames))
+	for _, name := range s.toolNames {
+		tools = append(tools, &fakeMCPTool{server: s, name: name, generation: s.generation})
+	}
+	return tools, nil
+}
+
+func (s *fakeMCPServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed++
+	return nil
+}
+
+// drop 模拟服务器进程退出
+func (s *fakeMCPServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped = true
+}
+
+// fakeMCPTool fakeMCPServer 提供的工具
+type fakeMCPTool struct {
+	server     *fakeMCPServer
+	name       string
+	generation int
+}
+
+func (t *fakeMCPTool) Name() string                 { return t.name }
+func (t *fakeMCPTool) Description() string          { return "Remote tool" }
+func (t *fakeMCPTool) InputSchema() map[string]any  { return map[string]any{"type": "object"} }
+func (t *fakeMCPTool) OutputSchema() map[string]any { return map[string]any{"type": "object"} }
+
+func (t *fakeMCPTool) Execute(context.Context, json.RawMessage) (any, error) {
+	t.server.mu.Lock()
+	defer t.server.mu.Unlock()
+	if t.server.dropped || t.generation != t.server.generation {
+		return nil, fmt.Errorf("calling %q: %w", "tools/call", sdkmcp.ErrConnectionClosed)
+	}
+	return fmt.Sprintf("gen-%d", t.generation), nil
+}
+
+// newMCPTestAgent 创建挂载 fakeMCPServer 工具的 Agent
+func newMCPTestAgent(t *testing.T, server *fakeMCPServer, opts ...Option) *Agent {
+	t.Helper()
+	provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return toolCallMessage("call-1", "remote", map[string]any{})
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+	ag := newTestAgent(t, provider, append([]Option{WithTools(newEchoTool())}, opts...)...)
+
+	require.NoError(t, server.Connect(context.Background()))
+	tools, err := server.LoadTools(context.Background())
+	require.NoError(t, err)
+	ag.mcpTools.add(ag.toolRegistry, ag.logger, server, tools)
+	return ag
+}
+
+func TestAgent_MCPReconnect(t *testing.T) {
+	t.Run("reconnects_and_retries", func(t *testing.T) {
+		server := &fakeMCPServer{toolNames: []string{"remote", "other"}}
+		ag := newMCPTestAgent(t, server)
+		server.drop()
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, server.connects)
+		msgs := ag.Messages()
+		block := msgs[2].ContentBlocks[0].(*llm.ToolResultBlock)
+		assert.False(t, block.IsError)
+		assert.Equal(t, `"gen-2"`, block.Content)
+
+		// 同一服务器的其他工具也已替换为新连接的实例
+		other, ok := ag.toolRegistry.Get("other")
+		require.True(t, ok)
+		assert.Equal(t, 2, other.(*fakeMCPTool).generation)
+	})
+
+	t.Run("removes_tools_no_longer_provided", func(t *testing.T) {
+		server := &fakeMCPServer{toolNames: []string{"remote", "other"}}
+		ag := newMCPTestAgent(t, server)
+		server.drop()
+		server.toolNames = []string{"remote"}
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		assert.False(t, ag.toolRegistry.Has("other"))
+		assert.NotContains(t, ag.mcpTools.owners, "other")
+	})
+
+	t.Run("reconnect_failure", func(t *testing.T) {
+		server := &fakeMCPServer{toolNames: []string{"remote"}}
+		ag := newMCPTestAgent(t, server)
+		server.drop()
+		server.connectErr = errors.New("spawn failed")
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		block := ag.Messages()[2].ContentBlocks[0].(*llm.ToolResultBlock)
+		assert.True(t, block.IsError)
+		assert.Contains(t, block.Content, "connection closed")
+		assert.Contains(t, block.Content, "spawn failed")
+	})
+
+	t.Run("disabled_without_retries", func(t *testing.T) {
+		server := &fakeMCPServer{toolNames: []string{"remote"}}
+		ag := newMCPTestAgent(t, server, WithRetryConfig(&RetryConfig{}))
+		server.drop()
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, server.connects)
+		block := ag.Messages()[2].ContentBlocks[0].(*llm.ToolResultBlock)
+		assert.True(t, block.IsError)
+	})
+
+	t.Run("connection_errors", func(t *testing.T) {
+		assert.True(t, isMCPConnectionError(fmt.Errorf("call: %w", sdkmcp.ErrConnectionClosed)))
+		assert.False(t, isMCPConnectionError(errors.New("tool error: bad input")))
+	})
+}
+
+func TestAgent_MCPServerManagement(t *testing.T) {
+	t.Run("add_and_remove", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithTools(newEchoTool()))
+		server := &fakeMCPServer{name: "remote-server", toolNames: []string{"remote", "other"}}
+
+		require.NoError(t, ag.addMCPServer(context.Background(), server))
+		assert.Equal(t, 1, server.connects)
+		assert.True(t, ag.toolRegistry.Has("remote"))
+		assert.True(t, ag.toolRegistry.Has("other"))
+
+		err := ag.addMCPServer(context.Background(), &fakeMCPServer{name: "remote-server"})
+		require.ErrorContains(t, err, "already added")
+
+		require.NoError(t, ag.RemoveMCPServer("remote-server"))
+		assert.Equal(t, 1, server.closed)
+		assert.False(t, ag.toolRegistry.Has("remote"))
+		assert.False(t, ag.toolRegistry.Has("other"))
+		assert.True(t, ag.toolRegistry.Has("echo"), "non-MCP tools are kept")
+		assert.Empty(t, ag.mcpServers)
+
+		require.ErrorContains(t, ag.RemoveMCPServer("remote-server"), "not found")
+	})
+
+	t.Run("overlapping_tool_names", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithTools(newEchoTool()))
+		first := &fakeMCPServer{name: "first", toolNames: []string{"search", "read"}}
+		second := &fakeMCPServer{name: "second", toolNames: []string{"search", "write"}}
+		require.NoError(t, ag.addMCPServer(context.Background(), first))
+		require.NoError(t, ag.addMCPServer(context.Background(), second))
+
+		// 同名工具以后添加的服务器为准
+		assert.Equal(t, []string{"read"}, ag.MCPToolNames("first"))
+		assert.Equal(t, []string{"search", "write"}, ag.MCPToolNames("second"))
+		assert.Nil(t, ag.MCPToolNames("missing"))
+
+		// 移除 second 后恢复 first 的同名工具
+		require.NoError(t, ag.RemoveMCPServer("second"))
+		search, ok := ag.toolRegistry.Get("search")
+		require.True(t, ok)
+		assert.Same(t, first, search.(*fakeMCPTool).server)
+		assert.False(t, ag.toolRegistry.Has("write"))
+		assert.Equal(t, []string{"search", "read"}, ag.MCPToolNames("first"))
+
+		require.NoError(t, ag.RemoveMCPServer("first"))
+		assert.False(t, ag.toolRegistry.Has("search"))
+		assert.True(t, ag.toolRegistry.Has("echo"))
+	})
+
+	t.Run("removing_shadowed_server_keeps_active_tool", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithTools(newEchoTool()))
+		first := &fakeMCPServer{name: "first", toolNames: []string{"search"}}
+		second := &fakeMCPServer{name: "second", toolNames: []string{"search"}}
+		require.NoError(t, ag.addMCPServer(context.Background(), first))
+		require.NoError(t, ag.addMCPServer(context.Background(), second))
+
+		require.NoError(t, ag.RemoveMCPServer("first"))
+		search, ok := ag.toolRegistry.Get("search")
+		require.True(t, ok)
+		assert.Same(t, second, search.(*fakeMCPTool).server)
+	})
+
+	t.Run("closed_with_agent", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithTools(newEchoTool()))
+		server := &fakeMCPServer{toolNames: []string{"remote"}}
+		require.NoError(t, ag.addMCPServer(context.Background(), server))
+
+		require.NoError(t, ag.Close())
+		assert.Equal(t, 1, server.closed)
+	})
+
+	t.Run("connect_error", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithTools(newEchoTool()))
+		err := ag.addMCPServer(context.Background(), &fakeMCPServer{connectErr: errors.New("spawn failed")})
+		require.ErrorContains(t, err, "connect MCP server fake: spawn failed")
+		assert.Empty(t, ag.mcpServers)
+	})
+
+	t.Run("no_tool_registry", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New())
+		err := ag.AddMCPServer(context.Background(), &mcp.ServerConfig{Name: "x", Command: "true"})
+		require.ErrorIs(t, err, ErrNoToolRegistry)
+	})
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 指标收集
+// ═══════════════════════════════════════════════════════════════════════════
+
+// Metrics 指标收集接口
+//
+// 用于把 Agent 内部的计数和耗时接入现有监控系统（Prometheus、StatsD 等）。
+// 方法在执行 goroutine 中同步调用，应尽快返回；开启 ParallelTools 时可能被并发调用，实现需并发安全。
+//
+// Prometheus 适配示例：
+//
+//	type promMetrics struct {
+//	    toolCalls *prometheus.CounterVec // labels: tool
+//	    latency   prometheus.Histogram
+//	    retries   prometheus.Counter
+//	    tokens    prometheus.Histogram
+//	}
+//
+//	func (m *promMetrics) IncToolCalls(name string)          { m.toolCalls.WithLabelValues(name).Inc() }
+//	func (m *promMetrics) ObserveLLMLatency(d time.Duration) { m.latency.Observe(d.Seconds()) }
+//	func (m *promMetrics) IncRetries(n int)                  { m.retries.Add(float64(n)) }
+//	func (m *promMetrics) ObserveTokens(n int)               { m.tokens.Observe(float64(n)) }
+//
+//	ag, err := agent.NewAgent(agent.WithMetrics(&promMetrics{...}))
+type Metrics interface {
+	// IncToolCalls 每次执行工具时调用（包括执行失败，不包括被拒绝的调用）
+	IncToolCalls(name string)
+
+	// ObserveLLMLatency 每次 LLM 调用成功返回后记录耗时（包括重试等待）
+	ObserveLLMLatency(d time.Duration)
+
+	// IncRetries 每次重试前调用（Provider 调用、工具执行和结构化输出纠正）
+	IncRetries(n int)
+
+	// ObserveTokens 每次 LLM 调用返回用量时记录本次消耗的 Token 总数
+	ObserveTokens(n int)
+}
+
+// NopMetrics 不记录任何指标的 Metrics 实现（未设置 Metrics 时的默认值）
+type NopMetrics struct{}
+
+// IncToolCalls 实现 Metrics 接口
+func (NopMetrics) IncToolCalls(string) {}
+
+// ObserveLLMLatency 实现 Metrics 接口
+func (NopMetrics) ObserveLLMLatency(time.Duration) {}
+
+// IncRetries 实现 Metrics 接口
+func (NopMetrics) IncRetries(int) {}
+
+// ObserveTokens 实现 Metrics 接口
+func (NopMetrics) ObserveTokens(int) {}
+
+// metricsOrNop 返回指标收集器（未设置时为 NopMetrics）
+func (a *Agent) metricsOrNop() Metrics {
+	if a.metrics == nil {
+		return NopMetrics{}
+	}
+	return a.metrics
+}
+
+// observeCall 记录单次 LLM 调用的耗时和 Token 消耗
+func (a *Agent) observeCall(latency time.Duration, usage *llm.TokenUsage) {
+	m := a.metricsOrNop()
+	m.ObserveLLMLatency(latency)
+	if usage != nil {
+		m.ObserveTokens(usageTotal(usage))
+	}
+}
+
+// 确保 NopMetrics 实现了 Metrics 接口
+var _ Metrics = NopMetrics{}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"context"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider 中间件
+// ═══════════════════════════════════════════════════════════════════════════
+
+// ProviderCallFunc 一次 Provider 调用
+//
+// 流式调用时，返回的是流结束后组装的完整响应。
+type ProviderCallFunc func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error)
+
+// ProviderMiddleware Provider 调用中间件
+//
+// 包装每一次 Provider 调用（流式与非流式），可用于日志、缓存、修改请求等。
+// 中间件可以不调用 next 而直接返回响应（短路），例如命中缓存；
+// 流式调用被短路时，Agent 会以单个文本事件发送完整文本。
+//
+// 示例：
+//
+//	logging := func(next agent.ProviderCallFunc) agent.ProviderCallFunc {
+//	    return func(ctx context.Context, msgs []llm.Message, opts *llm.Options) (*llm.Response, error) {
+//	        start := time.Now()
+//	        resp, err := next(ctx, msgs, opts)
+//	        log.Printf("llm call took %s", time.Since(start))
+//	        return resp, err
+//	    }
+//	}
+type ProviderMiddleware func(next ProviderCallFunc) ProviderCallFunc
+
+// streamingKey context 中标记流式调用的键
+type streamingKey struct{}
+
+// modelKey context 中记录调用模型的键
+type modelKey struct{}
+
+// contextWithStreaming 标记当前为流式调用
+func contextWithStreaming(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamingKey{}, true)
+}
+
+// contextWithModel 记录当前调用使用的模型
+func contextWithModel(ctx context.Context, model string) context.Context {
+	return context.WithValue(ctx, modelKey{}, model)
+}
+
+// CallModel 返回中间件收到的调用实际使用的模型（已考虑截止时间降级）
+func CallModel(ctx context.Context) string {
+	model, _ := ctx.Value(modelKey{}).(string)
+	return model
+}
+
+// IsStreamingCall 判断中间件收到的调用是否为流式调用
+func IsStreamingCall(ctx context.Context) bool {
+	streaming, _ := ctx.Value(streamingKey{}).(bool)
+	return streaming
+}
+
+// callModel 返回本次调用使用的模型
+func (a *Agent) callModel(downgraded bool) string {
+	if downgraded {
+		return a.config.DowngradeModel
+	}
+	return a.config.LLM.Model
+}
+
+// wrapProviderCall 按注册顺序包装中间件（先注册的在最外层）
+func (a *Agent) wrapProviderCall(call ProviderCallFunc) ProviderCallFunc {
+	for i := len(a.middlewares) - 1; i >= 0; i-- {
+		call = a.middlewares[i](call)
+	}
+	return call
+}
@@ -1,10 +1,16 @@
 package agent
 
 import (
+	"context"
 	"log/slog"
+	"maps"
+	"net/http"
 	"os"
+	"slices"
+	"time"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider"
 	"github.com/lwmacct/251215-go-pkg-mcp/pkg/mcp"
 	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
 	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool/builtin"
@@ -18,24 +24,107 @@ import (
 type builder struct {
 	config       *Config
 	provider     llm.Provider
+	fallbacks    []llm.Provider
 	toolRegistry *tool.Registry
 	logger       *slog.Logger
 
+	// Provider 工厂（自动创建 Provider 时使用）
+	newProvider func(cfg *llm.Config) (llm.Provider, error)
+
+	// ID 生成函数（nil 时使用默认的 agt-<uuid>）
+	idGenerator func() string
+
+	// 自动创建 Provider 时使用的 HTTP 客户端
+	httpClient *http.Client
+
 	// MCP 服务器
 	mcpServers []*mcp.Server
 
 	// 重试配置
-	retryConfig *RetryConfig
+	retryConfig     *RetryConfig
+	retryClassifier RetryClassifier
+
+	// 初始对话历史
+	history []llm.Message
+
+	// 结构化输出 Schema
+	responseSchema any
+
+	// 生命周期钩子
+	hooks Hooks
+
+	// 最终答案校验
+	answerValidator AnswerValidator
+
+	// Provider 中间件
+	middlewares []ProviderMiddleware
+
+	// 事件转换器
+	eventTransformers []EventTransformer
+
+	// 工具结果消息构建
+	toolResultMessageFunc ToolResultMessageFunc
+
+	// 工具调用审批
+	toolApproval ToolApprovalFunc
+
+	// 工具结果脱敏
+	redactor Redactor
+
+	// 工具错误格式化
+	toolErrorFormatter ToolErrorFormatter
+
+	// 工具结果缓存
+	toolCache ToolResultCache
+
+	// 工具执行的共享并发限制
+	toolSemaphore ToolSemaphore
+
+	// 模型价格表
+	pricing map[string]ModelPrice
+
+	// 对话历史压缩器
+	compactor Compactor
+
+	// Token 计数器
+	tokenCounter TokenCounter
+
+	// 指标收集器
+	metrics Metrics
+
+	// 链路追踪
+	tracer Tracer
+
+	// Agent 生命周期的父 context
+	baseCtx context.Context
 }
 
 // newBuilder 创建构建器
 func newBuilder() *builder {
 	return &builder{
-		config:     DefaultConfig(),
-		mcpServers: make([]*mcp.Server, 0),
+		config:      DefaultConfig(),
+		newProvider: provider.New,
+		mcpServers:  make([]*mcp.Server, 0),
 	}
 }
 
+// clone 复制构建器（配置深拷贝，工具注册表复制，MCP 服务器不复制）
+//
+// Provider、钩子、中间件等运行时依赖与原构建器共享。
+func (b *builder) clone() *builder {
+	c := *b
+	c.config = cloneConfig(b.config)
+	c.mcpServers = make([]*mcp.Server, 0)
+	c.history = slices.Clone(b.history)
+	c.fallbacks = slices.Clone(b.fallbacks)
+	c.middlewares = slices.Clone(b.middlewares)
+	c.eventTransformers = slices.Clone(b.eventTransformers)
+	if b.toolRegistry != nil {
+		c.toolRegistry = b.toolRegistry.Clone()
+	}
+	return &c
+}
+
 // Option Agent 配置选项
 type Option func(*builder)
 
@@ -50,6 +139,20 @@ func WithID(id string) Option {
 	}
 }
 
+// WithIDGenerator 设置 Agent ID 生成函数（未设置 ID 时生效，nil 恢复默认的 UUID 方案）
+func WithIDGenerator(fn func() string) Option {
+	return func(b *builder) {
+		b.idGenerator = fn
+	}
+}
+
+// WithDeterministicID 设置是否根据配置派生稳定的 Agent ID（未设置 ID 时生效）
+func WithDeterministicID(enabled bool) Option {
+	return func(b *builder) {
+		b.config.DeterministicID = enabled
+	}
+}
+
 // WithName 设置 Agent 名称
 func WithName(name string) Option {
 	return func(b *builder) {
@@ -89,6 +192,13 @@ func WithAPIKeyFromEnv(envName string) Option {
 	}
 }
 
+// WithProviderType 设置 Provider 类型（如 llm.ProviderTypeAnthropic）
+func WithProviderType(t llm.ProviderType) Option {
+	return func(b *builder) {
+		b.config.LLM.Type = t
+	}
+}
+
 // WithBaseURL 设置 API 端点
 func WithBaseURL(baseURL string) Option {
 	return func(b *builder) {
@@ -96,6 +206,13 @@ func WithBaseURL(baseURL string) Option {
 	}
 }
 
+// WithLLMTimeout 设置单次 Provider 调用的超时时间（0 表示不限制，执行 ctx 的截止时间始终生效）
+func WithLLMTimeout(d time.Duration) Option {
+	return func(b *builder) {
+		b.config.LLM.Timeout = d
+	}
+}
+
 // WithMaxTokens 设置最大 token 数
 func WithMaxTokens(maxTokens int) Option {
 	return func(b *builder) {
@@ -103,6 +220,79 @@ func WithMaxTokens(maxTokens int) Option {
 	}
 }
 
+// WithContextWindow 设置模型上下文窗口大小（用于计算上下文使用率）
+func WithContextWindow(tokens int) Option {
+	return func(b *builder) {
+		b.config.ContextWindow = tokens
+	}
+}
+
+// WithContextWarningThreshold 设置上下文溢出告警的使用率（0..1，0 表示使用 0.9）
+func WithContextWarningThreshold(ratio float64) Option {
+	return func(b *builder) {
+		b.config.ContextWarningThreshold = ratio
+	}
+}
+
+// WithTokenCounter 设置输入 token 数的计算方式（默认按字符数粗略估算）
+func WithTokenCounter(tc TokenCounter) Option {
+	return func(b *builder) {
+		b.tokenCounter = tc
+	}
+}
+
+// WithCompactor 设置对话历史压缩器（超过 CompactThreshold 时在调用 Provider 前压缩历史）
+func WithCompactor(c Compactor) Option {
+	return func(b *builder) {
+		b.compactor = c
+	}
+}
+
+// WithMaxHistoryMessages 设置每次调用 Provider 时最多发送的历史消息数（未设置 Compactor 时生效）
+func WithMaxHistoryMessages(n int) Option {
+	return func(b *builder) {
+		b.config.MaxHistoryMessages = n
+	}
+}
+
+// WithCompactThreshold 设置触发历史压缩的估算 token 数（0 表示使用 ContextWindow 的 80%）
+func WithCompactThreshold(tokens int) Option {
+	return func(b *builder) {
+		b.config.CompactThreshold = tokens
+	}
+}
+
+// WithTemperature 设置采样温度（显式的 0 会被保留）
+func WithTemperature(t float64) Option {
+	return func(b *builder) {
+		b.config.Temperature = &t
+	}
+}
+
+// WithTopP 设置核采样概率
+func WithTopP(p float64) Option {
+	return func(b *builder) {
+		b.config.TopP = &p
+	}
+}
+
+// WithSeed 设置采样随机种子（仅声明 ProviderCapabilities.Seed 的 Provider 使用，见 Builder.Seed）
+func WithSeed(seed int) Option {
+	return func(b *builder) {
+		b.config.Seed = &seed
+	}
+}
+
+// WithDeadlineDowngrade 设置临近截止时间时的模型降级策略
+//
+// 剩余时间低于 threshold 时，下一步改用 fastModel 并禁用工具。
+func WithDeadlineDowngrade(fastModel string, threshold time.Duration) Option {
+	return func(b *builder) {
+		b.config.DowngradeModel = fastModel
+		b.config.DowngradeThreshold = threshold
+	}
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // Agent 行为选项
 // ═══════════════════════════════════════════════════════════════════════════
@@ -114,6 +304,20 @@ func WithPrompt(prompt string) Option {
 	}
 }
 
+// WithSystemTemplate 设置系统提示词模板（每次执行时用 WithPromptVars 提供的变量渲染）
+func WithSystemTemplate(tmpl string) Option {
+	return func(b *builder) {
+		b.config.SystemTemplate = tmpl
+	}
+}
+
+// WithSystemSegments 追加系统提示词分段（追加在系统提示词之后，以空行分隔）
+func WithSystemSegments(segments ...string) Option {
+	return func(b *builder) {
+		b.config.SystemSegments = append(b.config.SystemSegments, segments...)
+	}
+}
+
 // WithWorkDir 设置工作目录
 func WithWorkDir(workDir string) Option {
 	return func(b *builder) {
@@ -121,6 +325,83 @@ func WithWorkDir(workDir string) Option {
 	}
 }
 
+// WithAllowEmptyInput 设置是否允许空输入（续写场景）
+func WithAllowEmptyInput(allow bool) Option {
+	return func(b *builder) {
+		b.config.AllowEmptyInput = allow
+	}
+}
+
+// WithStateless 设置无状态模式（每次执行前将会话历史重置为初始历史）
+func WithStateless(enabled bool) Option {
+	return func(b *builder) {
+		b.config.Stateless = enabled
+	}
+}
+
+// WithAuditMode 设置是否开启审计记录（结果附带每一步的请求与响应）
+func WithAuditMode(enabled bool) Option {
+	return func(b *builder) {
+		b.config.AuditMode = enabled
+	}
+}
+
+// WithLogPrompts 设置是否在 debug 日志中记录完整提示词与响应（已脱敏）
+func WithLogPrompts(enabled bool) Option {
+	return func(b *builder) {
+		b.config.LogPrompts = enabled
+	}
+}
+
+// WithHashPromptContent 设置提示词日志是否以 SHA-256 摘要代替消息内容
+func WithHashPromptContent(enabled bool) Option {
+	return func(b *builder) {
+		b.config.HashPromptContent = enabled
+	}
+}
+
+// WithCaptureReasoning 设置是否将推理内容记录到 Result.Reasoning
+func WithCaptureReasoning(enabled bool) Option {
+	return func(b *builder) {
+		b.config.CaptureReasoning = enabled
+	}
+}
+
+// WithResponseSchema 设置结构化输出的 JSON Schema
+//
+// 设置后 Provider 以 json_schema 模式返回，最终回复解析到 Result.Structured。
+// schema 无效时 NewAgent 返回错误。
+func WithResponseSchema(schema any) Option {
+	return func(b *builder) {
+		b.responseSchema = schema
+	}
+}
+
+// WithHistory 设置初始对话历史（恢复已保存的对话）
+//
+// 历史消息按原样追加到 Agent 消息列表，不校验角色顺序，
+// 会出现在 Messages() 中并在下一次 Run 时发送给 Provider。
+//
+// 使用示例：
+//
+//	ag, err := agent.NewAgent(
+//	    agent.WithHistory(savedMessages),
+//	)
+func WithHistory(msgs []llm.Message) Option {
+	return func(b *builder) {
+		b.history = append(b.history, msgs...)
+	}
+}
+
+// WithExamples 添加少样本示例（user/assistant 消息对）
+//
+// 示例在每次调用 Provider 时插入在会话历史之前，不计入 Messages()。
+func WithExamples(msgs ...llm.Message) Option {
+	return func(b *builder) {
+		b.config.Examples = append(b.config.Examples, msgs...)
+	}
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 依赖注入选项
 // ═══════════════════════════════════════════════════════════════════════════
@@ -150,6 +431,32 @@ func WithProvider(p llm.Provider) Option {
 	}
 }
 
+// WithProviderPool 使用 Provider 池作为 Provider（按加权轮询分配每次调用）
+func WithProviderPool(pool *ProviderPool) Option {
+	return func(b *builder) {
+		if pool != nil {
+			b.provider = pool
+		}
+	}
+}
+
+// WithHTTPClient 设置自动创建 Provider 时使用的 HTTP 客户端（Provider 需实现 HTTPClientSetter）
+func WithHTTPClient(client *http.Client) Option {
+	return func(b *builder) {
+		b.httpClient = client
+	}
+}
+
+// WithFallbacks 设置备用 Provider
+//
+// 主 Provider 重试后仍因超时、限流、5xx 等可用性错误失败时，依次改用备用 Provider 完成本次调用。
+// 备用 Provider 由 Agent 持有，Close 时一并关闭。
+func WithFallbacks(providers ...llm.Provider) Option {
+	return func(b *builder) {
+		b.fallbacks = append(b.fallbacks, providers...)
+	}
+}
+
 // WithToolRegistry 设置工具注册表
 func WithToolRegistry(registry *tool.Registry) Option {
 	return func(b *builder) {
@@ -157,6 +464,112 @@ func WithToolRegistry(registry *tool.Registry) Option {
 	}
 }
 
+// WithHooks 设置生命周期钩子
+//
+// 示例：
+//
+//	ag, err := agent.NewAgent(
+//	    agent.WithHooks(agent.Hooks{
+//	        OnToolCall: func(tc *llm.ToolCall) { metrics.Inc(tc.Name) },
+//	    }),
+//	)
+func WithHooks(h Hooks) Option {
+	return func(b *builder) {
+		b.hooks = h
+	}
+}
+
+// WithOnStateChange 设置 Agent 状态变化回调（等价于设置 Hooks.OnStateChange）
+func WithOnStateChange(fn func(from, to State)) Option {
+	return func(b *builder) {
+		b.hooks.OnStateChange = fn
+	}
+}
+
+// WithMetrics 设置指标收集器（工具调用次数、LLM 耗时、重试次数、Token 消耗）
+//
+// 未设置时使用 NopMetrics。
+func WithMetrics(m Metrics) Option {
+	return func(b *builder) {
+		b.metrics = m
+	}
+}
+
+// WithTracer 设置链路追踪器
+//
+// 每次执行创建 agent.run 根 span，每一步创建 agent.step 子 span，每个工具执行创建 agent.tool 子 span。
+// 未设置时不产生任何 span。
+func WithTracer(t Tracer) Option {
+	return func(b *builder) {
+		b.tracer = t
+	}
+}
+
+// WithApproveToolCall 设置工具调用审批函数
+//
+// 每个工具执行前调用 fn：返回 false 时跳过执行并告知模型调用被拒绝；返回 error 时中止本次执行。
+func WithApproveToolCall(fn ToolApprovalFunc) Option {
+	return func(b *builder) {
+		b.toolApproval = fn
+	}
+}
+
+// WithRedactor 设置工具结果脱敏函数（作用于日志和事件，不影响发送给模型的内容）
+func WithRedactor(fn Redactor) Option {
+	return func(b *builder) {
+		b.redactor = fn
+	}
+}
+
+// WithToolErrorFormatter 设置工具执行失败时反馈给模型的内容格式化函数（nil 恢复默认的 "Error: <err>"）
+func WithToolErrorFormatter(fn ToolErrorFormatter) Option {
+	return func(b *builder) {
+		b.toolErrorFormatter = fn
+	}
+}
+
+// WithAnswerValidator 设置最终答案校验函数
+//
+// 校验失败时按 WithAnswerRetries 设置的次数带着失败原因重新生成，
+// 重试耗尽后返回 ErrAnswerRejected。
+func WithAnswerValidator(fn AnswerValidator) Option {
+	return func(b *builder) {
+		b.answerValidator = fn
+	}
+}
+
+// WithAnswerRetries 设置答案校验失败后的最大重试次数（0 表示不重试）
+func WithAnswerRetries(n int) Option {
+	return func(b *builder) {
+		b.config.AnswerRetries = n
+	}
+}
+
+// WithMiddleware 添加 Provider 调用中间件（先添加的在最外层）
+func WithMiddleware(mw ...ProviderMiddleware) Option {
+	return func(b *builder) {
+		b.middlewares = append(b.middlewares, mw...)
+	}
+}
+
+// WithEventTransformers 添加事件转换器（按添加顺序依次执行，返回 nil 丢弃事件）
+func WithEventTransformers(fns ...EventTransformer) Option {
+	return func(b *builder) {
+		b.eventTransformers = append(b.eventTransformers, fns...)
+	}
+}
+
+// WithBaseContext 设置 Agent 生命周期的父 context
+//
+// Agent 内部 context 派生自 ctx：ctx 取消时，进行中的执行被中断，
+// Agent 自动关闭并拒绝新的 Run（返回 ErrAgentStopped）。
+// 适合服务端在收到 SIGTERM 时通过取消根 context 统一关闭所有 Agent。
+func WithBaseContext(ctx context.Context) Option {
+	return func(b *builder) {
+		b.baseCtx = ctx
+	}
+}
+
 // WithLogger 设置日志器
 func WithLogger(logger *slog.Logger) Option {
 	return func(b *builder) {
@@ -270,6 +683,159 @@ func WithGlobalTools(names ...string) Option {
 	}
 }
 
+// WithAllowedTools 限制模型只能使用指定的工具（未允许的工具不提供给模型，也不会被执行）
+func WithAllowedTools(names ...string) Option {
+	return func(b *builder) {
+		b.config.AllowedTools = append(b.config.AllowedTools, names...)
+	}
+}
+
+// WithToolResultCache 设置工具结果缓存（作用于实现 CacheableTool 或在 CacheableTools 中声明的工具）
+func WithToolResultCache(cache ToolResultCache) Option {
+	return func(b *builder) {
+		b.toolCache = cache
+	}
+}
+
+// WithCacheableTools 声明结果可缓存的工具（未设置 WithToolResultCache 时使用默认 LRU）
+func WithCacheableTools(names ...string) Option {
+	return func(b *builder) {
+		b.config.CacheableTools = append(b.config.CacheableTools, names...)
+	}
+}
+
+// WithDeniedTools 禁止模型使用指定的工具（优先于 WithAllowedTools）
+func WithDeniedTools(names ...string) Option {
+	return func(b *builder) {
+		b.config.DeniedTools = append(b.config.DeniedTools, names...)
+	}
+}
+
+// WithParallelTools 设置是否并发执行同一步中的多个工具调用
+func WithParallelTools(enabled bool) Option {
+	return func(b *builder) {
+		b.config.ParallelTools = enabled
+	}
+}
+
+// WithMaxParallelTools 设置并发执行工具的最大数量（0 表示使用默认值 4）
+func WithMaxParallelTools(n int) Option {
+	return func(b *builder) {
+		b.config.MaxParallelTools = n
+	}
+}
+
+// WithToolSemaphore 设置工具执行的共享并发限制（多个 Agent 可共享同一个限制）
+func WithToolSemaphore(sem ToolSemaphore) Option {
+	return func(b *builder) {
+		b.toolSemaphore = sem
+	}
+}
+
+// WithMaxToolCallsPerStep 设置单步最多执行的工具调用数（0 表示不限制）
+func WithMaxToolCallsPerStep(n int) Option {
+	return func(b *builder) {
+		b.config.MaxToolCallsPerStep = n
+	}
+}
+
+// WithMaxToolResultBytes 设置单个工具结果发送给模型的最大字节数（0 表示不限制）
+func WithMaxToolResultBytes(n int) Option {
+	return func(b *builder) {
+		b.config.MaxToolResultBytes = n
+	}
+}
+
+// WithFullToolResultEvents 设置工具结果被截断时 ToolResult 事件是否携带完整内容
+func WithFullToolResultEvents(enabled bool) Option {
+	return func(b *builder) {
+		b.config.FullToolResultEvents = enabled
+	}
+}
+
+// WithEventBufferSize 设置事件通道的缓冲大小（0 表示无缓冲，权衡见 Builder.EventBufferSize）
+func WithEventBufferSize(n int) Option {
+	return func(b *builder) {
+		b.config.EventBufferSize = &n
+	}
+}
+
+// WithRepairToolArgs 设置是否修复不规范的工具调用参数（尾随逗号、单引号等）
+func WithRepairToolArgs(enabled bool) Option {
+	return func(b *builder) {
+		b.config.RepairToolArgs = enabled
+	}
+}
+
+// WithInjectToolManual 设置是否将工具手册追加到系统提示词（默认注入）
+func WithInjectToolManual(enabled bool) Option {
+	return func(b *builder) {
+		b.config.InjectToolManual = &enabled
+	}
+}
+
+// WithForceToolSchemas 设置是否始终发送工具 Schema（忽略 Provider 的能力声明）
+func WithForceToolSchemas(enabled bool) Option {
+	return func(b *builder) {
+		b.config.ForceToolSchemas = enabled
+	}
+}
+
+// WithToolManualHeader 设置工具手册标题（同时用于避免重复注入）
+func WithToolManualHeader(header string) Option {
+	return func(b *builder) {
+		b.config.ToolManualHeader = header
+	}
+}
+
+// WithToolManualTemplate 设置工具手册正文模板（text/template 语法，数据为 ToolManualData）
+func WithToolManualTemplate(tmpl string) Option {
+	return func(b *builder) {
+		b.config.ToolManualTemplate = tmpl
+	}
+}
+
+// WithToolResultMessageBuilder 设置工具结果转换为对话消息的方式
+//
+// 默认所有结果合并为一条 RoleUser 消息（DefaultToolResultMessages）。
+func WithToolResultMessageBuilder(fn ToolResultMessageFunc) Option {
+	return func(b *builder) {
+		b.toolResultMessageFunc = fn
+	}
+}
+
+// WithToolResultRole 设置承载工具结果的消息角色（llm.RoleUser 或 llm.RoleTool）
+func WithToolResultRole(role llm.Role) Option {
+	return func(b *builder) {
+		b.config.ToolResultRole = role
+	}
+}
+
+// WithPricingTable 设置模型价格表，用于在 EventTypeUsage 事件中估算费用
+func WithPricingTable(table map[string]ModelPrice) Option {
+	return func(b *builder) {
+		b.pricing = maps.Clone(table)
+	}
+}
+
+// WithMaxSteps 设置单次执行的最大步数（0 表示不限制）
+//
+// 防止模型持续发起工具调用导致无限循环。
+func WithMaxSteps(n int) Option {
+	return func(b *builder) {
+		b.config.MaxSteps = n
+	}
+}
+
+// WithMaxConsecutiveToolErrors 设置连续工具失败步数上限（0 表示不限制）
+//
+// 用于打断"工具持续失败、模型持续重试"的循环。
+func WithMaxConsecutiveToolErrors(n int) Option {
+	return func(b *builder) {
+		b.config.MaxConsecutiveToolErrors = n
+	}
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // MCP 服务器选项
 // ═══════════════════════════════════════════════════════════════════════════
@@ -333,6 +899,7 @@ func WithAgent(src *Agent) Option {
 //
 // 这是便捷函数，基于现有 Agent 创建新实例。
 // 新 Agent 完全独立，修改配置不会影响源 Agent。
+// 只复制配置，新 Agent 从空历史开始；需要保留对话历史时使用 Agent.CloneWithHistory 或 Agent.Fork。
 //
 // 使用示例：
 //
@@ -377,6 +944,27 @@ func WithRetryConfig(cfg *RetryConfig) Option {
 	}
 }
 
+// WithRetryClassifier 设置自定义的可重试错误判断函数
+//
+// 设置后替代 IsRetriable 的默认判断，适合识别自定义工具返回的错误类型。
+//
+// 使用示例：
+//
+//	ag, err := agent.NewAgent(
+//	    agent.WithRetryClassifier(func(err error) bool {
+//	        var apiErr *myapi.Error
+//	        if errors.As(err, &apiErr) {
+//	            return apiErr.Temporary
+//	        }
+//	        return agent.IsRetriable(err)
+//	    }),
+//	)
+func WithRetryClassifier(fn RetryClassifier) Option {
+	return func(b *builder) {
+		b.retryClassifier = fn
+	}
+}
+
 // WithMaxRetries 设置最大重试次数（便捷方法）
 //
 // 使用默认的退避配置，只调整重试次数。
@@ -397,6 +985,23 @@ func WithMaxRetries(maxRetries int) Option {
 	}
 }
 
+// WithMaxTotalRetries 设置单次执行的重试总数上限（便捷方法）
+//
+// 额度在一次执行内的 Provider 调用和工具调用之间共享，用尽后失败不再重试；0 表示不限制。
+//
+// 使用示例：
+//
+//	// 每个操作最多重试 3 次，整次执行最多重试 5 次
+//	ag, err := agent.NewAgent(agent.WithMaxRetries(3), agent.WithMaxTotalRetries(5))
+func WithMaxTotalRetries(maxTotalRetries int) Option {
+	return func(b *builder) {
+		if b.retryConfig == nil {
+			b.retryConfig = DefaultRetryConfig()
+		}
+		b.retryConfig.MaxTotalRetries = maxTotalRetries
+	}
+}
+
 // DisableRetry 禁用重试（便捷方法）
 //
 // 等价于 WithMaxRetries(0)。
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 先规划后执行
+// ═══════════════════════════════════════════════════════════════════════════
+
+// planPrompt 规划阶段的提示模板
+const planPrompt = "Before taking any action, write a concise step-by-step plan for the following task. " +
+	"Do not execute the plan yet.\n\nTask: %s"
+
+// executePrompt 执行阶段的提示
+const executePrompt = "Now execute the plan above step by step, using the available tools as needed, " +
+	"and give the final answer."
+
+// PlanAndExecute 先规划后执行（同步，阻塞直到完成）
+//
+// 分两个阶段在同一会话中执行：
+//  1. 规划：禁用工具，让模型为任务生成执行计划
+//  2. 执行：启用工具，以上一阶段的计划为上下文完成任务
+//
+// 两个阶段期间一直持有默认会话的执行锁，并发的 Run/Chat 排在整个调用之后，不会插入两阶段之间；
+// Stateless 模式下只在规划阶段前重置历史，执行阶段仍能看到计划。
+//
+// 返回执行阶段的结果，计划文本记录在 Result.Metadata["plan"]；
+// Token 统计、步数、步骤明细和 Messages 覆盖两个阶段。
+// opts 同时作用于两个阶段；任一阶段的完成事件被 WithEventFilter 或 EventTransformer
+// 丢弃时无法得到结果，返回错误。
+//
+// 使用示例:
+//
+//	result, err := ag.PlanAndExecute(ctx, "统计项目中的 Go 文件数量")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	fmt.Println(result.Metadata["plan"])
+//	fmt.Println(result.Text)
+func (a *Agent) PlanAndExecute(ctx context.Context, text string, opts ...RunOption) (*Result, error) {
+	a.mu.Lock()
+	lock := a.threadLockLocked("")
+	a.mu.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-a.stopCh:
+		return nil, ErrAgentStopped
+	}
+	defer func() { <-lock }()
+
+	held := func(o *RunOptions) { o.threadLocked = true }
+	planOpts := append(slices.Clone(opts), WithToolsDisabled(), held)
+	plan, err := collectResult(a.Run(ctx, fmt.Sprintf(planPrompt, text), planOpts...))
+	if err != nil {
+		return plan, fmt.Errorf("plan phase: %w", err)
+	}
+	if plan == nil {
+		// 完成事件被 WithEventFilter 或 EventTransformer 丢弃
+		return nil, errors.New("plan phase produced no result")
+	}
+
+	execOpts := append(slices.Clone(opts), held, func(o *RunOptions) { o.keepHistory = true })
+	result, err := collectResult(a.Run(ctx, executePrompt, execOpts...))
+	if result != nil {
+		result = mergePlanResult(plan, result)
+	}
+	if err != nil {
+		return result, fmt.Errorf("execute phase: %w", err)
+	}
+	if result == nil {
+		return nil, errors.New("execute phase produced no result")
+	}
+	return result, nil
+}
+
+// mergePlanResult 合并规划阶段与执行阶段的结果
+func mergePlanResult(plan, exec *Result) *Result {
+	merged := *exec
+	merged.Messages = append(slices.Clone(plan.Messages), exec.Messages...)
+	merged.StepCount = plan.StepCount + exec.StepCount
+	merged.PromptTokens = plan.PromptTokens + exec.PromptTokens
+	merged.CompletionTokens = plan.CompletionTokens + exec.CompletionTokens
+	merged.TotalTokens = plan.TotalTokens + exec.TotalTokens
+
+	// 执行阶段的步骤序号接续规划阶段
+	merged.Steps = slices.Clone(plan.Steps)
+	for _, step := range exec.Steps {
+		step.Index += plan.StepCount
+		merged.Steps = append(merged.Steps, step)
+	}
+
+	if plan.Reasoning != "" && exec.Reasoning != "" {
+		merged.Reasoning = plan.Reasoning + "\n\n" + exec.Reasoning
+	} else {
+		merged.Reasoning = plan.Reasoning + exec.Reasoning
+	}
+
+	merged.Metadata = make(map[string]any, len(exec.Metadata)+1)
+	maps.Copy(merged.Metadata, exec.Metadata)
+	merged.Metadata["plan"] = plan.Text
+	return &merged
+}
@@ -0,0 +1,220 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider 负载均衡池
+// ═══════════════════════════════════════════════════════════════════════════
+
+const (
+	// DefaultPoolFailureThreshold 成员连续失败多少次后暂时移出轮询
+	DefaultPoolFailureThreshold = 3
+
+	// DefaultPoolCooldown 成员移出轮询后的恢复时间
+	DefaultPoolCooldown = 30 * time.Second
+)
+
+// PoolMember Provider 池成员
+type PoolMember struct {
+	Provider llm.Provider
+	Weight   int // 权重（小于等于 0 时视为 1）
+}
+
+// ProviderPool 按加权轮询在多个 Provider 之间分配调用
+//
+// 适用于同一模型部署在多个 API Key 或端点上、需要分摊限流的场景。ProviderPool 实现了
+// llm.Provider，可以直接作为 Agent 的 Provider 使用，每次调用选择一个成员。
+//
+// 健康检查：成员连续 FailureThreshold 次出现可用性错误（见 IsRetriable）后移出轮询，
+// Cooldown 后重新加入；恢复后再次失败会立即移出，成功一次即清零失败计数。
+// 所有成员都被移出时选择最早恢复的成员，避免池完全不可用。
+//
+// FailureThreshold 和 Cooldown 需在开始使用前设置。
+//
+// 使用示例:
+//
+//	pool := agent.NewProviderPool(
+//	    agent.PoolMember{Provider: keyA, Weight: 3},
+//	    agent.PoolMember{Provider: keyB, Weight: 1},
+//	)
+//	ag, err := agent.New().ProviderPool(pool).Build()
+type ProviderPool struct {
+	FailureThreshold int           // 移出轮询前允许的连续失败次数（0 表示使用 DefaultPoolFailureThreshold）
+	Cooldown         time.Duration // 移出轮询的时长（0 表示使用 DefaultPoolCooldown）
+
+	mu      sync.Mutex
+	members []*poolMember
+	now     func() time.Time
+}
+
+// poolMember 成员及其轮询、健康状态
+type poolMember struct {
+	provider  llm.Provider
+	weight    int
+	current   int       // 平滑加权轮询的当前权重
+	failures  int       // 连续失败次数
+	downUntil time.Time // 移出轮询的截止时间
+}
+
+// NewProviderPool 创建 Provider 池
+func NewProviderPool(members ...PoolMember) *ProviderPool {
+	p := &ProviderPool{now: time.Now}
+	for _, m := range members {
+		weight := m.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p.members = append(p.members, &poolMember{provider: m.Provider, weight: weight})
+	}
+	return p
+}
+
+// Complete 选择一个成员完成非流式调用
+func (p *ProviderPool) Complete(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+	m, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.provider.Complete(ctx, messages, opts)
+	p.report(ctx, m, err)
+	return resp, err
+}
+
+// Stream 选择一个成员完成流式调用
+//
+// 流中出现错误事件时计为该成员的一次失败，正常结束计为成功。
+func (p *ProviderPool) Stream(ctx context.Context, messages []llm.Message, opts *llm.Options) (<-chan *llm.Event, error) {
+	m, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	src, err := m.provider.Stream(ctx, messages, opts)
+	if err != nil {
+		p.report(ctx, m, err)
+		return nil, err
+	}
+
+	out := make(chan *llm.Event, cap(src))
+	go func() {
+		defer close(out)
+		var streamErr error
+		for event := range src {
+			if event.Type == llm.EventTypeError && streamErr == nil {
+				streamErr = event.Error
+				if streamErr == nil {
+					streamErr = errors.New("stream error")
+				}
+			}
+			// 调用方放弃读取时继续排空源通道，避免成员的发送方阻塞
+			select {
+			case out <- event:
+			case <-ctx.Done():
+			}
+		}
+		p.report(ctx, m, streamErr)
+	}()
+	return out, nil
+}
+
+// Close 关闭所有成员
+func (p *ProviderPool) Close() error {
+	var errs []error
+	for i, m := range p.members {
+		if err := m.provider.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close pool member %d: %w", i, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Available 返回当前参与轮询的成员数
+func (p *ProviderPool) Available() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	n := 0
+	for _, m := range p.members {
+		if !now.Before(m.downUntil) {
+			n++
+		}
+	}
+	return n
+}
+
+// next 按平滑加权轮询选择成员
+func (p *ProviderPool) next() (*poolMember, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.members) == 0 {
+		return nil, errors.New("provider pool is empty")
+	}
+
+	now := p.now()
+	var best *poolMember
+	total := 0
+	for _, m := range p.members {
+		if now.Before(m.downUntil) {
+			continue
+		}
+		m.current += m.weight
+		total += m.weight
+		if best == nil || m.current > best.current {
+			best = m
+		}
+	}
+	if best == nil {
+		// 全部被移出轮询：选择最早恢复的成员
+		best = p.members[0]
+		for _, m := range p.members[1:] {
+			if m.downUntil.Before(best.downUntil) {
+				best = m
+			}
+		}
+		return best, nil
+	}
+	best.current -= total
+	return best, nil
+}
+
+// report 记录成员的调用结果（调用方取消或超时不计为成员失败）
+func (p *ProviderPool) report(ctx context.Context, m *poolMember, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		m.failures = 0
+		return
+	}
+	if !IsRetriable(err) {
+		return
+	}
+
+	m.failures++
+	threshold := p.FailureThreshold
+	if threshold <= 0 {
+		threshold = DefaultPoolFailureThreshold
+	}
+	if m.failures >= threshold {
+		cooldown := p.Cooldown
+		if cooldown <= 0 {
+			cooldown = DefaultPoolCooldown
+		}
+		m.downUntil = p.now().Add(cooldown)
+	}
+}
+
+// 确保 ProviderPool 实现了 llm.Provider 接口
+var _ llm.Provider = (*ProviderPool)(nil)
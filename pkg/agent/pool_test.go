@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Provider Pool Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// poolPicks 连续调用 n 次，返回每次响应的文本
+func poolPicks(t *testing.T, pool *ProviderPool, n int) []string {
+	t.Helper()
+
+	picks := make([]string, 0, n)
+	for range n {
+		resp, err := pool.Complete(context.Background(), nil, &llm.Options{})
+		if err != nil {
+			picks = append(picks, "error")
+			continue
+		}
+		picks = append(picks, resp.Message.GetContent())
+	}
+	return picks
+}
+
+func TestProviderPool(t *testing.T) {
+	unavailable := errors.New("API error: 503 - service unavailable")
+
+	t.Run("weighted_round_robin", func(t *testing.T) {
+		pool := NewProviderPool(
+			PoolMember{Provider: mock.New(mock.WithResponse("a")), Weight: 3},
+			PoolMember{Provider: mock.New(mock.WithResponse("b")), Weight: 1},
+		)
+
+		// 平滑加权轮询：b 分散在 a 之间而不是连续出现
+		assert.Equal(t, []string{"a", "a", "b", "a", "a", "a", "b", "a"}, poolPicks(t, pool, 8))
+	})
+
+	t.Run("zero_weight_defaults_to_one", func(t *testing.T) {
+		pool := NewProviderPool(
+			PoolMember{Provider: mock.New(mock.WithResponse("a"))},
+			PoolMember{Provider: mock.New(mock.WithResponse("b"))},
+		)
+		assert.Equal(t, []string{"a", "b", "a", "b"}, poolPicks(t, pool, 4))
+	})
+
+	t.Run("unhealthy_member_removed_and_restored", func(t *testing.T) {
+		failing := mock.New(mock.WithError(unavailable))
+		healthy := mock.New(mock.WithResponse("ok"))
+		pool := NewProviderPool(PoolMember{Provider: failing}, PoolMember{Provider: healthy})
+		pool.FailureThreshold = 2
+		pool.Cooldown = time.Minute
+		now := time.Now()
+		pool.now = func() time.Time { return now }
+
+		poolPicks(t, pool, 4)
+		assert.Equal(t, 2, failing.CallCount())
+		assert.Equal(t, 1, pool.Available())
+
+		// 冷却期间只使用健康成员
+		assert.Equal(t, []string{"ok", "ok", "ok"}, poolPicks(t, pool, 3))
+		assert.Equal(t, 2, failing.CallCount())
+
+		// 冷却结束后重新加入，再次失败立即移出
+		now = now.Add(time.Minute)
+		assert.Equal(t, 2, pool.Available())
+		poolPicks(t, pool, 2)
+		assert.Equal(t, 3, failing.CallCount())
+		assert.Equal(t, 1, pool.Available())
+	})
+
+	t.Run("request_errors_do_not_affect_health", func(t *testing.T) {
+		pool := NewProviderPool(PoolMember{Provider: mock.New(mock.WithError(errors.New("API error: 400 - bad request")))})
+		pool.FailureThreshold = 1
+
+		poolPicks(t, pool, 3)
+		assert.Equal(t, 1, pool.Available())
+	})
+
+	t.Run("all_members_down", func(t *testing.T) {
+		failing := mock.New(mock.WithError(unavailable))
+		pool := NewProviderPool(PoolMember{Provider: failing})
+		pool.FailureThreshold = 1
+
+		poolPicks(t, pool, 3)
+		assert.Equal(t, 0, pool.Available())
+		assert.Equal(t, 3, failing.CallCount(), "still tries the member recovering first")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		_, err := NewProviderPool().Complete(context.Background(), nil, &llm.Options{})
+		require.Error(t, err)
+	})
+
+	t.Run("stream_errors_counted", func(t *testing.T) {
+		pool := NewProviderPool(PoolMember{Provider: mock.New(mock.WithError(unavailable))})
+		pool.FailureThreshold = 1
+
+		_, err := pool.Stream(context.Background(), nil, &llm.Options{})
+		require.Error(t, err)
+		assert.Equal(t, 0, pool.Available())
+	})
+
+	t.Run("agent_uses_pool", func(t *testing.T) {
+		a := &closeTrackingProvider{Client: mock.New(mock.WithResponse("a"))}
+		b := &closeTrackingProvider{Client: mock.New(mock.WithResponse("b"))}
+		pool := NewProviderPool(PoolMember{Provider: a}, PoolMember{Provider: b})
+
+		ag, err := New().ProviderPool(pool).Build()
+		require.NoError(t, err)
+
+		first, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+		_, result, err := ag.RunCollect(context.Background(), "Again", WithStreaming(true))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, []string{first.Text, result.Text})
+
+		require.NoError(t, ag.Close())
+		assert.Equal(t, int32(1), a.closed.Load())
+		assert.Equal(t, int32(1), b.closed.Load())
+	})
+
+	t.Run("nil_pool", func(t *testing.T) {
+		_, err := New().ProviderPool(nil).Build()
+		require.ErrorContains(t, err, "provider pool is nil")
+	})
+}
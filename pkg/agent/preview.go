@@ -0,0 +1,63 @@
+package agent
+
+import (
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 请求预览
+// ═══════════════════════════════════════════════════════════════════════════
+
+// RunPreview 一次执行第一步将发送给 Provider 的请求
+type RunPreview struct {
+	Model           string        `json:"model"`            // 使用的模型
+	Options         *llm.Options  `json:"options"`          // 完整的请求选项（含系统提示词、工具手册和工具 Schema）
+	Messages        []llm.Message `json:"messages"`         // 发送的消息列表（已按 MaxHistoryMessages 截取）
+	Tools           []string      `json:"tools,omitempty"`  // 提供给模型的工具名称
+	EstimatedTokens int           `json:"estimated_tokens"` // 估算的输入 token 数
+}
+
+// Preview 预览执行 text 时第一步将发送给 Provider 的内容（不调用 Provider）
+//
+// 返回解析后的系统提示词（含工具手册）、工具 Schema、采样参数和消息列表，
+// 用于排查模型为何不调用预期工具、提示词为何过长等问题。
+// 不修改对话历史，不触发钩子、中间件和历史压缩，也不进行任何网络调用。
+// opts 与 Run 相同（如 WithPromptVars、WithRunMaxTokens）。
+//
+// 使用示例:
+//
+//	preview, err := ag.Preview("查询北京天气", agent.WithPromptVars(vars))
+//	fmt.Println(preview.Options.System)
+//	fmt.Println(preview.Tools)
+func (a *Agent) Preview(text string, opts ...RunOption) (*RunPreview, error) {
+	input := textInput(text)
+	emptyInput := isEmptyInput(input)
+	if emptyInput && !a.config.AllowEmptyInput {
+		return nil, ErrEmptyInput
+	}
+
+	options := ApplyRunOptions(opts...)
+	if err := a.renderSystem(options); err != nil {
+		return nil, err
+	}
+
+	history := a.snapshotHistory("")
+	if !emptyInput {
+		history = append(history, llm.Message{Role: llm.RoleUser, ContentBlocks: input})
+	}
+	messages := a.providerMessages(history)
+	providerOpts := a.buildProviderOptions(options)
+
+	tools := make([]string, 0, len(providerOpts.Tools))
+	for _, schema := range providerOpts.Tools {
+		tools = append(tools, schema.Name)
+	}
+
+	return &RunPreview{
+		Model:           a.config.LLM.Model,
+		Options:         providerOpts,
+		Messages:        messages,
+		Tools:           tools,
+		EstimatedTokens: a.countTokens(messages, providerOpts),
+	}, nil
+}
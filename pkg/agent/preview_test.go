@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Preview Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Preview(t *testing.T) {
+	t.Run("assembles_request_without_calling_provider", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider,
+			WithModel("test-model"),
+			WithSystemTemplate("You help {{.user}}."),
+			WithTools(newEchoTool(), newFailingTool()),
+			WithDeniedTools("fail"),
+			WithHistory([]llm.Message{
+				{Role: llm.RoleUser, Content: "earlier"},
+				{Role: llm.RoleAssistant, Content: "reply"},
+			}),
+		)
+
+		preview, err := ag.Preview("Hello", WithPromptVars(map[string]any{"user": "alice"}), WithRunMaxTokens(128))
+		require.NoError(t, err)
+
+		assert.Equal(t, "test-model", preview.Model)
+		assert.Equal(t, []string{"echo"}, preview.Tools)
+		assert.Contains(t, preview.Options.System, "You help alice.")
+		assert.Contains(t, preview.Options.System, "### Tools Manual")
+		assert.Equal(t, 128, preview.Options.MaxTokens)
+		require.Len(t, preview.Messages, 3)
+		assert.Equal(t, "Hello", preview.Messages[2].GetContent())
+		assert.Positive(t, preview.EstimatedTokens)
+
+		assert.Zero(t, provider.CallCount())
+		assert.Len(t, ag.Messages(), 2, "preview must not modify history")
+	})
+
+	t.Run("matches_actual_request", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithTools(newEchoTool()), WithMaxHistoryMessages(2))
+		for range 2 {
+			_, err := ag.Chat(context.Background(), "turn")
+			require.NoError(t, err)
+		}
+
+		preview, err := ag.Preview("Hello")
+		require.NoError(t, err)
+		_, err = ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		assert.Equal(t, provider.LastCall().Messages, preview.Messages)
+		assert.Equal(t, provider.LastCall().Options.System, preview.Options.System)
+	})
+
+	t.Run("empty_input", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New())
+		_, err := ag.Preview(" ")
+		require.ErrorIs(t, err, ErrEmptyInput)
+	})
+
+	t.Run("template_error", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithSystemTemplate("Hi {{.missing}}"))
+		_, err := ag.Preview("Hello")
+		require.ErrorContains(t, err, "render system template")
+	})
+}
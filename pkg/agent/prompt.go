@@ -0,0 +1,94 @@
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 系统提示词模板
+// ═══════════════════════════════════════════════════════════════════════════
+
+// parseSystemTemplate 解析系统提示词模板（空字符串返回 nil）
+//
+// 模板使用 missingkey=error，引用未提供的变量时渲染失败，而不是输出 "<no value>"。
+func parseSystemTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil //nolint:nilnil // 未设置模板
+	}
+	tmpl, err := template.New("system").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse system template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// renderSystem 使用本次执行的变量渲染系统提示词模板
+//
+// 未设置模板时不做任何处理；渲染结果记录在 RunOptions 中，供 buildProviderOptions 使用。
+func (a *Agent) renderSystem(runOpts *RunOptions) error {
+	if a.systemTemplate == nil {
+		return nil
+	}
+
+	vars := runOpts.PromptVars
+	if vars == nil {
+		vars = map[string]any{}
+	}
+
+	var sb strings.Builder
+	if err := a.systemTemplate.Execute(&sb, vars); err != nil {
+		return fmt.Errorf("render system template: %w", err)
+	}
+	rendered := sb.String()
+	runOpts.system = &rendered
+	return nil
+}
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 工具手册模板
+// ═══════════════════════════════════════════════════════════════════════════
+
+// DefaultToolManualHeader 默认的工具手册标题
+const DefaultToolManualHeader = "### Tools Manual"
+
+// DefaultToolManualTemplate 默认的工具手册正文模板
+const DefaultToolManualTemplate = "The following tools are available:\n\n" +
+	"{{range $i, $t := .Tools}}{{if $i}}\n{{end}}- `{{$t.Name}}`: {{$t.Description}}{{end}}"
+
+// defaultToolManualTemplate 解析后的默认模板
+var defaultToolManualTemplate = template.Must(template.New("tool-manual").Parse(DefaultToolManualTemplate))
+
+// ToolManualData 渲染工具手册模板的数据
+type ToolManualData struct {
+	Tools []ToolManualEntry // 提供给模型的工具（已按 AllowedTools / DeniedTools 过滤）
+}
+
+// ToolManualEntry 工具手册中的单个工具
+type ToolManualEntry struct {
+	Name        string
+	Description string
+}
+
+// parseToolManualTemplate 解析工具手册模板（空字符串返回默认模板）
+func parseToolManualTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return defaultToolManualTemplate, nil
+	}
+	tmpl, err := template.New("tool-manual").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parse tool manual template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// systemPrompt 返回本次执行的系统提示词
+//
+// 已渲染模板时以渲染结果作为基础提示词，否则使用 SystemPrompt；SystemSegments 追加在其后。
+func (a *Agent) systemPrompt(runOpts *RunOptions) string {
+	if runOpts != nil && runOpts.system != nil {
+		return a.config.systemWith(*runOpts.system)
+	}
+	return a.config.system()
+}
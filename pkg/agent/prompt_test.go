@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// System Template Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_SystemTemplate(t *testing.T) {
+	t.Run("renders_per_run", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider,
+			WithSystemTemplate("Hello {{.User}}, locale {{.Locale}}."),
+			WithSystemSegments("Be brief."),
+		)
+
+		_, err := collectResult(ag.Run(context.Background(), "hi", WithPromptVars(map[string]any{"User": "alice", "Locale": "en"})))
+		require.NoError(t, err)
+		assert.Equal(t, "Hello alice, locale en.\n\nBe brief.", provider.LastCall().Options.System)
+
+		_, err = collectResult(ag.Run(context.Background(), "hi",
+			WithPromptVars(map[string]any{"User": "bob"}),
+			WithPromptVars(map[string]any{"Locale": "zh"}),
+		))
+		require.NoError(t, err)
+		assert.Equal(t, "Hello bob, locale zh.\n\nBe brief.", provider.LastCall().Options.System)
+	})
+
+	t.Run("missing_variable_errors", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithSystemTemplate("Hello {{.User}}."))
+
+		_, err := ag.Chat(context.Background(), "hi")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "render system template")
+		assert.Contains(t, err.Error(), "User")
+		assert.Zero(t, provider.CallCount())
+		assert.Empty(t, ag.Messages(), "user message should not be recorded")
+	})
+
+	t.Run("without_template_uses_prompt", func(t *testing.T) {
+		provider := mock.New(mock.WithResponse("ok"))
+		ag := newTestAgent(t, provider, WithPrompt("static"))
+
+		_, err := collectResult(ag.Run(context.Background(), "hi", WithPromptVars(map[string]any{"User": "alice"})))
+		require.NoError(t, err)
+		assert.Equal(t, "static", provider.LastCall().Options.System)
+	})
+
+	t.Run("invalid_template", func(t *testing.T) {
+		_, err := New().
+			Provider(mock.New()).
+			SystemTemplate("Hello {{.User").
+			Build()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "parse system template")
+
+		_, err = NewAgent(WithProvider(mock.New()), WithSystemTemplate("{{if}}"))
+		require.Error(t, err)
+	})
+}
@@ -2,7 +2,11 @@ package agent
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 )
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -17,6 +21,9 @@ import (
 //   - API Key: OPENAI_API_KEY, ANTHROPIC_API_KEY, OPENROUTER_API_KEY, LLM_API_KEY, API_KEY
 //   - Model: LLM_MODEL, OPENAI_MODEL, MODEL (默认: gpt-4o-mini)
 //
+// 通过 WithQuickProviderType 指定类型时，改为读取该类型对应的环境变量；
+// 通过 WithQuickProvider 直接传入 Provider 时跳过 API 密钥探测。
+//
 // 使用示例：
 //
 //	// 最简单的调用（使用环境变量）
@@ -27,25 +34,106 @@ import (
 //	    agent.WithQuickModel("gpt-4"),
 //	    agent.WithQuickSystem("你是一位诗人"),
 //	)
+//
+//	// 同时设置了多个厂商的密钥时，显式指定后端
+//	result, err := agent.Quick(ctx, "Hello",
+//	    agent.WithQuickProviderType(llm.ProviderTypeAnthropic),
+//	)
 func Quick(ctx context.Context, message string, opts ...QuickOption) (*Result, error) {
-	// 默认配置
-	cfg := &quickConfig{
-		model:  detectModel(),
-		apiKey: detectAPIKey(),
-	}
+	return newQuickBuilder(opts).Chat(ctx, message)
+}
 
-	// 应用选项
+// QuickStream 快速对话，并将回复文本实时写入 w
+//
+// 以流式模式执行，每个文本增量到达时立即写入 w，结束后返回完整结果，适合命令行工具。
+// 执行中途出错时，已产生的文本仍会写入 w，随后返回错误；写入 w 失败时中止执行并返回写入错误。
+// 配置探测与 Quick 相同。流式执行不统计 Token 用量，结果中的 Token 数为 0（见 Result）。
+//
+// 使用示例：
+//
+//	result, err := agent.QuickStream(ctx, "写一首诗", os.Stdout)
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	fmt.Printf("\n(%d steps, %s)\n", result.StepCount, result.FinishReason)
+func QuickStream(ctx context.Context, message string, w io.Writer, opts ...QuickOption) (*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	events := newQuickBuilder(opts).Run(ctx, message, WithStreaming(true))
+	return streamText(events, w, cancel)
+}
+
+// newQuickBuilder 应用选项并探测未设置的配置，返回配置好的 Builder
+//
+// 选项先于环境变量探测应用：显式设置的值不会被覆盖，
+// 直接传入 Provider 时不再探测 API 密钥。
+func newQuickBuilder(opts []QuickOption) *Builder {
+	cfg := &quickConfig{}
 	for _, opt := range opts {
 		opt(cfg)
 	}
 
-	// 使用 Builder 构建并执行
-	return New().
+	if cfg.model == "" {
+		cfg.model = detectModelFor(cfg.providerType)
+	}
+	if cfg.apiKey == "" && cfg.provider == nil {
+		cfg.apiKey = detectAPIKeyFor(cfg.providerType)
+	}
+
+	b := New().
 		Model(cfg.model).
-		APIKey(cfg.apiKey).
-		System(cfg.system).
-		MaxTokens(cfg.maxTokens).
-		Chat(ctx, message)
+		APIKey(cfg.apiKey)
+	if cfg.providerType != "" {
+		b.ProviderType(cfg.providerType)
+	}
+	if cfg.baseURL != "" {
+		b.BaseURL(cfg.baseURL)
+	}
+	if cfg.provider != nil {
+		b.Provider(cfg.provider)
+	}
+	if cfg.system != "" {
+		b.System(cfg.system)
+	}
+	if cfg.maxTokens > 0 {
+		b.MaxTokens(cfg.maxTokens)
+	}
+	return b
+}
+
+// streamText 消费事件流，将文本增量写入 w，返回最终结果和错误
+//
+// 写入失败时调用 cancel 中止执行，并继续排空事件流。
+func streamText(events <-chan *AgentEvent, w io.Writer, cancel context.CancelFunc) (*Result, error) {
+	var result *Result
+	var lastError, writeErr error
+
+	for event := range events {
+		switch event.Type {
+		case llm.EventTypeText:
+			if writeErr != nil || event.Text == "" {
+				continue
+			}
+			if _, err := io.WriteString(w, event.Text); err != nil {
+				writeErr = fmt.Errorf("write stream output: %w", err)
+				cancel()
+			}
+		case llm.EventTypeDone:
+			result = event.Result
+		case llm.EventTypeError:
+			lastError = event.Error
+		case llm.EventTypeToolCall, llm.EventTypeToolResult,
+			llm.EventTypeReasoning, llm.EventTypeThinking, EventTypeUsage, EventTypeToolCallDelta,
+			EventTypeHeartbeat, EventTypeContextWarning:
+			// 仅输出回复文本
+		}
+	}
+
+	if writeErr != nil {
+		return result, writeErr
+	}
+	return result, lastError
 }
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -54,10 +142,13 @@ func Quick(ctx context.Context, message string, opts ...QuickOption) (*Result, e
 
 // quickConfig 快速调用的配置
 type quickConfig struct {
-	model     string
-	apiKey    string
-	system    string
-	maxTokens int
+	model        string
+	apiKey       string
+	baseURL      string
+	providerType llm.ProviderType
+	provider     llm.Provider
+	system       string
+	maxTokens    int
 }
 
 // QuickOption 快速调用的配置选项
@@ -77,6 +168,30 @@ func WithQuickAPIKey(apiKey string) QuickOption {
 	}
 }
 
+// WithQuickBaseURL 设置 API 端点
+func WithQuickBaseURL(url string) QuickOption {
+	return func(c *quickConfig) {
+		c.baseURL = url
+	}
+}
+
+// WithQuickProviderType 指定 Provider 类型（如 llm.ProviderTypeAnthropic）
+//
+// 指定后 API 密钥和模型优先从该类型对应的环境变量探测（如 ANTHROPIC_API_KEY），
+// 不再受多个密钥环境变量同时存在时的探测顺序影响。
+func WithQuickProviderType(t llm.ProviderType) QuickOption {
+	return func(c *quickConfig) {
+		c.providerType = t
+	}
+}
+
+// WithQuickProvider 直接使用指定的 Provider（跳过 API 密钥探测）
+func WithQuickProvider(p llm.Provider) QuickOption {
+	return func(c *quickConfig) {
+		c.provider = p
+	}
+}
+
 // WithQuickSystem 设置系统提示词
 func WithQuickSystem(prompt string) QuickOption {
 	return func(c *quickConfig) {
@@ -112,6 +227,39 @@ func detectModel() string {
 	return "gpt-4o-mini"
 }
 
+// detectModelFor 按 Provider 类型探测模型
+//
+// 未指定类型时与 detectModel 相同；指定类型时 LLM_MODEL 优先，
+// 其次为该类型的模型环境变量，最后使用该类型的默认模型。
+func detectModelFor(t llm.ProviderType) string {
+	if t == "" {
+		return detectModel()
+	}
+	if model := os.Getenv("LLM_MODEL"); model != "" {
+		return model
+	}
+	return t.GetEnvModel()
+}
+
+// detectAPIKeyFor 按 Provider 类型探测 API 密钥
+//
+// 未指定类型时与 detectAPIKey 相同；指定类型时先读取该类型的密钥环境变量，
+// 再回退到通用的 LLM_API_KEY、API_KEY，不会取到其他厂商的密钥。
+func detectAPIKeyFor(t llm.ProviderType) string {
+	if t == "" {
+		return detectAPIKey()
+	}
+	if key := t.GetEnvAPIKey(); key != "" {
+		return key
+	}
+	for _, name := range []string{"LLM_API_KEY", "API_KEY"} {
+		if key := os.Getenv(name); key != "" {
+			return key
+		}
+	}
+	return ""
+}
+
 // detectAPIKey 探测 API 密钥
 func detectAPIKey() string {
 	// 按常见程度排序
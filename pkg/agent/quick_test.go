@@ -1,9 +1,16 @@
 package agent
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
+	"strings"
 	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
 )
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -292,6 +299,153 @@ func TestQuickOptions(t *testing.T) {
 	})
 }
 
+// TestQuickProviderSelection 测试 Provider 类型与直接传入 Provider
+func TestQuickProviderSelection(t *testing.T) {
+	t.Run("WithQuickProvider_skips_api_key", func(t *testing.T) {
+		for _, key := range []string{"OPENAI_API_KEY", "ANTHROPIC_API_KEY", "OPENROUTER_API_KEY", "LLM_API_KEY", "API_KEY"} {
+			t.Setenv(key, "")
+		}
+
+		p := mock.New(mock.WithResponse("from mock"))
+		result, err := Quick(context.Background(), "Hello", WithQuickProvider(p))
+		if err != nil {
+			t.Fatalf("Quick() error = %v", err)
+		}
+		if result.Text != "from mock" {
+			t.Errorf("Text = %q, want %q", result.Text, "from mock")
+		}
+		if p.CallCount() != 1 {
+			t.Errorf("CallCount() = %d, want 1", p.CallCount())
+		}
+	})
+
+	t.Run("WithQuickProviderType_uses_matching_key", func(t *testing.T) {
+		t.Setenv("OPENAI_API_KEY", "sk-openai")
+		t.Setenv("ANTHROPIC_API_KEY", "sk-anthropic")
+		t.Setenv("LLM_MODEL", "")
+		t.Setenv("ANTHROPIC_MODEL", "")
+
+		b := newQuickBuilder([]QuickOption{
+			WithQuickProviderType(llm.ProviderTypeAnthropic),
+			WithQuickBaseURL("https://proxy.example.com/v1"),
+		})
+		cfg := b.inner.config.LLM
+		if cfg.Type != llm.ProviderTypeAnthropic {
+			t.Errorf("Type = %v, want anthropic", cfg.Type)
+		}
+		if cfg.APIKey != "sk-anthropic" {
+			t.Errorf("APIKey = %v, want sk-anthropic", cfg.APIKey)
+		}
+		if cfg.Model != llm.ProviderTypeAnthropic.DefaultModel() {
+			t.Errorf("Model = %v, want %v", cfg.Model, llm.ProviderTypeAnthropic.DefaultModel())
+		}
+		if cfg.BaseURL != "https://proxy.example.com/v1" {
+			t.Errorf("BaseURL = %v, want proxy URL", cfg.BaseURL)
+		}
+	})
+
+	t.Run("explicit_options_win", func(t *testing.T) {
+		t.Setenv("ANTHROPIC_API_KEY", "sk-anthropic")
+
+		b := newQuickBuilder([]QuickOption{
+			WithQuickProviderType(llm.ProviderTypeAnthropic),
+			WithQuickAPIKey("sk-explicit"),
+			WithQuickModel("claude-custom"),
+		})
+		if b.inner.config.LLM.APIKey != "sk-explicit" {
+			t.Errorf("APIKey = %v, want sk-explicit", b.inner.config.LLM.APIKey)
+		}
+		if b.inner.config.LLM.Model != "claude-custom" {
+			t.Errorf("Model = %v, want claude-custom", b.inner.config.LLM.Model)
+		}
+	})
+}
+
+// TestDetectAPIKeyFor 测试按类型探测 API 密钥
+func TestDetectAPIKeyFor(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-openai")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("LLM_API_KEY", "sk-generic")
+
+	if got := detectAPIKeyFor(""); got != "sk-openai" {
+		t.Errorf("detectAPIKeyFor(\"\") = %v, want sk-openai", got)
+	}
+	// 指定类型的密钥缺失时回退到通用密钥，而不是其他厂商的密钥
+	if got := detectAPIKeyFor(llm.ProviderTypeAnthropic); got != "sk-generic" {
+		t.Errorf("detectAPIKeyFor(anthropic) = %v, want sk-generic", got)
+	}
+}
+
+// partialStreamProvider 输出部分文本后流中出错
+type partialStreamProvider struct{}
+
+func (partialStreamProvider) Complete(context.Context, []llm.Message, *llm.Options) (*llm.Response, error) {
+	return nil, errors.New("not supported")
+}
+
+func (partialStreamProvider) Stream(context.Context, []llm.Message, *llm.Options) (<-chan *llm.Event, error) {
+	ch := make(chan *llm.Event, 2)
+	ch <- &llm.Event{Type: llm.EventTypeText, TextDelta: "partial "}
+	ch <- &llm.Event{Type: llm.EventTypeError, Error: errors.New("connection reset")}
+	close(ch)
+	return ch, nil
+}
+
+func (partialStreamProvider) Close() error { return nil }
+
+// failingWriter 写入总是失败
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+// TestStreamText 测试 QuickStream 的流式输出
+func TestStreamText(t *testing.T) {
+	stream := func(t *testing.T, p llm.Provider, w io.Writer) (*Result, error) {
+		t.Helper()
+		ag, err := NewAgent(WithProvider(p))
+		if err != nil {
+			t.Fatalf("NewAgent() error = %v", err)
+		}
+		t.Cleanup(func() { _ = ag.Close() })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		return streamText(ag.Run(ctx, "Hello", WithStreaming(true)), w, cancel)
+	}
+
+	t.Run("writes_text_deltas", func(t *testing.T) {
+		var buf bytes.Buffer
+		result, err := stream(t, mock.New(mock.WithResponse("Hello there")), &buf)
+		if err != nil {
+			t.Fatalf("streamText() error = %v", err)
+		}
+		if buf.String() != "Hello there" {
+			t.Errorf("output = %q, want %q", buf.String(), "Hello there")
+		}
+		if result == nil || result.Text != "Hello there" {
+			t.Errorf("result = %+v, want text %q", result, "Hello there")
+		}
+	})
+
+	t.Run("error_after_partial_output", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := stream(t, partialStreamProvider{}, &buf)
+		if err == nil || !strings.Contains(err.Error(), "connection reset") {
+			t.Errorf("streamText() error = %v, want connection reset", err)
+		}
+		if buf.String() != "partial " {
+			t.Errorf("output = %q, want %q", buf.String(), "partial ")
+		}
+	})
+
+	t.Run("write_error", func(t *testing.T) {
+		_, err := stream(t, mock.New(mock.WithResponse("Hello")), failingWriter{})
+		if err == nil || !strings.Contains(err.Error(), "broken pipe") {
+			t.Errorf("streamText() error = %v, want broken pipe", err)
+		}
+	})
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // 示例测试（需要真实 API key，已移至 manual_test.go）
 // ═══════════════════════════════════════════════════════════════════════════
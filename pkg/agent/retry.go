@@ -2,16 +2,36 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 )
 
 // RetryConfig 重试配置
 type RetryConfig struct {
 	MaxRetries     int           // 最大重试次数（0 表示不重试）
 	InitialBackoff time.Duration // 初始退避时间
-	MaxBackoff     time.Duration // 最大退避时间
+	MaxBackoff     time.Duration // 最大退避时间（同时限制 Retry-After 建议的等待时间）
 	Multiplier     float64       // 退避倍数（指数退避）
+	Jitter         float64       // 随机抖动比例（0..1，实际等待时间在 backoff×(1±Jitter) 之间）
+
+	// MaxTotalRetries 单次执行内所有 Provider 调用和工具调用的重试总数上限（0 表示不限制）
+	//
+	// MaxRetries 针对单个操作；工具频繁失败时一次执行可能累计重试数十次，
+	// 设置总数上限后额度用尽的失败不再重试，便于控制尾延迟。
+	MaxTotalRetries int
+
+	// Rand 返回 [0, 1) 的随机数（nil 使用 math/rand/v2），测试时可注入固定值
+	Rand func() float64
 }
 
 // DefaultRetryConfig 默认重试配置
@@ -21,15 +41,83 @@ func DefaultRetryConfig() *RetryConfig {
 		InitialBackoff: 500 * time.Millisecond,
 		MaxBackoff:     5 * time.Second,
 		Multiplier:     2.0,
+		Jitter:         0.2,
+	}
+}
+
+// jittered 对退避时间施加随机抖动，避免大量客户端同步重试
+func (c *RetryConfig) jittered(backoff time.Duration) time.Duration {
+	jitter := min(max(c.Jitter, 0), 1)
+	if jitter == 0 || backoff <= 0 {
+		return backoff
+	}
+
+	random := rand.Float64
+	if c.Rand != nil {
+		random = c.Rand
+	}
+	// 将 [0, 1) 映射到 [-jitter, +jitter)
+	factor := 1 + jitter*(2*random()-1)
+	return time.Duration(float64(backoff) * factor)
+}
+
+// RetryClassifier 判断错误是否可重试
+//
+// 设置后完全替代 IsRetriable 的默认判断（结构化输出校验失败除外，始终重试）。
+type RetryClassifier func(err error) bool
+
+// statusCoder 携带 HTTP 状态码的错误
+type statusCoder interface {
+	StatusCode() int
+}
+
+// retryAfterer 携带服务端建议重试间隔的错误（如 429 响应的 Retry-After 头）
+type retryAfterer interface {
+	RetryAfter() time.Duration
+}
+
+// suggestedBackoff 返回错误携带的建议重试间隔（按 MaxBackoff 截断，ok 为 false 表示没有建议）
+func (c *RetryConfig) suggestedBackoff(err error) (time.Duration, bool) {
+	var ra retryAfterer
+	if !errors.As(err, &ra) {
+		return 0, false
+	}
+	wait := ra.RetryAfter()
+	if wait <= 0 {
+		return 0, false
+	}
+	if c.MaxBackoff > 0 {
+		wait = min(wait, c.MaxBackoff)
 	}
+	return wait, true
 }
 
+// apiErrorPattern 匹配 Provider 返回的 "API error: <status> - <body>" 错误
+var apiErrorPattern = regexp.MustCompile(`API error: (\d{3})\b`)
+
 // IsRetriable 判断错误是否可重试
+//
+// 判断顺序：
+//  1. 类型判断：context 错误、net.Error 超时、携带 HTTP 状态码的错误
+//  2. Provider 的 "API error: <status>" 错误按状态码判断
+//  3. 以上均无法判断时，回退到错误信息的关键字匹配
+//
+// 状态码可判断时以状态码为准，不再进行关键字匹配，
+// 避免 "invalid request: timeout parameter" 之类的永久错误被误判为可重试。
 func IsRetriable(err error) bool {
 	if err == nil {
 		return false
 	}
 
+	// 结构化输出不符合 Schema 时重新请求
+	if errors.Is(err, ErrInvalidStructuredOutput) {
+		return true
+	}
+
+	if retriable, ok := classifyTyped(err); ok {
+		return retriable
+	}
+
 	errStr := strings.ToLower(err.Error())
 
 	// 可重试的错误模式
@@ -52,9 +140,140 @@ func IsRetriable(err error) bool {
 	return false
 }
 
+// classifyTyped 根据错误类型和状态码判断是否可重试（ok 为 false 表示无法判断）
+func classifyTyped(err error) (retriable, ok bool) {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return false, true
+	case errors.Is(err, context.DeadlineExceeded):
+		return true, true
+	}
+
+	var sc statusCoder
+	if errors.As(err, &sc) {
+		return retriableStatus(sc.StatusCode()), true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, true
+	}
+
+	if m := apiErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+		status, _ := strconv.Atoi(m[1])
+		return retriableStatus(status), true
+	}
+
+	return false, false
+}
+
+// retriableStatus 判断 HTTP 状态码是否可重试（408、429 和 5xx）
+func retriableStatus(status int) bool {
+	return status == 408 || status == 429 || status >= 500
+}
+
+// isRetriable 使用自定义 RetryClassifier（如有）判断错误是否可重试
+func (a *Agent) isRetriable(err error) bool {
+	if a.retryClassifier == nil || errors.Is(err, ErrInvalidStructuredOutput) {
+		return IsRetriable(err)
+	}
+	return a.retryClassifier(err)
+}
+
+// retryBudget 单次执行内共享的重试额度（并发执行的工具共用，nil 表示不限制）
+type retryBudget struct {
+	limit     int
+	used      atomic.Int64
+	exhausted atomic.Bool
+}
+
+// newRetryBudget 按 MaxTotalRetries 创建重试额度（未设置上限时返回 nil）
+func newRetryBudget(cfg *RetryConfig) *retryBudget {
+	if cfg == nil || cfg.MaxTotalRetries <= 0 {
+		return nil
+	}
+	return &retryBudget{limit: cfg.MaxTotalRetries}
+}
+
+// take 消耗一次重试额度，额度用尽时返回 false（首次用尽时记录警告）
+func (b *retryBudget) take(logger *slog.Logger) bool {
+	if b == nil {
+		return true
+	}
+	if b.used.Add(1) <= int64(b.limit) {
+		return true
+	}
+	if b.exhausted.CompareAndSwap(false, true) {
+		logger.Warn("retry budget exhausted, further failures will not be retried", "max_total_retries", b.limit)
+	}
+	return false
+}
+
+// noRetryError 标记本次失败不应重试（如流式输出已发送部分内容）
+type noRetryError struct {
+	err error
+}
+
+func (e *noRetryError) Error() string { return e.err.Error() }
+func (e *noRetryError) Unwrap() error { return e.err }
+
+// unwrapNoRetry 去除 noRetryError 包装
+func unwrapNoRetry(err error) error {
+	var nr *noRetryError
+	if errors.As(err, &nr) {
+		return nr.err
+	}
+	return err
+}
+
+// callWithTimeout 为单次 Provider 调用设置 LLM.Timeout 超时（0 表示不限制）
+//
+// 超时由 ctx 派生，ctx 先到期时以 ctx 为准；仅单次调用超时时包装错误说明原因，
+// 错误仍满足 errors.Is(err, context.DeadlineExceeded)，按可重试错误处理。
+func (a *Agent) callWithTimeout(ctx context.Context, call func(ctx context.Context) (*llm.Response, error)) (*llm.Response, error) {
+	timeout := a.config.LLM.Timeout
+	if timeout <= 0 {
+		return call(ctx)
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := call(callCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("provider call timed out after %s: %w", timeout, err)
+	}
+	return resp, err
+}
+
+// retryProviderCall 按 retryConfig 对 Provider 调用进行退避重试
+//
+// MaxRetries 为 0 时只调用一次；call 返回 noRetryError 时立即放弃重试。
+func (a *Agent) retryProviderCall(ctx context.Context, state *runState, call func() (*llm.Response, error)) (*llm.Response, error) {
+	if a.retryConfig == nil || a.retryConfig.MaxRetries <= 0 {
+		resp, err := call()
+		return resp, unwrapNoRetry(err)
+	}
+
+	out, attempts, err := a.retryWithBackoff(ctx, state.logger, state.retryBudget, func() (any, error) {
+		return call()
+	}, a.retryConfig)
+	if err != nil {
+		return nil, err
+	}
+	if attempts > 0 {
+		state.logger.Info("provider call succeeded after retry", "retries", attempts)
+	}
+	return out.(*llm.Response), nil
+}
+
 // retryWithBackoff 使用指数退避重试执行操作
+//
+// 错误实现 RetryAfter() time.Duration 时按建议间隔等待（不超过 MaxBackoff）。
+// 每次重试前从 budget 中扣除额度，额度用尽时直接返回最近一次的错误。
 func (a *Agent) retryWithBackoff(
 	ctx context.Context,
+	logger *slog.Logger,
+	budget *retryBudget,
 	operation func() (any, error),
 	cfg *RetryConfig,
 ) (any, int, error) {
@@ -69,25 +288,42 @@ func (a *Agent) retryWithBackoff(
 
 		lastErr = err
 
+		var nr *noRetryError
+		if errors.As(err, &nr) {
+			logger.Debug("retry suppressed", "error", nr.err, "attempt", attempt)
+			return nil, attempt, nr.err
+		}
+
 		// 检查是否可重试
-		if !IsRetriable(err) {
-			a.logger.Debug("error not retriable", "error", err, "attempt", attempt)
+		if !a.isRetriable(err) {
+			logger.Debug("error not retriable", "error", err, "attempt", attempt)
 			return nil, attempt, err
 		}
 
 		// 达到最大重试次数
 		if attempt >= cfg.MaxRetries {
-			a.logger.Warn("max retries reached", "max_retries", cfg.MaxRetries, "error", err)
+			logger.Warn("max retries reached", "max_retries", cfg.MaxRetries, "error", err)
 			break
 		}
 
+		// 本次执行的重试总额度已用尽
+		if !budget.take(logger) {
+			return nil, attempt, err
+		}
+
 		// 退避等待
-		a.logger.Info("retrying after backoff", "attempt", attempt+1, "backoff", backoff, "error", err)
+		a.metricsOrNop().IncRetries(1)
+		// 错误携带 Retry-After 建议时以其为准，否则使用指数退避
+		wait, suggested := cfg.suggestedBackoff(err)
+		if !suggested {
+			wait = cfg.jittered(backoff)
+		}
+		logger.Info("retrying after backoff", "attempt", attempt+1, "backoff", wait, "retry_after", suggested, "error", err)
 
 		select {
 		case <-ctx.Done():
 			return nil, attempt, ctx.Err()
-		case <-time.After(backoff):
+		case <-time.After(wait):
 			backoff = min(time.Duration(float64(backoff)*cfg.Multiplier), cfg.MaxBackoff)
 		}
 	}
@@ -1,11 +1,20 @@
 package agent
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -20,6 +29,7 @@ func TestDefaultRetryConfig(t *testing.T) {
 	assert.Equal(t, 500*time.Millisecond, cfg.InitialBackoff)
 	assert.Equal(t, 5*time.Second, cfg.MaxBackoff)
 	assert.InDelta(t, 2.0, cfg.Multiplier, 0.001)
+	assert.InDelta(t, 0.2, cfg.Jitter, 0.001)
 }
 
 // ═══════════════════════════════════════════════════════════════════════════
@@ -119,6 +129,291 @@ func TestIsRetriable_EdgeCases(t *testing.T) {
 	})
 }
 
+// httpStatusError 携带 HTTP 状态码的测试错误
+type httpStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *httpStatusError) Error() string   { return e.msg }
+func (e *httpStatusError) StatusCode() int { return e.status }
+
+// netTimeoutError 模拟 net.Error 超时
+type netTimeoutError struct{}
+
+func (netTimeoutError) Error() string   { return "i/o deadline reached" }
+func (netTimeoutError) Timeout() bool   { return true }
+func (netTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = netTimeoutError{}
+
+func TestIsRetriable_Typed(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "status_400_mentions_timeout",
+			err:  &httpStatusError{status: 400, msg: "invalid request: timeout parameter"},
+			want: false,
+		},
+		{
+			name: "status_429",
+			err:  &httpStatusError{status: 429, msg: "slow down"},
+			want: true,
+		},
+		{
+			name: "wrapped_status_502",
+			err:  fmt.Errorf("call provider: %w", &httpStatusError{status: 502, msg: "bad gateway"}),
+			want: true,
+		},
+		{
+			name: "provider_api_error_400_mentions_timeout",
+			err:  errors.New(`API error: 400 - {"error":"invalid value for 'timeout'"}`),
+			want: false,
+		},
+		{
+			name: "provider_api_error_503",
+			err:  errors.New("API error: 503 - overloaded"),
+			want: true,
+		},
+		{
+			name: "net_timeout",
+			err:  fmt.Errorf("dial: %w", netTimeoutError{}),
+			want: true,
+		},
+		{
+			name: "deadline_exceeded",
+			err:  fmt.Errorf("tool: %w", context.DeadlineExceeded),
+			want: true,
+		},
+		{
+			name: "canceled",
+			err:  fmt.Errorf("tool: %w", context.Canceled),
+			want: false,
+		},
+		{
+			name: "structured_output",
+			err:  fmt.Errorf("%w: missing field", ErrInvalidStructuredOutput),
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, IsRetriable(tt.err))
+		})
+	}
+}
+
+func TestAgent_RetryClassifier(t *testing.T) {
+	cfg := &RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}
+	permanent := errors.New("invalid request: timeout parameter")
+
+	run := func(a *Agent) (int, error) {
+		calls := 0
+		_, _, err := a.retryWithBackoff(context.Background(), slog.Default(), nil, func() (any, error) {
+			calls++
+			return nil, permanent
+		}, cfg)
+		return calls, err
+	}
+
+	t.Run("string_fallback_retries", func(t *testing.T) {
+		calls, err := run(&Agent{})
+		require.ErrorIs(t, err, permanent)
+		assert.Equal(t, 4, calls)
+	})
+
+	t.Run("classifier_overrides", func(t *testing.T) {
+		var seen error
+		a := &Agent{retryClassifier: func(err error) bool {
+			seen = err
+			return false
+		}}
+
+		calls, err := run(a)
+		require.ErrorIs(t, err, permanent)
+		assert.Equal(t, 1, calls, "permanent error should not be retried")
+		assert.Equal(t, permanent, seen)
+	})
+
+	t.Run("structured_output_always_retried", func(t *testing.T) {
+		a := &Agent{retryClassifier: func(error) bool { return false }}
+		assert.True(t, a.isRetriable(ErrInvalidStructuredOutput))
+	})
+
+	t.Run("option_wiring", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(), WithRetryClassifier(func(error) bool { return false }))
+		require.NotNil(t, ag.retryClassifier)
+		assert.False(t, ag.isRetriable(errors.New("connection timeout")))
+	})
+}
+
+func TestAgent_LLMTimeout(t *testing.T) {
+	retry := WithRetryConfig(&RetryConfig{MaxRetries: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1})
+
+	// hangOnce 第一次调用挂起直到 ctx 结束，之后正常调用
+	hangOnce := func() ProviderMiddleware {
+		var calls atomic.Int32
+		return func(next ProviderCallFunc) ProviderCallFunc {
+			return func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+				if calls.Add(1) == 1 {
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return next(ctx, messages, opts)
+			}
+		}
+	}
+
+	for _, streaming := range []bool{false, true} {
+		t.Run(fmt.Sprintf("slow_call_retried/streaming=%v", streaming), func(t *testing.T) {
+			ag := newTestAgent(t, mock.New(mock.WithResponse("ok")),
+				WithLLMTimeout(20*time.Millisecond), WithMiddleware(hangOnce()), retry)
+
+			_, result, err := ag.RunCollect(context.Background(), "Hello", WithStreaming(streaming))
+			require.NoError(t, err)
+			assert.Equal(t, "ok", result.Text)
+		})
+	}
+
+	t.Run("timeout_error", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithDelay(time.Second)),
+			WithLLMTimeout(20*time.Millisecond), WithRetryConfig(&RetryConfig{}))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorContains(t, err, "timed out after 20ms")
+	})
+
+	t.Run("run_context_wins", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithDelay(time.Second)), WithLLMTimeout(time.Minute), retry)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		_, err := ag.Chat(ctx, "Hello")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.NotContains(t, err.Error(), "timed out after")
+	})
+
+	t.Run("negative_rejected", func(t *testing.T) {
+		_, err := New().Provider(mock.New()).LLMTimeout(-time.Second).Build()
+		require.ErrorContains(t, err, "llmTimeout must be non-negative")
+	})
+}
+
+func TestAgent_MaxTotalRetries(t *testing.T) {
+	// flaky 总是返回可重试错误的工具
+	flaky := func(calls *atomic.Int32) tool.Tool {
+		return tool.Func("flaky", "Always times out", func(context.Context, echoInput) (string, error) {
+			calls.Add(1)
+			return "", errors.New("connection timeout")
+		})
+	}
+	retry := &RetryConfig{MaxRetries: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, Multiplier: 1}
+
+	t.Run("budget_shared_across_tool_calls", func(t *testing.T) {
+		var calls atomic.Int32
+		cfg := *retry
+		cfg.MaxTotalRetries = 2
+		ag := newTestAgent(t, repeatedCallsProvider("flaky", "a", "b"),
+			WithTools(flaky(&calls)),
+			WithRetryConfig(&cfg),
+		)
+
+		_, err := ag.Chat(context.Background(), "Go")
+		require.NoError(t, err)
+		// 第一次调用：1 次执行 + 2 次重试；第二次调用额度已用尽，只执行 1 次
+		assert.Equal(t, int32(4), calls.Load())
+	})
+
+	t.Run("budget_reset_per_run", func(t *testing.T) {
+		var calls atomic.Int32
+		cfg := *retry
+		// 每次执行依次调用两次工具后结束
+		provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n%3 != 0 {
+				return toolCallMessage(fmt.Sprintf("call-%d", n), "flaky", map[string]any{"text": "x"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+		ag := newTestAgent(t, provider,
+			WithTools(flaky(&calls)),
+			WithRetryConfig(&cfg),
+			WithMaxTotalRetries(1),
+		)
+
+		for range 2 {
+			calls.Store(0)
+			_, err := ag.Chat(context.Background(), "Go")
+			require.NoError(t, err)
+			// 每次执行：首个调用 1 次执行 + 1 次重试，其余调用不再重试
+			assert.Equal(t, int32(3), calls.Load())
+		}
+	})
+
+	t.Run("unlimited_by_default", func(t *testing.T) {
+		var calls atomic.Int32
+		ag := newTestAgent(t, repeatedCallsProvider("flaky", "a", "b"),
+			WithTools(flaky(&calls)),
+			WithRetryConfig(retry),
+		)
+
+		_, err := ag.Chat(context.Background(), "Go")
+		require.NoError(t, err)
+		assert.Equal(t, int32(8), calls.Load())
+	})
+}
+
+// rateLimitError 携带 Retry-After 建议的 429 错误
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string             { return "API error: 429 - rate limited" }
+func (e *rateLimitError) StatusCode() int           { return 429 }
+func (e *rateLimitError) RetryAfter() time.Duration { return e.retryAfter }
+
+func TestAgent_RetryAfter(t *testing.T) {
+	t.Run("suggested_backoff", func(t *testing.T) {
+		cfg := &RetryConfig{MaxBackoff: 5 * time.Second}
+
+		wait, ok := cfg.suggestedBackoff(fmt.Errorf("complete: %w", &rateLimitError{retryAfter: 2 * time.Second}))
+		assert.True(t, ok)
+		assert.Equal(t, 2*time.Second, wait)
+
+		wait, ok = cfg.suggestedBackoff(&rateLimitError{retryAfter: time.Minute})
+		assert.True(t, ok)
+		assert.Equal(t, 5*time.Second, wait, "capped by MaxBackoff")
+
+		_, ok = cfg.suggestedBackoff(&rateLimitError{})
+		assert.False(t, ok, "zero hint ignored")
+		_, ok = cfg.suggestedBackoff(errors.New("rate limit"))
+		assert.False(t, ok)
+	})
+
+	t.Run("honored_instead_of_backoff", func(t *testing.T) {
+		// 指数退避需要等待 1 小时，Retry-After 建议 1 毫秒
+		cfg := &RetryConfig{MaxRetries: 2, InitialBackoff: time.Hour, MaxBackoff: time.Hour, Multiplier: 1}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		calls := 0
+		out, retries, err := (&Agent{}).retryWithBackoff(ctx, slog.Default(), nil, func() (any, error) {
+			calls++
+			if calls < 3 {
+				return nil, &rateLimitError{retryAfter: time.Millisecond}
+			}
+			return "ok", nil
+		}, cfg)
+		require.NoError(t, err)
+		assert.Equal(t, "ok", out)
+		assert.Equal(t, 2, retries)
+	})
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // RetryConfig Tests
 // ═══════════════════════════════════════════════════════════════════════════
@@ -147,6 +442,39 @@ func TestRetryConfig(t *testing.T) {
 	})
 }
 
+func TestRetryConfig_Jitter(t *testing.T) {
+	fixed := func(v float64) func() float64 { return func() float64 { return v } }
+
+	tests := []struct {
+		name   string
+		jitter float64
+		random float64
+		want   time.Duration
+	}{
+		{name: "disabled", jitter: 0, random: 0.9, want: time.Second},
+		{name: "lower_bound", jitter: 0.2, random: 0, want: 800 * time.Millisecond},
+		{name: "midpoint", jitter: 0.2, random: 0.5, want: time.Second},
+		{name: "upper_range", jitter: 0.2, random: 0.75, want: 1100 * time.Millisecond},
+		{name: "clamped_above_one", jitter: 3, random: 0, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &RetryConfig{Jitter: tt.jitter, Rand: fixed(tt.random)}
+			assert.Equal(t, tt.want, cfg.jittered(time.Second))
+		})
+	}
+
+	t.Run("default_source_within_bounds", func(t *testing.T) {
+		cfg := &RetryConfig{Jitter: 0.5}
+		for range 100 {
+			d := cfg.jittered(time.Second)
+			assert.GreaterOrEqual(t, d, 500*time.Millisecond)
+			assert.Less(t, d, 1500*time.Millisecond)
+		}
+	})
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // Benchmark Tests
 // ═══════════════════════════════════════════════════════════════════════════
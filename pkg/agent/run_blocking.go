@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 )
@@ -12,103 +13,193 @@ import (
 // ═══════════════════════════════════════════════════════════════════════════
 
 // runLoopBlocking 非流式对话循环（默认）
-func (a *Agent) runLoopBlocking(ctx context.Context, eventCh chan<- *AgentEvent, startMsgIndex int) *Result {
+func (a *Agent) runLoopBlocking(ctx context.Context, eventCh chan<- *AgentEvent, state *runState) *Result {
 	// 循环级 panic recovery
 	defer func() {
 		if r := recover(); r != nil {
-			a.logger.Error("panic in runLoopBlocking",
+			state.logger.Error("panic in runLoopBlocking",
 				"panic", r,
 				"agent_id", a.id,
 			)
-			eventCh <- &AgentEvent{
-				Type:  llm.EventTypeError,
-				Error: fmt.Errorf("execution loop panic: %v", r),
-			}
+			a.emitRunError(ctx, state, eventCh, fmt.Errorf("execution loop panic: %v", r))
 		}
 	}()
 
-	var toolsUsed []string
-	stepCount := 0
-
 	for {
 		select {
 		case <-ctx.Done():
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: ctx.Err()}
-			return nil
+			return a.failRun(ctx, state, eventCh, ctx.Err())
 		case <-a.stopCh:
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: ErrAgentStopped}
-			return nil
+			return a.failRun(ctx, state, eventCh, ErrAgentStopped)
 		default:
 		}
 
-		stepCount++
+		// 步数上限检查
+		if err := a.checkMaxSteps(state); err != nil {
+			return a.failRun(ctx, state, eventCh, err)
+		}
+
+		state.stepCount++
+		a.hookStep(state.stepCount)
+		stepCtx := a.beginStepSpan(ctx, state)
+
+		// 上下文过长时压缩历史
+		a.maybeCompact(stepCtx, state)
 
 		// 调用 Provider（非流式）
-		response, err := a.callProviderBlocking(ctx)
+		callStart := time.Now()
+		response, err := a.callProviderBlocking(stepCtx, state, eventCh)
 		if err != nil {
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: err}
-			return nil
+			return a.failRun(ctx, state, eventCh, err)
 		}
 
+		a.recordUsage(state, response)
+		a.captureReasoning(state, response.Message)
+		state.lastText = response.Message.GetContent()
+		state.finishReason = response.FinishReason
+		latency := time.Since(callStart)
+		a.observeCall(latency, response.Usage)
+		state.recordStep(latency, response.Usage)
+
 		// 添加响应消息
-		a.appendMessage(response.Message)
+		a.appendMessage(state.threadID, response.Message)
 
 		// 提取工具调用
 		toolCalls := response.Message.GetToolCalls()
 		if len(toolCalls) == 0 {
-			// 无工具调用，发送完整文本事件
+			// 无工具调用，解析结构化输出（如已设置 Schema）
 			text := response.Message.GetContent()
+			var finalErr error
+			if a.responseFormat != nil {
+				text, finalErr = a.resolveStructured(stepCtx, state, text, eventCh)
+			}
+
+			// 校验最终答案，未通过且可重试时带着反馈继续
+			if finalErr == nil {
+				retry, err := a.checkAnswer(stepCtx, state, text)
+				if retry {
+					continue
+				}
+				finalErr = err
+			}
+
+			// 发送完整文本事件
 			if text != "" {
-				eventCh <- &AgentEvent{Type: llm.EventTypeText, Text: text}
+				a.sendEvent(ctx, eventCh, &AgentEvent{Type: llm.EventTypeText, Text: text})
 			}
-			return a.buildResult(startMsgIndex, text, toolsUsed, stepCount)
+			if finalErr != nil {
+				// 错误事件附带的部分结果保留最终文本
+				state.lastText = text
+				return a.failRun(ctx, state, eventCh, finalErr)
+			}
+			return a.buildResult(state, text)
 		}
 
 		// 发送工具调用事件
 		for _, tc := range toolCalls {
-			eventCh <- &AgentEvent{
+			a.sendEvent(ctx, eventCh, &AgentEvent{
 				Type:     llm.EventTypeToolCall,
 				ToolCall: tc,
-			}
+			})
 		}
 
 		// 执行工具
-		results, usedNames := a.executeToolsWithEvents(ctx, toolCalls, eventCh)
-		toolsUsed = append(toolsUsed, usedNames...)
+		results, usedNames, toolErr := a.executeToolsWithEvents(stepCtx, state, toolCalls, eventCh)
+		state.toolsUsed = append(state.toolsUsed, usedNames...)
+		state.setStepTools(usedNames)
 
 		// 添加工具结果消息
-		a.appendMessage(llm.Message{
-			Role:          llm.RoleUser,
-			ContentBlocks: results,
-		})
+		for _, msg := range a.toolResultMessages(state, results) {
+			a.appendMessage(state.threadID, msg)
+		}
+
+		// 审批出错时中止
+		if toolErr != nil {
+			return a.failRun(ctx, state, eventCh, toolErr)
+		}
+
+		// 连续工具失败检查
+		if err := a.checkToolErrors(state, results); err != nil {
+			return a.failRun(ctx, state, eventCh, err)
+		}
 	}
 }
 
 // buildResult 构建对话结果
-func (a *Agent) buildResult(startMsgIndex int, text string, toolsUsed []string, stepCount int) *Result {
+func (a *Agent) buildResult(state *runState, text string) *Result {
 	a.mu.RLock()
-	msgs := a.messages[startMsgIndex:]
+	msgs := a.historyLocked(state.threadID)[state.startMsgIndex:]
 	msgsCopy := make([]llm.Message, len(msgs))
 	copy(msgsCopy, msgs)
 	a.mu.RUnlock()
 
 	return &Result{
-		Text:      text,
-		Messages:  msgsCopy,
-		ToolsUsed: toolsUsed,
-		StepCount: stepCount,
+		Text:             text,
+		Messages:         msgsCopy,
+		ToolsUsed:        state.toolsUsed,
+		StepCount:        state.stepCount,
+		PromptTokens:     state.promptTokens,
+		CompletionTokens: state.completionTokens,
+		TotalTokens:      state.totalTokens,
+		Steps:            state.steps,
+		Metadata:         state.metadata,
+		Audit:            state.audit,
+		Structured:       state.structured,
+		Reasoning:        state.reasoning.String(),
+		FinishReason:     state.finishReason,
+		Err:              state.err,
+	}
+}
+
+// failRun 以错误结束执行：错误事件附带截至出错时的部分结果，返回 nil（不发送完成事件）
+func (a *Agent) failRun(ctx context.Context, state *runState, eventCh chan<- *AgentEvent, err error) *Result {
+	a.recordRunError(state, err)
+	a.emitErrorEvent(ctx, eventCh, &AgentEvent{
+		Type:   llm.EventTypeError,
+		Error:  err,
+		Result: a.buildResult(state, state.lastText),
+	})
+	return nil
+}
+
+// captureReasoning 记录响应中的思考内容块（仅 CaptureReasoning 开启时）
+func (a *Agent) captureReasoning(state *runState, msg llm.Message) {
+	if !a.config.CaptureReasoning {
+		return
+	}
+	for _, block := range msg.ContentBlocks {
+		if tb, ok := block.(*llm.ThinkingBlock); ok {
+			state.addReasoning(tb.Thinking)
+		}
 	}
 }
 
 // callProviderBlocking 非流式调用 Provider
-func (a *Agent) callProviderBlocking(ctx context.Context) (*llm.Response, error) {
-	a.mu.RLock()
-	messages := make([]llm.Message, len(a.messages))
-	copy(messages, a.messages)
-	a.mu.RUnlock()
+func (a *Agent) callProviderBlocking(ctx context.Context, state *runState, eventCh chan<- *AgentEvent) (*llm.Response, error) {
+	messages := a.providerMessages(a.snapshotHistory(state.threadID))
 
-	opts := a.buildProviderOptions()
+	opts := a.buildProviderOptions(state.options)
 
-	// 使用非流式 API
-	return a.provider.Complete(ctx, messages, opts)
+	// 临近截止时间时降级，并禁用工具以尽快给出最终回答
+	p, downgraded := a.selectProvider(ctx, state)
+	if downgraded {
+		opts.Tools = nil
+	}
+	a.updateContextUsage(ctx, state, messages, opts, eventCh)
+
+	// 使用非流式 API（经过中间件链），主 Provider 不可用时依次尝试备用 Provider
+	callCtx := contextWithModel(ctx, a.callModel(downgraded))
+	return a.callWithFallback(ctx, state, p, func(target llm.Provider) (*llm.Response, error) {
+		call := a.wrapProviderCall(func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+			start := time.Now()
+			resp, err := target.Complete(ctx, messages, opts)
+			a.recordAudit(state, start, downgraded, messages, opts, resp, err)
+			return resp, err
+		})
+		return a.retryProviderCall(ctx, state, func() (*llm.Response, error) {
+			return a.callWithTimeout(callCtx, func(ctx context.Context) (*llm.Response, error) {
+				return call(ctx, messages, opts)
+			})
+		})
+	})
 }
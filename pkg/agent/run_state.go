@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 单次执行状态
+// ═══════════════════════════════════════════════════════════════════════════
+
+// runState 单次 Run 的执行状态
+//
+// 由 Run 创建并传给执行循环，在步骤之间累积数据，最终用于构建 Result。
+type runState struct {
+	options *RunOptions  // 本次执行选项
+	logger  *slog.Logger // 本次执行的日志器（已附加 RunOptions.LogAttrs）
+
+	threadID      string         // 会话 ID（空表示默认会话）
+	startMsgIndex int            // 本轮第一条消息在历史中的位置
+	stepCount     int            // 已执行步数（LLM 调用次数）
+	lastText      string         // 最近一次模型回复的文本
+	finishReason  string         // 最近一次模型调用的结束原因
+	err           error          // 首个执行错误（写入 Result.Err）
+	toolsUsed     []string       // 使用过的工具
+	metadata      map[string]any // 附加到 Result 的元数据
+
+	// Token 统计（累加所有步骤）
+	promptTokens     int
+	completionTokens int
+	totalTokens      int
+	cost             float64 // 按价格表估算的费用
+
+	// 步骤明细
+	steps []StepInfo
+
+	// 连续"工具全部失败"的步数
+	consecutiveToolErrors int
+
+	// 审计记录（仅 AuditMode 开启时填充）
+	audit []AuditEntry
+
+	// 最终答案校验失败后的重试次数
+	answerRetries int
+
+	// 本次执行共享的重试额度（未设置 MaxTotalRetries 时为 nil）
+	retryBudget *retryBudget
+
+	// 结构化输出（仅设置 ResponseSchema 时填充）
+	structured    json.RawMessage
+	structuredErr error
+
+	// 推理内容（仅 CaptureReasoning 开启时填充）
+	reasoning     strings.Builder
+	reasoningStep int // 最近一段推理所属的步骤，用于分隔不同步骤的推理
+
+	// 链路追踪（未设置 Tracer 时为空 span）
+	span     Span // 本次执行的根 span
+	stepSpan Span // 当前步骤的 span
+}
+
+// newRunState 创建执行状态
+//
+// 日志属性只在这里通过 logger.With 附加一次，整个执行过程复用同一个日志器。
+func (a *Agent) newRunState(options *RunOptions, threadID string, startMsgIndex int) *runState {
+	logger := a.logger
+	if len(options.LogAttrs) > 0 {
+		args := make([]any, len(options.LogAttrs))
+		for i, attr := range options.LogAttrs {
+			args[i] = attr
+		}
+		logger = logger.With(args...)
+	}
+
+	return &runState{
+		options:       options,
+		logger:        logger,
+		threadID:      threadID,
+		startMsgIndex: startMsgIndex,
+		retryBudget:   newRetryBudget(a.retryConfig),
+		span:          nopSpan{},
+		stepSpan:      nopSpan{},
+	}
+}
+
+// addUsage 累加单次 LLM 调用的 Token 用量
+func (s *runState) addUsage(usage *llm.TokenUsage) {
+	if usage == nil {
+		return
+	}
+	s.promptTokens += int(usage.InputTokens)
+	s.completionTokens += int(usage.OutputTokens)
+	s.totalTokens += usageTotal(usage)
+}
+
+// recordStep 记录当前步骤的模型调用耗时和 Token 用量
+func (s *runState) recordStep(duration time.Duration, usage *llm.TokenUsage) {
+	s.steps = append(s.steps, StepInfo{
+		Index:    s.stepCount,
+		Duration: duration,
+		Tokens:   usageTotal(usage),
+	})
+}
+
+// setStepTools 记录当前步骤调用的工具
+func (s *runState) setStepTools(names []string) {
+	if len(s.steps) == 0 {
+		return
+	}
+	s.steps[len(s.steps)-1].ToolsUsed = names
+}
+
+// addReasoning 追加推理内容，不同步骤之间以空行分隔
+func (s *runState) addReasoning(text string) {
+	if text == "" {
+		return
+	}
+	if s.reasoning.Len() > 0 && s.reasoningStep != s.stepCount {
+		s.reasoning.WriteString("\n\n")
+	}
+	s.reasoningStep = s.stepCount
+	s.reasoning.WriteString(text)
+}
+
+// usageTotal 计算 Token 总量（Provider 未返回总量时按输入+输出计算）
+func usageTotal(usage *llm.TokenUsage) int {
+	if usage == nil {
+		return 0
+	}
+	if usage.TotalTokens > 0 {
+		return int(usage.TotalTokens)
+	}
+	return int(usage.InputTokens + usage.OutputTokens)
+}
+
+// setMetadata 记录结果元数据
+func (s *runState) setMetadata(key string, value any) {
+	if s.metadata == nil {
+		s.metadata = make(map[string]any)
+	}
+	s.metadata[key] = value
+}
@@ -2,9 +2,10 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 )
@@ -14,90 +15,174 @@ import (
 // ═══════════════════════════════════════════════════════════════════════════
 
 // runLoopStreaming 流式对话循环
-func (a *Agent) runLoopStreaming(ctx context.Context, eventCh chan<- *AgentEvent, startMsgIndex int) *Result {
+func (a *Agent) runLoopStreaming(ctx context.Context, eventCh chan<- *AgentEvent, state *runState) *Result {
 	// 循环级 panic recovery
 	defer func() {
 		if r := recover(); r != nil {
-			a.logger.Error("panic in runLoopStreaming",
+			state.logger.Error("panic in runLoopStreaming",
 				"panic", r,
 				"agent_id", a.id,
 			)
-			eventCh <- &AgentEvent{
-				Type:  llm.EventTypeError,
-				Error: fmt.Errorf("streaming loop panic: %v", r),
-			}
+			a.emitRunError(ctx, state, eventCh, fmt.Errorf("streaming loop panic: %v", r))
 		}
 	}()
 
-	var toolsUsed []string
-	stepCount := 0
-
 	for {
 		select {
 		case <-ctx.Done():
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: ctx.Err()}
-			return nil
+			return a.failRun(ctx, state, eventCh, ctx.Err())
 		case <-a.stopCh:
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: ErrAgentStopped}
-			return nil
+			return a.failRun(ctx, state, eventCh, ErrAgentStopped)
 		default:
 		}
 
-		stepCount++
+		// 步数上限检查
+		if err := a.checkMaxSteps(state); err != nil {
+			return a.failRun(ctx, state, eventCh, err)
+		}
+
+		state.stepCount++
+		a.hookStep(state.stepCount)
+		stepCtx := a.beginStepSpan(ctx, state)
+
+		// 上下文过长时压缩历史
+		a.maybeCompact(stepCtx, state)
 
 		// 调用 Provider（流式）
-		response, err := a.callProviderStreaming(ctx, eventCh)
+		callStart := time.Now()
+		response, err := a.callProviderStreaming(stepCtx, state, eventCh)
 		if err != nil {
-			eventCh <- &AgentEvent{Type: llm.EventTypeError, Error: err}
-			return nil
+			return a.failRun(ctx, state, eventCh, err)
 		}
 
+		a.recordUsage(state, response)
+		state.lastText = response.Message.GetContent()
+		state.finishReason = response.FinishReason
+		latency := time.Since(callStart)
+		a.observeCall(latency, response.Usage)
+		state.recordStep(latency, response.Usage)
+
 		// 添加响应消息
-		a.appendMessage(response.Message)
+		a.appendMessage(state.threadID, response.Message)
 
 		// 提取工具调用
 		toolCalls := response.Message.GetToolCalls()
 		if len(toolCalls) == 0 {
-			// 无工具调用，对话完成
-			return a.buildResult(startMsgIndex, response.Message.GetContent(), toolsUsed, stepCount)
+			// 无工具调用，对话完成（已设置 Schema 时解析结构化输出）
+			text := response.Message.GetContent()
+			var finalErr error
+			if a.responseFormat != nil {
+				text, finalErr = a.resolveStructured(stepCtx, state, text, eventCh)
+			}
+
+			// 校验最终答案，未通过且可重试时带着反馈继续
+			if finalErr == nil {
+				retry, err := a.checkAnswer(stepCtx, state, text)
+				if retry {
+					continue
+				}
+				finalErr = err
+			}
+
+			if finalErr != nil {
+				// 错误事件附带的部分结果保留最终文本
+				state.lastText = text
+				return a.failRun(ctx, state, eventCh, finalErr)
+			}
+			return a.buildResult(state, text)
 		}
 
 		// 发送工具调用事件
 		for _, tc := range toolCalls {
-			eventCh <- &AgentEvent{
+			a.sendEvent(ctx, eventCh, &AgentEvent{
 				Type:     llm.EventTypeToolCall,
 				ToolCall: tc,
-			}
+			})
 		}
 
 		// 执行工具
-		results, usedNames := a.executeToolsWithEvents(ctx, toolCalls, eventCh)
-		toolsUsed = append(toolsUsed, usedNames...)
+		results, usedNames, toolErr := a.executeToolsWithEvents(stepCtx, state, toolCalls, eventCh)
+		state.toolsUsed = append(state.toolsUsed, usedNames...)
+		state.setStepTools(usedNames)
 
 		// 添加工具结果消息
-		a.appendMessage(llm.Message{
-			Role:          llm.RoleUser,
-			ContentBlocks: results,
-		})
+		for _, msg := range a.toolResultMessages(state, results) {
+			a.appendMessage(state.threadID, msg)
+		}
+
+		// 审批出错时中止
+		if toolErr != nil {
+			return a.failRun(ctx, state, eventCh, toolErr)
+		}
+
+		// 连续工具失败检查
+		if err := a.checkToolErrors(state, results); err != nil {
+			return a.failRun(ctx, state, eventCh, err)
+		}
 	}
 }
 
 // callProviderStreaming 流式调用 Provider
-func (a *Agent) callProviderStreaming(ctx context.Context, eventCh chan<- *AgentEvent) (*llm.Response, error) {
-	a.mu.RLock()
-	messages := make([]llm.Message, len(a.messages))
-	copy(messages, a.messages)
-	a.mu.RUnlock()
+func (a *Agent) callProviderStreaming(ctx context.Context, state *runState, eventCh chan<- *AgentEvent) (*llm.Response, error) {
+	messages := a.providerMessages(a.snapshotHistory(state.threadID))
 
-	opts := a.buildProviderOptions()
+	opts := a.buildProviderOptions(state.options)
+
+	// 临近截止时间时降级，并禁用工具以尽快给出最终回答
+	p, downgraded := a.selectProvider(ctx, state)
+	if downgraded {
+		opts.Tools = nil
+	}
+	a.updateContextUsage(ctx, state, messages, opts, eventCh)
 
+	// 经过中间件链调用；中间件短路（如命中缓存）时补发完整文本事件
+	// 主 Provider 不可用时依次尝试备用 Provider，已输出部分内容时不再转移
+	streamed := false
+	callCtx := contextWithModel(contextWithStreaming(ctx), a.callModel(downgraded))
+	response, err := a.callWithFallback(ctx, state, p, func(target llm.Provider) (*llm.Response, error) {
+		partial := false
+		call := a.wrapProviderCall(func(ctx context.Context, messages []llm.Message, opts *llm.Options) (*llm.Response, error) {
+			streamed = true
+			resp, err := a.streamProvider(ctx, state, target, downgraded, messages, opts, eventCh)
+			var nr *noRetryError
+			if errors.As(err, &nr) {
+				partial = true
+			}
+			return resp, err
+		})
+		resp, err := a.retryProviderCall(ctx, state, func() (*llm.Response, error) {
+			streamed = false
+			return a.callWithTimeout(callCtx, func(ctx context.Context) (*llm.Response, error) {
+				return call(ctx, messages, opts)
+			})
+		})
+		if err != nil && partial {
+			return nil, &noRetryError{err: err}
+		}
+		return resp, err
+	})
+	if err == nil && !streamed {
+		if text := response.Message.GetContent(); text != "" {
+			a.sendEvent(ctx, eventCh, &AgentEvent{Type: llm.EventTypeText, Text: text})
+		}
+	}
+	return response, err
+}
+
+// streamProvider 调用 Provider 流式 API，转发增量事件并组装完整响应
+func (a *Agent) streamProvider(ctx context.Context, state *runState, p llm.Provider, downgraded bool,
+	messages []llm.Message, opts *llm.Options, eventCh chan<- *AgentEvent,
+) (*llm.Response, error) {
 	// 使用流式 API
-	chunkCh, err := a.provider.Stream(ctx, messages, opts)
+	start := time.Now()
+	chunkCh, err := p.Stream(ctx, messages, opts)
 	if err != nil {
+		a.recordAudit(state, start, downgraded, messages, opts, nil, err)
 		return nil, err
 	}
 
 	var textBuilder strings.Builder
+	text := newTextCoalescer(state.options.TextCoalesce, func(event *AgentEvent) { a.sendEvent(ctx, eventCh, event) })
 	// 用于累积流式工具调用
 	toolCallsMap := make(map[int]*struct {
 		id   string
@@ -105,22 +190,43 @@ func (a *Agent) callProviderStreaming(ctx context.Context, eventCh chan<- *Agent
 		args strings.Builder
 	})
 
+	// 流中出现错误时记录首个错误并继续排空通道
+	var streamErr error
+	received := false
+	finishReason := ""
+
 	for chunk := range chunkCh {
+		if streamErr != nil {
+			continue
+		}
+		if chunk.Type == llm.EventTypeError {
+			streamErr = chunk.Error
+			if streamErr == nil {
+				streamErr = errors.New("stream error")
+			}
+			continue
+		}
+		received = true
+		if chunk.FinishReason != "" {
+			finishReason = chunk.FinishReason
+		}
+
 		switch chunk.Type {
 		case llm.EventTypeText:
 			if chunk.TextDelta != "" {
 				textBuilder.WriteString(chunk.TextDelta)
-				eventCh <- &AgentEvent{
-					Type: llm.EventTypeText,
-					Text: chunk.TextDelta,
-				}
+				text.write(chunk.TextDelta)
 			}
-		case llm.EventTypeReasoning:
-			if chunk.TextDelta != "" {
-				eventCh <- &AgentEvent{
-					Type:      llm.EventTypeReasoning,
-					Reasoning: chunk.TextDelta,
+		case llm.EventTypeReasoning, llm.EventTypeThinking:
+			if delta := reasoningDelta(chunk); delta != "" {
+				text.flush()
+				if a.config.CaptureReasoning {
+					state.addReasoning(delta)
 				}
+				a.sendEvent(ctx, eventCh, &AgentEvent{
+					Type:      llm.EventTypeReasoning,
+					Reasoning: delta,
+				})
 			}
 		case llm.EventTypeToolCall:
 			if chunk.ToolCall != nil {
@@ -145,27 +251,46 @@ func (a *Agent) callProviderStreaming(ctx context.Context, eventCh chan<- *Agent
 				if tc.ArgumentsDelta != "" {
 					entry.args.WriteString(tc.ArgumentsDelta)
 				}
+				if state.options.StreamingToolArgs {
+					text.flush()
+					a.sendEvent(ctx, eventCh, &AgentEvent{
+						Type: EventTypeToolCallDelta,
+						ToolCallDelta: &llm.ToolCallDelta{
+							Index:          tc.Index,
+							ID:             entry.id,
+							Name:           entry.name,
+							ArgumentsDelta: tc.ArgumentsDelta,
+						},
+					})
+				}
 			}
-		case llm.EventTypeToolResult, llm.EventTypeThinking, llm.EventTypeDone, llm.EventTypeError:
+		case llm.EventTypeToolResult, llm.EventTypeDone, llm.EventTypeError:
 			// 这些事件类型在流式块处理中不出现，由上层处理
 		}
 	}
 
+	// 发送剩余的缓冲文本
+	text.flush()
+
+	// Provider 因取消而提前关闭通道时，不把截断的内容当作完整响应
+	if streamErr == nil {
+		streamErr = ctx.Err()
+	}
+	if streamErr != nil {
+		a.recordAudit(state, start, downgraded, messages, opts, nil, streamErr)
+		// 已收到部分内容时不再重试，避免重复输出
+		if received {
+			return nil, &noRetryError{err: streamErr}
+		}
+		return nil, streamErr
+	}
+
 	// 将累积的工具调用转换为 ContentBlocks
 	toolCallBlocks := make([]*llm.ToolCall, 0, len(toolCallsMap))
 	for i := range len(toolCallsMap) {
 		if entry, exists := toolCallsMap[i]; exists {
-			// 解析 JSON 参数
-			var input map[string]any
-			if argsStr := entry.args.String(); argsStr != "" {
-				if err := json.Unmarshal([]byte(argsStr), &input); err != nil {
-					a.logger.Warn("failed to parse tool call arguments",
-						"name", entry.name,
-						"error", err,
-					)
-					input = make(map[string]any)
-				}
-			}
+			// 解析 JSON 参数（开启 RepairToolArgs 时尝试修复）
+			input := a.parseToolArgs(state, entry.name, entry.args.String())
 			toolCallBlocks = append(toolCallBlocks, &llm.ToolCall{
 				ID:    entry.id,
 				Name:  entry.name,
@@ -189,5 +314,61 @@ func (a *Agent) callProviderStreaming(ctx context.Context, eventCh chan<- *Agent
 		ContentBlocks: contentBlocks,
 	}
 
-	return &llm.Response{Message: msg}, nil
+	// llm.Event 没有用量字段，流式响应无法得到 Token 用量（见 Result）
+	response := &llm.Response{Message: msg, FinishReason: finishReason}
+	a.recordAudit(state, start, downgraded, messages, opts, response, nil)
+	return response, nil
+}
+
+// reasoningDelta 提取推理增量（兼容 TextDelta 和 Reasoning.ThoughtDelta 两种形式）
+func reasoningDelta(chunk *llm.Event) string {
+	if chunk.TextDelta != "" {
+		return chunk.TextDelta
+	}
+	if chunk.Reasoning != nil {
+		return chunk.Reasoning.ThoughtDelta
+	}
+	return ""
+}
+
+// textCoalescer 流式文本增量合并器
+//
+// window 为 0 时直接透传每个增量；否则缓冲增量，距上次发送超过 window 时合并发送。
+type textCoalescer struct {
+	window    time.Duration
+	send      func(event *AgentEvent)
+	buf       strings.Builder
+	lastFlush time.Time
+}
+
+// newTextCoalescer 创建文本增量合并器
+func newTextCoalescer(window time.Duration, send func(event *AgentEvent)) *textCoalescer {
+	return &textCoalescer{
+		window:    window,
+		send:      send,
+		lastFlush: time.Now(),
+	}
+}
+
+// write 写入文本增量，窗口到期时发送
+func (c *textCoalescer) write(delta string) {
+	if c.window <= 0 {
+		c.send(&AgentEvent{Type: llm.EventTypeText, Text: delta})
+		return
+	}
+
+	c.buf.WriteString(delta)
+	if time.Since(c.lastFlush) >= c.window {
+		c.flush()
+	}
+}
+
+// flush 发送缓冲的文本
+func (c *textCoalescer) flush() {
+	c.lastFlush = time.Now()
+	if c.buf.Len() == 0 {
+		return
+	}
+	c.send(&AgentEvent{Type: llm.EventTypeText, Text: c.buf.String()})
+	c.buf.Reset()
 }
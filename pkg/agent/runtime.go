@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 内存 Runtime
+// ═══════════════════════════════════════════════════════════════════════════
+
+var (
+	// ErrAgentExists Agent ID 已在 Runtime 中注册错误
+	ErrAgentExists = errors.New("agent already exists")
+
+	// ErrAgentNotFound Runtime 中不存在指定 Agent 错误
+	ErrAgentNotFound = errors.New("agent not found")
+)
+
+// memoryRuntime 线程安全的内存 Runtime 实现
+//
+// 按 ID 记录 Agent 并保留加入顺序，父子关系通过各 Agent 的 ParentID() 计算。
+type memoryRuntime struct {
+	mu     sync.RWMutex
+	agents map[string]AgentInterface
+	order  []string // 加入顺序（List 系列方法按此顺序返回）
+}
+
+// NewRuntime 创建内存 Runtime
+//
+// 使用示例:
+//
+//	rt := agent.NewRuntime()
+//	_ = rt.AddAgent(lead)
+//	_ = rt.AddAgent(worker) // worker.ParentID() == lead.ID()
+//
+//	team := rt.ListDescendantAgents(lead.ID())
+//	chain := rt.GetAgentLineage(worker.ID()) // [lead.ID(), worker.ID()]
+func NewRuntime() Runtime {
+	return &memoryRuntime{
+		agents: make(map[string]AgentInterface),
+	}
+}
+
+// AddAgent 添加 Agent（ID 重复时返回 ErrAgentExists）
+func (r *memoryRuntime) AddAgent(ag AgentInterface) error {
+	if ag == nil {
+		return errors.New("agent is nil")
+	}
+
+	id := ag.ID()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.agents[id]; exists {
+		return fmt.Errorf("%w: %s", ErrAgentExists, id)
+	}
+	r.agents[id] = ag
+	r.order = append(r.order, id)
+	return nil
+}
+
+// RemoveAgent 移除 Agent（不关闭，子 Agent 保留）
+func (r *memoryRuntime) RemoveAgent(agentID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(agentID)
+}
+
+// CloseAgent 关闭并移除 Agent（不存在时返回 ErrAgentNotFound）
+func (r *memoryRuntime) CloseAgent(agentID string) error {
+	r.mu.Lock()
+	ag, exists := r.agents[agentID]
+	if exists {
+		r.removeLocked(agentID)
+	}
+	r.mu.Unlock()
+
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, agentID)
+	}
+	return ag.Close()
+}
+
+// removeLocked 移除 Agent（调用方持有写锁）
+func (r *memoryRuntime) removeLocked(agentID string) {
+	if _, exists := r.agents[agentID]; !exists {
+		return
+	}
+	delete(r.agents, agentID)
+	r.order = slices.DeleteFunc(r.order, func(id string) bool { return id == agentID })
+}
+
+// GetAgent 获取 Agent
+func (r *memoryRuntime) GetAgent(agentID string) (AgentInterface, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ag, exists := r.agents[agentID]
+	return ag, exists
+}
+
+// ListAgents 按加入顺序列出所有 Agent
+func (r *memoryRuntime) ListAgents() []AgentInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]AgentInterface, 0, len(r.order))
+	for _, id := range r.order {
+		list = append(list, r.agents[id])
+	}
+	return list
+}
+
+// ListChildAgents 列出直接子 Agent
+func (r *memoryRuntime) ListChildAgents(parentID string) []AgentInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var children []AgentInterface
+	for _, id := range r.order {
+		if ag := r.agents[id]; ag.ParentID() == parentID {
+			children = append(children, ag)
+		}
+	}
+	return children
+}
+
+// ListDescendantAgents 列出所有后代 Agent（广度优先，不含 parentID 本身）
+func (r *memoryRuntime) ListDescendantAgents(parentID string) []AgentInterface {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// 一次遍历建立父 -> 子索引
+	children := make(map[string][]AgentInterface, len(r.order))
+	for _, id := range r.order {
+		ag := r.agents[id]
+		children[ag.ParentID()] = append(children[ag.ParentID()], ag)
+	}
+
+	var descendants []AgentInterface
+	visited := map[string]bool{parentID: true} // 防止异常的循环引用
+	queue := []string{parentID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, child := range children[current] {
+			if visited[child.ID()] {
+				continue
+			}
+			visited[child.ID()] = true
+			descendants = append(descendants, child)
+			queue = append(queue, child.ID())
+		}
+	}
+	return descendants
+}
+
+// GetAgentLineage 获取血统链（从根 Agent 到 agentID，含自身）
+//
+// 沿 ParentID 向上查找；父 Agent 未在 Runtime 中注册时，其 ID 作为链的起点。
+// agentID 未注册时返回 nil。
+func (r *memoryRuntime) GetAgentLineage(agentID string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, exists := r.agents[agentID]; !exists {
+		return nil
+	}
+
+	var lineage []string
+	visited := make(map[string]bool)
+	for id := agentID; id != "" && !visited[id]; {
+		visited[id] = true
+		lineage = append(lineage, id)
+
+		ag, exists := r.agents[id]
+		if !exists {
+			break
+		}
+		id = ag.ParentID()
+	}
+
+	slices.Reverse(lineage)
+	return lineage
+}
+
+// 确保 memoryRuntime 实现了 Runtime 接口
+var _ Runtime = (*memoryRuntime)(nil)
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Runtime Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// newRuntimeAgent 创建指定 ID 和父 ID 的测试 Agent
+func newRuntimeAgent(t *testing.T, id, parentID string) *Agent {
+	t.Helper()
+	return newTestAgent(t, mock.New(), WithID(id), WithParentID(parentID))
+}
+
+// agentIDs 提取 Agent ID 列表
+func agentIDs(agents []AgentInterface) []string {
+	ids := make([]string, 0, len(agents))
+	for _, ag := range agents {
+		ids = append(ids, ag.ID())
+	}
+	return ids
+}
+
+func TestRuntime(t *testing.T) {
+	// root
+	// ├── a
+	// │   ├── a1
+	// │   └── a2
+	// │       └── a2x
+	// └── b
+	rt := NewRuntime()
+	for _, pair := range [][2]string{
+		{"root", ""}, {"a", "root"}, {"b", "root"}, {"a1", "a"}, {"a2", "a"}, {"a2x", "a2"},
+	} {
+		require.NoError(t, rt.AddAgent(newRuntimeAgent(t, pair[0], pair[1])))
+	}
+
+	t.Run("get_and_list", func(t *testing.T) {
+		ag, ok := rt.GetAgent("a1")
+		require.True(t, ok)
+		assert.Equal(t, "a1", ag.ID())
+
+		_, ok = rt.GetAgent("missing")
+		assert.False(t, ok)
+
+		assert.Equal(t, []string{"root", "a", "b", "a1", "a2", "a2x"}, agentIDs(rt.ListAgents()))
+	})
+
+	t.Run("children", func(t *testing.T) {
+		assert.Equal(t, []string{"a", "b"}, agentIDs(rt.ListChildAgents("root")))
+		assert.Equal(t, []string{"a1", "a2"}, agentIDs(rt.ListChildAgents("a")))
+		assert.Empty(t, rt.ListChildAgents("b"))
+	})
+
+	t.Run("descendants", func(t *testing.T) {
+		assert.Equal(t, []string{"a", "b", "a1", "a2", "a2x"}, agentIDs(rt.ListDescendantAgents("root")))
+		assert.Equal(t, []string{"a1", "a2", "a2x"}, agentIDs(rt.ListDescendantAgents("a")))
+		assert.Empty(t, rt.ListDescendantAgents("a2x"))
+	})
+
+	t.Run("lineage", func(t *testing.T) {
+		assert.Equal(t, []string{"root", "a", "a2", "a2x"}, rt.GetAgentLineage("a2x"))
+		assert.Equal(t, []string{"root"}, rt.GetAgentLineage("root"))
+		assert.Nil(t, rt.GetAgentLineage("missing"))
+	})
+
+	t.Run("duplicate_id", func(t *testing.T) {
+		err := rt.AddAgent(newRuntimeAgent(t, "a", ""))
+		require.ErrorIs(t, err, ErrAgentExists)
+		require.Error(t, rt.AddAgent(nil))
+	})
+}
+
+func TestRuntime_RemoveAndClose(t *testing.T) {
+	rt := NewRuntime()
+	parent := newRuntimeAgent(t, "parent", "")
+	child := newRuntimeAgent(t, "child", "parent")
+	require.NoError(t, rt.AddAgent(parent))
+	require.NoError(t, rt.AddAgent(child))
+
+	t.Run("lineage_with_unregistered_parent", func(t *testing.T) {
+		rt.RemoveAgent("parent")
+		assert.Equal(t, []string{"parent", "child"}, rt.GetAgentLineage("child"))
+		assert.Equal(t, []string{"child"}, agentIDs(rt.ListAgents()))
+	})
+
+	t.Run("close", func(t *testing.T) {
+		require.NoError(t, rt.CloseAgent("child"))
+		assert.Equal(t, StateStopped, child.Status().State)
+		assert.Empty(t, rt.ListAgents())
+
+		require.ErrorIs(t, rt.CloseAgent("child"), ErrAgentNotFound)
+	})
+}
+
+func TestRuntime_Concurrent(t *testing.T) {
+	rt := NewRuntime()
+	require.NoError(t, rt.AddAgent(newRuntimeAgent(t, "root", "")))
+
+	const workers = 20
+	agents := make([]*Agent, workers)
+	for i := range workers {
+		agents[i] = newRuntimeAgent(t, fmt.Sprintf("worker-%d", i), "root")
+	}
+
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Go(func() {
+			assert.NoError(t, rt.AddAgent(agents[i]))
+		})
+		wg.Go(func() {
+			_ = rt.ListDescendantAgents("root")
+			_ = rt.GetAgentLineage(agents[i].ID())
+			_, _ = rt.GetAgent("root")
+		})
+	}
+	wg.Wait()
+
+	assert.Len(t, rt.ListChildAgents("root"), workers)
+
+	for i := range workers {
+		if i%2 == 0 {
+			wg.Go(func() { rt.RemoveAgent(agents[i].ID()) })
+		} else {
+			wg.Go(func() { _ = rt.ListAgents() })
+		}
+	}
+	wg.Wait()
+
+	assert.Len(t, rt.ListDescendantAgents("root"), workers/2)
+}
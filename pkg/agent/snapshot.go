@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 状态快照
+// ═══════════════════════════════════════════════════════════════════════════
+
+// snapshotVersion 快照格式版本（格式不兼容变更时递增）
+const snapshotVersion = 1
+
+// agentSnapshot Agent 状态快照的序列化格式
+type agentSnapshot struct {
+	Version      int                          `json:"version"`
+	ID           string                       `json:"id"`
+	State        State                        `json:"state"`
+	StepCount    int                          `json:"step_count"`
+	LastActivity time.Time                    `json:"last_activity,omitzero"`
+	Config       *Config                      `json:"config"`
+	Examples     []snapshotMessage            `json:"examples,omitempty"` // Config.Examples（与历史消息相同的编码）
+	Messages     []snapshotMessage            `json:"messages,omitempty"`
+	Threads      map[string][]snapshotMessage `json:"threads,omitempty"`
+}
+
+// snapshotMessage 可序列化的消息（llm.ContentBlock 为接口，需记录块类型才能还原）
+type snapshotMessage struct {
+	Role    llm.Role        `json:"role"`
+	Content string          `json:"content,omitempty"`
+	Blocks  []snapshotBlock `json:"blocks,omitempty"`
+}
+
+// snapshotBlock 带类型标记的内容块
+type snapshotBlock struct {
+	Type string          `json:"type"` // llm.ContentBlock.BlockType()
+	Data json.RawMessage `json:"data"`
+}
+
+// Snapshot 将 Agent 状态序列化为 JSON
+//
+// 快照包含配置、默认会话与命名会话的消息历史（含工具调用与工具结果）、步数和状态，
+// 可写入持久存储，之后通过 RestoreAgent 恢复，用于跨进程暂停和继续长任务。
+//
+// Provider、工具注册表、回调等运行时对象无法序列化，不包含在快照中；
+// 出于安全考虑，LLM.APIKey 也不会写入快照。
+func (a *Agent) Snapshot() ([]byte, error) {
+	a.mu.RLock()
+	snap := agentSnapshot{
+		Version:      snapshotVersion,
+		ID:           a.id,
+		State:        a.state,
+		StepCount:    a.stepCount,
+		LastActivity: a.lastActivity,
+		Config:       cloneConfig(a.config),
+	}
+	messages := cloneMessages(a.messages)
+	threads := make(map[string][]llm.Message, len(a.threads))
+	for id, msgs := range a.threads {
+		threads[id] = cloneMessages(msgs)
+	}
+	a.mu.RUnlock()
+
+	snap.Config.LLM.APIKey = ""
+
+	// 示例消息可能包含内容块接口，单独编码，不随配置原样序列化
+	examples := snap.Config.Examples
+	snap.Config.Examples = nil
+
+	var err error
+	if snap.Examples, err = encodeMessages(examples); err != nil {
+		return nil, fmt.Errorf("snapshot agent examples: %w", err)
+	}
+	if snap.Messages, err = encodeMessages(messages); err != nil {
+		return nil, fmt.Errorf("snapshot agent: %w", err)
+	}
+	if len(threads) > 0 {
+		snap.Threads = make(map[string][]snapshotMessage, len(threads))
+		for id, msgs := range threads {
+			if snap.Threads[id], err = encodeMessages(msgs); err != nil {
+				return nil, fmt.Errorf("snapshot agent thread %s: %w", id, err)
+			}
+		}
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot agent: %w", err)
+	}
+	return data, nil
+}
+
+// RestoreAgent 从快照恢复 Agent
+//
+// 使用快照中的配置和 ID 创建 Agent，并恢复消息历史与步数；恢复后的 Agent 处于 StateReady。
+// Provider 和工具等运行时对象需通过 opts 重新提供，opts 在快照配置之后应用，可覆盖其中的设置。
+//
+// 使用示例:
+//
+//	data, _ := ag.Snapshot()
+//	_ = os.WriteFile("session.json", data, 0o600)
+//
+//	// 进程重启后
+//	data, _ = os.ReadFile("session.json")
+//	ag, err := agent.RestoreAgent(data,
+//	    agent.WithProvider(myProvider),
+//	    agent.WithTools(tools...),
+//	)
+func RestoreAgent(data []byte, opts ...Option) (*Agent, error) {
+	var snap agentSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("restore agent: %w", err)
+	}
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("restore agent: unsupported snapshot version %d", snap.Version)
+	}
+	if snap.Config == nil {
+		snap.Config = DefaultConfig()
+	}
+
+	messages, err := decodeMessages(snap.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("restore agent: %w", err)
+	}
+	if len(snap.Examples) > 0 {
+		if snap.Config.Examples, err = decodeMessages(snap.Examples); err != nil {
+			return nil, fmt.Errorf("restore agent examples: %w", err)
+		}
+	}
+	threads := make(map[string][]llm.Message, len(snap.Threads))
+	for id, msgs := range snap.Threads {
+		if threads[id], err = decodeMessages(msgs); err != nil {
+			return nil, fmt.Errorf("restore agent thread %s: %w", id, err)
+		}
+	}
+
+	allOpts := make([]Option, 0, len(opts)+1)
+	allOpts = append(allOpts, func(b *builder) {
+		b.config = snap.Config
+		b.config.ID = snap.ID
+		b.history = messages
+	})
+	allOpts = append(allOpts, opts...)
+
+	ag, err := NewAgent(allOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("restore agent: %w", err)
+	}
+
+	ag.mu.Lock()
+	if len(threads) > 0 {
+		ag.threads = threads
+	}
+	ag.stepCount = snap.StepCount
+	ag.lastActivity = snap.LastActivity
+	ag.mu.Unlock()
+	return ag, nil
+}
+
+// encodeMessages 将消息转换为可序列化格式
+func encodeMessages(msgs []llm.Message) ([]snapshotMessage, error) {
+	out := make([]snapshotMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		sm := snapshotMessage{Role: msg.Role, Content: msg.Content}
+		for _, block := range msg.ContentBlocks {
+			switch block.(type) {
+			case *llm.TextBlock, *llm.ToolCall, *llm.ToolResultBlock, *llm.ThinkingBlock:
+			default:
+				return nil, fmt.Errorf("unsupported content block %T", block)
+			}
+			data, err := json.Marshal(block)
+			if err != nil {
+				return nil, fmt.Errorf("encode %s block: %w", block.BlockType(), err)
+			}
+			sm.Blocks = append(sm.Blocks, snapshotBlock{Type: block.BlockType(), Data: data})
+		}
+		out = append(out, sm)
+	}
+	return out, nil
+}
+
+// decodeMessages 从序列化格式还原消息
+func decodeMessages(msgs []snapshotMessage) ([]llm.Message, error) {
+	out := make([]llm.Message, 0, len(msgs))
+	for _, sm := range msgs {
+		msg := llm.Message{Role: sm.Role, Content: sm.Content}
+		for _, sb := range sm.Blocks {
+			block, err := decodeBlock(sb)
+			if err != nil {
+				return nil, err
+			}
+			msg.ContentBlocks = append(msg.ContentBlocks, block)
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
+
+// decodeBlock 按块类型还原内容块
+func decodeBlock(sb snapshotBlock) (llm.ContentBlock, error) {
+	var block llm.ContentBlock
+	switch sb.Type {
+	case (&llm.TextBlock{}).BlockType():
+		block = &llm.TextBlock{}
+	case (&llm.ToolCall{}).BlockType():
+		block = &llm.ToolCall{}
+	case (&llm.ToolResultBlock{}).BlockType():
+		block = &llm.ToolResultBlock{}
+	case (&llm.ThinkingBlock{}).BlockType():
+		block = &llm.ThinkingBlock{}
+	default:
+		return nil, fmt.Errorf("unknown content block type %q", sb.Type)
+	}
+	if err := json.Unmarshal(sb.Data, block); err != nil {
+		return nil, fmt.Errorf("decode %s block: %w", sb.Type, err)
+	}
+	return block, nil
+}
@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Snapshot Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Snapshot(t *testing.T) {
+	provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return toolCallMessage("call-1", "echo", map[string]any{"text": "hi"})
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+	ag := newTestAgent(t, provider,
+		WithName("worker"),
+		WithAPIKey("sk-secret"),
+		WithTools(newEchoTool()),
+		WithSystemSegments("context"),
+	)
+
+	_, err := ag.Chat(context.Background(), "Hello")
+	require.NoError(t, err)
+	_, err = collectResult(ag.RunThread(context.Background(), "side", "Other"))
+	require.NoError(t, err)
+
+	data, err := ag.Snapshot()
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "sk-secret")
+
+	t.Run("round_trip", func(t *testing.T) {
+		next := mock.New(mock.WithResponse("resumed"))
+		restored, err := RestoreAgent(data, WithProvider(next), WithTools(newEchoTool()))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = restored.Close() })
+
+		assert.Equal(t, ag.ID(), restored.ID())
+		assert.Equal(t, "worker", restored.Name())
+		assert.Equal(t, []string{"context"}, restored.Config().SystemSegments)
+		assert.Empty(t, restored.Config().LLM.APIKey)
+		assert.Equal(t, ag.Messages(), restored.Messages())
+		assert.Equal(t, ag.ThreadMessages("side"), restored.ThreadMessages("side"))
+		assert.Equal(t, ag.Status().StepCount, restored.Status().StepCount)
+		assert.Equal(t, StateReady, restored.Status().State)
+
+		// 工具调用与结果按原类型恢复
+		history := restored.Messages()
+		calls := history[1].GetToolCalls()
+		require.Len(t, calls, 1)
+		assert.Equal(t, map[string]any{"text": "hi"}, calls[0].Input)
+		require.Len(t, history[2].GetToolResults(), 1)
+		assert.Equal(t, "call-1", history[2].GetToolResults()[0].ToolUseID)
+
+		// 恢复后继续对话，历史随请求发送
+		result, err := restored.Chat(context.Background(), "Continue")
+		require.NoError(t, err)
+		assert.Equal(t, "resumed", result.Text)
+		assert.Len(t, next.LastCall().Messages, len(history)+1)
+	})
+
+	t.Run("options_override", func(t *testing.T) {
+		restored, err := RestoreAgent(data, WithProvider(mock.New()), WithName("renamed"))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = restored.Close() })
+		assert.Equal(t, "renamed", restored.Name())
+	})
+
+	t.Run("invalid_snapshot", func(t *testing.T) {
+		_, err := RestoreAgent([]byte("not json"), WithProvider(mock.New()))
+		require.Error(t, err)
+
+		_, err = RestoreAgent([]byte(`{"version": 99}`), WithProvider(mock.New()))
+		require.ErrorContains(t, err, "unsupported snapshot version")
+
+		_, err = RestoreAgent([]byte(`{"version": 1, "messages": [{"role": "user", "blocks": [{"type": "image", "data": {}}]}]}`),
+			WithProvider(mock.New()))
+		require.ErrorContains(t, err, "unknown content block type")
+	})
+}
+
+func TestAgent_SnapshotExamples(t *testing.T) {
+	examples := []llm.Message{
+		{Role: llm.RoleUser, ContentBlocks: []llm.ContentBlock{&llm.TextBlock{Text: "2+2?"}}},
+		{Role: llm.RoleAssistant, Content: "4"},
+	}
+	ag := newTestAgent(t, mock.New(), WithExamples(examples...))
+
+	data, err := ag.Snapshot()
+	require.NoError(t, err)
+
+	provider := mock.New(mock.WithResponse("ok"))
+	restored, err := RestoreAgent(data, WithProvider(provider))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = restored.Close() })
+
+	assert.Equal(t, examples, restored.Config().Examples)
+	assert.Equal(t, examples, ag.Config().Examples, "source config unchanged")
+
+	// 恢复后的示例仍随请求发送
+	_, err = restored.Chat(context.Background(), "3+3?")
+	require.NoError(t, err)
+	sent := provider.LastCall().Messages
+	require.Len(t, sent, 3)
+	assert.Equal(t, examples, sent[:2])
+}
@@ -0,0 +1,52 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Server-Sent Events 输出
+// ═══════════════════════════════════════════════════════════════════════════
+
+// WriteSSE 将事件流以 Server-Sent Events 格式写入 HTTP 响应
+//
+// 每个事件写成一帧：event 行为事件类型，data 行为事件的 JSON（见 AgentEvent.MarshalJSON），
+// 每帧写入后立即 flush。未设置 Content-Type 时设置为 text/event-stream 并关闭缓存。
+//
+// 事件通道关闭后返回 nil；写入失败（如客户端断开）时立即返回错误，不再读取剩余事件，
+// 因此应使用请求的 context 执行，客户端断开时执行随之取消。
+//
+// 使用示例：
+//
+//	http.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+//	    events := ag.Run(r.Context(), r.FormValue("q"), agent.WithStreaming(true))
+//	    if err := agent.WriteSSE(w, events); err != nil {
+//	        log.Printf("sse: %v", err)
+//	    }
+//	})
+func WriteSSE(w http.ResponseWriter, ch <-chan *AgentEvent) error {
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+	}
+
+	rc := http.NewResponseController(w)
+	for event := range ch {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("marshal %s event: %w", event.Type, err)
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return fmt.Errorf("write %s event: %w", event.Type, err)
+		}
+		// 不支持 flush 的 ResponseWriter 由服务器在响应结束时统一发送
+		if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return fmt.Errorf("flush %s event: %w", event.Type, err)
+		}
+	}
+	return nil
+}
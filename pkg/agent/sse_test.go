@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// SSE Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgentEvent_JSON(t *testing.T) {
+	t.Run("error_as_message", func(t *testing.T) {
+		data, err := json.Marshal(&AgentEvent{Type: llm.EventTypeError, Error: errors.New("boom")})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"type":"error","error":"boom"}`, string(data))
+
+		var decoded AgentEvent
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, llm.EventTypeError, decoded.Type)
+		require.Error(t, decoded.Error)
+		assert.Equal(t, "boom", decoded.Error.Error())
+	})
+
+	t.Run("logged_with_slog_json", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		event := &AgentEvent{Type: llm.EventTypeError, Error: fmt.Errorf("run: %w", context.DeadlineExceeded)}
+
+		logger.Info("agent event", "event", event, "events", []AgentEvent{*event})
+		assert.Equal(t, 2, strings.Count(buf.String(), `"error":"run: context deadline exceeded"`))
+		assert.NotContains(t, buf.String(), `"error":{}`)
+	})
+
+	t.Run("other_fields_unchanged", func(t *testing.T) {
+		data, err := json.Marshal(AgentEvent{Type: llm.EventTypeText, Text: "hi"})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"type":"text","text":"hi"}`, string(data))
+
+		var decoded AgentEvent
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, "hi", decoded.Text)
+		assert.NoError(t, decoded.Error)
+	})
+}
+
+// sseFrames 解析 SSE 响应体为 (event, data) 帧
+func sseFrames(t *testing.T, body string) [][2]string {
+	t.Helper()
+
+	var frames [][2]string
+	for frame := range strings.SplitSeq(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		lines := strings.Split(frame, "\n")
+		require.Len(t, lines, 2, "frame: %q", frame)
+		frames = append(frames, [2]string{
+			strings.TrimPrefix(lines[0], "event: "),
+			strings.TrimPrefix(lines[1], "data: "),
+		})
+	}
+	return frames
+}
+
+func TestWriteSSE(t *testing.T) {
+	t.Run("frames_and_headers", func(t *testing.T) {
+		ch := make(chan *AgentEvent, 3)
+		ch <- &AgentEvent{Type: llm.EventTypeText, Text: "line1\nline2"}
+		ch <- &AgentEvent{Type: llm.EventTypeError, Error: errors.New("boom")}
+		close(ch)
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, WriteSSE(rec, ch))
+
+		assert.Equal(t, "text/event-stream", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "no-cache", rec.Header().Get("Cache-Control"))
+		assert.True(t, rec.Flushed)
+
+		frames := sseFrames(t, rec.Body.String())
+		require.Len(t, frames, 2)
+		assert.Equal(t, "text", frames[0][0])
+		assert.JSONEq(t, `{"type":"text","text":"line1\nline2"}`, frames[0][1])
+		assert.Equal(t, "error", frames[1][0])
+		assert.JSONEq(t, `{"type":"error","error":"boom"}`, frames[1][1])
+	})
+
+	t.Run("agent_run", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("Hello there")))
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, WriteSSE(rec, ag.Run(context.Background(), "Hi", WithStreaming(true))))
+
+		frames := sseFrames(t, rec.Body.String())
+		require.NotEmpty(t, frames)
+		last := frames[len(frames)-1]
+		assert.Equal(t, "done", last[0])
+
+		var done struct {
+			Result struct {
+				Text string `json:"text"`
+			} `json:"result"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(last[1]), &done))
+		assert.Equal(t, "Hello there", done.Result.Text)
+	})
+
+	t.Run("write_error", func(t *testing.T) {
+		ch := make(chan *AgentEvent, 1)
+		ch <- &AgentEvent{Type: llm.EventTypeText, Text: "hi"}
+		close(ch)
+
+		err := WriteSSE(failingResponseWriter{httptest.NewRecorder()}, ch)
+		require.ErrorContains(t, err, "write text event")
+	})
+}
+
+// failingResponseWriter 写入总是失败的 ResponseWriter
+type failingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (failingResponseWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
@@ -0,0 +1,218 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 结构化输出
+// ═══════════════════════════════════════════════════════════════════════════
+
+// structuredOutputName 传给 Provider 的 Schema 名称
+const structuredOutputName = "structured_output"
+
+// structuredRetryPrompt 结构化输出校验失败后的纠正提示
+const structuredRetryPrompt = "Your previous reply was not valid JSON matching the required schema (%v). " +
+	"Reply again with only the JSON document."
+
+// newResponseFormat 将 Schema 转换为 llm.ResponseFormat
+//
+// schema 可以是 map[string]any、JSON 字符串 / []byte / json.RawMessage，
+// 或任意可序列化为 JSON Schema 的值。
+func newResponseFormat(schema any) (*llm.ResponseFormat, error) {
+	var data []byte
+	switch s := schema.(type) {
+	case nil:
+		return nil, errors.New("response schema is nil")
+	case map[string]any:
+		return &llm.ResponseFormat{Type: "json_schema", Name: structuredOutputName, Schema: s}, nil
+	case string:
+		data = []byte(s)
+	case []byte:
+		data = s
+	case json.RawMessage:
+		data = s
+	default:
+		var err error
+		if data, err = json.Marshal(schema); err != nil {
+			return nil, fmt.Errorf("marshal response schema: %w", err)
+		}
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse response schema: %w", err)
+	}
+	return &llm.ResponseFormat{Type: "json_schema", Name: structuredOutputName, Schema: m}, nil
+}
+
+// resolveStructured 解析最终回复中的结构化输出
+//
+// 首次校验失败时追加纠正提示并通过 retryWithBackoff 重新请求一次，
+// 仍失败则返回 ErrInvalidStructuredOutput。返回值中的 text 为最终采用的回复文本。
+func (a *Agent) resolveStructured(ctx context.Context, state *runState, text string, eventCh chan<- *AgentEvent) (string, error) {
+	attempt := 0
+	operation := func() (any, error) {
+		attempt++
+		if attempt > 1 {
+			a.appendMessage(state.threadID, llm.Message{
+				Role:    llm.RoleUser,
+				Content: fmt.Sprintf(structuredRetryPrompt, state.structuredErr),
+			})
+
+			state.stepCount++
+			a.hookStep(state.stepCount)
+			callStart := time.Now()
+			response, err := a.callProviderBlocking(ctx, state, eventCh)
+			if err != nil {
+				return nil, err
+			}
+			a.recordUsage(state, response)
+			a.captureReasoning(state, response.Message)
+			state.recordStep(time.Since(callStart), response.Usage)
+			a.appendMessage(state.threadID, response.Message)
+			text = response.Message.GetContent()
+			state.lastText = text
+			state.finishReason = response.FinishReason
+		}
+
+		raw, err := parseStructured(text, a.responseFormat.Schema)
+		if err != nil {
+			state.structuredErr = err
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStructuredOutput, err)
+		}
+		state.structured = raw
+		return raw, nil
+	}
+
+	cfg := DefaultRetryConfig()
+	if a.retryConfig != nil {
+		cfg.InitialBackoff = a.retryConfig.InitialBackoff
+		cfg.MaxBackoff = a.retryConfig.MaxBackoff
+		cfg.Multiplier = a.retryConfig.Multiplier
+		cfg.Jitter = a.retryConfig.Jitter
+		cfg.Rand = a.retryConfig.Rand
+	}
+	cfg.MaxRetries = 1
+
+	if _, _, err := a.retryWithBackoff(ctx, state.logger, state.retryBudget, operation, cfg); err != nil {
+		state.logger.Warn("invalid structured output", "error", err)
+		return text, err
+	}
+	return text, nil
+}
+
+// parseStructured 从回复文本中提取 JSON 并按 Schema 校验
+func parseStructured(text string, schema map[string]any) (json.RawMessage, error) {
+	data := extractJSON(text)
+	var value any
+	if err := json.Unmarshal([]byte(data), &value); err != nil {
+		return nil, fmt.Errorf("parse JSON: %w", err)
+	}
+	if err := validateSchema(value, schema, "$"); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// extractJSON 去除空白和 Markdown 代码块包裹
+func extractJSON(text string) string {
+	s := strings.TrimSpace(text)
+	if strings.HasPrefix(s, "```") {
+		s = strings.TrimPrefix(s, "```")
+		s = strings.TrimPrefix(s, "json")
+		s = strings.TrimSuffix(strings.TrimSpace(s), "```")
+	}
+	return strings.TrimSpace(s)
+}
+
+// validateSchema 按 JSON Schema 的常用子集校验（type、required、properties、items、enum）
+func validateSchema(value any, schema map[string]any, path string) error {
+	if len(schema) == 0 {
+		return nil
+	}
+
+	if typ, ok := schema["type"].(string); ok && !matchesType(value, typ) {
+		return fmt.Errorf("%s: expected %s", path, typ)
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, v := range enum {
+			if fmt.Sprint(v) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value not in enum", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				key, _ := name.(string)
+				if _, exists := v[key]; !exists {
+					return fmt.Errorf("%s: missing required property %q", path, key)
+				}
+			}
+		}
+		if props, ok := schema["properties"].(map[string]any); ok {
+			for key, child := range v {
+				childSchema, ok := props[key].(map[string]any)
+				if !ok {
+					continue
+				}
+				if err := validateSchema(child, childSchema, path+"."+key); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// matchesType 判断 JSON 值是否符合 Schema 类型
+func matchesType(value any, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == float64(int64(f))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	default:
+		return true
+	}
+}
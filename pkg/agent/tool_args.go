@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 工具参数解析与修复
+// ═══════════════════════════════════════════════════════════════════════════
+
+// parseToolArgs 解析工具调用参数
+//
+// 开启 RepairToolArgs 时，解析失败会先尝试修复常见格式问题再重新解析；
+// 仍失败则返回空参数。
+func (a *Agent) parseToolArgs(state *runState, name, args string) map[string]any {
+	if args == "" {
+		return nil
+	}
+
+	input := make(map[string]any)
+	err := json.Unmarshal([]byte(args), &input)
+	if err == nil {
+		return input
+	}
+
+	if a.config.RepairToolArgs {
+		if repaired, ok := repairJSON(args); ok {
+			repairedInput := make(map[string]any)
+			if repairErr := json.Unmarshal([]byte(repaired), &repairedInput); repairErr == nil {
+				state.logger.Info("repaired tool call arguments", "name", name)
+				return repairedInput
+			}
+		}
+	}
+
+	state.logger.Warn("failed to parse tool call arguments",
+		"name", name,
+		"error", err,
+	)
+	return make(map[string]any)
+}
+
+// repairJSON 尝试修复宽松格式的 JSON
+//
+// 处理较弱模型常见的输出问题：
+//   - Markdown 代码块包裹
+//   - 单引号字符串
+//   - 对象/数组末尾多余的逗号
+//   - 未闭合的括号
+//
+// 返回修复后的文本，以及是否做了修改。
+func repairJSON(s string) (string, bool) {
+	src := extractJSON(s)
+
+	var out strings.Builder
+	out.Grow(len(src) + 4)
+
+	var stack []byte // 未闭合的括号
+	inString := false
+	var quote byte
+	escaped := false
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+				// 单引号字符串内的 \' 无需转义
+				if c == '\'' && quote == '\'' {
+					str := out.String()
+					out.Reset()
+					out.WriteString(str[:len(str)-1])
+				}
+				out.WriteByte(c)
+			case c == '\\':
+				escaped = true
+				out.WriteByte(c)
+			case c == quote:
+				inString = false
+				out.WriteByte('"')
+			case c == '"' && quote == '\'':
+				// 单引号字符串内的双引号需要转义
+				out.WriteString(`\"`)
+			default:
+				out.WriteByte(c)
+			}
+			continue
+		}
+
+		switch c {
+		case '"', '\'':
+			inString = true
+			quote = c
+			out.WriteByte('"')
+		case '{':
+			stack = append(stack, '}')
+			out.WriteByte(c)
+		case '[':
+			stack = append(stack, ']')
+			out.WriteByte(c)
+		case '}', ']':
+			trimTrailingComma(&out)
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			out.WriteByte(c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	// 补全未闭合的字符串和括号
+	if inString {
+		out.WriteByte('"')
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		trimTrailingComma(&out)
+		out.WriteByte(stack[i])
+	}
+
+	repaired := out.String()
+	return repaired, repaired != s
+}
+
+// trimTrailingComma 去除末尾的逗号（忽略其后的空白）
+func trimTrailingComma(b *strings.Builder) {
+	str := b.String()
+	trimmed := strings.TrimRight(str, " \t\r\n")
+	if strings.HasSuffix(trimmed, ",") {
+		b.Reset()
+		b.WriteString(trimmed[:len(trimmed)-1])
+	}
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 工具结果缓存
+// ═══════════════════════════════════════════════════════════════════════════
+
+// ToolResultCache 工具结果缓存存储
+//
+// 以工具名和序列化后的参数为键，值为发送给模型的工具结果内容。实现需要并发安全。
+type ToolResultCache interface {
+	Get(key string) (string, bool)
+	Set(key string, content string)
+}
+
+// CacheableTool 可缓存的工具（标记接口）
+//
+// 纯函数类工具（单位换算、静态查表等）实现该接口并返回 true 后，
+// 相同参数的调用直接复用缓存结果。也可以通过 Config.CacheableTools 按名称声明。
+type CacheableTool interface {
+	Cacheable() bool
+}
+
+// DefaultToolResultCacheSize 声明了 CacheableTools 但未设置缓存时默认 LRU 的容量
+const DefaultToolResultCacheSize = 256
+
+// ToolResultLRU 工具结果的内存 LRU 缓存（并发安全）
+type ToolResultLRU struct {
+	lru *lru[string]
+}
+
+// NewToolResultLRU 创建工具结果 LRU 缓存，capacity 为最大条目数（小于 1 时按 1 处理）
+func NewToolResultLRU(capacity int) *ToolResultLRU {
+	return &ToolResultLRU{lru: newLRU[string](capacity)}
+}
+
+// Get 获取缓存并标记为最近使用
+func (c *ToolResultLRU) Get(key string) (string, bool) {
+	return c.lru.get(key)
+}
+
+// Set 写入缓存，超出容量时淘汰最久未使用的条目
+func (c *ToolResultLRU) Set(key string, content string) {
+	c.lru.set(key, content)
+}
+
+// Len 返回当前条目数
+func (c *ToolResultLRU) Len() int {
+	return c.lru.len()
+}
+
+// toolCacheKey 计算工具结果缓存键（SHA-256 十六进制）
+//
+// 参数来自 json.Marshal(map)，键按字典序排列，相同参数得到相同的键。
+func toolCacheKey(name string, inputJSON []byte) string {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(inputJSON)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// toolCacheable 判断工具结果是否可以缓存（未设置缓存时总是 false）
+func (a *Agent) toolCacheable(t tool.Tool) bool {
+	if a.toolCache == nil {
+		return false
+	}
+	if c, ok := t.(CacheableTool); ok && c.Cacheable() {
+		return true
+	}
+	return slices.Contains(a.config.CacheableTools, t.Name())
+}
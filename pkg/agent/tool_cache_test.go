@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Tool Result Cache Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// markedTool 通过 CacheableTool 标记为可缓存的工具
+type markedTool struct {
+	tool.Tool
+}
+
+func (markedTool) Cacheable() bool { return true }
+
+// newCountingTool 创建统计执行次数的工具（text 为 "fail" 时返回错误）
+func newCountingTool(name string, calls *atomic.Int32) tool.Tool {
+	return tool.Func(name, "Counts executions",
+		func(_ context.Context, in echoInput) (string, error) {
+			calls.Add(1)
+			if in.Text == "fail" {
+				return "", errors.New("boom")
+			}
+			return "result:" + in.Text, nil
+		})
+}
+
+// repeatedCallsProvider 依次发起携带 texts 中参数的工具调用，之后返回最终答案
+func repeatedCallsProvider(name string, texts ...string) *mock.Client {
+	return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n <= len(texts) {
+			return toolCallMessage(fmt.Sprintf("call-%d", n), name, map[string]any{"text": texts[n-1]})
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+	}))
+}
+
+func TestAgent_ToolResultCache(t *testing.T) {
+	t.Run("cacheable_by_name", func(t *testing.T) {
+		var calls atomic.Int32
+		ag := newTestAgent(t, repeatedCallsProvider("convert", "1km", "1km", "2km"),
+			WithTools(newCountingTool("convert", &calls)),
+			WithCacheableTools("convert"),
+		)
+
+		result, err := ag.Chat(context.Background(), "Convert")
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load(), "repeated input served from cache")
+
+		// 命中缓存的结果与首次执行一致
+		first := result.Messages[2].GetToolResults()[0].Content
+		second := result.Messages[4].GetToolResults()[0].Content
+		assert.Equal(t, `"result:1km"`, first)
+		assert.Equal(t, first, second)
+	})
+
+	t.Run("cacheable_marker_with_shared_cache", func(t *testing.T) {
+		var calls atomic.Int32
+		cache := NewToolResultLRU(16)
+		marked := markedTool{newCountingTool("lookup", &calls)}
+
+		for range 2 {
+			ag := newTestAgent(t, repeatedCallsProvider("lookup", "key"),
+				WithTools(marked),
+				WithToolResultCache(cache),
+			)
+			_, err := ag.Chat(context.Background(), "Lookup")
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, int32(1), calls.Load(), "cache shared across agents")
+		assert.Equal(t, 1, cache.Len())
+	})
+
+	t.Run("errors_not_cached", func(t *testing.T) {
+		var calls atomic.Int32
+		ag := newTestAgent(t, repeatedCallsProvider("convert", "fail", "fail"),
+			WithTools(newCountingTool("convert", &calls)),
+			WithCacheableTools("convert"),
+		)
+
+		_, err := ag.Chat(context.Background(), "Convert")
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("not_cacheable_by_default", func(t *testing.T) {
+		var calls atomic.Int32
+		ag := newTestAgent(t, repeatedCallsProvider("convert", "1km", "1km"),
+			WithTools(newCountingTool("convert", &calls)),
+			WithToolResultCache(NewToolResultLRU(16)),
+		)
+
+		_, err := ag.Chat(context.Background(), "Convert")
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("marker_without_cache", func(t *testing.T) {
+		var calls atomic.Int32
+		ag := newTestAgent(t, repeatedCallsProvider("lookup", "key", "key"),
+			WithTools(markedTool{newCountingTool("lookup", &calls)}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Lookup")
+		require.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
+
+func TestToolCacheKey(t *testing.T) {
+	assert.Equal(t, toolCacheKey("a", []byte(`{"x":1}`)), toolCacheKey("a", []byte(`{"x":1}`)))
+	assert.NotEqual(t, toolCacheKey("a", []byte(`{"x":1}`)), toolCacheKey("b", []byte(`{"x":1}`)))
+	assert.NotEqual(t, toolCacheKey("a", []byte(`{"x":1}`)), toolCacheKey("a", []byte(`{"x":2}`)))
+}
+
+func TestToolResultLRU(t *testing.T) {
+	cache := NewToolResultLRU(2)
+	cache.Set("a", "1")
+	cache.Set("b", "2")
+	_, _ = cache.Get("a")
+	cache.Set("c", "3")
+
+	_, ok := cache.Get("b")
+	assert.False(t, ok, "least recently used entry evicted")
+	got, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "1", got)
+	assert.Equal(t, 2, cache.Len())
+}
@@ -3,7 +3,13 @@ package agent
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
 	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
@@ -13,172 +19,579 @@ import (
 // 工具执行
 // ═══════════════════════════════════════════════════════════════════════════
 
+// defaultMaxParallelTools 并发执行工具的默认上限
+const defaultMaxParallelTools = 4
+
+// ToolResultMessageFunc 将一步的工具结果转换为对话消息
+//
+// 默认实现把所有结果放在一条 RoleUser 消息中；某些 Provider 协议要求每个结果单独成消息，
+// 或按其他方式分组。返回的消息必须包含全部结果且保持 ToolUseID 不变。
+type ToolResultMessageFunc func(results []llm.ContentBlock) []llm.Message
+
+// DefaultToolResultMessages 默认的工具结果消息构建方式：单条 RoleUser 消息
+func DefaultToolResultMessages(results []llm.ContentBlock) []llm.Message {
+	return []llm.Message{{
+		Role:          llm.RoleUser,
+		ContentBlocks: results,
+	}}
+}
+
+// toolResultMessages 构建工具结果消息
+//
+// 自定义函数返回的消息丢失或篡改了 ToolUseID 时，记录警告并回退到默认方式，
+// 保证每个工具调用都有对应的结果。
+func (a *Agent) toolResultMessages(state *runState, results []llm.ContentBlock) []llm.Message {
+	if a.toolResultMessageFunc == nil {
+		return a.defaultToolResultMessages(results)
+	}
+
+	msgs := a.toolResultMessageFunc(results)
+	if !sameToolUseIDs(results, msgs) {
+		state.logger.Warn("custom tool result messages lost tool use IDs, using default")
+		return a.defaultToolResultMessages(results)
+	}
+	return msgs
+}
+
+// defaultToolResultMessages 按默认方式构建工具结果消息，角色取自 Config.ToolResultRole
+func (a *Agent) defaultToolResultMessages(results []llm.ContentBlock) []llm.Message {
+	msgs := DefaultToolResultMessages(results)
+	if a.config.ToolResultRole != "" {
+		msgs[0].Role = a.config.ToolResultRole
+	}
+	return msgs
+}
+
+// sameToolUseIDs 检查消息中的工具结果 ID 与原始结果一一对应
+func sameToolUseIDs(results []llm.ContentBlock, msgs []llm.Message) bool {
+	want := make(map[string]int)
+	for _, block := range results {
+		if tr, ok := block.(*llm.ToolResultBlock); ok {
+			want[tr.ToolUseID]++
+		}
+	}
+	for i := range msgs {
+		for _, tr := range msgs[i].GetToolResults() {
+			want[tr.ToolUseID]--
+		}
+	}
+	for _, n := range want {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// checkToolErrors 检查连续工具失败次数
+//
+// 本步所有工具调用都失败时计数加一，否则重置；超过上限时返回 ErrTooManyToolErrors。
+func (a *Agent) checkToolErrors(state *runState, results []llm.ContentBlock) error {
+	if !allToolsFailed(results) {
+		state.consecutiveToolErrors = 0
+		return nil
+	}
+
+	state.consecutiveToolErrors++
+	limit := a.config.MaxConsecutiveToolErrors
+	if limit > 0 && state.consecutiveToolErrors > limit {
+		state.logger.Warn("too many consecutive tool errors",
+			"count", state.consecutiveToolErrors,
+			"limit", limit,
+		)
+		return fmt.Errorf("%w: %d consecutive steps with only failed tool calls (limit %d)",
+			ErrTooManyToolErrors, state.consecutiveToolErrors, limit)
+	}
+	return nil
+}
+
+// allToolsFailed 判断工具结果是否全部为错误
+func allToolsFailed(results []llm.ContentBlock) bool {
+	if len(results) == 0 {
+		return false
+	}
+	for _, block := range results {
+		if tr, ok := block.(*llm.ToolResultBlock); !ok || !tr.IsError {
+			return false
+		}
+	}
+	return true
+}
+
+// Redactor 工具结果脱敏函数
+//
+// 作用于日志和事件（ToolResult 事件、OnToolResult 钩子）中的工具结果内容，
+// 用于屏蔽卡号、密钥等敏感数据；发送给模型的工具结果保持原样，不影响模型推理。
+type Redactor func(content string) string
+
+// redactToolOutput 对工具结果内容应用 Redactor（未设置时原样返回）
+func (a *Agent) redactToolOutput(content string) string {
+	if a.redactor == nil {
+		return content
+	}
+	return a.redactor(content)
+}
+
+// ToolErrorFormatter 工具执行失败时反馈给模型的内容格式化函数
+//
+// 用于调整错误措辞或附加修复建议，帮助模型从工具错误中恢复。
+type ToolErrorFormatter func(toolName string, err error) string
+
+// formatToolError 生成工具失败时反馈给模型的内容（未设置 ToolErrorFormatter 时为 "Error: <err>"）
+func (a *Agent) formatToolError(toolName string, err error) string {
+	if a.toolErrorFormatter == nil {
+		return fmt.Sprintf("Error: %v", err)
+	}
+	return a.toolErrorFormatter(toolName, err)
+}
+
+// ToolApprovalFunc 工具调用审批函数（人工确认）
+//
+// 在每个工具执行前调用：返回 true 时执行；返回 false 时跳过执行，
+// 并以错误结果告知模型该调用被拒绝，由模型调整后续行为；返回 error 时中止本次执行。
+// 同一步的多个工具调用按顺序逐个审批，即使开启了 ParallelTools。
+type ToolApprovalFunc func(ctx context.Context, call *llm.ToolCall) (bool, error)
+
+// toolDeniedMessage 工具调用被拒绝时反馈给模型的内容
+const toolDeniedMessage = "Error: the call to tool '%s' was denied by the user. Do not retry it; adjust your approach."
+
+// toolsDisabledMessage 本次执行禁用工具时反馈给模型的内容
+const toolsDisabledMessage = "Error: tools are disabled for this request; answer with text only"
+
+// toolNotPermittedMessage 调用未允许的工具时反馈给模型的内容
+const toolNotPermittedMessage = "Error: tool '%s' is not permitted for this agent"
+
+// toolResultTruncatedNote 工具结果被截断时附加给模型的说明
+const toolResultTruncatedNote = "\n\n[Output truncated: showing the first %d of %d bytes. " +
+	"Narrow the request (filters, pagination, a smaller range) to see the rest.]"
+
+// truncateToolResult 将工具结果截断到 limit 字节以内（不截断多字节字符）并附加说明
+func truncateToolResult(content string, limit int) string {
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	return content[:cut] + fmt.Sprintf(toolResultTruncatedNote, cut, len(content))
+}
+
+// toolUnavailableMessage 调用本次执行未提供的工具（WithOnlyTools 名单外）时反馈给模型的内容
+func (a *Agent) toolUnavailableMessage(name string, runOpts *RunOptions) string {
+	available := make([]string, 0, len(runOpts.OnlyTools))
+	for _, n := range runOpts.OnlyTools {
+		if a.toolPermitted(n) && a.toolRegistry.Has(n) {
+			available = append(available, n)
+		}
+	}
+	if len(available) == 0 {
+		return fmt.Sprintf("Error: tool '%s' is not available for this request; no tools are available", name)
+	}
+	return fmt.Sprintf("Error: tool '%s' is not available for this request; available tools: %s",
+		name, strings.Join(available, ", "))
+}
+
+// toolLimitMessage 超出单步调用数上限时反馈给模型的内容
+const toolLimitMessage = "Error: at most %d tool calls are executed per step; this call was skipped. Call it again in a later step if still needed."
+
+// approveToolCalls 逐个审批工具调用
+//
+// 被拒绝的调用直接写入 results；审批出错时其余未审批的调用也记为错误结果并返回该错误。
+func (a *Agent) approveToolCalls(ctx context.Context, state *runState, toolCalls []*llm.ToolCall, results []llm.ContentBlock, eventCh chan<- *AgentEvent) error {
+	if a.toolApproval == nil {
+		return nil
+	}
+
+	for i, tc := range toolCalls {
+		if results[i] != nil {
+			continue // 已被权限检查拒绝
+		}
+		approved, err := a.toolApproval(ctx, tc)
+		if err != nil {
+			state.logger.Warn("tool approval failed", "tool", tc.Name, "error", err)
+			for j := i; j < len(toolCalls); j++ {
+				if results[j] == nil {
+					results[j] = a.rejectToolCall(ctx, eventCh, toolCalls[j], "Error: tool call aborted: approval failed")
+				}
+			}
+			return fmt.Errorf("approve tool call %s: %w", tc.Name, err)
+		}
+		if !approved {
+			state.logger.Info("tool call denied", "tool", tc.Name, "id", tc.ID)
+			results[i] = a.rejectToolCall(ctx, eventCh, tc, fmt.Sprintf(toolDeniedMessage, tc.Name))
+		}
+	}
+	return nil
+}
+
+// rejectToolCall 不执行工具，发送并返回错误结果
+func (a *Agent) rejectToolCall(ctx context.Context, eventCh chan<- *AgentEvent, tc *llm.ToolCall, content string) llm.ContentBlock {
+	a.emitToolResult(ctx, eventCh, &llm.ToolResult{
+		ToolID:  tc.ID,
+		Name:    tc.Name,
+		Content: content,
+		IsError: true,
+	})
+	return &llm.ToolResultBlock{
+		ToolUseID: tc.ID,
+		Content:   content,
+		IsError:   true,
+	}
+}
+
 // executeToolsWithEvents 执行工具并发送事件
-func (a *Agent) executeToolsWithEvents(ctx context.Context, toolCalls []*llm.ToolCall, eventCh chan<- *AgentEvent) ([]llm.ContentBlock, []string) {
+//
+// 开启 ParallelTools 时使用有界并发执行同一步的多个工具调用，
+// 返回的结果顺序始终与 toolCalls 一致；事件可能乱序到达，但都带有正确的 ToolID。
+// 不在 AllowedTools / DeniedTools 允许范围内的调用、超出 MaxToolCallsPerStep 的调用直接返回错误结果。
+// 设置了 ToolApprovalFunc 时先逐个审批，被拒绝的调用不执行；审批出错时不执行任何调用并返回错误，
+// 此时 results 仍包含每个调用的（错误）结果，调用方应先写入历史再中止。
+func (a *Agent) executeToolsWithEvents(ctx context.Context, state *runState, toolCalls []*llm.ToolCall, eventCh chan<- *AgentEvent) ([]llm.ContentBlock, []string, error) {
+	logger := state.logger
+
 	if a.toolRegistry == nil {
-		a.logger.Error("tool registry not configured")
-		return nil, nil
+		logger.Error("tool registry not configured")
+		return nil, nil, nil
 	}
 
-	results := make([]llm.ContentBlock, 0, len(toolCalls))
-	usedNames := make([]string, 0, len(toolCalls))
-
-	a.logger.Info("executing tools", "count", len(toolCalls))
+	// 执行期间发送心跳，避免长连接超时
+	stopHeartbeat := startHeartbeat(ctx, state.options.Heartbeat, eventCh)
+	defer stopHeartbeat()
 
+	results := make([]llm.ContentBlock, len(toolCalls))
+	usedNames := make([]string, 0, len(toolCalls))
 	for _, tc := range toolCalls {
 		usedNames = append(usedNames, tc.Name)
+	}
 
-		a.logger.Info("tool call", "tool", tc.Name, "id", tc.ID)
-
-		// 单个工具执行的 panic recovery
-		func() {
-			defer func() {
-				if r := recover(); r != nil {
-					a.logger.Error("panic in tool execution",
-						"panic", r,
-						"tool", tc.Name,
-						"agent_id", a.id,
-					)
-					tr := &llm.ToolResult{
-						ToolID:  tc.ID,
-						Name:    tc.Name,
-						Content: fmt.Sprintf("Tool execution panic: %v", r),
-						IsError: true,
-					}
-					eventCh <- &AgentEvent{Type: llm.EventTypeToolResult, ToolResult: tr}
-					results = append(results, &llm.ToolResultBlock{
-						ToolUseID: tc.ID,
-						Content:   tr.Content,
-						IsError:   true,
-					})
-				}
-			}()
+	// 权限检查：拒绝未允许的工具（模型可能调用未提供给它的工具）
+	for i, tc := range toolCalls {
+		if state.options.disableTools {
+			logger.Warn("tools disabled for this run", "tool", tc.Name, "id", tc.ID)
+			results[i] = a.rejectToolCall(ctx, eventCh, tc, toolsDisabledMessage)
+			continue
+		}
+		if !a.toolPermitted(tc.Name) {
+			logger.Warn("tool not permitted", "tool", tc.Name, "id", tc.ID)
+			results[i] = a.rejectToolCall(ctx, eventCh, tc, fmt.Sprintf(toolNotPermittedMessage, tc.Name))
+			continue
+		}
+		if !a.toolAvailable(tc.Name, state.options) {
+			logger.Warn("tool not available for this run", "tool", tc.Name, "id", tc.ID)
+			results[i] = a.rejectToolCall(ctx, eventCh, tc, a.toolUnavailableMessage(tc.Name, state.options))
+		}
+	}
 
-			t, ok := a.toolRegistry.Get(tc.Name)
-			if !ok {
-				a.logger.Warn("tool not found", "tool", tc.Name)
-				tr := &llm.ToolResult{
-					ToolID:  tc.ID,
-					Name:    tc.Name,
-					Content: fmt.Sprintf("Error: tool '%s' not found", tc.Name),
-					IsError: true,
-				}
-				eventCh <- &AgentEvent{Type: llm.EventTypeToolResult, ToolResult: tr}
-				results = append(results, &llm.ToolResultBlock{
-					ToolUseID: tc.ID,
-					Content:   tr.Content,
-					IsError:   true,
-				})
-				return // 闭包内使用 return 而不是 continue
+	// 单步调用数上限：只执行前 MaxToolCallsPerStep 个调用
+	if limit := a.config.MaxToolCallsPerStep; limit > 0 && len(toolCalls) > limit {
+		logger.Warn("tool calls exceed per-step limit", "count", len(toolCalls), "limit", limit)
+		for i := limit; i < len(toolCalls); i++ {
+			if results[i] == nil {
+				results[i] = a.rejectToolCall(ctx, eventCh, toolCalls[i], fmt.Sprintf(toolLimitMessage, limit))
 			}
+		}
+	}
 
-			// 序列化参数
-			inputJSON, err := json.Marshal(tc.Input)
-			if err != nil {
-				a.logger.Error("failed to marshal arguments", "error", err)
-				tr := &llm.ToolResult{
-					ToolID:  tc.ID,
-					Name:    tc.Name,
-					Content: fmt.Sprintf("Error: failed to marshal arguments: %v", err),
-					IsError: true,
-				}
-				eventCh <- &AgentEvent{Type: llm.EventTypeToolResult, ToolResult: tr}
-				results = append(results, &llm.ToolResultBlock{
-					ToolUseID: tc.ID,
-					Content:   tr.Content,
-					IsError:   true,
-				})
-				return // 闭包内使用 return 而不是 continue
-			}
+	if err := a.approveToolCalls(ctx, state, toolCalls, results, eventCh); err != nil {
+		return results, usedNames, err
+	}
 
-			// 将 AgentID 存入 context
-			toolCtx := tool.ContextWithAgentID(ctx, a.id)
-
-			// 执行工具（优先使用 ExecuteResult）
-			a.logger.Debug("executing tool", "tool", tc.Name)
-
-			var output any
-			var execErr error
-			var metadata tool.Metadata
-			var retries int
-
-			// 定义工具执行操作
-			operation := func() (any, error) {
-				// 检查是否实现了 ResultExecutor 接口
-				if re, ok := t.(tool.ResultExecutor); ok {
-					result := re.ExecuteResult(toolCtx, inputJSON)
-					if result.IsErr() {
-						return nil, result.Error()
-					}
-					metadata = result.Meta()
-					return result.Value(), nil
-				} else {
-					// 兼容旧工具
-					return t.Execute(toolCtx, inputJSON)
-				}
-			}
+	workers := a.config.MaxParallelTools
+	if workers <= 0 {
+		workers = defaultMaxParallelTools
+	}
+	parallel := a.config.ParallelTools && workers > 1 && len(toolCalls) > 1
+	logger.Info("executing tools", "count", len(toolCalls), "parallel", parallel)
 
-			// 使用重试机制执行工具
-			if a.retryConfig != nil && a.retryConfig.MaxRetries > 0 {
-				output, retries, execErr = a.retryWithBackoff(toolCtx, operation, a.retryConfig)
-			} else {
-				// 不重试，直接执行
-				output, execErr = operation()
+	if parallel {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, workers)
+		for i, tc := range toolCalls {
+			if results[i] != nil {
+				continue // 已被拒绝
 			}
-
-			// 更新元数据中的重试次数
-			if metadata.Retries == 0 {
-				metadata.Retries = retries
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				results[i] = a.executeLimitedToolCall(ctx, state, tc, eventCh)
+			}()
+		}
+		wg.Wait()
+	} else {
+		for i, tc := range toolCalls {
+			if results[i] != nil {
+				continue // 已被拒绝
 			}
+			results[i] = a.executeLimitedToolCall(ctx, state, tc, eventCh)
+		}
+	}
 
-			var content string
-			var isError bool
-			if execErr != nil {
-				a.logger.Error("tool execution failed", "tool", tc.Name, "error", execErr)
-				content = fmt.Sprintf("Error: %v", execErr)
-				isError = true
-			} else {
-				jsonBytes, marshalErr := json.Marshal(output)
-				if marshalErr != nil {
-					a.logger.Error("failed to marshal output", "tool", tc.Name, "error", marshalErr)
-					content = fmt.Sprintf("%v", output)
-				} else {
-					content = string(jsonBytes)
-				}
+	logger.Info("tools executed", "count", len(results))
+	return results, usedNames, nil
+}
+
+// ToolSemaphore 工具执行的共享并发限制
+//
+// 方法签名与 golang.org/x/sync/semaphore.Weighted 一致，可以直接传入 *semaphore.Weighted。
+// 每次工具执行前 Acquire(ctx, 1)，结束后 Release(1)。
+type ToolSemaphore interface {
+	Acquire(ctx context.Context, n int64) error
+	Release(n int64)
+}
+
+// executeLimitedToolCall 在共享并发限制内执行单个工具调用（未设置 ToolSemaphore 时直接执行）
+func (a *Agent) executeLimitedToolCall(ctx context.Context, state *runState, tc *llm.ToolCall, eventCh chan<- *AgentEvent) llm.ContentBlock {
+	if a.toolSemaphore == nil {
+		return a.executeToolCall(ctx, state, tc, eventCh)
+	}
+	if err := a.toolSemaphore.Acquire(ctx, 1); err != nil {
+		state.logger.Warn("tool semaphore acquire failed", "tool", tc.Name, "error", err)
+		return a.rejectToolCall(ctx, eventCh, tc, fmt.Sprintf("Error: tool '%s' was not executed: %v", tc.Name, err))
+	}
+	defer a.toolSemaphore.Release(1)
+	return a.executeToolCall(ctx, state, tc, eventCh)
+}
+
+// startHeartbeat 每隔 interval 发送一次心跳事件，返回的函数停止发送并等待 goroutine 退出
+//
+// interval <= 0 时不启动。停止后不会再向 eventCh 发送，调用方可以安全地关闭通道。
+func startHeartbeat(ctx context.Context, interval time.Duration, eventCh chan<- *AgentEvent) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
 
-			// 记录元数据（如果有）
-			if metadata.ToolName != "" || metadata.Duration > 0 {
-				logAttrs := []any{"tool", tc.Name}
-				if metadata.Duration > 0 {
-					logAttrs = append(logAttrs, "duration", metadata.Duration)
-				}
-				if metadata.Cached {
-					logAttrs = append(logAttrs, "cached", true)
-				}
-				if metadata.Retries > 0 {
-					logAttrs = append(logAttrs, "retries", metadata.Retries)
-				}
-				a.logger.Debug("tool metadata", logAttrs...)
+			select {
+			case eventCh <- &AgentEvent{Type: EventTypeHeartbeat}:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
 			}
+		}
+	})
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// executeToolCall 执行单个工具调用并发送结果事件（包含 panic recovery）
+func (a *Agent) executeToolCall(ctx context.Context, state *runState, tc *llm.ToolCall, eventCh chan<- *AgentEvent) (result llm.ContentBlock) {
+	logger := state.logger
 
-			a.logger.Info("tool result", "tool", tc.Name, "result_preview", truncateString(content, 200))
+	logger.Info("tool call", "tool", tc.Name, "id", tc.ID)
+	a.hookToolCall(tc)
+	a.metricsOrNop().IncToolCalls(tc.Name)
 
+	// 工具 span（ctx 携带该 span 传给工具）
+	ctx, span := a.startSpan(ctx, SpanTool, slog.String("tool.name", tc.Name), slog.String("tool.call_id", tc.ID))
+	start := time.Now()
+	defer func() {
+		span.SetAttributes(slog.Duration("tool.duration", time.Since(start)))
+		if block, ok := result.(*llm.ToolResultBlock); ok && block.IsError {
+			span.SetError(errors.New(block.Content))
+		}
+		span.End()
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("panic in tool execution",
+				"panic", r,
+				"tool", tc.Name,
+				"agent_id", a.id,
+			)
 			tr := &llm.ToolResult{
 				ToolID:  tc.ID,
 				Name:    tc.Name,
-				Content: content,
-				IsError: isError,
+				Content: fmt.Sprintf("Tool execution panic: %v", r),
+				IsError: true,
 			}
-			eventCh <- &AgentEvent{Type: llm.EventTypeToolResult, ToolResult: tr}
-			results = append(results, &llm.ToolResultBlock{
+			a.emitToolResult(ctx, eventCh, tr)
+			result = &llm.ToolResultBlock{
 				ToolUseID: tc.ID,
-				Content:   content,
-				IsError:   isError,
-			})
-		}() // 闭包结束
+				Content:   tr.Content,
+				IsError:   true,
+			}
+		}
+	}()
+
+	t, ok := a.toolRegistry.Get(tc.Name)
+	if !ok {
+		logger.Warn("tool not found", "tool", tc.Name)
+		tr := &llm.ToolResult{
+			ToolID:  tc.ID,
+			Name:    tc.Name,
+			Content: fmt.Sprintf("Error: tool '%s' not found", tc.Name),
+			IsError: true,
+		}
+		a.emitToolResult(ctx, eventCh, tr)
+		return &llm.ToolResultBlock{
+			ToolUseID: tc.ID,
+			Content:   tr.Content,
+			IsError:   true,
+		}
+	}
+
+	// 序列化参数
+	inputJSON, err := json.Marshal(tc.Input)
+	if err != nil {
+		logger.Error("failed to marshal arguments", "error", err)
+		tr := &llm.ToolResult{
+			ToolID:  tc.ID,
+			Name:    tc.Name,
+			Content: fmt.Sprintf("Error: failed to marshal arguments: %v", err),
+			IsError: true,
+		}
+		a.emitToolResult(ctx, eventCh, tr)
+		return &llm.ToolResultBlock{
+			ToolUseID: tc.ID,
+			Content:   tr.Content,
+			IsError:   true,
+		}
+	}
+
+	// 可缓存的工具命中时直接复用结果，不再执行
+	var cacheKey string
+	if a.toolCacheable(t) {
+		cacheKey = toolCacheKey(tc.Name, inputJSON)
+	}
+
+	var content string
+	var isError bool
+	var metadata tool.Metadata
+	cached := false
+	if cacheKey != "" {
+		content, cached = a.toolCache.Get(cacheKey)
+	}
+	if cached {
+		logger.Debug("tool result cache hit", "tool", tc.Name)
+		metadata = tool.Metadata{ToolName: tc.Name, Cached: true}
+	} else {
+		content, isError, metadata = a.invokeTool(ctx, logger, state.retryBudget, t, tc, inputJSON)
+		// 只缓存成功的结果
+		if cacheKey != "" && !isError {
+			a.toolCache.Set(cacheKey, content)
+		}
 	}
 
-	a.logger.Info("tools executed", "count", len(results))
-	return results, usedNames
+	// 记录元数据（如果有）
+	if metadata.ToolName != "" || metadata.Duration > 0 {
+		logAttrs := []any{"tool", tc.Name}
+		if metadata.Duration > 0 {
+			logAttrs = append(logAttrs, "duration", metadata.Duration)
+		}
+		if metadata.Cached {
+			logAttrs = append(logAttrs, "cached", true)
+		}
+		if metadata.Retries > 0 {
+			logAttrs = append(logAttrs, "retries", metadata.Retries)
+		}
+		logger.Debug("tool metadata", logAttrs...)
+	}
+
+	logger.Info("tool result", "tool", tc.Name, "result_preview", truncateString(a.redactToolOutput(content), 200))
+
+	// 超出大小上限时截断发送给模型的内容
+	modelContent := content
+	if limit := a.config.MaxToolResultBytes; limit > 0 && len(content) > limit {
+		logger.Warn("tool result truncated", "tool", tc.Name, "bytes", len(content), "limit", limit)
+		modelContent = truncateToolResult(content, limit)
+		if !a.config.FullToolResultEvents {
+			content = modelContent
+		}
+	}
+
+	tr := &llm.ToolResult{
+		ToolID:  tc.ID,
+		Name:    tc.Name,
+		Content: content,
+		IsError: isError,
+	}
+	a.emitToolResult(ctx, eventCh, tr)
+	return &llm.ToolResultBlock{
+		ToolUseID: tc.ID,
+		Content:   modelContent,
+		IsError:   isError,
+	}
+}
+
+// invokeTool 执行工具（含重试和 MCP 断线恢复），返回发送给模型的内容
+func (a *Agent) invokeTool(ctx context.Context, logger *slog.Logger, budget *retryBudget, t tool.Tool, tc *llm.ToolCall, inputJSON []byte) (content string, isError bool, metadata tool.Metadata) {
+	// 将 AgentID 存入 context
+	toolCtx := tool.ContextWithAgentID(ctx, a.id)
+
+	// 执行工具（优先使用 ExecuteResult）
+	logger.Debug("executing tool", "tool", tc.Name)
+
+	var output any
+	var execErr error
+	var retries int
+
+	// 定义工具执行操作
+	execute := func(target tool.Tool) (any, error) {
+		// 检查是否实现了 ResultExecutor 接口
+		if re, ok := target.(tool.ResultExecutor); ok {
+			result := re.ExecuteResult(toolCtx, inputJSON)
+			if result.IsErr() {
+				return nil, result.Error()
+			}
+			metadata = result.Meta()
+			return result.Value(), nil
+		} else {
+			// 兼容旧工具
+			return target.Execute(toolCtx, inputJSON)
+		}
+	}
+	operation := func() (any, error) {
+		return execute(t)
+	}
+
+	// 使用重试机制执行工具
+	if a.retryConfig != nil && a.retryConfig.MaxRetries > 0 {
+		output, retries, execErr = a.retryWithBackoff(toolCtx, logger, budget, operation, a.retryConfig)
+	} else {
+		// 不重试，直接执行
+		output, execErr = operation()
+	}
+
+	// MCP 连接断开时重连服务器后重试
+	if execErr != nil && isMCPConnectionError(execErr) {
+		output, execErr = a.recoverMCPTool(toolCtx, logger, t, execErr, execute)
+	}
+
+	// 更新元数据中的重试次数
+	if metadata.Retries == 0 {
+		metadata.Retries = retries
+	}
+
+	if execErr != nil {
+		logger.Error("tool execution failed", "tool", tc.Name, "error", execErr)
+		content = a.formatToolError(tc.Name, execErr)
+		isError = true
+	} else {
+		jsonBytes, marshalErr := json.Marshal(output)
+		if marshalErr != nil {
+			logger.Error("failed to marshal output", "tool", tc.Name, "error", marshalErr)
+			content = fmt.Sprintf("%v", output)
+		} else {
+			content = string(jsonBytes)
+		}
+	}
+	return content, isError, metadata
 }
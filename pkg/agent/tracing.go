@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 链路追踪
+// ═══════════════════════════════════════════════════════════════════════════
+
+// Span 名称
+const (
+	SpanRun  = "agent.run"  // 单次 Run（根 span）
+	SpanStep = "agent.step" // 单个步骤（一次 LLM 调用及其工具执行）
+	SpanTool = "agent.tool" // 单个工具执行
+)
+
+// Tracer 链路追踪接口
+//
+// 本包不依赖 OpenTelemetry，通过少量适配代码即可接入 otel 的 trace.Tracer。
+// Start 返回的 context 会传递给 Provider 和工具，用于跨服务传播 span 上下文。
+//
+// OpenTelemetry 适配示例：
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (o otelTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, agent.Span) {
+//	    ctx, span := o.t.Start(ctx, name, trace.WithAttributes(toKeyValues(attrs)...))
+//	    return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ s trace.Span }
+//
+//	func (o otelSpan) SetAttributes(attrs ...slog.Attr) { o.s.SetAttributes(toKeyValues(attrs)...) }
+//	func (o otelSpan) SetError(err error)              { o.s.RecordError(err); o.s.SetStatus(codes.Error, err.Error()) }
+//	func (o otelSpan) End()                            { o.s.End() }
+//
+//	ag, err := agent.New().Tracer(otelTracer{otel.Tracer("agent")}).Build()
+type Tracer interface {
+	// Start 开始一个子 span，返回携带该 span 的 context
+	Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span)
+}
+
+// Span 追踪区间
+type Span interface {
+	// SetAttributes 设置属性
+	SetAttributes(attrs ...slog.Attr)
+
+	// SetError 标记为错误状态并记录错误
+	SetError(err error)
+
+	// End 结束 span
+	End()
+}
+
+// nopSpan 未设置 Tracer 时使用的空 span
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(...slog.Attr) {}
+func (nopSpan) SetError(error)             {}
+func (nopSpan) End()                       {}
+
+// startSpan 开始一个 span（未设置 Tracer 时原样返回 ctx 和空 span）
+func (a *Agent) startSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	if a.tracer == nil {
+		return ctx, nopSpan{}
+	}
+	spanCtx, span := a.tracer.Start(ctx, name, attrs...)
+	if span == nil {
+		return spanCtx, nopSpan{}
+	}
+	return spanCtx, span
+}
+
+// beginStepSpan 结束上一步的 span 并开始新一步的 span，返回携带新 span 的 context
+func (a *Agent) beginStepSpan(ctx context.Context, state *runState) context.Context {
+	state.stepSpan.End()
+	ctx, state.stepSpan = a.startSpan(ctx, SpanStep, slog.Int("agent.step", state.stepCount))
+	return ctx
+}
+
+// emitRunError 记录执行错误，然后发送错误事件
+func (a *Agent) emitRunError(ctx context.Context, state *runState, eventCh chan<- *AgentEvent, err error) {
+	a.recordRunError(state, err)
+	a.emitError(ctx, eventCh, err)
+}
+
+// recordRunError 将错误记录到当前执行的 span 和 Result.Err 上（Result.Err 保留首个错误）
+func (a *Agent) recordRunError(state *runState, err error) {
+	if state.err == nil {
+		state.err = err
+	}
+	state.stepSpan.SetError(err)
+	state.span.SetError(err)
+}
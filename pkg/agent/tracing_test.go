@@ -0,0 +1,169 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/lwmacct/251215-go-pkg-tool/pkg/tool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Tracing Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+// spanKey context 中当前 span 的键
+type spanKey struct{}
+
+// recordedSpan 记录的 span
+type recordedSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent string
+	attrs  map[string]slog.Value
+	err    error
+	ended  bool
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...slog.Attr) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) SetError(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.err = err
+}
+
+func (s *recordedSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.ended = true
+}
+
+// recordingTracer 按开始顺序记录所有 span，父 span 通过 context 传递
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, Span) {
+	s := &recordedSpan{tracer: t, name: name, attrs: make(map[string]slog.Value)}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		s.parent = parent.name
+	}
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func TestAgent_Tracing(t *testing.T) {
+	toolThenAnswer := func(name string) *mock.Client {
+		return mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+			if n == 1 {
+				return toolCallMessage("call-1", name, map[string]any{"text": "hi"})
+			}
+			return llm.Message{Role: llm.RoleAssistant, Content: "done"}
+		}))
+	}
+
+	t.Run("run_step_and_tool_spans", func(t *testing.T) {
+		var toolSpan string
+		probe := tool.Func("probe", "Reports the current span",
+			func(ctx context.Context, _ echoInput) (string, error) {
+				if s, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+					toolSpan = s.name
+				}
+				return "ok", nil
+			})
+		tracer := &recordingTracer{}
+		ag := newTestAgent(t, toolThenAnswer("probe"), WithTools(probe), WithTracer(tracer))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		require.Len(t, tracer.spans, 4)
+		run, step1, toolCall, step2 := tracer.spans[0], tracer.spans[1], tracer.spans[2], tracer.spans[3]
+
+		assert.Equal(t, SpanRun, run.name)
+		assert.Empty(t, run.parent)
+		assert.Equal(t, ag.ID(), run.attrs["agent.id"].String())
+		assert.Equal(t, int64(2), run.attrs["agent.steps"].Int64())
+
+		assert.Equal(t, SpanStep, step1.name)
+		assert.Equal(t, SpanRun, step1.parent)
+		assert.Equal(t, int64(1), step1.attrs["agent.step"].Int64())
+
+		assert.Equal(t, SpanTool, toolCall.name)
+		assert.Equal(t, SpanStep, toolCall.parent)
+		assert.Equal(t, "probe", toolCall.attrs["tool.name"].String())
+		assert.Contains(t, toolCall.attrs, "tool.duration")
+		assert.NoError(t, toolCall.err)
+
+		assert.Equal(t, SpanStep, step2.name)
+		assert.Equal(t, int64(2), step2.attrs["agent.step"].Int64())
+
+		// span 上下文传递给工具
+		assert.Equal(t, SpanTool, toolSpan)
+
+		for _, s := range tracer.spans {
+			assert.True(t, s.ended, "span %s not ended", s.name)
+		}
+	})
+
+	t.Run("tool_error", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		ag := newTestAgent(t, toolThenAnswer("fail"), WithTools(newFailingTool()), WithTracer(tracer))
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.NoError(t, err)
+
+		require.Len(t, tracer.spans, 4)
+		require.Error(t, tracer.spans[2].err)
+		assert.Contains(t, tracer.spans[2].err.Error(), "boom")
+		assert.NoError(t, tracer.spans[0].err)
+	})
+
+	t.Run("provider_error", func(t *testing.T) {
+		providerErr := errors.New("provider down")
+		tracer := &recordingTracer{}
+		ag := newTestAgent(t, mock.New(mock.WithError(providerErr)),
+			WithTracer(tracer),
+			WithRetryConfig(&RetryConfig{}),
+		)
+
+		_, err := ag.Chat(context.Background(), "Hello")
+		require.Error(t, err)
+
+		require.Len(t, tracer.spans, 2)
+		require.ErrorIs(t, tracer.spans[0].err, providerErr)
+		require.ErrorIs(t, tracer.spans[1].err, providerErr)
+	})
+
+	t.Run("disabled_by_default", func(t *testing.T) {
+		ag := newTestAgent(t, mock.New(mock.WithResponse("ok")))
+		ctx, span := ag.startSpan(context.Background(), SpanRun)
+		assert.Equal(t, context.Background(), ctx)
+		assert.Equal(t, nopSpan{}, span)
+	})
+
+	t.Run("builder", func(t *testing.T) {
+		tracer := &recordingTracer{}
+		assert.Same(t, tracer, New().Tracer(tracer).inner.tracer)
+	})
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 对话记录导出
+// ═══════════════════════════════════════════════════════════════════════════
+
+// TranscriptVersion 对话记录 JSON 格式的版本号（字段只增不改，不兼容变更时递增）
+const TranscriptVersion = 1
+
+// TranscriptRoleTool 工具结果条目的角色（工具结果默认以 user 角色发送，导出时单独标出）
+const TranscriptRoleTool = "tool"
+
+// TranscriptEntry 对话记录中的一条消息
+//
+// 与 Snapshot 不同：Snapshot 用于恢复 Agent，格式跟随内部结构；
+// TranscriptEntry 面向分享和归档，与 Provider 无关，字段在各版本间保持稳定。
+type TranscriptEntry struct {
+	Role        string                 `json:"role"`                   // user、assistant、system 或 tool
+	Text        string                 `json:"text,omitempty"`         // 文本内容
+	Reasoning   string                 `json:"reasoning,omitempty"`    // 思考过程
+	ToolCalls   []TranscriptToolCall   `json:"tool_calls,omitempty"`   // 助手发起的工具调用
+	ToolResults []TranscriptToolResult `json:"tool_results,omitempty"` // 工具返回的结果
+}
+
+// TranscriptToolCall 对话记录中的工具调用
+type TranscriptToolCall struct {
+	ID    string         `json:"id"`
+	Name  string         `json:"name"`
+	Input map[string]any `json:"input,omitempty"`
+}
+
+// TranscriptToolResult 对话记录中的工具结果
+type TranscriptToolResult struct {
+	ToolCallID string `json:"tool_call_id"`
+	Name       string `json:"name,omitempty"` // 对应调用的工具名（找不到调用时为空）
+	Content    string `json:"content"`
+	IsError    bool   `json:"is_error,omitempty"`
+}
+
+// Transcript 导出默认会话历史的对话记录
+//
+// 使用示例:
+//
+//	md := agent.MarshalTranscriptMarkdown(ag.Transcript())
+//	_ = os.WriteFile("chat.md", md, 0o644)
+func (a *Agent) Transcript() []TranscriptEntry {
+	return NewTranscript(a.Messages())
+}
+
+// NewTranscript 将消息列表转换为对话记录（可用于 Result.Messages 或 ThreadMessages）
+func NewTranscript(msgs []llm.Message) []TranscriptEntry {
+	entries := make([]TranscriptEntry, 0, len(msgs))
+	toolNames := make(map[string]string)
+	for _, msg := range msgs {
+		entry := TranscriptEntry{Role: string(msg.Role)}
+
+		texts := make([]string, 0, 1)
+		if msg.Content != "" {
+			texts = append(texts, msg.Content)
+		}
+		for _, block := range msg.ContentBlocks {
+			switch b := block.(type) {
+			case *llm.TextBlock:
+				texts = append(texts, b.Text)
+			case *llm.ThinkingBlock:
+				entry.Reasoning += b.Thinking
+			case *llm.ToolCall:
+				toolNames[b.ID] = b.Name
+				entry.ToolCalls = append(entry.ToolCalls, TranscriptToolCall{ID: b.ID, Name: b.Name, Input: b.Input})
+			case *llm.ToolResultBlock:
+				entry.ToolResults = append(entry.ToolResults, TranscriptToolResult{
+					ToolCallID: b.ToolUseID,
+					Name:       toolNames[b.ToolUseID],
+					Content:    b.Content,
+					IsError:    b.IsError,
+				})
+			}
+		}
+		entry.Text = strings.Join(texts, "\n\n")
+		if len(entry.ToolResults) > 0 && entry.Text == "" && msg.Role == llm.RoleUser {
+			entry.Role = TranscriptRoleTool
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// MarshalTranscriptJSON 将对话记录序列化为带版本号的 JSON
+//
+// 输出格式：{"version": 1, "entries": [...]}。
+func MarshalTranscriptJSON(entries []TranscriptEntry) ([]byte, error) {
+	if entries == nil {
+		entries = []TranscriptEntry{}
+	}
+	return json.MarshalIndent(struct {
+		Version int               `json:"version"`
+		Entries []TranscriptEntry `json:"entries"`
+	}{TranscriptVersion, entries}, "", "  ")
+}
+
+// MarshalTranscriptMarkdown 将对话记录渲染为 Markdown
+//
+// 每条消息一个以角色命名的二级标题；工具调用参数以 json 代码块呈现，
+// 工具结果以代码块呈现（内容包含反引号时自动加长围栏）。
+func MarshalTranscriptMarkdown(entries []TranscriptEntry) []byte {
+	var sb strings.Builder
+	for i, entry := range entries {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "## %s\n", transcriptTitle(entry.Role))
+
+		if entry.Reasoning != "" {
+			sb.WriteString("\n")
+			for line := range strings.SplitSeq(entry.Reasoning, "\n") {
+				sb.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+			}
+		}
+		if entry.Text != "" {
+			sb.WriteString("\n" + entry.Text + "\n")
+		}
+		for _, tc := range entry.ToolCalls {
+			input, err := json.MarshalIndent(tc.Input, "", "  ")
+			if err != nil {
+				input = fmt.Appendf(nil, "%v", tc.Input)
+			}
+			fmt.Fprintf(&sb, "\n**Tool call** `%s` (%s)\n\n", tc.Name, tc.ID)
+			writeFenced(&sb, "json", string(input))
+		}
+		for _, tr := range entry.ToolResults {
+			label := "**Tool result**"
+			if tr.IsError {
+				label = "**Tool error**"
+			}
+			if tr.Name != "" {
+				fmt.Fprintf(&sb, "\n%s `%s` (%s)\n\n", label, tr.Name, tr.ToolCallID)
+			} else {
+				fmt.Fprintf(&sb, "\n%s (%s)\n\n", label, tr.ToolCallID)
+			}
+			writeFenced(&sb, "", tr.Content)
+		}
+	}
+	return []byte(sb.String())
+}
+
+// transcriptTitle 返回角色的标题（首字母大写）
+func transcriptTitle(role string) string {
+	if role == "" {
+		return "Unknown"
+	}
+	return strings.ToUpper(role[:1]) + role[1:]
+}
+
+// writeFenced 写入代码块，围栏长度大于内容中最长的连续反引号
+func writeFenced(sb *strings.Builder, lang, content string) {
+	longest, run := 0, 0
+	for _, r := range content {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	sb.WriteString(fence + lang + "\n" + content)
+	if !strings.HasSuffix(content, "\n") {
+		sb.WriteString("\n")
+	}
+	sb.WriteString(fence + "\n")
+}
@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm/provider/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// Transcript Tests
+// ═══════════════════════════════════════════════════════════════════════════
+
+func TestAgent_Transcript(t *testing.T) {
+	provider := mock.New(mock.WithMessageFunc(func(_ []llm.Message, n int) llm.Message {
+		if n == 1 {
+			return llm.Message{Role: llm.RoleAssistant, ContentBlocks: []llm.ContentBlock{
+				&llm.ThinkingBlock{Thinking: "need echo"},
+				&llm.TextBlock{Text: "Let me check."},
+				&llm.ToolCall{ID: "call-1", Name: "echo", Input: map[string]any{"text": "hi"}},
+			}}
+		}
+		return llm.Message{Role: llm.RoleAssistant, Content: "It said hi."}
+	}))
+	ag := newTestAgent(t, provider, WithTools(newEchoTool()))
+
+	_, err := ag.Chat(context.Background(), "Say hi")
+	require.NoError(t, err)
+
+	entries := ag.Transcript()
+	assert.Equal(t, []TranscriptEntry{
+		{Role: "user", Text: "Say hi"},
+		{
+			Role:      "assistant",
+			Text:      "Let me check.",
+			Reasoning: "need echo",
+			ToolCalls: []TranscriptToolCall{{ID: "call-1", Name: "echo", Input: map[string]any{"text": "hi"}}},
+		},
+		{Role: "tool", ToolResults: []TranscriptToolResult{{ToolCallID: "call-1", Name: "echo", Content: `"hi"`}}},
+		{Role: "assistant", Text: "It said hi."},
+	}, entries)
+
+	t.Run("json", func(t *testing.T) {
+		data, err := MarshalTranscriptJSON(entries)
+		require.NoError(t, err)
+
+		var decoded struct {
+			Version int               `json:"version"`
+			Entries []TranscriptEntry `json:"entries"`
+		}
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, TranscriptVersion, decoded.Version)
+		assert.Equal(t, entries, decoded.Entries)
+
+		empty, err := MarshalTranscriptJSON(nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"version":1,"entries":[]}`, string(empty))
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		want := "## User\n" +
+			"\nSay hi\n" +
+			"\n## Assistant\n" +
+			"\n> need echo\n" +
+			"\nLet me check.\n" +
+			"\n**Tool call** `echo` (call-1)\n\n" +
+			"```json\n{\n  \"text\": \"hi\"\n}\n```\n" +
+			"\n## Tool\n" +
+			"\n**Tool result** `echo` (call-1)\n\n" +
+			"```\n\"hi\"\n```\n" +
+			"\n## Assistant\n" +
+			"\nIt said hi.\n"
+		assert.Equal(t, want, string(MarshalTranscriptMarkdown(entries)))
+	})
+}
+
+func TestMarshalTranscriptMarkdown_Fences(t *testing.T) {
+	md := MarshalTranscriptMarkdown([]TranscriptEntry{{
+		Role:        "tool",
+		ToolResults: []TranscriptToolResult{{ToolCallID: "c1", Content: "```go\nx\n```", IsError: true}},
+	}})
+	assert.Equal(t, "## Tool\n\n**Tool error** (c1)\n\n````\n```go\nx\n```\n````\n", string(md))
+}
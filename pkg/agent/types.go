@@ -2,6 +2,10 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
 	"time"
 
 	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
@@ -19,16 +23,42 @@ type Status struct {
 	MessageCount int            `json:"message_count"`
 	LastActivity time.Time      `json:"last_activity,omitzero"`
 	Metadata     map[string]any `json:"metadata,omitempty"`
+
+	// 上下文窗口使用情况（每次调用 Provider 前更新）
+	ContextTokens      int     `json:"context_tokens,omitempty"`      // 最近一次请求的估算输入 token 数
+	ContextUtilization float64 `json:"context_utilization,omitempty"` // 占 ContextWindow 的比例（未配置时为 0）
 }
 
 // Result 对话完成结果
+//
+// Token 统计累加本轮所有 LLM 调用（包括工具循环中的每一步），
+// 仅在 Provider 返回用量信息时有值。流式执行（WithStreaming）时 llm.Event 不携带用量，
+// PromptTokens、CompletionTokens、TotalTokens 与 StepInfo.Tokens 均为 0。
 type Result struct {
-	Text        string         `json:"text"`                   // 完整响应文本
-	Messages    []llm.Message  `json:"messages,omitempty"`     // 本轮对话的所有消息
-	ToolsUsed   []string       `json:"tools_used,omitempty"`   // 使用过的工具列表
-	StepCount   int            `json:"step_count"`             // 执行步数（LLM 调用次数）
-	TotalTokens int            `json:"total_tokens,omitempty"` // Token 消耗
-	Metadata    map[string]any `json:"metadata,omitempty"`
+	Text             string          `json:"text"`                        // 完整响应文本
+	Messages         []llm.Message   `json:"messages,omitempty"`          // 本轮对话的所有消息
+	ToolsUsed        []string        `json:"tools_used,omitempty"`        // 使用过的工具列表
+	StepCount        int             `json:"step_count"`                  // 执行步数（LLM 调用次数）
+	PromptTokens     int             `json:"prompt_tokens,omitempty"`     // 输入 Token 消耗
+	CompletionTokens int             `json:"completion_tokens,omitempty"` // 输出 Token 消耗
+	TotalTokens      int             `json:"total_tokens,omitempty"`      // Token 总消耗
+	Steps            []StepInfo      `json:"steps,omitempty"`             // 每一步的执行明细
+	Metadata         map[string]any  `json:"metadata,omitempty"`
+	Audit            []AuditEntry    `json:"audit,omitempty"`         // 审计记录（仅 AuditMode 开启时填充）
+	Structured       json.RawMessage `json:"structured,omitempty"`    // 结构化输出（仅设置 ResponseSchema 时填充）
+	Reasoning        string          `json:"reasoning,omitempty"`     // 推理内容（仅 CaptureReasoning 开启时填充）
+	FinishReason     string          `json:"finish_reason,omitempty"` // 最后一次模型调用的结束原因（如 stop、length、tool_calls）
+	Err              error           `json:"-"`                       // 执行失败时的首个错误（此时为部分结果，成功时为 nil）
+}
+
+// StepInfo 单步执行明细
+//
+// 每次 LLM 调用对应一个步骤，可用于绘制执行时间线、排查慢对话。
+type StepInfo struct {
+	Index     int           `json:"index"`                // 步骤序号（从 1 开始）
+	Duration  time.Duration `json:"duration"`             // 模型调用耗时
+	Tokens    int           `json:"tokens,omitempty"`     // 本步 Token 消耗（流式调用时为 0）
+	ToolsUsed []string      `json:"tools_used,omitempty"` // 本步调用的工具
 }
 
 // Sandbox 沙箱接口
@@ -53,6 +83,55 @@ type RunOptions struct {
 	// true: 实时返回文本增量事件
 	// false: 一次性返回完整结果（默认）
 	Streaming bool
+
+	// LogAttrs 附加到本次执行所有日志的属性（如 request_id）
+	// 每次执行只通过 logger.With 附加一次，避免逐条日志重复传参
+	LogAttrs []slog.Attr
+
+	// TextCoalesce 流式文本增量的合并窗口
+	// 大于 0 时缓冲文本增量，最多每隔该时长发送一次（工具调用/完成时立即发送）
+	// 0 表示不合并，每个增量单独发送（默认）
+	TextCoalesce time.Duration
+
+	// StreamingToolArgs 流式模式下是否发送工具调用参数增量（EventTypeToolCallDelta）
+	// 完整的 llm.EventTypeToolCall 事件仍在参数接收完毕后发送
+	StreamingToolArgs bool
+
+	// Heartbeat 工具执行期间发送 EventTypeHeartbeat 的间隔（0 表示不发送）
+	Heartbeat time.Duration
+
+	// Temperature 本次执行的采样温度（nil 表示使用 Agent 配置）
+	Temperature *float64
+
+	// MaxTokens 本次执行的最大 token 数（nil 表示使用 Agent 配置）
+	MaxTokens *int
+
+	// StopSequences 本次执行追加的停止序列（与 Agent 配置的 StopSequences 合并）
+	StopSequences []string
+
+	// EventFilter 只在事件通道上发送这些类型的事件（空表示发送全部；错误事件始终发送）
+	EventFilter []llm.EventType
+
+	// EventBuffer 本次执行事件通道的缓冲大小（nil 表示使用 Agent 配置；0 表示无缓冲）
+	EventBuffer *int
+
+	// OnlyTools 本次执行只提供并允许这些工具（nil 表示不额外限制；与 Agent 级 AllowedTools / DeniedTools 同时生效）
+	OnlyTools []string
+
+	// PromptVars 渲染系统提示词模板的变量（仅在设置了 SystemTemplate 时生效）
+	PromptVars map[string]any
+
+	// system 本次执行渲染后的系统提示词模板（nil 表示未设置模板）
+	system *string
+
+	// disableTools 本次执行不向模型提供工具，也不执行任何工具调用（见 WithToolsDisabled）
+	disableTools bool
+
+	// threadLocked 调用方已持有会话的执行锁，本次执行不再排队获取（见 PlanAndExecute）
+	threadLocked bool
+
+	// keepHistory Stateless 模式下本次执行也不重置会话历史（见 PlanAndExecute）
+	keepHistory bool
 }
 
 // DefaultRunOptions 返回默认执行选项
@@ -87,6 +166,211 @@ func WithStreaming(enabled bool) RunOption {
 	}
 }
 
+// WithLogAttrs 为本次执行的日志附加属性
+//
+// 属性在执行开始时通过 logger.With 预先绑定，执行期间所有日志复用，
+// 适合高 QPS 场景下按请求附加关联 ID。
+//
+// 示例：
+//
+//	for event := range agent.Run(ctx, "Hello",
+//	    WithLogAttrs(slog.String("request_id", reqID)),
+//	) {
+//	    // ...
+//	}
+func WithLogAttrs(attrs ...slog.Attr) RunOption {
+	return func(o *RunOptions) {
+		o.LogAttrs = append(o.LogAttrs, attrs...)
+	}
+}
+
+// WithTextCoalesce 合并流式文本增量
+//
+// 部分 Provider 逐字符返回增量，会产生大量细碎事件。启用后文本增量在窗口 d 内
+// 缓冲合并，最多每隔 d 发送一次；在推理事件、工具调用和本轮结束前会立即发送缓冲内容，
+// 保证文本不丢失且顺序不变。仅对流式模式生效。
+//
+// 示例：
+//
+//	for event := range agent.Run(ctx, "写一篇文章",
+//	    WithStreaming(true),
+//	    WithTextCoalesce(50*time.Millisecond),
+//	) {
+//	    // ...
+//	}
+func WithTextCoalesce(d time.Duration) RunOption {
+	return func(o *RunOptions) {
+		o.TextCoalesce = d
+	}
+}
+
+// WithStreamingToolArgs 流式发送工具调用参数增量
+//
+// 启用后，模型生成工具调用参数的过程中逐块发送 EventTypeToolCallDelta 事件，
+// 适合实时展示较大的工具输入（如代码补丁）。参数接收完毕后仍会发送完整的 llm.EventTypeToolCall。
+// 默认关闭，仅对流式模式生效。
+//
+// 示例：
+//
+//	for event := range agent.Run(ctx, "重构这个函数",
+//	    WithStreaming(true),
+//	    WithStreamingToolArgs(true),
+//	) {
+//	    if event.Type == agent.EventTypeToolCallDelta {
+//	        fmt.Print(event.ToolCallDelta.ArgumentsDelta)
+//	    }
+//	}
+func WithStreamingToolArgs(enabled bool) RunOption {
+	return func(o *RunOptions) {
+		o.StreamingToolArgs = enabled
+	}
+}
+
+// WithHeartbeat 在工具执行期间定期发送心跳事件
+//
+// 慢速工具执行时可能长时间没有任何事件，SSE/WebSocket 等长连接容易被代理或客户端判定超时。
+// 启用后每隔 interval 发送一次 EventTypeHeartbeat，工具执行结束后立即停止。
+// interval <= 0 表示不发送（默认）。
+//
+// 示例：
+//
+//	for event := range agent.Run(ctx, "分析这个仓库", WithHeartbeat(15*time.Second)) {
+//	    if event.Type == agent.EventTypeHeartbeat {
+//	        fmt.Fprint(w, ": ping\n\n") // SSE 注释行保活
+//	        continue
+//	    }
+//	    // ...
+//	}
+func WithHeartbeat(interval time.Duration) RunOption {
+	return func(o *RunOptions) {
+		o.Heartbeat = interval
+	}
+}
+
+// WithEventFilter 只发送指定类型的事件
+//
+// 仅过滤返回通道上的事件，消息历史、Result 等内部处理不受影响。
+// llm.EventTypeError 始终发送，避免调用方错过执行失败。多次调用时类型合并。
+//
+// 示例：
+//
+//	// 只关心最终结果
+//	for event := range agent.Run(ctx, "整理这些文件",
+//	    WithEventFilter(llm.EventTypeDone),
+//	) {
+//	    // 只会收到 done 和 error 事件
+//	}
+func WithEventFilter(types ...llm.EventType) RunOption {
+	return func(o *RunOptions) {
+		o.EventFilter = append(o.EventFilter, types...)
+	}
+}
+
+// WithEventBuffer 为本次执行设置事件通道的缓冲大小
+//
+// 优先于 Agent 配置的 EventBufferSize，0 表示无缓冲，负数被忽略。
+// 消费者较慢时增大缓冲可避免执行频繁阻塞，权衡见 Builder.EventBufferSize。
+func WithEventBuffer(n int) RunOption {
+	return func(o *RunOptions) {
+		if n >= 0 {
+			o.EventBuffer = &n
+		}
+	}
+}
+
+// WithRunTemperature 为本次执行覆盖采样温度
+//
+// 优先于 Agent 配置的 Temperature，仅影响本次 Run。
+// 命名带 Run 前缀以区别于构建期选项 WithTemperature。
+//
+// 示例：
+//
+//	// 本次调用使用确定性输出
+//	for event := range agent.Run(ctx, "1+1=?", WithRunTemperature(0)) {
+//	    // ...
+//	}
+func WithRunTemperature(t float64) RunOption {
+	return func(o *RunOptions) {
+		o.Temperature = &t
+	}
+}
+
+// WithRunMaxTokens 为本次执行覆盖最大 token 数
+//
+// 优先于 Agent 配置的 MaxTokens，仅影响本次 Run。
+// 命名带 Run 前缀以区别于构建期选项 WithMaxTokens。
+func WithRunMaxTokens(n int) RunOption {
+	return func(o *RunOptions) {
+		o.MaxTokens = &n
+	}
+}
+
+// WithStopSequences 为本次执行追加停止序列
+//
+// 与 Agent 配置的 StopSequences 合并（重复的序列只保留一个），仅影响本次 Run。
+// 并非所有 Provider 都支持停止序列，不支持时由 Provider 忽略。
+//
+// 示例：
+//
+//	// 生成到分隔符时停止
+//	for event := range agent.Run(ctx, "列出三个要点", WithStopSequences("---")) {
+//	    // ...
+//	}
+func WithStopSequences(stops ...string) RunOption {
+	return func(o *RunOptions) {
+		o.StopSequences = append(o.StopSequences, stops...)
+	}
+}
+
+// WithPromptVars 设置渲染系统提示词模板的变量
+//
+// 变量在每次执行开始时代入 SystemTemplate，适合日期、用户名、语言等随请求变化的内容。
+// 多次调用时合并，后设置的同名变量覆盖先前的值。
+func WithPromptVars(vars map[string]any) RunOption {
+	return func(o *RunOptions) {
+		if o.PromptVars == nil {
+			o.PromptVars = make(map[string]any, len(vars))
+		}
+		maps.Copy(o.PromptVars, vars)
+	}
+}
+
+// WithToolsDisabled 本次执行禁用工具
+//
+// 不向模型提供工具 Schema 和工具手册，模型仍返回的工具调用不会执行，而是反馈错误结果。
+// Agent 的工具注册表保持不变，之后的执行照常使用工具。适合最终总结等只需要文本回答的轮次，
+// 也可以用于控制成本。
+//
+// 示例：
+//
+//	_, result, err := ag.RunCollect(ctx, "总结你刚才做了什么", agent.WithToolsDisabled())
+func WithToolsDisabled() RunOption {
+	return func(o *RunOptions) {
+		o.disableTools = true
+	}
+}
+
+// WithOnlyTools 本次执行只使用指定的工具
+//
+// 只向模型提供名单内的工具，调用名单外的工具时不执行，而是反馈包含可用工具列表的错误结果。
+// 与 Agent 级的 AllowedTools / DeniedTools 同时生效（取交集）；多次调用时合并名单，
+// 不传名称时本次执行不提供任何工具。适合按任务阶段限定能力，无需维护多个 Agent。
+//
+// 示例：
+//
+//	// 调研阶段只允许搜索
+//	_, research, err := ag.RunCollect(ctx, "收集资料", agent.WithOnlyTools("web_search"))
+//	// 写作阶段只允许文件工具
+//	_, draft, err := ag.RunCollect(ctx, "写成报告", agent.WithOnlyTools("read_file", "write_file"))
+func WithOnlyTools(names ...string) RunOption {
+	return func(o *RunOptions) {
+		if o.OnlyTools == nil {
+			o.OnlyTools = make([]string, 0, len(names))
+		}
+		o.OnlyTools = append(o.OnlyTools, names...)
+	}
+}
+
 // ApplyRunOptions 应用选项
 func ApplyRunOptions(opts ...RunOption) *RunOptions {
 	options := DefaultRunOptions()
@@ -100,6 +384,14 @@ func ApplyRunOptions(opts ...RunOption) *RunOptions {
 // 事件系统
 // ═══════════════════════════════════════════════════════════════════════════
 
+// EventTypeToolCallDelta 工具调用参数增量事件（需启用 WithStreamingToolArgs）
+//
+// ToolCallDelta.Index 标识同一次响应中的第几个工具调用，ID 和 Name 为已知的调用信息。
+const EventTypeToolCallDelta llm.EventType = "tool_call_delta"
+
+// EventTypeHeartbeat 心跳事件（需启用 WithHeartbeat），仅用于保持连接，不携带数据
+const EventTypeHeartbeat llm.EventType = "heartbeat"
+
 // AgentEvent Agent 执行事件
 //
 // 与 llm.Event 的区别：
@@ -141,19 +433,60 @@ type AgentEvent struct {
 	// llm.EventTypeToolCall
 	ToolCall *llm.ToolCall `json:"tool_call,omitempty"`
 
+	// EventTypeToolCallDelta
+	ToolCallDelta *llm.ToolCallDelta `json:"tool_call_delta,omitempty"`
+
 	// llm.EventTypeToolResult
 	ToolResult *llm.ToolResult `json:"tool_result,omitempty"`
 
 	// llm.EventTypeReasoning
 	Reasoning string `json:"reasoning,omitempty"`
 
-	// llm.EventTypeDone
+	// EventTypeUsage
+	Usage *UsageInfo `json:"usage,omitempty"`
+
+	// EventTypeContextWarning
+	ContextWarning *ContextWarning `json:"context_warning,omitempty"`
+
+	// llm.EventTypeDone（执行中途失败时，llm.EventTypeError 事件也附带部分结果）
 	Result *Result `json:"result,omitempty"`
 
-	// llm.EventTypeError
+	// llm.EventTypeError（JSON 中序列化为错误消息字符串，见 MarshalJSON）
 	Error error `json:"error,omitempty"`
 }
 
+// MarshalJSON 序列化事件，Error 序列化为错误消息字符串（error 接口默认序列化为 {}）
+func (e AgentEvent) MarshalJSON() ([]byte, error) {
+	type event AgentEvent
+	out := struct {
+		event
+		Error string `json:"error,omitempty"`
+	}{event: event(e)}
+	if e.Error != nil {
+		out.Error = e.Error.Error()
+	}
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON 反序列化事件，错误消息还原为 errors.New 创建的错误
+//
+// 注意：Result.Messages 中的内容块（llm.ContentBlock 接口）无法还原，包含内容块的 Done 事件会返回错误。
+func (e *AgentEvent) UnmarshalJSON(data []byte) error {
+	type event AgentEvent
+	var in struct {
+		event
+		Error string `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(data, &in); err != nil {
+		return err
+	}
+	*e = AgentEvent(in.event)
+	if in.Error != "" {
+		e.Error = errors.New(in.Error)
+	}
+	return nil
+}
+
 // ═══════════════════════════════════════════════════════════════════════════
 // Agent 接口
 // ═══════════════════════════════════════════════════════════════════════════
@@ -244,7 +577,7 @@ type AgentInterface interface {
 }
 
 // AgentFactory Agent 工厂接口
-// 供工具创建 Agent 使用（如 agent_create 工具）
+// 供工具创建 Agent 使用（如 spawn_agent 工具），内置实现见 NewAgentFactory
 type AgentFactory interface {
 	// CreateAgent 创建 Agent
 	CreateAgent(ctx context.Context, config *Config) (AgentInterface, error)
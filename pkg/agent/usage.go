@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"github.com/lwmacct/251215-go-pkg-llm/pkg/llm"
+)
+
+// ═══════════════════════════════════════════════════════════════════════════
+// 用量与费用
+// ═══════════════════════════════════════════════════════════════════════════
+
+// EventTypeUsage 用量事件，在 EventTypeDone 之前发送，携带本次执行的汇总用量
+const EventTypeUsage llm.EventType = "usage"
+
+// ModelPrice 模型单价（每百万 token）
+type ModelPrice struct {
+	Input  float64 `json:"input"`  // 输入 token 单价
+	Output float64 `json:"output"` // 输出 token 单价
+}
+
+// UsageInfo 单次执行的汇总用量
+//
+// 与 Result 的 Token 统计同源：流式执行时 Provider 不返回用量，Token 数与费用均为 0。
+type UsageInfo struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Cost             float64 `json:"cost"` // 估算费用（未设置价格表或模型不在表中时为 0）
+}
+
+// recordUsage 累加单次 LLM 调用的 Token 用量并按价格表计算费用
+//
+// 优先使用响应中的模型名查价，Provider 未返回时使用配置的模型。
+func (a *Agent) recordUsage(state *runState, response *llm.Response) {
+	usage := response.Usage
+	state.addUsage(usage)
+	if usage == nil || len(a.pricing) == 0 {
+		return
+	}
+
+	model := response.Model
+	if model == "" {
+		model = a.config.LLM.Model
+	}
+	price, ok := a.pricing[model]
+	if !ok {
+		state.logger.Debug("no price for model", "model", model)
+		return
+	}
+	state.cost += (float64(usage.InputTokens)*price.Input + float64(usage.OutputTokens)*price.Output) / 1e6
+}
+
+// usageInfo 构建本次执行的汇总用量
+func (s *runState) usageInfo() *UsageInfo {
+	return &UsageInfo{
+		PromptTokens:     s.promptTokens,
+		CompletionTokens: s.completionTokens,
+		TotalTokens:      s.totalTokens,
+		Cost:             s.cost,
+	}
+}